@@ -1,6 +1,7 @@
 import os
 from flask_pymongo import PyMongo
 from bson.objectid import ObjectId
+from bson.errors import InvalidId
 import logging
 
 MONGO_URL = os.environ.get("CLUSTER_MONGO_URL")
@@ -47,6 +48,14 @@ def mongo_find_node_by_id_and_update_subnetwork(node_id, addr, addr_v6):
     return 1
 
 
+def mongo_find_node_by_id(node_id):
+    global mongo_nodes
+    try:
+        return mongo_nodes.db.nodes.find_one({"_id": ObjectId(node_id)})
+    except InvalidId:
+        return None
+
+
 # ........... Job Operations ............#
 #########################################
 
@@ -215,6 +224,38 @@ def mongo_update_job_address(job_name, node_id, instance_number, host_ip, host_p
     )
 
 
+def mongo_update_job_exposure(job_name, node_id, instance_number, exposures):
+    global mongo_jobs
+    return mongo_jobs.db.jobs.find_one_and_update(
+        {
+            "job_name": job_name,
+            "instance_list.instance_number": int(instance_number),
+        },
+        {
+            "$set": {
+                "instance_list.$.public_exposure": exposures,
+                "instance_list.$.worker_id": node_id,
+            }
+        },
+        return_document=True,
+    )
+
+
+def mongo_update_node_address(node_id, host_ip, host_port):
+    global mongo_jobs
+    mongo_jobs.db.jobs.update_many(
+        {"instance_list.worker_id": node_id},
+        {
+            "$set": {
+                "instance_list.$[instance].host_ip": host_ip,
+                "instance_list.$[instance].host_port": int(host_port),
+            }
+        },
+        array_filters=[{"instance.worker_id": node_id}],
+    )
+    return list(mongo_jobs.db.jobs.find({"instance_list.worker_id": node_id}))
+
+
 def mongo_find_job_by_id(id):
     return mongo_jobs.db.jobs.find_one({"_id": ObjectId(id)})
 
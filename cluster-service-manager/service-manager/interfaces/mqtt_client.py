@@ -1,6 +1,9 @@
 import re
 import traceback
-from interfaces.mongodb_requests import mongo_find_node_by_id_and_update_subnetwork
+from interfaces.mongodb_requests import (
+    mongo_find_node_by_id,
+    mongo_find_node_by_id_and_update_subnetwork,
+)
 from network.deployment import *
 from network.tablequery import resolution, interests
 import paho.mqtt.client as paho_mqtt
@@ -27,9 +30,12 @@ def handle_mqtt_message(client, userdata, message):
     re_job_deployment_topic = re.search("^nodes/.*/net/service/deployed", topic)
     re_job_undeployment_topic = re.search("^nodes/.*/net/service/undeployed", topic)
     re_job_address_topic = re.search("^nodes/.*/net/service/address-changed", topic)
+    re_job_exposure_topic = re.search("^nodes/.*/net/service/exposed", topic)
+    re_node_address_topic = re.search("^nodes/.*/net/address-changed", topic)
     re_job_tablequery_topic = re.search("^nodes/.*/net/tablequery/request", topic)
     re_job_subnet_topic = re.search("^nodes/.*/net/subnet", topic)
     re_job_interest_remove = re.search("^nodes/.*/net/interest/remove", topic)
+    re_nat_punch_topic = re.search("^nodes/.*/net/nat/punch/request", topic)
 
     topic_split = topic.split("/")
     client_id = topic_split[1]
@@ -44,6 +50,12 @@ def handle_mqtt_message(client, userdata, message):
     if re_job_address_topic is not None:
         logger.debug("JOB-ADDRESS-UPDATE")
         _address_handler(client_id, payload)
+    if re_job_exposure_topic is not None:
+        logger.debug("JOB-EXPOSURE-UPDATE")
+        _exposure_handler(client_id, payload)
+    if re_node_address_topic is not None:
+        logger.debug("NODE-ADDRESS-UPDATE")
+        _node_address_handler(client_id, payload)
     if re_job_tablequery_topic is not None:
         logger.debug("JOB-TABLEQUERY-REQUEST")
         _tablequery_handler(client_id, payload)
@@ -53,6 +65,9 @@ def handle_mqtt_message(client, userdata, message):
     if re_job_interest_remove is not None:
         logger.debug("JOB-INTEREST-REMOVE")
         _interest_remove_handler(client_id, payload)
+    if re_nat_punch_topic is not None:
+        logger.debug("NAT-PUNCH-REQUEST")
+        _nat_punch_handler(client_id, payload)
 
 
 def mqtt_init(flask_app):
@@ -133,12 +148,65 @@ def _address_handler(client_id, payload):
         print(e)
 
 
+def _exposure_handler(client_id, payload):
+    appname = payload.get("appname")
+    instance_number = payload.get("instance_number")
+    exposures = payload.get("exposures", [])
+    try:
+        service_exposure_update(appname, client_id, instance_number, exposures)
+    except Exception as e:
+        traceback.print_exc()
+        print(e)
+
+
+def _node_address_handler(client_id, payload):
+    host_ip = payload.get("host_ip")
+    host_port = payload.get("host_port")
+    try:
+        node_address_update(client_id, host_ip, host_port)
+    except Exception as e:
+        traceback.print_exc()
+        print(e)
+
+
 def _interest_remove_handler(client_id, payload):
     appname = payload.get("appname")
     interests.remove_interest(appname, client_id)
 
 
+def _nat_punch_handler(client_id, payload):
+    # the sender is the node owning the topic, the request is only forwarded between the nodes of the cluster
+    peer = payload.get("peer")
+    if not peer or peer == client_id:
+        return
+    try:
+        if mongo_find_node_by_id(client_id) is None:
+            logger.error("NAT - hole punching request from unknown node " + client_id)
+            return
+        if mongo_find_node_by_id(peer) is None:
+            logger.error("NAT - hole punching request towards unknown node " + peer)
+            return
+    except Exception as e:
+        logger.error(e)
+        return
+    mqtt_publish_nat_punch(
+        peer,
+        {
+            "worker_id": client_id,
+            "endpoints": payload.get("endpoints", []),
+            "key": payload.get("key"),
+        },
+    )
+
+
 def _tablequery_handler(client_id, payload):
+    # the worker nodes batch the queries asked within a short window, each one gets its own result
+    queries = payload.get("queries")
+    if queries:
+        for query in queries:
+            _tablequery_handler(client_id, query)
+        return
+
     querySname = payload.get("sname")
     serviceName = payload.get("sname")
     sip = payload.get("sip")
@@ -183,8 +251,10 @@ def _subnet_handler(client_id, payload):
                 )
                 return
             mongo_find_node_by_id_and_update_subnetwork(client_id, addr[0], addr[1])
+            # the worker nodes only batch their table queries with the cluster managers advertising it
             mqtt_publish_subnetwork_result(
-                client_id, {"address": addr[0], "addressv6": addr[1]}
+                client_id,
+                {"address": addr[0], "addressv6": addr[1], "tablequery_batch": True},
             )
         except Exception as e:
             logger.error(e)
@@ -203,6 +273,11 @@ def mqtt_publish_subnetwork_result(client_id, result):
     mqtt.publish(topic, json.dumps(result), qos=1)
 
 
+def mqtt_publish_nat_punch(client_id, request):
+    topic = "nodes/" + client_id + "/net/nat/punch"
+    mqtt.publish(topic, json.dumps(request), qos=1)
+
+
 def mqtt_notify_service_change(job_name, type=None):
     topic = "jobs/" + job_name + "/updates_available"
     mqtt.publish(topic, json.dumps({"type": type}), qos=1)
@@ -43,6 +43,8 @@ def system_manager_notify_deployment_status(job, worker_id):
                 "host_ip": instance["host_ip"],
                 "host_port": instance["host_port"],
             }
+            if instance.get("public_exposure"):
+                elem["public_exposure"] = instance["public_exposure"]
             data["instances"].append(elem)
     try:
         logger.debug(job)
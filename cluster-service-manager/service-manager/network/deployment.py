@@ -28,3 +28,27 @@ def deployment_address_update(appname, node_id, instance_number, host_ip, host_p
 
     # Notify all interested worker nodes of the address change
     mqtt_client.mqtt_notify_service_change(appname, type="DEPLOYMENT")
+
+
+def service_exposure_update(appname, node_id, instance_number, exposures):
+    # Update mongo
+    job = mongodb_requests.mongo_update_job_exposure(
+        appname, node_id, instance_number, exposures
+    )
+    if job is None:
+        raise FileNotFoundError
+
+    # Notify System manager
+    system_manager_notify_deployment_status(job, node_id)
+
+
+def node_address_update(node_id, host_ip, host_port):
+    # Update all the instances of the node at once
+    jobs = mongodb_requests.mongo_update_node_address(node_id, host_ip, host_port)
+
+    for job in jobs:
+        # Notify System manager
+        system_manager_notify_deployment_status(job, node_id)
+
+        # Notify all interested worker nodes of the address change
+        mqtt_client.mqtt_notify_service_change(job["job_name"], type="DEPLOYMENT")
@@ -75,6 +75,49 @@ def test_deployment_status_report(requests_mock):
     assert adapter.last_request.json() == data
 
 
+def test_service_exposure_update(requests_mock):
+    from interfaces.root_service_manager_requests import ROOT_SERVICE_MANAGER_ADDR
+
+    exposures = [{"mode": "address", "address": "203.0.113.7", "ports": ""}]
+    job = _get_fake_job("aaa")
+    job["instance_list"][0]["public_exposure"] = exposures
+    mongodb_client.mongo_update_job_exposure = MagicMock(return_value=job)
+    adapter = requests_mock.post(
+        ROOT_SERVICE_MANAGER_ADDR + "/api/net/service/net_deploy_status",
+        status_code=200,
+    )
+
+    deployment.service_exposure_update("aaa", "abab", 0, exposures)
+
+    mongodb_client.mongo_update_job_exposure.assert_called_once_with(
+        "aaa", "abab", 0, exposures
+    )
+    assert adapter.call_count == 1
+    assert adapter.last_request.json()["instances"][0]["public_exposure"] == exposures
+
+
+def test_node_address_update(requests_mock):
+    from interfaces.root_service_manager_requests import ROOT_SERVICE_MANAGER_ADDR
+
+    jobs = [_get_fake_job("aaa"), _get_fake_job("bbb")]
+    mongodb_client.mongo_update_node_address = MagicMock(return_value=jobs)
+    mqtt_client.mqtt_notify_service_change = MagicMock()
+    adapter = requests_mock.post(
+        ROOT_SERVICE_MANAGER_ADDR + "/api/net/service/net_deploy_status",
+        status_code=200,
+    )
+
+    deployment.node_address_update("abab", "192.168.1.7", "50103")
+
+    mongodb_client.mongo_update_node_address.assert_called_once_with(
+        "abab", "192.168.1.7", "50103"
+    )
+    # one update for each service of the node
+    assert adapter.call_count == 2
+    mqtt_client.mqtt_notify_service_change.assert_any_call("aaa", type="DEPLOYMENT")
+    mqtt_client.mqtt_notify_service_change.assert_any_call("bbb", type="DEPLOYMENT")
+
+
 @patch("network.tablequery.interests.add_interest")
 def test_tablequery_service_ip_local(add_interest):
     job = _get_fake_job("aaa")
@@ -139,6 +182,27 @@ def test_tablequery_service_name_local(add_interest):
     )
 
 
+@patch("network.tablequery.interests.add_interest")
+def test_tablequery_batch(add_interest):
+    job = _get_fake_job("aaa")
+    mongodb_client.mongo_find_job_by_ip = MagicMock(return_value=job)
+    mongodb_client.mongo_find_job_by_name = MagicMock(return_value=job.copy())
+    mqtt_client.mqtt_publish_tablequery_result = MagicMock()
+
+    _tablequery_handler(
+        "baba",
+        {"queries": [{"sip": "172.30.0.1", "sname": ""}, {"sip": "", "sname": "aaa"}]},
+    )
+
+    assert add_interest.call_count == 2
+    assert mqtt_client.mqtt_publish_tablequery_result.call_count == 2
+    query_keys = [
+        call.args[1]["query_key"]
+        for call in mqtt_client.mqtt_publish_tablequery_result.call_args_list
+    ]
+    assert query_keys == ["172.30.0.1", "aaa"]
+
+
 @patch("network.tablequery.interests.add_interest")
 def test_tablequery_service_ip_root(add_interest, requests_mock):
     from interfaces.root_service_manager_requests import ROOT_SERVICE_MANAGER_ADDR
@@ -259,3 +323,23 @@ def test_remove_interest(requests_mock):
     interests.remove_interest("app1.aa", "dafsdòf22")
     mongodb_client.mongo_remove_interest.assert_called_with("app1.aa", "dafsdòf22")
     assert adapter.call_count == 1
+
+
+def test_nat_punch_forwarded_between_known_nodes():
+    known = {"aaa": {"_id": "aaa"}, "bbb": {"_id": "bbb"}}
+    mqtt_client.mongo_find_node_by_id = MagicMock(side_effect=known.get)
+    mqtt_client.mqtt_publish_nat_punch = MagicMock()
+    request = {"peer": "bbb", "endpoints": ["1.1.1.1:50103"], "key": "a2V5"}
+
+    mqtt_client._nat_punch_handler("aaa", request)
+    mqtt_client.mqtt_publish_nat_punch.assert_called_once_with(
+        "bbb",
+        {"worker_id": "aaa", "endpoints": ["1.1.1.1:50103"], "key": "a2V5"},
+    )
+
+    # the unknown nodes neither send nor receive hole punching requests
+    mqtt_client.mqtt_publish_nat_punch = MagicMock()
+    mqtt_client._nat_punch_handler("intruder", request)
+    mqtt_client._nat_punch_handler("aaa", dict(request, peer="intruder"))
+    mqtt_client._nat_punch_handler("aaa", dict(request, peer="aaa"))
+    mqtt_client.mqtt_publish_nat_punch.assert_not_called()
@@ -1,9 +1,13 @@
 package TableEntryCache
 
 import (
+	"NetManager/events"
+	"encoding/json"
 	"fmt"
 	"net"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestTableInsertSuccessfull(t *testing.T) {
@@ -366,3 +370,140 @@ func TestTableDeleteManyInstances_2(t *testing.T) {
 		t.Errorf("a1 should not be there: %v", table.SearchByJobName("a1.a1.a2.a2"))
 	}
 }
+
+func TestTableDraining(t *testing.T) {
+	table := NewTableManager()
+	for i := 1; i < 4; i++ {
+		_ = table.Add(TableEntry{
+			JobName:          "a1.a1.a2.a2",
+			Appname:          "a1",
+			Appns:            "a1",
+			Servicename:      "a2",
+			Servicenamespace: "a2",
+			Instancenumber:   i,
+			Nodeip:           net.ParseIP("10.30.0.1"),
+			Nodeport:         1003,
+			Nsip:             net.ParseIP(fmt.Sprintf("10.18.0.%d", i)),
+			Nsipv6:           net.ParseIP(fmt.Sprintf("fc00::%d", i)),
+			ServiceIP: []ServiceIP{{
+				IpType:     RoundRobin,
+				Address:    net.ParseIP("10.30.1.1"),
+				Address_v6: net.ParseIP("fdff:2000::1"),
+			}},
+		})
+	}
+
+	now := time.Now()
+	if err := table.MarkDraining(net.ParseIP("fc00::1"), now.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err := table.MarkDraining(net.ParseIP("10.18.0.2"), now.Add(2*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err := table.MarkDraining(net.ParseIP("10.18.0.9"), now); err == nil {
+		t.Error("Draining an unknown entry should fail")
+	}
+
+	entry, _ := table.SearchByNsIP(net.ParseIP("10.18.0.1"))
+	if !entry.IsDraining() || entry.GetWeight() != 0 {
+		t.Error("Entry should be draining")
+	}
+	if len(table.SearchByServiceIP(net.ParseIP("10.30.1.1"))) != 3 {
+		t.Error("Draining entries must still be resolved")
+	}
+
+	if removed := table.RemoveExpiredDraining(now); removed != 0 {
+		t.Error("No entry should be expired, removed: ", removed)
+	}
+	if removed := table.RemoveExpiredDraining(now.Add(90 * time.Second)); removed != 1 {
+		t.Error("Only one entry should be expired, removed: ", removed)
+	}
+	if _, found := table.SearchByNsIP(net.ParseIP("10.18.0.1")); found {
+		t.Error("Expired entry should be removed")
+	}
+	if entry, found := table.SearchByNsIP(net.ParseIP("10.18.0.3")); !found || entry.IsDraining() {
+		t.Error("Active entry should be untouched")
+	}
+}
+
+func TestServiceIPAffinityTTLInSeconds(t *testing.T) {
+	sip := ServiceIP{IpType: RoundRobin, Address: net.ParseIP("10.30.1.1"), Affinity: AffinitySourceInstance, AffinityTTL: 90 * time.Second}
+	data, err := json.Marshal(sip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"affinity_ttl":90`) {
+		t.Error("AffinityTTL not serialized in seconds: ", string(data))
+	}
+	var decoded ServiceIP
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.AffinityTTL != sip.AffinityTTL || !decoded.Address.Equal(sip.Address) || decoded.Affinity != sip.Affinity {
+		t.Error("ServiceIP not preserved: ", decoded)
+	}
+}
+
+func TestTableEventsEmittedUnlocked(t *testing.T) {
+	table := NewTableManager()
+	entry := TableEntry{
+		Appname:          "e1",
+		Appns:            "e1",
+		Servicename:      "e2",
+		Servicenamespace: "e2",
+		JobName:          "e1.e1.e2.e2",
+		Instancenumber:   0,
+		Cluster:          0,
+		Nodeip:           net.ParseIP("10.30.0.1"),
+		Nodeport:         1003,
+		Nsip:             net.ParseIP("10.18.0.1"),
+		Nsipv6:           net.ParseIP("fc00::1"),
+		ServiceIP: []ServiceIP{{
+			IpType:     RoundRobin,
+			Address:    net.ParseIP("10.30.1.1"),
+			Address_v6: net.ParseIP("fdff:2000::1"),
+		}},
+	}
+	// the subscriber reads the table before taking each event, the emitter blocks on the full buffer meanwhile
+	subscription := events.GetInstance().Subscribe(events.Filter{Target: entry.JobName}, events.SubscriptionOptions{Buffer: 1, Policy: events.Block})
+	defer events.GetInstance().Unsubscribe(subscription)
+	received := make(chan events.EventType, 4)
+	go func() {
+		for i := 0; i < 4; i++ {
+			table.SearchByJobName(entry.JobName)
+			event, ok := <-subscription.Events
+			if !ok {
+				return
+			}
+			received <- event.EventType
+		}
+	}()
+
+	done := make(chan bool)
+	go func() {
+		first := table.Add(entry)
+		entry.Instancenumber = 1
+		entry.Nsip = net.ParseIP("10.18.0.2")
+		entry.Nsipv6 = net.ParseIP("fc00::2")
+		second := table.Add(entry)
+		done <- first == nil && second == nil && table.RemoveByJobName(entry.JobName) == nil
+	}()
+	select {
+	case ok := <-done:
+		if !ok {
+			t.Fatal("Error during insertion or removal")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the table is locked while emitting the events")
+	}
+	for _, expected := range []events.EventType{events.TableEntryAdded, events.TableEntryAdded, events.TableEntryRemoved, events.TableEntryRemoved} {
+		select {
+		case eventType := <-received:
+			if eventType != expected {
+				t.Errorf("expected %v, got %v", expected, eventType)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%v not received", expected)
+		}
+	}
+}
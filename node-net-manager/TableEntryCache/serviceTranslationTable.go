@@ -1,12 +1,16 @@
 package TableEntryCache
 
 import (
+	"NetManager/events"
 	"NetManager/logger"
+	"encoding/json"
 	"errors"
 	"log"
+	"math"
 	"net"
 	"regexp"
 	"sync"
+	"time"
 )
 
 type TableEntry struct {
@@ -17,13 +21,20 @@ type TableEntry struct {
 	Servicenamespace string      `json:"servicenamespace"`
 	Instancenumber   int         `json:"instancenumber"`
 	Cluster          int         `json:"cluster"`
+	Nodeid           string      `json:"nodeid"`
 	Nodeip           net.IP      `json:"nodeip"`
 	Nodeport         int         `json:"nodeport"`
 	Nsip             net.IP      `json:"nsip"`
 	Nsipv6           net.IP      `json:"nsipv6"`
 	ServiceIP        []ServiceIP `json:"serviceIP"`
+	Weight           *int        `json:"weight,omitempty"`
+	LoadHint         float64     `json:"load_hint"`
+	DrainingUntil    time.Time   `json:"-"`
 }
 
+// DEFAULT_WEIGHT is the weight of the instances for which the cluster did not specify any
+const DEFAULT_WEIGHT = 1
+
 type ServiceIpType int
 
 const (
@@ -32,10 +43,55 @@ const (
 	RoundRobin     ServiceIpType = iota
 )
 
+// AffinityMode defines how the flows towards a ServiceIP are pinned to a service instance
+type AffinityMode int
+
+const (
+	AffinityNone AffinityMode = iota
+	AffinitySourceInstance
+	AffinitySourceIPDestPort
+)
+
 type ServiceIP struct {
-	IpType     ServiceIpType `json:"ip_type"`
-	Address    net.IP        `json:"address"`
-	Address_v6 net.IP        `json:"address_v6"`
+	IpType      ServiceIpType `json:"ip_type"`
+	Address     net.IP        `json:"address"`
+	Address_v6  net.IP        `json:"address_v6"`
+	Affinity    AffinityMode  `json:"affinity"`
+	AffinityTTL time.Duration `json:"-"`
+}
+
+// serviceIPJson is the ServiceIP with the AffinityTTL in seconds, as given by the cluster
+type serviceIPJson struct {
+	IpType      ServiceIpType `json:"ip_type"`
+	Address     net.IP        `json:"address"`
+	Address_v6  net.IP        `json:"address_v6"`
+	Affinity    AffinityMode  `json:"affinity"`
+	AffinityTTL int           `json:"affinity_ttl"`
+}
+
+func (sip ServiceIP) MarshalJSON() ([]byte, error) {
+	return json.Marshal(serviceIPJson{
+		IpType:      sip.IpType,
+		Address:     sip.Address,
+		Address_v6:  sip.Address_v6,
+		Affinity:    sip.Affinity,
+		AffinityTTL: int(sip.AffinityTTL / time.Second),
+	})
+}
+
+func (sip *ServiceIP) UnmarshalJSON(data []byte) error {
+	var decoded serviceIPJson
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+	*sip = ServiceIP{
+		IpType:      decoded.IpType,
+		Address:     decoded.Address,
+		Address_v6:  decoded.Address_v6,
+		Affinity:    decoded.Affinity,
+		AffinityTTL: time.Duration(decoded.AffinityTTL) * time.Second,
+	}
+	return nil
 }
 
 type TableManager struct {
@@ -54,8 +110,10 @@ func NewTableManager() TableManager {
 func (t *TableManager) Add(entry TableEntry) error {
 	if t.isValid(entry) {
 		t.rwlock.Lock()
-		defer t.rwlock.Unlock()
 		t.translationTable = append(t.translationTable, entry)
+		t.rwlock.Unlock()
+		// the subscribers may read the table back
+		emitTableEntryEvent(events.TableEntryAdded, entry)
 		return nil
 	}
 	return errors.New("InvalidEntry")
@@ -66,8 +124,6 @@ func (t *TableManager) RemoveByNsip(nsip net.IP) error {
 	logger.DebugLogger().Printf("Remove by Nsip tableManager: %v", t)
 
 	t.rwlock.Lock()
-	defer t.rwlock.Unlock()
-
 	found := -1
 	// this will need to be optimised for IPv6, since that will be hell performance wise
 	for i, tableElement := range t.translationTable {
@@ -76,36 +132,94 @@ func (t *TableManager) RemoveByNsip(nsip net.IP) error {
 			break
 		}
 	}
+	removed, err := t.removeByIndex(found)
+	t.rwlock.Unlock()
 
-	return t.removeByIndex(found)
+	if err != nil {
+		return err
+	}
+	emitTableEntryEvent(events.TableEntryRemoved, removed)
+	return nil
 }
 
 func (t *TableManager) RemoveByJobName(jobname string) error {
 	t.rwlock.Lock()
-	defer t.rwlock.Unlock()
-
+	removed := make([]TableEntry, 0)
 	elems := len(t.translationTable)
 	for i := 0; i < elems; i++ {
 		if t.translationTable[i].JobName == jobname {
-			err := t.removeByIndex(i)
-			if err != nil {
-				return err
-			}
+			entry, _ := t.removeByIndex(i)
+			removed = append(removed, entry)
 			elems = elems - 1
 			i = i - 1
 		}
 	}
+	t.rwlock.Unlock()
+
+	for _, entry := range removed {
+		emitTableEntryEvent(events.TableEntryRemoved, entry)
+	}
 	return nil
 }
 
-func (t *TableManager) removeByIndex(index int) error {
+// MarkDraining flags the entry with the given Namespace IP as draining until the given deadline
+func (t *TableManager) MarkDraining(nsip net.IP, until time.Time) error {
+	t.rwlock.Lock()
+	defer t.rwlock.Unlock()
+	for i, tableElement := range t.translationTable {
+		if tableElement.Nsip.Equal(nsip) || tableElement.Nsipv6.Equal(nsip) {
+			t.translationTable[i].DrainingUntil = until
+			return nil
+		}
+	}
+	return errors.New("entry not found")
+}
+
+// RemoveExpiredDraining removes the draining entries whose deadline is before now and returns how many were removed
+func (t *TableManager) RemoveExpiredDraining(now time.Time) int {
+	t.rwlock.Lock()
+	removed := make([]TableEntry, 0)
+	elems := len(t.translationTable)
+	for i := 0; i < elems; i++ {
+		if t.translationTable[i].IsDraining() && !t.translationTable[i].DrainingUntil.After(now) {
+			entry, _ := t.removeByIndex(i)
+			removed = append(removed, entry)
+			elems = elems - 1
+			i = i - 1
+		}
+	}
+	t.rwlock.Unlock()
+
+	for _, entry := range removed {
+		emitTableEntryEvent(events.TableEntryRemoved, entry)
+	}
+	return len(removed)
+}
+
+// emitTableEntryEvent tells the event subscribers about an added or removed entry
+func emitTableEntryEvent(eventType events.EventType, entry TableEntry) {
+	payload := events.TableEntryEvent{
+		JobName:  entry.JobName,
+		Instance: entry.Instancenumber,
+		Nsip:     entry.Nsip.String(),
+		Nodeip:   entry.Nodeip.String(),
+	}
+	if entry.Nsipv6 != nil {
+		payload.Nsipv6 = entry.Nsipv6.String()
+	}
+	events.GetInstance().Emit(events.Event{EventType: eventType, EventTarget: entry.JobName, Payload: payload})
+}
+
+// removeByIndex returns the removed entry, the caller holds the lock and emits the event once it is released
+func (t *TableManager) removeByIndex(index int) (TableEntry, error) {
 	if index > -1 {
-		logger.DebugLogger().Printf("Removing from TableManager: %v", t.translationTable[index])
+		removed := t.translationTable[index]
+		logger.DebugLogger().Printf("Removing from TableManager: %v", removed)
 		t.translationTable[index] = t.translationTable[len(t.translationTable)-1]
 		t.translationTable = t.translationTable[:len(t.translationTable)-1]
-		return nil
+		return removed, nil
 	}
-	return errors.New("entry not found")
+	return TableEntry{}, errors.New("entry not found")
 }
 
 func (t *TableManager) SearchByServiceIP(ip net.IP) []TableEntry {
@@ -149,6 +263,18 @@ func (t *TableManager) SearchByNodeIp(ip net.IP) []TableEntry {
 	return result
 }
 
+func (t *TableManager) SearchDraining() []TableEntry {
+	t.rwlock.RLock()
+	defer t.rwlock.RUnlock()
+	results := make([]TableEntry, 0)
+	for _, tableElement := range t.translationTable {
+		if tableElement.IsDraining() {
+			results = append(results, tableElement)
+		}
+	}
+	return results
+}
+
 func (t *TableManager) SearchByJobName(jobname string) []TableEntry {
 	t.rwlock.Lock()
 	defer t.rwlock.Unlock()
@@ -218,6 +344,50 @@ func (t *TableManager) isValid(entry TableEntry) bool {
 	return true
 }
 
+// IsDraining returns true if the instance has been removed from the service and only serves the existing flows
+func (entry TableEntry) IsDraining() bool {
+	return !entry.DrainingUntil.IsZero()
+}
+
+// GetWeight returns the weight of the instance, 0 means that the instance is draining
+func (entry TableEntry) GetWeight() int {
+	if entry.IsDraining() {
+		return 0
+	}
+	if entry.Weight == nil {
+		return DEFAULT_WEIGHT
+	}
+	if *entry.Weight < 0 {
+		return 0
+	}
+	return *entry.Weight
+}
+
+// GetEffectiveWeight returns the weight of the instance scaled down by the load reported by the cluster.
+// LoadHint goes from 0 (idle) to 1 (saturated). A non draining instance always keeps a minimum weight of 1.
+func (entry TableEntry) GetEffectiveWeight() int {
+	weight := entry.GetWeight()
+	if weight == 0 {
+		return 0
+	}
+	load := math.Min(math.Max(entry.LoadHint, 0), 1)
+	effective := int(math.Round(float64(weight*100) * (1 - load)))
+	if effective < 1 {
+		return 1
+	}
+	return effective
+}
+
+// GetServiceIP returns the ServiceIP of the entry matching the given IPv4 or IPv6 address
+func (entry TableEntry) GetServiceIP(ip net.IP) (ServiceIP, bool) {
+	for _, sip := range entry.ServiceIP {
+		if sip.Address.Equal(ip) || sip.Address_v6.Equal(ip) {
+			return sip, true
+		}
+	}
+	return ServiceIP{}, false
+}
+
 func IsNamespaceStillValid(nsip net.IP, table *[]TableEntry) bool {
 	for _, entry := range *table {
 		if entry.Nsip.Equal(nsip) || entry.Nsipv6.Equal(nsip) {
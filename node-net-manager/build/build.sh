@@ -6,3 +6,7 @@ env GOOS=linux GOARCH=arm64 go build -ldflags="-X 'NetManager/cmd.Version=$versi
 #amd build
 env GOOS=linux GOARCH=amd64 go build -ldflags="-X 'NetManager/cmd.Version=$version'" -o bin/amd64-NetManager ../NetManager.go
 
+
+#cni plugin
+env GOOS=linux GOARCH=arm64 go build -o bin/arm64-oakestra-cni ../cni
+env GOOS=linux GOARCH=amd64 go build -o bin/amd64-oakestra-cni ../cni
@@ -5,6 +5,9 @@ import (
 	"NetManager/model"
 	"NetManager/network"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"NetManager/server"
@@ -52,6 +55,19 @@ func startNetManager() error {
 
 	network.IptableFlushAll()
 
+	// remove the firewall rules installed by the NetManager when it is stopped
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-c
+		log.Println("NetManager stopping, removing the firewall rules")
+		network.CleanupRules()
+		if err := network.RestoreSysctls(); err != nil {
+			log.Printf("ERROR: unable to restore the kernel parameters: %v", err)
+		}
+		os.Exit(0)
+	}()
+
 	log.Println("NetManager started, but waiting for NodeEngine registration 🟠")
 	server.HandleRequests(localPort)
 
@@ -0,0 +1,406 @@
+// Command oakestra is a CNI plugin attaching the containers to the NetManager running on the node.
+// The plugin forwards ADD and DEL to the /container/deploy and /container/undeploy API of the daemon,
+// the service instance is given with CNI_ARGS, e.g.
+//
+//	CNI_ARGS="OAKESTRA_SERVICE_NAME=app.app.svc.svc;OAKESTRA_INSTANCE_NUMBER=0"
+//
+// Network configuration:
+//
+//	{
+//		"cniVersion": "1.0.0",
+//		"name": "oakestra",
+//		"type": "oakestra",
+//		"socket": "/etc/netmanager/netmanager.sock", # optional
+//		"capabilities": {"portMappings": true}
+//	}
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+const (
+	DEFAULT_NETMANAGER_SOCKET = "/etc/netmanager/netmanager.sock"
+	CNI_VERSION               = "1.0.0"
+	ARG_SERVICE_NAME          = "OAKESTRA_SERVICE_NAME"
+	ARG_INSTANCE_NUMBER       = "OAKESTRA_INSTANCE_NUMBER"
+)
+
+var supportedVersions = []string{"0.3.0", "0.3.1", "0.4.0", "1.0.0"}
+
+// CNI error codes
+const (
+	errIncompatibleVersion = 1
+	errInvalidEnvironment  = 4
+	errDecoding            = 6
+	errInvalidConfig       = 7
+	errTryAgainLater       = 11
+	errPlugin              = 999
+)
+
+type cniError struct {
+	CNIVersion string `json:"cniVersion"`
+	Code       int    `json:"code"`
+	Msg        string `json:"msg"`
+	Details    string `json:"details,omitempty"`
+}
+
+func (e *cniError) Error() string {
+	return e.Msg
+}
+
+func newError(code int, msg string, details ...interface{}) *cniError {
+	result := &cniError{CNIVersion: CNI_VERSION, Code: code, Msg: msg}
+	if len(details) > 0 {
+		result.Details = fmt.Sprint(details...)
+	}
+	return result
+}
+
+type portMapping struct {
+	HostPort      int    `json:"hostPort"`
+	ContainerPort int    `json:"containerPort"`
+	Protocol      string `json:"protocol"`
+	HostIP        string `json:"hostIP"`
+}
+
+// netManagerPortMapping is a port mapping of the NetManager deploy API
+type netManagerPortMapping struct {
+	HostIP        string   `json:"hostIP,omitempty"`
+	HostPort      int      `json:"hostPort"`
+	ContainerPort int      `json:"containerPort"`
+	Protocols     []string `json:"protocols"`
+}
+
+type netConf struct {
+	CNIVersion    string `json:"cniVersion"`
+	Name          string `json:"name"`
+	Type          string `json:"type"`
+	Socket        string `json:"socket"`
+	RuntimeConfig struct {
+		PortMappings []portMapping `json:"portMappings"`
+	} `json:"runtimeConfig"`
+	PrevResult *cniResult `json:"prevResult"`
+}
+
+type cniInterface struct {
+	Name    string `json:"name"`
+	Mac     string `json:"mac,omitempty"`
+	Sandbox string `json:"sandbox,omitempty"`
+}
+
+type cniIPConfig struct {
+	// only in the results before 1.0.0
+	Version   string `json:"version,omitempty"`
+	Address   string `json:"address"`
+	Gateway   string `json:"gateway,omitempty"`
+	Interface *int   `json:"interface,omitempty"`
+}
+
+type cniRoute struct {
+	Dst string `json:"dst"`
+	GW  string `json:"gw,omitempty"`
+}
+
+type cniResult struct {
+	CNIVersion string         `json:"cniVersion"`
+	Interfaces []cniInterface `json:"interfaces,omitempty"`
+	IPs        []cniIPConfig  `json:"ips,omitempty"`
+	Routes     []cniRoute     `json:"routes,omitempty"`
+	DNS        struct{}       `json:"dns"`
+}
+
+// runtime arguments given by the container runtime
+type cniArgs struct {
+	command     string
+	containerID string
+	netns       string
+	ifname      string
+	args        map[string]string
+}
+
+// deployResponse is the /container/deploy response of the NetManager
+type deployResponse struct {
+	ServiceName string `json:"serviceName"`
+	NsAddress   string `json:"nsAddress"`
+	NsAddressv6 string `json:"nsAddressv6"`
+	Gateway     string `json:"gateway"`
+	Gatewayv6   string `json:"gatewayv6"`
+}
+
+func main() {
+	output, err := run(os.Getenv, os.Stdin)
+	if err != nil {
+		_ = json.NewEncoder(os.Stdout).Encode(err)
+		os.Exit(1)
+	}
+	if output != nil {
+		_, _ = os.Stdout.Write(output)
+	}
+}
+
+// run executes the CNI command and returns the output to be printed
+func run(getenv func(string) string, stdin io.Reader) ([]byte, *cniError) {
+	args := cniArgs{
+		command:     getenv("CNI_COMMAND"),
+		containerID: getenv("CNI_CONTAINERID"),
+		netns:       getenv("CNI_NETNS"),
+		ifname:      getenv("CNI_IFNAME"),
+		args:        parseArgs(getenv("CNI_ARGS")),
+	}
+	if args.command == "VERSION" {
+		return marshal(map[string]interface{}{
+			"cniVersion":        CNI_VERSION,
+			"supportedVersions": supportedVersions,
+		})
+	}
+
+	input, err := io.ReadAll(stdin)
+	if err != nil {
+		return nil, newError(errDecoding, "unable to read the network configuration", err)
+	}
+	conf := netConf{}
+	if err := json.Unmarshal(input, &conf); err != nil {
+		return nil, newError(errDecoding, "invalid network configuration", err)
+	}
+	if !isSupported(conf.CNIVersion) {
+		return nil, newError(errIncompatibleVersion, "unsupported CNI version "+conf.CNIVersion)
+	}
+	if conf.Socket == "" {
+		conf.Socket = DEFAULT_NETMANAGER_SOCKET
+	}
+
+	switch args.command {
+	case "ADD":
+		return cmdAdd(conf, args)
+	case "DEL":
+		return nil, cmdDel(conf, args)
+	case "CHECK":
+		return nil, cmdCheck(conf, args)
+	}
+	return nil, newError(errInvalidEnvironment, "unknown CNI_COMMAND "+args.command)
+}
+
+func cmdAdd(conf netConf, args cniArgs) ([]byte, *cniError) {
+	if args.netns == "" || args.ifname == "" {
+		return nil, newError(errInvalidEnvironment, "CNI_NETNS and CNI_IFNAME are required")
+	}
+	serviceName, instance, cerr := serviceInstance(args)
+	if cerr != nil {
+		return nil, cerr
+	}
+	request := map[string]interface{}{
+		"netns":          args.netns,
+		"ifname":         args.ifname,
+		"serviceName":    serviceName,
+		"instanceNumber": instance,
+		"portMappings":   portMappings(conf.RuntimeConfig.PortMappings),
+	}
+	response := deployResponse{}
+	if cerr := callNetManager(conf.Socket, "/container/deploy", request, &response); cerr != nil {
+		return nil, cerr
+	}
+	result, cerr := buildResult(conf.CNIVersion, args, response)
+	if cerr != nil {
+		return nil, cerr
+	}
+	return marshal(result)
+}
+
+// cmdDel releases the network of the instance, a missing instance is not an error
+func cmdDel(conf netConf, args cniArgs) *cniError {
+	serviceName, instance, cerr := serviceInstance(args)
+	if cerr != nil {
+		return nil
+	}
+	request := map[string]interface{}{
+		"serviceName":    serviceName,
+		"instanceNumber": instance,
+	}
+	return callNetManager(conf.Socket, "/container/undeploy", request, nil)
+}
+
+// cmdCheck verifies that the interface in the namespace still has the addresses of the previous result
+func cmdCheck(conf netConf, args cniArgs) *cniError {
+	if conf.PrevResult == nil {
+		return newError(errInvalidConfig, "CHECK requires the prevResult")
+	}
+	ns, err := netns.GetFromPath(args.netns)
+	if err != nil {
+		return newError(errInvalidEnvironment, "unable to open "+args.netns, err)
+	}
+	defer ns.Close()
+	handle, err := netlink.NewHandleAt(ns)
+	if err != nil {
+		return newError(errPlugin, "unable to inspect the namespace", err)
+	}
+	defer handle.Close()
+	link, err := handle.LinkByName(args.ifname)
+	if err != nil {
+		return newError(errPlugin, "interface "+args.ifname+" not found", err)
+	}
+	addresses, err := handle.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return newError(errPlugin, "unable to list the addresses", err)
+	}
+	for _, ip := range conf.PrevResult.IPs {
+		expected, _, err := net.ParseCIDR(ip.Address)
+		if err != nil {
+			return newError(errInvalidConfig, "invalid address in prevResult "+ip.Address)
+		}
+		found := false
+		for _, addr := range addresses {
+			found = found || addr.IP.Equal(expected)
+		}
+		if !found {
+			return newError(errPlugin, fmt.Sprintf("address %s missing on %s", ip.Address, args.ifname))
+		}
+	}
+	return nil
+}
+
+func buildResult(version string, args cniArgs, response deployResponse) (*cniResult, *cniError) {
+	result := &cniResult{
+		CNIVersion: version,
+		Interfaces: []cniInterface{{Name: args.ifname, Sandbox: args.netns}},
+		IPs:        make([]cniIPConfig, 0, 2),
+		Routes:     make([]cniRoute, 0, 2),
+	}
+	index := 0
+	add := func(address string, gateway string, ipVersion string, defaultRoute string) *cniError {
+		ip := net.ParseIP(address)
+		if ip == nil {
+			// e.g. no IPv6 on the node
+			return nil
+		}
+		gw, subnet, err := net.ParseCIDR(gateway)
+		if err != nil {
+			return newError(errPlugin, "invalid gateway returned by the NetManager", gateway)
+		}
+		config := cniIPConfig{
+			Address:   (&net.IPNet{IP: ip, Mask: subnet.Mask}).String(),
+			Gateway:   gw.String(),
+			Interface: &index,
+		}
+		if strings.HasPrefix(version, "0.") {
+			config.Version = ipVersion
+		}
+		result.IPs = append(result.IPs, config)
+		result.Routes = append(result.Routes, cniRoute{Dst: defaultRoute, GW: gw.String()})
+		return nil
+	}
+	if cerr := add(response.NsAddress, response.Gateway, "4", "0.0.0.0/0"); cerr != nil {
+		return nil, cerr
+	}
+	if cerr := add(response.NsAddressv6, response.Gatewayv6, "6", "::/0"); cerr != nil {
+		return nil, cerr
+	}
+	if len(result.IPs) == 0 {
+		return nil, newError(errPlugin, "no address returned by the NetManager")
+	}
+	return result, nil
+}
+
+func callNetManager(socket string, path string, request interface{}, response interface{}) *cniError {
+	client := &http.Client{
+		Timeout: 60 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+	payload, _ := json.Marshal(request)
+	resp, err := client.Post("http://netmanager"+path, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return newError(errTryAgainLater, "NetManager not reachable on "+socket, err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return newError(errPlugin, fmt.Sprintf("NetManager %s failed with status %d", path, resp.StatusCode), string(body))
+	}
+	if response == nil {
+		return nil
+	}
+	if err := json.Unmarshal(body, response); err != nil {
+		return newError(errPlugin, "invalid NetManager response", err)
+	}
+	return nil
+}
+
+func serviceInstance(args cniArgs) (string, int, *cniError) {
+	serviceName := args.args[ARG_SERVICE_NAME]
+	if serviceName == "" {
+		return "", 0, newError(errInvalidEnvironment, ARG_SERVICE_NAME+" missing in CNI_ARGS")
+	}
+	instance, err := strconv.Atoi(args.args[ARG_INSTANCE_NUMBER])
+	if err != nil {
+		return "", 0, newError(errInvalidEnvironment, ARG_INSTANCE_NUMBER+" missing or invalid in CNI_ARGS")
+	}
+	return serviceName, instance, nil
+}
+
+// parseArgs parses the CNI_ARGS, e.g. "K8S_POD_NAME=a;OAKESTRA_INSTANCE_NUMBER=0"
+func parseArgs(cniArgs string) map[string]string {
+	result := make(map[string]string)
+	for _, pair := range strings.Split(cniArgs, ";") {
+		key, value, found := strings.Cut(pair, "=")
+		if found {
+			result[key] = value
+		}
+	}
+	return result
+}
+
+// portMappings converts the portMappings capability to the NetManager port mappings
+func portMappings(mappings []portMapping) []netManagerPortMapping {
+	result := make([]netManagerPortMapping, 0, len(mappings))
+	for _, mapping := range mappings {
+		protocol := strings.ToLower(mapping.Protocol)
+		if protocol == "" {
+			protocol = "tcp"
+		}
+		hostIP := ""
+		if ip := net.ParseIP(mapping.HostIP); ip != nil && !ip.IsUnspecified() {
+			hostIP = ip.String()
+		}
+		result = append(result, netManagerPortMapping{
+			HostIP:        hostIP,
+			HostPort:      mapping.HostPort,
+			ContainerPort: mapping.ContainerPort,
+			Protocols:     []string{protocol},
+		})
+	}
+	return result
+}
+
+func marshal(result interface{}) ([]byte, *cniError) {
+	output, err := json.Marshal(result)
+	if err != nil {
+		return nil, newError(errPlugin, "unable to encode the result", err)
+	}
+	return output, nil
+}
+
+func isSupported(version string) bool {
+	for _, supported := range supportedVersions {
+		if version == supported {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+// fakeNetManager serves the container API on a unix socket and records the requests.
+// Like the NetManager /v1 API, undeploying an instance that is not deployed succeeds.
+func fakeNetManager(t *testing.T) (string, *[]map[string]interface{}) {
+	dir, err := os.MkdirTemp("", "cni")
+	if err != nil {
+		t.Fatal(err)
+	}
+	socket := filepath.Join(dir, "netmanager.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	requests := make([]map[string]interface{}, 0)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/container/deploy", func(writer http.ResponseWriter, request *http.Request) {
+		body := map[string]interface{}{}
+		_ = json.NewDecoder(request.Body).Decode(&body)
+		requests = append(requests, body)
+		_ = json.NewEncoder(writer).Encode(deployResponse{
+			ServiceName: "app.app.svc.svc",
+			NsAddress:   "10.19.1.2",
+			NsAddressv6: "fc00::2",
+			Gateway:     "10.19.1.1/26",
+			Gatewayv6:   "fc00::1/120",
+		})
+	})
+	mux.HandleFunc("/container/undeploy", func(writer http.ResponseWriter, request *http.Request) {
+		body := map[string]interface{}{}
+		_ = json.NewDecoder(request.Body).Decode(&body)
+		requests = append(requests, body)
+	})
+	server := &http.Server{Handler: mux}
+	go func() { _ = server.Serve(listener) }()
+	t.Cleanup(func() {
+		_ = server.Close()
+		_ = os.RemoveAll(dir)
+	})
+	return socket, &requests
+}
+
+func environment(values map[string]string) func(string) string {
+	return func(key string) string {
+		return values[key]
+	}
+}
+
+func TestCniAdd(t *testing.T) {
+	socket, requests := fakeNetManager(t)
+	config := `{"cniVersion":"1.0.0","name":"oakestra","type":"oakestra","socket":"` + socket + `",
+		"runtimeConfig":{"portMappings":[{"hostPort":8080,"containerPort":80,"protocol":"tcp","hostIP":"0.0.0.0"},{"hostPort":5353,"containerPort":53,"protocol":"udp","hostIP":"192.168.1.10"}]}}`
+	output, cerr := run(environment(map[string]string{
+		"CNI_COMMAND":     "ADD",
+		"CNI_CONTAINERID": "id",
+		"CNI_NETNS":       "/var/run/netns/test",
+		"CNI_IFNAME":      "eth0",
+		"CNI_ARGS":        "IgnoreUnknown=1;OAKESTRA_SERVICE_NAME=app.app.svc.svc;OAKESTRA_INSTANCE_NUMBER=3",
+	}), strings.NewReader(config))
+	assert.Assert(t, cerr == nil, cerr)
+
+	assert.Equal(t, len(*requests), 1)
+	request := (*requests)[0]
+	assert.Equal(t, request["netns"], "/var/run/netns/test")
+	assert.Equal(t, request["ifname"], "eth0")
+	assert.Equal(t, request["serviceName"], "app.app.svc.svc")
+	assert.Equal(t, request["instanceNumber"], float64(3))
+	assert.DeepEqual(t, request["portMappings"], []interface{}{
+		map[string]interface{}{"hostPort": float64(8080), "containerPort": float64(80), "protocols": []interface{}{"tcp"}},
+		map[string]interface{}{"hostIP": "192.168.1.10", "hostPort": float64(5353), "containerPort": float64(53), "protocols": []interface{}{"udp"}},
+	})
+
+	result := cniResult{}
+	assert.NilError(t, json.Unmarshal(output, &result))
+	assert.Equal(t, result.CNIVersion, "1.0.0")
+	assert.DeepEqual(t, result.Interfaces, []cniInterface{{Name: "eth0", Sandbox: "/var/run/netns/test"}})
+	assert.Equal(t, len(result.IPs), 2)
+	assert.Equal(t, result.IPs[0].Address, "10.19.1.2/26")
+	assert.Equal(t, result.IPs[0].Gateway, "10.19.1.1")
+	assert.Equal(t, *result.IPs[0].Interface, 0)
+	assert.Equal(t, result.IPs[0].Version, "")
+	assert.Equal(t, result.IPs[1].Address, "fc00::2/120")
+	assert.DeepEqual(t, result.Routes, []cniRoute{{Dst: "0.0.0.0/0", GW: "10.19.1.1"}, {Dst: "::/0", GW: "fc00::1"}})
+}
+
+func TestCniResultVersions(t *testing.T) {
+	args := cniArgs{ifname: "eth0", netns: "/proc/1/ns/net"}
+	result, cerr := buildResult("0.4.0", args, deployResponse{NsAddress: "10.19.1.2", NsAddressv6: "<nil>", Gateway: "10.19.1.1/26"})
+	assert.Assert(t, cerr == nil)
+	assert.Equal(t, len(result.IPs), 1)
+	assert.Equal(t, result.IPs[0].Version, "4")
+
+	_, cerr = buildResult("1.0.0", args, deployResponse{NsAddress: "<nil>", NsAddressv6: "<nil>"})
+	assert.Assert(t, cerr != nil)
+}
+
+func TestCniDel(t *testing.T) {
+	socket, requests := fakeNetManager(t)
+	config := `{"cniVersion":"0.4.0","name":"oakestra","type":"oakestra","socket":"` + socket + `"}`
+	_, cerr := run(environment(map[string]string{
+		"CNI_COMMAND": "DEL",
+		"CNI_ARGS":    "OAKESTRA_SERVICE_NAME=app.app.svc.svc;OAKESTRA_INSTANCE_NUMBER=3",
+	}), strings.NewReader(config))
+	assert.Assert(t, cerr == nil, cerr)
+	assert.Equal(t, len(*requests), 1)
+	assert.Equal(t, (*requests)[0]["serviceName"], "app.app.svc.svc")
+
+	// nothing to release without the service instance
+	_, cerr = run(environment(map[string]string{"CNI_COMMAND": "DEL"}), strings.NewReader(config))
+	assert.Assert(t, cerr == nil, cerr)
+	assert.Equal(t, len(*requests), 1)
+}
+
+func TestCniDelTwice(t *testing.T) {
+	socket, requests := fakeNetManager(t)
+	config := `{"cniVersion":"1.0.0","name":"oakestra","type":"oakestra","socket":"` + socket + `"}`
+	args := "OAKESTRA_SERVICE_NAME=app.app.svc.svc;OAKESTRA_INSTANCE_NUMBER=3"
+	_, cerr := run(environment(map[string]string{
+		"CNI_COMMAND": "ADD",
+		"CNI_NETNS":   "/var/run/netns/test",
+		"CNI_IFNAME":  "eth0",
+		"CNI_ARGS":    args,
+	}), strings.NewReader(config))
+	assert.Assert(t, cerr == nil, cerr)
+
+	// the second DEL finds the instance already released
+	for i := 0; i < 2; i++ {
+		_, cerr = run(environment(map[string]string{"CNI_COMMAND": "DEL", "CNI_ARGS": args}), strings.NewReader(config))
+		assert.Assert(t, cerr == nil, cerr)
+	}
+	assert.Equal(t, len(*requests), 3)
+}
+
+func TestCniErrors(t *testing.T) {
+	output, cerr := run(environment(map[string]string{"CNI_COMMAND": "VERSION"}), strings.NewReader(""))
+	assert.Assert(t, cerr == nil)
+	assert.Assert(t, strings.Contains(string(output), `"supportedVersions":["0.3.0","0.3.1","0.4.0","1.0.0"]`))
+
+	_, cerr = run(environment(map[string]string{"CNI_COMMAND": "ADD"}), strings.NewReader(`{"cniVersion":"0.2.0"}`))
+	assert.Equal(t, cerr.Code, errIncompatibleVersion)
+
+	_, cerr = run(environment(map[string]string{"CNI_COMMAND": "ADD"}), strings.NewReader(`{`))
+	assert.Equal(t, cerr.Code, errDecoding)
+
+	_, cerr = run(environment(map[string]string{
+		"CNI_COMMAND": "ADD",
+		"CNI_NETNS":   "/var/run/netns/test",
+		"CNI_IFNAME":  "eth0",
+		"CNI_ARGS":    "OAKESTRA_SERVICE_NAME=app.app.svc.svc",
+	}), strings.NewReader(`{"cniVersion":"1.0.0"}`))
+	assert.Equal(t, cerr.Code, errInvalidEnvironment)
+
+	_, cerr = run(environment(map[string]string{
+		"CNI_COMMAND": "ADD",
+		"CNI_NETNS":   "/var/run/netns/test",
+		"CNI_IFNAME":  "eth0",
+		"CNI_ARGS":    "OAKESTRA_SERVICE_NAME=app.app.svc.svc;OAKESTRA_INSTANCE_NUMBER=0",
+	}), strings.NewReader(`{"cniVersion":"1.0.0","socket":"/nonexistent.sock"}`))
+	assert.Equal(t, cerr.Code, errTryAgainLater)
+
+	_, cerr = run(environment(map[string]string{"CNI_COMMAND": "CHECK"}), strings.NewReader(`{"cniVersion":"1.0.0"}`))
+	assert.Equal(t, cerr.Code, errInvalidConfig)
+}
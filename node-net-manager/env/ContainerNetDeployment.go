@@ -1,12 +1,12 @@
 package env
 
 import (
+	"NetManager/events"
 	"NetManager/logger"
 	"NetManager/mqtt"
 	"NetManager/network"
 	"fmt"
 	"net"
-	"runtime/debug"
 
 	"github.com/vishvananda/netlink"
 )
@@ -31,151 +31,220 @@ func InitContainerDeployment(env *Environment) {
 }
 
 // AttachNetworkToContainer Attach a Docker container to the bridge and the current network environment
-func (h *ContainerDeyplomentHandler) DeployNetwork(pid int, sname string, instancenumber int, portmapping string) (net.IP, net.IP, error) {
-	env := h.env
-
-	cleanup := func(veth *netlink.Veth) {
-		_ = netlink.LinkDel(veth)
-	}
-
-	vethIfce, err := env.createVethsPairAndAttachToBridge(sname, env.mtusize)
-	if err != nil {
-		go cleanup(vethIfce)
-		return nil, nil, err
-	}
-
-	// Attach veth2 to the docker container
-	logger.DebugLogger().Println("Attaching peerveth to container ")
-	peerVeth, err := netlink.LinkByName(vethIfce.PeerName)
+func (h *ContainerDeyplomentHandler) DeployNetwork(request DeploymentRequest) (net.IP, net.IP, bool, error) {
+	target, err := newNetnsTarget(request.Pid, request.NetnsPath)
 	if err != nil {
-		cleanup(vethIfce)
-		return nil, nil, err
+		return nil, nil, false, err
 	}
-	if err := netlink.LinkSetNsPid(peerVeth, pid); err != nil {
-		cleanup(vethIfce)
-		return nil, nil, err
-	}
-
-	// generate a new ip for this container
-	ip, err := env.generateAddress()
-	if err != nil {
-		cleanup(vethIfce)
-		return nil, nil, err
+	if err := target.validate(); err != nil {
+		return nil, nil, false, err
 	}
+	return h.env.attachVethToNamespace(target, request)
+}
 
-	// generate a new ipv6 for this container
-	ipv6, err := env.generateIPv6Address()
+// attachVethToNamespace creates a veth pair on the bridge, moves the peer into the namespace and assigns the addresses, routes and port mappings.
+// The steps are undone in reverse order if one of them fails, and again when the instance is detached.
+// created is false when the instance was already deployed and the request only updated its ports.
+func (env *Environment) attachVethToNamespace(target netnsTarget, request DeploymentRequest) (ip net.IP, ipv6 net.IP, created bool, err error) {
+	ops := env.vethOps
+	sname := request.ServiceName
+	key := fmt.Sprintf("%s.%d", sname, request.Instancenumber)
+	owner := network.InstanceRuleOwner(sname, request.Instancenumber)
+	if ip, ipv6, deployed, err := env.redeploy(key, target.String(), request); deployed {
+		return ip, ipv6, false, err
+	}
+	// the undo steps close the ports published last
+	ports := newPublishedPorts(request)
+
+	var vethIfce *netlink.Veth
+	peerName := ""
+	vethNumber := 0
+	transaction := newDeploymentTransaction(request.Context, key)
+	err = transaction.run(
+		deploymentStep{
+			name: "create veth",
+			apply: func() (err error) {
+				vethIfce, vethNumber, err = env.createBookedVeth(func() (*netlink.Veth, error) {
+					return ops.createVeth(sname)
+				})
+				return err
+			},
+			undo: func() {
+				ops.deleteVeth(vethIfce)
+				env.unbookVethNumber(vethNumber)
+			},
+		},
+		deploymentStep{
+			// the peer is deleted together with the bridge side of the veth
+			name: "move peer into namespace",
+			apply: func() error {
+				logger.DebugLogger().Println("Attaching peerveth to container ", target)
+				peerName = vethIfce.PeerName
+				return ops.moveLink(target, peerName)
+			},
+		},
+		deploymentStep{
+			name: "rename peer",
+			apply: func() error {
+				if request.Ifname == "" {
+					return nil
+				}
+				if err := ops.renameLink(target, peerName, request.Ifname); err != nil {
+					return err
+				}
+				peerName = request.Ifname
+				return nil
+			},
+		},
+		deploymentStep{
+			name: "allocate ipv4",
+			apply: func() (err error) {
+				ip, err = env.generateAddress()
+				return err
+			},
+			undo: func() { env.freeContainerAddress(ip) },
+		},
+		deploymentStep{
+			name: "allocate ipv6",
+			apply: func() (err error) {
+				ipv6, err = env.generateIPv6Address()
+				return err
+			},
+			undo: func() { env.freeContainerAddress(ipv6) },
+		},
+		deploymentStep{
+			name: "assign ipv4",
+			apply: func() error {
+				logger.DebugLogger().Println("Assigning ip ", ip.String()+env.config.HostBridgeMask, " to container ")
+				return ops.addAddress(target, ip.String()+env.config.HostBridgeMask, peerName)
+			},
+		},
+		deploymentStep{
+			name: "disable DAD",
+			apply: func() error {
+				return ops.disableDAD(target, peerName)
+			},
+		},
+		deploymentStep{
+			name: "assign ipv6",
+			apply: func() error {
+				logger.DebugLogger().Println("Assigning ipv6 ", ipv6.String()+env.config.HostBridgeIPv6Prefix, " to container ")
+				return ops.addAddress(target, ipv6.String()+env.config.HostBridgeIPv6Prefix, peerName)
+			},
+		},
+		deploymentStep{
+			name: "set ipv4 routes",
+			apply: func() error {
+				return ops.setRoutes(target, peerName)
+			},
+		},
+		deploymentStep{
+			name: "set ipv6 routes",
+			apply: func() error {
+				return ops.setIPv6Routes(target, peerName)
+			},
+		},
+		deploymentStep{
+			name: "set firewall rules",
+			apply: func() error {
+				return ops.setFirewallRules(owner, vethIfce.Name)
+			},
+			undo: func() { ops.removeFirewallRules(owner, vethIfce.Name) },
+		},
+		deploymentStep{
+			name: "open ipv4 ports",
+			apply: func() error {
+				return ops.managePorts(owner, ip, request.PortMappings, network.OpenPorts)
+			},
+			undo: func() {
+				mappings, _ := ports.get()
+				_ = ops.managePorts(owner, ip, mappings, network.ClosePorts)
+			},
+		},
+		deploymentStep{
+			name: "open ipv6 ports",
+			apply: func() error {
+				return ops.managePorts(owner, ipv6, request.PortMappings, network.OpenPorts)
+			},
+			undo: func() {
+				mappings, _ := ports.get()
+				_ = ops.managePorts(owner, ipv6, mappings, network.ClosePorts)
+			},
+		},
+		deploymentStep{
+			name: "expose publicly",
+			apply: func() error {
+				return ops.exposePublicly(owner, request.PublicExposures, ip, ipv6, network.OpenPorts)
+			},
+			undo: func() {
+				_, exposures := ports.get()
+				_ = ops.exposePublicly(owner, exposures, ip, ipv6, network.ClosePorts)
+			},
+		},
+		deploymentStep{
+			name: "register service",
+			apply: func() error {
+				env.deployedServicesLock.Lock()
+				defer env.deployedServicesLock.Unlock()
+				if _, exist := env.deployedServices[key]; exist {
+					return fmt.Errorf("%w: %s", ErrInstanceConflict, key)
+				}
+				env.deployedServices[key] = service{
+					ip:          ip,
+					ipv6:        ipv6,
+					sname:       sname,
+					runtime:     request.Runtime,
+					instance:    request.Instancenumber,
+					netns:       target.String(),
+					ports:       ports,
+					owner:       owner,
+					veth:        vethIfce,
+					transaction: transaction,
+				}
+				return nil
+			},
+			undo: func() {
+				env.deployedServicesLock.Lock()
+				delete(env.deployedServices, key)
+				env.deployedServicesLock.Unlock()
+			},
+		},
+	)
 	if err != nil {
-		cleanup(vethIfce)
-		env.freeContainerAddress(ip)
-		return nil, nil, err
-	}
-
-	// set ip to the container veth
-	logger.DebugLogger().Println("Assigning ip ", ip.String()+env.config.HostBridgeMask, " to container ")
-	if err := env.addPeerLinkNetwork(pid, ip.String()+env.config.HostBridgeMask, vethIfce.PeerName); err != nil {
-		logger.ErrorLogger().Println("Error in addPeerLinkNetwork")
-		cleanup(vethIfce)
-		env.freeContainerAddress(ip)
-		env.freeContainerAddress(ipv6)
-		return nil, nil, err
-	}
-
-	logger.DebugLogger().Println("Disabling DAD for IPv6")
-	if err := env.disableDAD(pid, vethIfce.PeerName); err != nil {
-		logger.ErrorLogger().Println("Error in Disabling DAD")
-		cleanup(vethIfce)
-		env.freeContainerAddress(ip)
-		env.freeContainerAddress(ipv6)
-		return nil, nil, err
-	}
-
-	logger.DebugLogger().Println("Assigning ipv6 ", ipv6.String()+env.config.HostBridgeIPv6Prefix, " to container ")
-	if err := env.addPeerLinkNetwork(pid, ipv6.String()+env.config.HostBridgeIPv6Prefix, vethIfce.PeerName); err != nil {
-		logger.ErrorLogger().Println("Error in addPeerLinkNetworkv6")
-		cleanup(vethIfce)
-		env.freeContainerAddress(ip)
-		env.freeContainerAddress(ipv6)
-		return nil, nil, err
+		return nil, nil, false, err
 	}
-
-	// Add traffic route to bridge
-	logger.DebugLogger().Println("Setting container routes ")
-	if err = env.setContainerRoutes(pid, vethIfce.PeerName); err != nil {
-		logger.ErrorLogger().Println("Error in setContainerRoutes")
-		cleanup(vethIfce)
-		env.freeContainerAddress(ip)
-		env.freeContainerAddress(ipv6)
-		return nil, nil, err
-	}
-
-	if err = env.setIPv6ContainerRoutes(pid, vethIfce.PeerName); err != nil {
-		logger.ErrorLogger().Println("Error in setIPv6ContainerRoutes")
-		cleanup(vethIfce)
-		env.freeContainerAddress(ip)
-		env.freeContainerAddress(ipv6)
-		return nil, nil, err
-	}
-
-	env.BookVethNumber()
-
-	if err = env.setVethFirewallRules(vethIfce.Name); err != nil {
-		logger.ErrorLogger().Println("Error in setFirewallRules")
-		cleanup(vethIfce)
-		env.freeContainerAddress(ip)
-		env.freeContainerAddress(ipv6)
-		return nil, nil, err
-	}
-
-	if err = network.ManageContainerPorts(ip, portmapping, network.OpenPorts); err != nil {
-		logger.ErrorLogger().Println("Error in ManageContainerPorts v4")
-		debug.PrintStack()
-		cleanup(vethIfce)
-		env.freeContainerAddress(ip)
-		env.freeContainerAddress(ipv6)
-		return nil, nil, err
-	}
-
-	if err = network.ManageContainerPorts(ipv6, portmapping, network.OpenPorts); err != nil {
-		logger.ErrorLogger().Println("Error in ManageContainerPorts v6")
-		debug.PrintStack()
-		cleanup(vethIfce)
-		env.freeContainerAddress(ip)
-		env.freeContainerAddress(ipv6)
-		return nil, nil, err
-	}
-
-	env.deployedServicesLock.Lock()
-	env.deployedServices[fmt.Sprintf("%s.%d", sname, instancenumber)] = service{
-		ip:          ip,
-		ipv6:        ipv6,
-		sname:       sname,
-		portmapping: portmapping,
-		veth:        vethIfce,
-	}
-	env.deployedServicesLock.Unlock()
+	env.deployedServicesLock.RLock()
 	logger.DebugLogger().Printf("New deployedServices table: %v", env.deployedServices)
-	return ip, ipv6, nil
+	env.deployedServicesLock.RUnlock()
+	emitServiceEvent(events.ServiceDeployed, service{ip: ip, ipv6: ipv6, sname: sname, runtime: request.Runtime, instance: request.Instancenumber})
+	return ip, ipv6, true, nil
 }
 
-func (env *Environment) DetachContainer(sname string, instance int) {
+// DetachContainer removes the network of the instance, returns false if the instance is not deployed
+func (env *Environment) DetachContainer(sname string, instance int) bool {
 	snameAndInstance := fmt.Sprintf("%s.%d", sname, instance)
 	env.deployedServicesLock.RLock()
 	s, ok := env.deployedServices[snameAndInstance]
 	env.deployedServicesLock.RUnlock()
 	if ok {
 		_ = env.translationTable.RemoveByNsip(s.ip)
-		env.deployedServicesLock.Lock()
-		delete(env.deployedServices, snameAndInstance)
-		env.deployedServicesLock.Unlock()
-		env.freeContainerAddress(s.ip)
-		env.freeContainerAddress(s.ipv6)
-		_ = network.ManageContainerPorts(s.ip, s.portmapping, network.ClosePorts)
-		_ = network.ManageContainerPorts(s.ipv6, s.portmapping, network.ClosePorts)
-		_ = netlink.LinkDel(s.veth)
+		if s.transaction != nil {
+			s.transaction.rollback()
+		} else {
+			env.deployedServicesLock.Lock()
+			delete(env.deployedServices, snameAndInstance)
+			env.deployedServicesLock.Unlock()
+			env.freeContainerAddress(s.ip)
+			env.freeContainerAddress(s.ipv6)
+			_ = netlink.LinkDel(s.veth)
+		}
+		// the rules left by the deployment
+		_ = network.ReleaseRules(network.InstanceRuleOwner(sname, instance))
 		// if no interest registered delete all remaining info about the service
 		if !mqtt.MqttIsInterestRegistered(sname) {
 			env.RemoveServiceEntries(sname)
 		}
+		emitServiceEvent(events.ServiceUndeployed, s)
 	}
+	return ok
 }
@@ -0,0 +1,71 @@
+package env
+
+import (
+	"NetManager/logger"
+	"context"
+	"fmt"
+	"sync"
+)
+
+// deploymentStep is a step of a deployment, undo compensates a successful apply and may be nil
+type deploymentStep struct {
+	name  string
+	apply func() error
+	undo  func()
+}
+
+// deploymentTransaction applies the deployment steps in order.
+// When a step fails the applied ones are undone in reverse order, once committed the same steps undo the whole deployment.
+type deploymentTransaction struct {
+	name string
+	// a cancelled context fails the next step
+	ctx     context.Context
+	applied []deploymentStep
+	lock    sync.Mutex
+}
+
+// injectDeploymentFault, when set, is called before each step and fails the step returning an error. Tests only.
+var injectDeploymentFault func(step string) error
+
+func newDeploymentTransaction(ctx context.Context, name string) *deploymentTransaction {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return &deploymentTransaction{name: name, ctx: ctx}
+}
+
+// run applies the steps, on failure the transaction is rolled back and the error of the failed step returned
+func (t *deploymentTransaction) run(steps ...deploymentStep) error {
+	for _, step := range steps {
+		err := t.ctx.Err()
+		if err == nil && injectDeploymentFault != nil {
+			err = injectDeploymentFault(step.name)
+		}
+		if err == nil {
+			err = step.apply()
+		}
+		if err != nil {
+			logger.ErrorLogger().Printf("Deployment of %s failed at %s: %v, rolling back", t.name, step.name, err)
+			t.rollback()
+			return fmt.Errorf("%s: %w", step.name, err)
+		}
+		t.lock.Lock()
+		t.applied = append(t.applied, step)
+		t.lock.Unlock()
+	}
+	return nil
+}
+
+// rollback undoes the applied steps in reverse order, only once
+func (t *deploymentTransaction) rollback() {
+	t.lock.Lock()
+	applied := t.applied
+	t.applied = nil
+	t.lock.Unlock()
+	for i := len(applied) - 1; i >= 0; i-- {
+		if step := applied[i]; step.undo != nil {
+			logger.DebugLogger().Printf("Undoing %s of %s", step.name, t.name)
+			step.undo()
+		}
+	}
+}
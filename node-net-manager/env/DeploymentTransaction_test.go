@@ -0,0 +1,315 @@
+package env
+
+import (
+	"NetManager/TableEntryCache"
+	"NetManager/network"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+	"gotest.tools/assert"
+)
+
+type fakeVeth struct {
+	peer      string
+	netns     string
+	addresses []string
+	routes    int
+}
+
+// fakeVethOps records the host resources instead of creating them
+type fakeVethOps struct {
+	veths    map[string]*fakeVeth
+	firewall map[string]bool
+	ports    map[string]bool
+	exposed  map[string]bool
+}
+
+func newFakeVethOps() *fakeVethOps {
+	return &fakeVethOps{
+		veths:    make(map[string]*fakeVeth),
+		firewall: make(map[string]bool),
+		ports:    make(map[string]bool),
+		exposed:  make(map[string]bool),
+	}
+}
+
+// peer returns the veth whose peer is called name in the namespace, "" for the host one
+func (o *fakeVethOps) peer(netns string, name string) (*fakeVeth, error) {
+	for _, veth := range o.veths {
+		if veth.peer == name && veth.netns == netns {
+			return veth, nil
+		}
+	}
+	return nil, fmt.Errorf("link %s not found in %s", name, netns)
+}
+
+func (o *fakeVethOps) createVeth(sname string) (*netlink.Veth, error) {
+	name := fmt.Sprintf("veth00%d", len(o.veths))
+	peer := fmt.Sprintf("veth01%d", len(o.veths))
+	o.veths[name] = &fakeVeth{peer: peer}
+	return &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: name}, PeerName: peer}, nil
+}
+
+func (o *fakeVethOps) deleteVeth(veth *netlink.Veth) {
+	delete(o.veths, veth.Name)
+}
+
+func (o *fakeVethOps) moveLink(target netnsTarget, name string) error {
+	veth, err := o.peer("", name)
+	if err != nil {
+		return err
+	}
+	veth.netns = target.String()
+	return nil
+}
+
+func (o *fakeVethOps) renameLink(target netnsTarget, name string, ifname string) error {
+	veth, err := o.peer(target.String(), name)
+	if err != nil {
+		return err
+	}
+	veth.peer = ifname
+	return nil
+}
+
+func (o *fakeVethOps) addAddress(target netnsTarget, addr string, ifname string) error {
+	veth, err := o.peer(target.String(), ifname)
+	if err != nil {
+		return err
+	}
+	veth.addresses = append(veth.addresses, addr)
+	return nil
+}
+
+func (o *fakeVethOps) disableDAD(target netnsTarget, ifname string) error {
+	_, err := o.peer(target.String(), ifname)
+	return err
+}
+
+func (o *fakeVethOps) setRoutes(target netnsTarget, ifname string) error {
+	veth, err := o.peer(target.String(), ifname)
+	if err != nil {
+		return err
+	}
+	veth.routes++
+	return nil
+}
+
+func (o *fakeVethOps) setIPv6Routes(target netnsTarget, ifname string) error {
+	return o.setRoutes(target, ifname)
+}
+
+func (o *fakeVethOps) setFirewallRules(owner network.RuleOwner, vethName string) error {
+	o.firewall[string(owner)+" "+vethName] = true
+	return nil
+}
+
+func (o *fakeVethOps) removeFirewallRules(owner network.RuleOwner, vethName string) {
+	delete(o.firewall, string(owner)+" "+vethName)
+}
+
+func (o *fakeVethOps) managePorts(owner network.RuleOwner, ip net.IP, portmapping network.PortMappings, operation network.PortOperation) error {
+	key := string(owner) + " " + ip.String() + " " + portmapping.String()
+	if operation == network.OpenPorts {
+		o.ports[key] = true
+	} else {
+		delete(o.ports, key)
+	}
+	return nil
+}
+
+func (o *fakeVethOps) exposePublicly(owner network.RuleOwner, exposures network.PublicExposures, ip net.IP, ipv6 net.IP, operation network.PortOperation) error {
+	for _, exposure := range exposures {
+		key := string(owner) + " " + exposure.Address
+		if operation == network.OpenPorts {
+			o.exposed[key] = true
+		} else {
+			delete(o.exposed, key)
+		}
+	}
+	return nil
+}
+
+func newTestEnvironment() (*Environment, *fakeVethOps) {
+	ops := newFakeVethOps()
+	return &Environment{
+		config: Configuration{
+			HostBridgeName:       "goProxyBridge",
+			HostBridgeIP:         "10.19.1.1",
+			HostBridgeMask:       "/26",
+			HostBridgeIPv6:       "fc00::1",
+			HostBridgeIPv6Prefix: "/120",
+		},
+		translationTable:  TableEntryCache.NewTableManager(),
+		nextContainerIP:   net.ParseIP("10.19.1.2").To4(),
+		nextContainerIPv6: net.ParseIP("fc00::2"),
+		totNextAddr:       1,
+		totNextAddrv6:     1,
+		addrCache:         make([]net.IP, 0),
+		addrCachev6:       make([]net.IP, 0),
+		deployedServices:  make(map[string]service),
+		vethOps:           ops,
+	}, ops
+}
+
+// assertNoResources checks that the environment is back to the initial state, apart from the freed addresses
+func assertNoResources(t *testing.T, env *Environment, ops *fakeVethOps, msg string) {
+	t.Helper()
+	assert.Equal(t, len(ops.veths), 0, msg)
+	assert.Equal(t, len(ops.firewall), 0, msg)
+	assert.Equal(t, len(ops.ports), 0, msg)
+	assert.Equal(t, len(ops.exposed), 0, msg)
+	assert.Equal(t, len(env.deployedServices), 0, msg)
+	assert.Equal(t, env.nextVethNumber, 0, msg)
+	assert.Equal(t, env.totNextAddr-1, len(env.addrCache), msg)
+	assert.Equal(t, env.totNextAddrv6-1, len(env.addrCachev6), msg)
+}
+
+func testDeploymentRequest() DeploymentRequest {
+	return DeploymentRequest{
+		NetnsPath:      "/var/run/netns/test",
+		Ifname:         "eth0",
+		ServiceName:    "app.app.svc.svc",
+		Instancenumber: 0,
+		PortMappings:   network.PortMappings{{HostPort: 8080, ContainerPort: 80}},
+		PublicExposures: network.PublicExposures{
+			{Mode: network.EXPOSURE_MODE_ADDRESS, Address: "203.0.113.7"},
+		},
+	}
+}
+
+func TestVethDeploymentRollback(t *testing.T) {
+	target := netnsTarget{path: "/var/run/netns/test"}
+	steps := make([]string, 0)
+	injectDeploymentFault = func(step string) error {
+		steps = append(steps, step)
+		return nil
+	}
+	defer func() { injectDeploymentFault = nil }()
+
+	env, ops := newTestEnvironment()
+	ip, ipv6, _, err := env.attachVethToNamespace(target, testDeploymentRequest())
+	assert.NilError(t, err)
+	assert.Equal(t, ip.String(), "10.19.1.2")
+	assert.Equal(t, ipv6.String(), "fc00::2")
+	veth := ops.veths["veth000"]
+	assert.Equal(t, veth.peer, "eth0")
+	assert.Equal(t, veth.netns, "/var/run/netns/test")
+	assert.DeepEqual(t, veth.addresses, []string{"10.19.1.2/26", "fc00::2/120"})
+	assert.Equal(t, veth.routes, 2)
+	assert.Equal(t, len(ops.firewall), 1)
+	assert.Equal(t, len(ops.ports), 2)
+	assert.Equal(t, len(ops.exposed), 1)
+	assert.Equal(t, env.nextVethNumber, 1)
+	assert.Assert(t, len(steps) > 10)
+
+	for _, failing := range steps {
+		env, ops := newTestEnvironment()
+		injectDeploymentFault = func(step string) error {
+			if step == failing {
+				return errors.New("injected fault")
+			}
+			return nil
+		}
+		_, _, _, err := env.attachVethToNamespace(target, testDeploymentRequest())
+		assert.ErrorContains(t, err, failing)
+		assertNoResources(t, env, ops, failing)
+	}
+}
+
+func TestVethDeploymentDetach(t *testing.T) {
+	target := netnsTarget{path: "/var/run/netns/test"}
+	env, ops := newTestEnvironment()
+	request := testDeploymentRequest()
+	_, _, _, err := env.attachVethToNamespace(target, request)
+	assert.NilError(t, err)
+
+	// a second deployment of the same instance is rolled back without touching the first one
+	_, _, _, err = env.attachVethToNamespace(netnsTarget{path: "/var/run/netns/other"}, request)
+	assert.Assert(t, errors.Is(err, ErrInstanceConflict))
+	assert.Equal(t, len(ops.veths), 1)
+	assert.Equal(t, len(ops.ports), 2)
+	assert.Equal(t, len(env.deployedServices), 1)
+
+	env.DetachContainer(request.ServiceName, request.Instancenumber)
+	assertNoResources(t, env, ops, "detach")
+
+	// detaching twice is a no-op
+	assert.Assert(t, !env.DetachContainer(request.ServiceName, request.Instancenumber))
+	assertNoResources(t, env, ops, "second detach")
+}
+
+func TestVethDeploymentCancelled(t *testing.T) {
+	target := netnsTarget{path: "/var/run/netns/test"}
+	ctx, cancel := context.WithCancel(context.Background())
+	injectDeploymentFault = func(step string) error {
+		if step == "set ipv4 routes" {
+			cancel()
+		}
+		return nil
+	}
+	defer func() { injectDeploymentFault = nil }()
+
+	env, ops := newTestEnvironment()
+	request := testDeploymentRequest()
+	request.Context = ctx
+	_, _, _, err := env.attachVethToNamespace(target, request)
+	assert.Assert(t, errors.Is(err, context.Canceled))
+	assertNoResources(t, env, ops, "cancelled")
+}
+
+func TestVethRedeployment(t *testing.T) {
+	target := netnsTarget{path: "/var/run/netns/test"}
+	env, ops := newTestEnvironment()
+	request := testDeploymentRequest()
+	ip, ipv6, created, err := env.attachVethToNamespace(target, request)
+	assert.NilError(t, err)
+	assert.Assert(t, created)
+
+	// the same request returns the existing addresses
+	again, againv6, created, err := env.attachVethToNamespace(target, request)
+	assert.NilError(t, err)
+	assert.Assert(t, !created)
+	assert.Assert(t, again.Equal(ip) && againv6.Equal(ipv6))
+	assert.Equal(t, len(ops.veths), 1)
+	assert.Equal(t, env.totNextAddr, 2)
+
+	// new port mappings replace the previous ones in place
+	request.PortMappings = network.PortMappings{{HostPort: 9090, ContainerPort: 90}}
+	request.PublicExposures = nil
+	again, _, _, err = env.attachVethToNamespace(target, request)
+	assert.NilError(t, err)
+	assert.Assert(t, again.Equal(ip))
+	assert.Equal(t, len(ops.veths), 1)
+	assert.DeepEqual(t, ops.ports, map[string]bool{
+		"instance/app.app.svc.svc/0 10.19.1.2 9090:90/tcp": true,
+		"instance/app.app.svc.svc/0 fc00::2 9090:90/tcp":   true,
+	})
+	assert.Equal(t, len(ops.exposed), 0)
+
+	assert.Assert(t, env.DetachContainer(request.ServiceName, request.Instancenumber))
+	assertNoResources(t, env, ops, "detach after update")
+	assert.Assert(t, !env.DetachContainer(request.ServiceName, request.Instancenumber))
+}
+
+func TestContainerDeploymentRejectsNonNamespace(t *testing.T) {
+	env, ops := newTestEnvironment()
+	handler := &ContainerDeyplomentHandler{env: env}
+	file := filepath.Join(t.TempDir(), "netns")
+	assert.NilError(t, os.WriteFile(file, nil, 0o600))
+
+	// a regular file and a namespace of another type are never used as the network namespace
+	for _, path := range []string{file, "/proc/self/ns/uts"} {
+		request := testDeploymentRequest()
+		request.NetnsPath = path
+		_, _, _, err := handler.DeployNetwork(request)
+		assert.ErrorContains(t, err, path)
+		assertNoResources(t, env, ops, path)
+	}
+}
@@ -0,0 +1,246 @@
+package env
+
+import (
+	"NetManager/events"
+	"NetManager/logger"
+	"NetManager/mqtt"
+	"NetManager/network"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	// DOCKER_DRIVER_NAME is the name of the network and IPAM drivers, matching the plugin socket name
+	DOCKER_DRIVER_NAME = "oakestra"
+	// DOCKER_NETWORK_NAME is the Docker network attaching the containers to the node bridge
+	DOCKER_NETWORK_NAME = "oakestra"
+	DOCKER_SOCKET       = "/var/run/docker.sock"
+)
+
+// dockerEndpoint is a container interface created through the Docker network plugin.
+// The addresses belong to the IPAM driver, they are released by Docker and not when the endpoint is deleted.
+type dockerEndpoint struct {
+	veth *netlink.Veth
+	ip   net.IP
+	ipv6 net.IP
+	// deployedServices key, set once the container joined
+	service string
+}
+
+// RequestDockerAddress reserves a container address in the node subnet
+func (env *Environment) RequestDockerAddress(v6 bool) (net.IP, error) {
+	if v6 {
+		return env.generateIPv6Address()
+	}
+	return env.generateAddress()
+}
+
+// ReleaseDockerAddress returns the address reserved with RequestDockerAddress
+func (env *Environment) ReleaseDockerAddress(ip net.IP) {
+	env.freeContainerAddress(ip)
+}
+
+// CreateDockerEndpoint creates the veth pair of the endpoint and attaches it to the bridge
+func (env *Environment) CreateDockerEndpoint(endpointID string, ip net.IP, ipv6 net.IP) error {
+	env.dockerEndpointsLock.Lock()
+	defer env.dockerEndpointsLock.Unlock()
+	if _, exist := env.dockerEndpoints[endpointID]; exist {
+		return fmt.Errorf("endpoint %s already exists", endpointID)
+	}
+	vethIfce, _, err := env.createBookedVeth(func() (*netlink.Veth, error) {
+		return env.createVethsPairAndAttachToBridge(endpointID, env.mtusize)
+	})
+	if err != nil {
+		if vethIfce != nil {
+			_ = netlink.LinkDel(vethIfce)
+		}
+		return err
+	}
+	env.dockerEndpoints[endpointID] = &dockerEndpoint{
+		veth: vethIfce,
+		ip:   ip,
+		ipv6: ipv6,
+	}
+	return nil
+}
+
+// JoinDockerEndpoint deploys the service instance on the endpoint and returns the interface Docker moves into the container
+func (env *Environment) JoinDockerEndpoint(endpointID string, request DeploymentRequest) (string, error) {
+	env.dockerEndpointsLock.Lock()
+	defer env.dockerEndpointsLock.Unlock()
+	endpoint, exist := env.dockerEndpoints[endpointID]
+	if !exist {
+		return "", fmt.Errorf("unknown endpoint %s", endpointID)
+	}
+
+	owner := network.InstanceRuleOwner(request.ServiceName, request.Instancenumber)
+	if err := env.setVethFirewallRules(owner, endpoint.veth.Name); err != nil {
+		logger.ErrorLogger().Println("Error in setFirewallRules")
+		return "", err
+	}
+	if err := network.ManageContainerPortMappings(owner, endpoint.ip, request.PortMappings, network.OpenPorts); err != nil {
+		logger.ErrorLogger().Println("Error in ManageContainerPortMappings v4")
+		_ = network.ReleaseRules(owner)
+		return "", err
+	}
+	if endpoint.ipv6 != nil {
+		if err := network.ManageContainerPortMappings(owner, endpoint.ipv6, request.PortMappings, network.OpenPorts); err != nil {
+			logger.ErrorLogger().Println("Error in ManageContainerPortMappings v6")
+			_ = network.ReleaseRules(owner)
+			return "", err
+		}
+	}
+
+	endpoint.service = fmt.Sprintf("%s.%d", request.ServiceName, request.Instancenumber)
+	deployed := service{
+		ip:       endpoint.ip,
+		ipv6:     endpoint.ipv6,
+		sname:    request.ServiceName,
+		instance: request.Instancenumber,
+		ports:    newPublishedPorts(request),
+		owner:    owner,
+		veth:     endpoint.veth,
+	}
+	env.deployedServicesLock.Lock()
+	env.deployedServices[endpoint.service] = deployed
+	env.deployedServicesLock.Unlock()
+	emitServiceEvent(events.ServiceDeployed, deployed)
+	return endpoint.veth.PeerName, nil
+}
+
+// LeaveDockerEndpoint removes the service instance deployed on the endpoint
+func (env *Environment) LeaveDockerEndpoint(endpointID string) error {
+	env.dockerEndpointsLock.Lock()
+	endpoint, exist := env.dockerEndpoints[endpointID]
+	if !exist {
+		env.dockerEndpointsLock.Unlock()
+		return fmt.Errorf("unknown endpoint %s", endpointID)
+	}
+	key := endpoint.service
+	endpoint.service = ""
+	env.dockerEndpointsLock.Unlock()
+
+	env.deployedServicesLock.Lock()
+	s, ok := env.deployedServices[key]
+	delete(env.deployedServices, key)
+	env.deployedServicesLock.Unlock()
+	if !ok {
+		return nil
+	}
+	_ = env.translationTable.RemoveByNsip(s.ip)
+	_ = network.ReleaseRules(s.owner)
+	// if no interest registered delete all remaining info about the service
+	if !mqtt.MqttIsInterestRegistered(s.sname) {
+		env.RemoveServiceEntries(s.sname)
+	}
+	emitServiceEvent(events.ServiceUndeployed, s)
+	return nil
+}
+
+// DeleteDockerEndpoint removes the veth pair of the endpoint
+func (env *Environment) DeleteDockerEndpoint(endpointID string) error {
+	env.dockerEndpointsLock.Lock()
+	endpoint, exist := env.dockerEndpoints[endpointID]
+	delete(env.dockerEndpoints, endpointID)
+	env.dockerEndpointsLock.Unlock()
+	if !exist {
+		return nil
+	}
+	if endpoint.service != "" {
+		logger.InfoLogger().Printf("Deleting endpoint %s before leaving it", endpointID)
+	}
+	// the peer moved into the container is removed together with the container namespace
+	_ = netlink.LinkDel(endpoint.veth)
+	return nil
+}
+
+// ConfigureDockerNetwork creates a docker network compatible with the enviornment and returns its id.
+// The network uses the NetManager network and IPAM drivers, so it MUST be created after the plugin is listening.
+// A leftover network from a previous run is recreated, as the node subnet may have changed in the meantime.
+func (env *Environment) ConfigureDockerNetwork(networkname string) (string, error) {
+	client := dockerClient()
+	if err := dockerRequest(client, http.MethodDelete, "/networks/"+networkname, nil, nil); err != nil && !errors.Is(err, errDockerNotFound) {
+		logger.InfoLogger().Printf("Unable to remove the existing docker network %s: %v", networkname, err)
+	}
+	request := map[string]interface{}{
+		"Name":       networkname,
+		"Driver":     DOCKER_DRIVER_NAME,
+		"EnableIPv6": true,
+		"IPAM": map[string]interface{}{
+			"Driver": DOCKER_DRIVER_NAME,
+		},
+	}
+	response := struct {
+		Id string
+	}{}
+	err := dockerRequest(client, http.MethodPost, "/networks/create", request, &response)
+	if errors.Is(err, errDockerConflict) {
+		// still in use by some container
+		inspect := struct {
+			Id string
+		}{}
+		err = dockerRequest(client, http.MethodGet, "/networks/"+networkname, nil, &inspect)
+		return inspect.Id, err
+	}
+	return response.Id, err
+}
+
+var (
+	errDockerNotFound = errors.New("docker object not found")
+	errDockerConflict = errors.New("docker object already exists")
+)
+
+func dockerClient() *http.Client {
+	return &http.Client{
+		Timeout: 30 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", DOCKER_SOCKET)
+			},
+		},
+	}
+}
+
+// dockerRequest calls the Docker engine API
+func dockerRequest(client *http.Client, method string, path string, body interface{}, result interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		payload, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(payload)
+	}
+	request, err := http.NewRequest(method, "http://docker"+path, reader)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	switch {
+	case response.StatusCode == http.StatusNotFound:
+		return errDockerNotFound
+	case response.StatusCode == http.StatusConflict:
+		return errDockerConflict
+	case response.StatusCode >= 300:
+		message, _ := io.ReadAll(response.Body)
+		return fmt.Errorf("docker API %s %s: %s", method, path, message)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(response.Body).Decode(result)
+}
@@ -9,6 +9,7 @@ import (
 	"NetManager/network"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"os"
@@ -16,6 +17,7 @@ import (
 	"runtime"
 	"strconv"
 	"sync"
+	"time"
 
 	"github.com/vishvananda/netlink"
 	"github.com/vishvananda/netns"
@@ -27,8 +29,13 @@ type EnvironmentManager interface {
 	GetTableEntryByServiceIP(ip net.IP) []TableEntryCache.TableEntry
 	GetTableEntryByNsIP(ip net.IP) (TableEntryCache.TableEntry, bool)
 	GetTableEntryByInstanceIP(ip net.IP) (TableEntryCache.TableEntry, bool)
+	GetDrainingInstances() []TableEntryCache.TableEntry
+	ReleaseDrainingInstance(nsip net.IP)
 }
 
+// DEFAULT_DRAINING_GRACE_PERIOD is the time given to the existing flows towards a removed instance before dropping it
+const DEFAULT_DRAINING_GRACE_PERIOD = 60 * time.Second
+
 type Configuration struct {
 	HostBridgeName             string
 	HostBridgeIP               string
@@ -38,6 +45,7 @@ type Configuration struct {
 	HostTunName                string
 	ConnectedInternetInterface string
 	Mtusize                    int
+	DrainingGracePeriod        time.Duration
 }
 
 type Environment struct {
@@ -50,6 +58,7 @@ type Environment struct {
 	proxyName         string
 	config            Configuration
 	translationTable  TableEntryCache.TableManager
+	tableQuery        mqtt.TablequeryMqttInterface
 	//### Deployment management variables
 	deployedServices     map[string]service // all the deployed services with the ip and ports
 	deployedServicesLock sync.RWMutex
@@ -59,6 +68,12 @@ type Environment struct {
 	totNextAddrv6        int
 	addrCache            []net.IP // Cache used to store the free addresses available for new containers
 	addrCachev6          []net.IP
+	// guards the address pools and the veth numbers, the deployments of different instances run concurrently
+	allocationLock sync.Mutex
+	// endpoints created by the Docker network plugin
+	dockerEndpoints     map[string]*dockerEndpoint
+	dockerEndpointsLock sync.Mutex
+	vethOps             vethOperations
 	//### Communication variables
 	clusterPort string
 	clusterAddr string
@@ -66,11 +81,23 @@ type Environment struct {
 }
 
 type service struct {
-	ip          net.IP
-	ipv6        net.IP
-	sname       string
-	portmapping string
-	veth        *netlink.Veth
+	ip    net.IP
+	ipv6  net.IP
+	sname string
+	// runtime and instance number of the deployment request, no runtime for the Docker network plugin
+	runtime  string
+	instance int
+	// namespace the instance is attached to, veth deployments only
+	netns string
+	ports *publishedPorts
+	// owner of the firewall rules of the instance
+	owner network.RuleOwner
+	veth  *netlink.Veth
+	// network inside the namespace, unikernels only
+	unikernel  *UnikernelNetwork
+	responders []io.Closer
+	// steps of the veth deployment, rolled back to detach the instance
+	transaction *deploymentTransaction
 }
 
 // current network interfaces in the system
@@ -94,6 +121,7 @@ func NewCustom(proxyname string, customConfig Configuration) *Environment {
 		proxyName:         proxyname,
 		config:            customConfig,
 		translationTable:  TableEntryCache.NewTableManager(),
+		tableQuery:        mqtt.GetTableQueryRequestCacheInstance(),
 		nextContainerIP:   network.NextIPv4(net.ParseIP(customConfig.HostBridgeIP), 1),
 		nextContainerIPv6: network.NextIPv6(net.ParseIP(customConfig.HostBridgeIPv6), 1),
 		totNextAddr:       1,
@@ -101,10 +129,12 @@ func NewCustom(proxyname string, customConfig Configuration) *Environment {
 		addrCache:         make([]net.IP, 0),
 		addrCachev6:       make([]net.IP, 0),
 		deployedServices:  make(map[string]service, 0),
+		dockerEndpoints:   make(map[string]*dockerEndpoint),
 		clusterAddr:       os.Getenv("CLUSTER_MANAGER_IP"),
 		clusterPort:       os.Getenv("CLUSTER_MANAGER_PORT"),
 		mtusize:           customConfig.Mtusize,
 	}
+	e.vethOps = hostVethOperations{env: &e}
 
 	// Get Connected Internet Interface
 	if e.config.ConnectedInternetInterface == "" {
@@ -119,9 +149,11 @@ func NewCustom(proxyname string, customConfig Configuration) *Environment {
 		log.Fatal(err)
 	}
 
-	// disable reverse path filtering
-	logger.InfoLogger().Println("Disabling reverse path filtering")
-	network.DisableReversePathFiltering(e.config.HostBridgeName)
+	// disable reverse path filtering and enable the forwarding
+	logger.InfoLogger().Println("Configuring the host kernel parameters")
+	if err := network.ConfigureHostSysctls(); err != nil {
+		log.Fatal(err)
+	}
 
 	// Enable tun device forwarding
 	logger.InfoLogger().Println("Enabling packet forwarding")
@@ -131,12 +163,26 @@ func NewCustom(proxyname string, customConfig Configuration) *Environment {
 	logger.InfoLogger().Println("Enabling packet masquerading")
 	network.EnableMasquerading(e.config.HostBridgeIP, e.config.HostBridgeMask, e.config.HostBridgeIPv6, e.config.HostBridgeIPv6Prefix, e.config.HostBridgeName, e.config.ConnectedInternetInterface)
 
+	// restore the rules removed by other tools
+	network.StartRulesReconciliation(network.RULES_RECONCILIATION_INTERVAL)
+
 	// update status with current network configuration
 	logger.InfoLogger().Println("Reading the current environment configuration")
 
 	return &e
 }
 
+// NewTranslationEnvironment creates an environment only translating the service addresses with the given table query,
+// the host network is left untouched and no service can be deployed
+func NewTranslationEnvironment(customConfig Configuration, tableQuery mqtt.TablequeryMqttInterface) *Environment {
+	return &Environment{
+		config:           customConfig,
+		translationTable: TableEntryCache.NewTableManager(),
+		tableQuery:       tableQuery,
+		deployedServices: make(map[string]service, 0),
+	}
+}
+
 // NewEnvironmentClusterConfigured Creates a new environment using the default configuration and asking the cluster for a new subnetwork
 func NewEnvironmentClusterConfigured(proxyname string) *Environment {
 	logger.InfoLogger().Println("Asking the cluster for a new subnetwork")
@@ -153,6 +199,10 @@ func NewEnvironmentClusterConfigured(proxyname string) *Environment {
 		logger.InfoLogger().Printf("Default to mtusize 1450")
 		mtusize = 1450
 	}
+	drainingGracePeriod := time.Duration(model.NetConfig.DrainingGracePeriod) * time.Second
+	if model.NetConfig.DrainingGracePeriod == 0 {
+		drainingGracePeriod = DEFAULT_DRAINING_GRACE_PERIOD
+	}
 	config := Configuration{
 		HostBridgeName:             "goProxyBridge",
 		HostBridgeIP:               network.NextIPv4(net.ParseIP(ipv4_subnet), 1).String(),
@@ -162,6 +212,7 @@ func NewEnvironmentClusterConfigured(proxyname string) *Environment {
 		HostTunName:                "goProxyTun",
 		ConnectedInternetInterface: "",
 		Mtusize:                    mtusize,
+		DrainingGracePeriod:        drainingGracePeriod,
 	}
 	return NewCustom(proxyname, config)
 }
@@ -185,11 +236,6 @@ func (env *Environment) IsServiceDeployed(jobName string) bool {
 	return false
 }
 
-// ConfigureDockerNetwork creates a docker network compatible with the enviornment and returns it
-func (env *Environment) ConfigureDockerNetwork(containername string) (string, error) {
-	return "", errors.New("not yet implemented")
-}
-
 // create veth pair and connect one to the host bridge
 // returns: bridgeVeth name, free Veth name, Vether interface to the veth pair and eventually an error
 func (env *Environment) createVethsPairAndAttachToBridge(sname string, mtu int) (*netlink.Veth, error) {
@@ -217,45 +263,42 @@ func (env *Environment) createVethsPairAndAttachToBridge(sname string, mtu int)
 	if err != nil {
 		return nil, err
 	}
+	if err = network.ConfigureInterface(veth1name, network.VETH_INTERFACE); err != nil {
+		_ = netlink.LinkDel(veth)
+		return nil, err
+	}
 
 	// add veth1 to the bridge
 	err = netlink.LinkSetMaster(veth, bridge)
 	if err != nil {
+		_ = netlink.LinkDel(veth)
 		return nil, err
 	}
 
 	// set veth status up
 	if err = netlink.LinkSetUp(veth); err != nil {
+		_ = netlink.LinkDel(veth)
 		return nil, err
 	}
 
 	return veth, nil
 }
 
-// sets the FORWARD firewall rules for the bridge veth
-func (env *Environment) setVethFirewallRules(bridgeVethName string) error {
-	runtime.LockOSThread()
-	defer runtime.UnlockOSThread()
+// sets the FORWARD firewall rules for the bridge veth, owned by the service instance
+func (env *Environment) setVethFirewallRules(owner network.RuleOwner, bridgeVethName string) error {
+	return network.ManageVethForwarding(owner, env.config.HostBridgeName, bridgeVethName, network.OpenPorts)
+}
 
-	// iptables -A FORWARD -o goProxyBridge -i veth -j ACCEPT
-	cmd := exec.Command("iptables", "-A", "FORWARD", "-o", env.config.HostBridgeName, "-i", bridgeVethName, "-j", "ACCEPT")
-	err := cmd.Run()
-	if err != nil {
-		return err
-	}
-	cmd = exec.Command("iptables", "-A", "FORWARD", "-i", env.config.HostBridgeName, "-o", bridgeVethName, "-j", "ACCEPT")
-	err = cmd.Run()
-	if err != nil {
-		return err
-	}
-	return nil
+// removes the FORWARD firewall rules of the bridge veth
+func (env *Environment) removeVethFirewallRules(owner network.RuleOwner, bridgeVethName string) error {
+	return network.ManageVethForwarding(owner, env.config.HostBridgeName, bridgeVethName, network.ClosePorts)
 }
 
 // add routes inside the container namespace to forward the traffic using the bridge
-func (env *Environment) setContainerRoutes(containerPid int, peerVeth string) error {
+func (env *Environment) setContainerRoutes(target netnsTarget, peerVeth string) error {
 	// Add route to bridge
 	// sudo nsenter -n -t 5565 ip route add 0.0.0.0/0 via 127.19.x.y dev veth013
-	err := env.execInsideNs(containerPid, func() error {
+	err := env.execInsideNs(target, func() error {
 		link, err := netlink.LinkByName(peerVeth)
 		if err != nil {
 			return err
@@ -278,8 +321,8 @@ func (env *Environment) setContainerRoutes(containerPid int, peerVeth string) er
 	return nil
 }
 
-func (env *Environment) setIPv6ContainerRoutes(containerPid int, peerVeth string) error {
-	err := env.execInsideNs(containerPid, func() error {
+func (env *Environment) setIPv6ContainerRoutes(target netnsTarget, peerVeth string) error {
+	err := env.execInsideNs(target, func() error {
 		link, err := netlink.LinkByName(peerVeth)
 		if err != nil {
 			return err
@@ -303,12 +346,12 @@ func (env *Environment) setIPv6ContainerRoutes(containerPid int, peerVeth string
 }
 
 // setup the address of the network namespace veth
-func (env *Environment) addPeerLinkNetwork(nspid int, addr string, vethname string) error {
+func (env *Environment) addPeerLinkNetwork(target netnsTarget, addr string, vethname string) error {
 	netlinkAddr, err := netlink.ParseAddr(addr)
 	if err != nil {
 		return err
 	}
-	err = env.execInsideNs(nspid, func() error {
+	err = env.execInsideNs(target, func() error {
 		link, err := netlink.LinkByName(vethname)
 		if err != nil {
 			return err
@@ -347,22 +390,36 @@ func (env *Environment) addPeerLinkNetworkByNsName(NsName string, addr string, v
 
 // disable Duplicate Address Detection (DAD) for IPv6 interfaces in namespace
 // to prevent interface startup delay
-func (env *Environment) disableDAD(pid int, vethname string) error {
-	err := env.execInsideNs(pid, func() error {
-		cmd := exec.Command("sysctl", "-w", "net.ipv6.conf.default.accept_dad=0")
-		err := cmd.Run()
-		if err != nil {
-			return err
-		}
-		cmd = exec.Command("sysctl", "-w", "net.ipv6.conf."+vethname+".accept_dad=0")
-		err = cmd.Run()
-		return err
+func (env *Environment) disableDAD(target netnsTarget, vethname string) error {
+	err := env.execInsideNs(target, func() error {
+		return disableDADInsideNs(vethname)
+	})
+	return err
+}
+
+// disable Duplicate Address Detection (DAD) for IPv6 interfaces in namespace based on Ns name
+func (env *Environment) disableDADByNsName(NsName string, ifaces ...string) error {
+	err := env.execInsideNsByName(NsName, func() error {
+		return disableDADInsideNs(ifaces...)
 	})
 	return err
 }
 
+// disableDADInsideNs must be executed inside the target namespace
+func disableDADInsideNs(ifaces ...string) error {
+	if err := network.WriteSysctl("net/ipv6/conf/default/accept_dad", "0"); err != nil {
+		return err
+	}
+	for _, iface := range ifaces {
+		if err := network.ConfigureInterface(iface, network.WORKLOAD_INTERFACE); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Execute function inside a namespace
-func (env *Environment) execInsideNs(pid int, function func() error) error {
+func (env *Environment) execInsideNs(target netnsTarget, function func() error) error {
 	var containerNs netns.NsHandle
 
 	runtime.LockOSThread()
@@ -371,8 +428,9 @@ func (env *Environment) execInsideNs(pid int, function func() error) error {
 	stdNetns, err := netns.Get()
 	if err == nil {
 		defer stdNetns.Close()
-		containerNs, err = netns.GetFromPid(pid)
+		containerNs, err = target.open()
 		if err == nil {
+			defer containerNs.Close()
 			defer netns.Set(stdNetns)
 			err = netns.Set(containerNs)
 			if err == nil {
@@ -383,6 +441,17 @@ func (env *Environment) execInsideNs(pid int, function func() error) error {
 	return err
 }
 
+// renamePeerLink gives the veth moved into the namespace the name expected by the workload
+func (env *Environment) renamePeerLink(target netnsTarget, vethname string, ifname string) error {
+	return env.execInsideNs(target, func() error {
+		link, err := netlink.LinkByName(vethname)
+		if err != nil {
+			return err
+		}
+		return netlink.LinkSetName(link, ifname)
+	})
+}
+
 // Execute function inside a namespace based on Ns name
 func (env *Environment) execInsideNsByName(Nsname string, function func() error) error {
 	var containerNs netns.NsHandle
@@ -405,11 +474,49 @@ func (env *Environment) execInsideNsByName(Nsname string, function func() error)
 	return err
 }
 
+// BridgeAddress returns the bridge address with the node subnet mask, the gateway of the workloads
+func (env *Environment) BridgeAddress(v6 bool) *net.IPNet {
+	address := env.config.HostBridgeIP + env.config.HostBridgeMask
+	if v6 {
+		address = env.config.HostBridgeIPv6 + env.config.HostBridgeIPv6Prefix
+	}
+	ip, subnet, err := net.ParseCIDR(address)
+	if err != nil {
+		return nil
+	}
+	return &net.IPNet{IP: ip, Mask: subnet.Mask}
+}
+
 // BookVethNumber Update the veth number to be used for the next veth
 func (env *Environment) BookVethNumber() {
+	env.allocationLock.Lock()
+	defer env.allocationLock.Unlock()
 	env.nextVethNumber = env.nextVethNumber + 1
 }
 
+// createBookedVeth creates the veth pair named after the next veth number and books the number,
+// no other deployment creates a veth in between. Returns the booked number.
+func (env *Environment) createBookedVeth(create func() (*netlink.Veth, error)) (*netlink.Veth, int, error) {
+	env.allocationLock.Lock()
+	defer env.allocationLock.Unlock()
+	booked := env.nextVethNumber
+	veth, err := create()
+	if err != nil {
+		return veth, booked, err
+	}
+	env.nextVethNumber = booked + 1
+	return veth, booked, nil
+}
+
+// unbookVethNumber gives back the veth number booked by a rolled back deployment, if no other veth was booked since then
+func (env *Environment) unbookVethNumber(booked int) {
+	env.allocationLock.Lock()
+	defer env.allocationLock.Unlock()
+	if env.nextVethNumber == booked+1 {
+		env.nextVethNumber = booked
+	}
+}
+
 // CreateHostBridge create host bridge if it has not been created yet, return the current host bridge name or the newly created one
 func (env *Environment) CreateHostBridge() error {
 	// check current declared bridges
@@ -459,12 +566,30 @@ func (env *Environment) CreateHostBridge() error {
 		return err
 	}
 
-	return nil
+	return network.ConfigureInterface(env.config.HostBridgeName, network.BRIDGE_INTERFACE)
+}
+
+// emitServiceEvent tells the event subscribers about a deployed or undeployed instance
+func emitServiceEvent(eventType events.EventType, s service) {
+	payload := events.ServiceEvent{
+		ServiceName: s.sname,
+		Instance:    s.instance,
+		Runtime:     s.runtime,
+		Address:     s.ip.String(),
+	}
+	if s.ipv6 != nil {
+		payload.Addressv6 = s.ipv6.String()
+	}
+	events.GetInstance().Emit(events.Event{
+		EventType:   eventType,
+		EventTarget: fmt.Sprintf("%s.%d", s.sname, s.instance),
+		Payload:     payload,
+	})
 }
 
 // GetTableEntriesOnNode performs a search in the local ServiceCache for entries with the NodeIp of this node
 func (env *Environment) GetTableEntriesOnNode() []TableEntryCache.TableEntry {
-	ip := net.ParseIP(model.NetConfig.NodePublicAddress)
+	ip := net.ParseIP(model.GetNodePublicAddress())
 	return env.translationTable.SearchByNodeIp(ip)
 }
 
@@ -483,7 +608,7 @@ func (env *Environment) GetTableEntryByServiceIP(ip net.IP) []TableEntryCache.Ta
 	}
 
 	// if no entry available -> TableQuery
-	entryList, err := tableQueryByIP(ip)
+	entryList, err := env.tableQueryByIP(ip)
 
 	if err == nil {
 		var once sync.Once
@@ -540,15 +665,50 @@ func (env *Environment) AddTableQueryEntry(entry TableEntryCache.TableEntry) {
 // RefreshServiceTable force a table query refresh for a service
 func (env *Environment) RefreshServiceTable(jobname string) {
 	logger.DebugLogger().Printf("Requested table query refresh for %s", jobname)
-	entryList, err := tableQueryByJobName(jobname, true)
+	entryList, err := env.tableQueryByJobName(jobname, true)
 	if err == nil {
-		_ = env.translationTable.RemoveByJobName(jobname)
+		env.drainRemovedInstances(jobname, entryList)
 		for _, tableEntry := range entryList {
 			env.AddTableQueryEntry(tableEntry)
 		}
 	}
 }
 
+// drainRemovedInstances keeps the instances that are no longer part of the service as draining entries.
+// The existing flows can still reach them until the grace period expires, while new flows avoid them.
+// A negative grace period removes the instances right away.
+func (env *Environment) drainRemovedInstances(jobname string, entryList []TableEntryCache.TableEntry) {
+	gracePeriod := env.config.DrainingGracePeriod
+	for _, current := range env.translationTable.SearchByJobName(jobname) {
+		if current.IsDraining() || TableEntryCache.IsNamespaceStillValid(current.Nsip, &entryList) {
+			continue
+		}
+		if gracePeriod <= 0 {
+			_ = env.translationTable.RemoveByNsip(current.Nsip)
+			continue
+		}
+		logger.InfoLogger().Printf("Draining instance %d of %s for %v", current.Instancenumber, jobname, gracePeriod)
+		_ = env.translationTable.MarkDraining(current.Nsip, time.Now().Add(gracePeriod))
+		time.AfterFunc(gracePeriod, func() {
+			env.translationTable.RemoveExpiredDraining(time.Now())
+		})
+	}
+}
+
+// GetDrainingInstances returns the table entries of the instances that are currently draining
+func (env *Environment) GetDrainingInstances() []TableEntryCache.TableEntry {
+	return env.translationTable.SearchDraining()
+}
+
+// ReleaseDrainingInstance removes a draining instance before the grace period expires, e.g. when no flow uses it anymore
+func (env *Environment) ReleaseDrainingInstance(nsip net.IP) {
+	entry, exist := env.translationTable.SearchByNsIP(nsip)
+	if exist && entry.IsDraining() {
+		logger.InfoLogger().Printf("Draining of instance %d of %s completed", entry.Instancenumber, entry.JobName)
+		_ = env.translationTable.RemoveByNsip(nsip)
+	}
+}
+
 func (env *Environment) RemoveServiceEntries(jobname string) {
 	err := env.translationTable.RemoveByJobName(jobname)
 	if err != nil {
@@ -561,6 +721,8 @@ func (env *Environment) RemoveNsIPEntries(nsip string) {
 }
 
 func (env *Environment) generateAddress() (net.IP, error) {
+	env.allocationLock.Lock()
+	defer env.allocationLock.Unlock()
 	var result net.IP
 	if len(env.addrCache) > 0 {
 		result, env.addrCache = env.addrCache[0], env.addrCache[1:]
@@ -578,6 +740,8 @@ func (env *Environment) generateAddress() (net.IP, error) {
 }
 
 func (env *Environment) generateIPv6Address() (net.IP, error) {
+	env.allocationLock.Lock()
+	defer env.allocationLock.Unlock()
 	var result net.IP
 	if len(env.addrCachev6) > 0 {
 		result, env.addrCachev6 = env.addrCachev6[0], env.addrCachev6[1:]
@@ -595,6 +759,8 @@ func (env *Environment) generateIPv6Address() (net.IP, error) {
 }
 
 func (env *Environment) freeContainerAddress(ip net.IP) {
+	env.allocationLock.Lock()
+	defer env.allocationLock.Unlock()
 	// if ip is an IPv4 addr
 	if err := ip.To4(); err != nil {
 		env.addrCache = append(env.addrCache, ip)
@@ -0,0 +1,51 @@
+package env
+
+import (
+	"NetManager/logger"
+	"errors"
+	"net"
+)
+
+// NamespaceDeploymentHandler attaches pre-created network namespaces, e.g. the ones of Kata, gVisor or crun,
+// given by path or by file descriptor instead of the pid of a process running inside.
+type NamespaceDeploymentHandler struct {
+	env *Environment
+}
+
+var namespaceHandler *NamespaceDeploymentHandler = nil
+
+func GetNamespaceNetDeployment() *NamespaceDeploymentHandler {
+	if namespaceHandler == nil {
+		logger.ErrorLogger().Fatal("Namespace Handler not initialized")
+	}
+	return namespaceHandler
+}
+
+func InitNamespaceDeployment(env *Environment) {
+	namespaceHandler = &NamespaceDeploymentHandler{
+		env: env,
+	}
+}
+
+// DeployNetwork attaches the namespace given by NetnsPath, or by the NetnsFd of the process Pid, to the bridge
+func (h *NamespaceDeploymentHandler) DeployNetwork(request DeploymentRequest) (net.IP, net.IP, bool, error) {
+	target, err := namespaceTarget(request)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	if err := target.validate(); err != nil {
+		return nil, nil, false, err
+	}
+	logger.DebugLogger().Println("Attaching namespace ", target)
+	return h.env.attachVethToNamespace(target, request)
+}
+
+func namespaceTarget(request DeploymentRequest) (netnsTarget, error) {
+	if request.NetnsFd != nil {
+		return newNetnsTargetFromFd(request.Pid, *request.NetnsFd)
+	}
+	if request.NetnsPath == "" {
+		return netnsTarget{}, errors.New("either a network namespace path or file descriptor is required")
+	}
+	return newNetnsTarget(0, request.NetnsPath)
+}
@@ -1,14 +1,42 @@
 package env
 
-import "net"
+import (
+	"NetManager/network"
+	"context"
+	"net"
+)
 
 const (
 	CONTAINER_RUNTIME = "container"
 	UNIKERNEL_RUNTIME = "unikernel"
+	NAMESPACE_RUNTIME = "namespace"
 )
 
+// DeploymentRequest is the network requested for a new service instance
+type DeploymentRequest struct {
+	// runtime requesting the deployment
+	Runtime string
+	Pid     int
+	// network namespace path, used instead of the pid when set
+	NetnsPath string
+	// file descriptor of the network namespace held by the process Pid, namespace runtime only
+	NetnsFd *int
+	// name of the interface inside the namespace, the veth name when empty
+	Ifname         string
+	ServiceName    string
+	Instancenumber int
+	PortMappings   network.PortMappings
+	// public addresses of the instance, PublicIPNetworking only
+	PublicExposures network.PublicExposures
+	// network inside the unikernel namespace, nil for the default single NIC topology
+	Unikernel *UnikernelTopology
+	// cancels the deployment between its steps, rolling it back. Never cancelled when nil
+	Context context.Context
+}
+
 type NetDeploymentInterface interface {
-	DeployNetwork(pid int, sname string, instancenumber int, portmapping string) (net.IP, net.IP, error)
+	// DeployNetwork returns the addresses of the instance, created is false when the instance was already deployed
+	DeployNetwork(request DeploymentRequest) (ip net.IP, ipv6 net.IP, created bool, err error)
 }
 
 func GetNetDeployment(handler string) NetDeploymentInterface {
@@ -17,6 +45,8 @@ func GetNetDeployment(handler string) NetDeploymentInterface {
 		return GetContainerNetDeployment()
 	case UNIKERNEL_RUNTIME:
 		return GetUnikernelNetDeployment()
+	case NAMESPACE_RUNTIME:
+		return GetNamespaceNetDeployment()
 	}
 	return nil
 }
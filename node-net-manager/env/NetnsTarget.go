@@ -0,0 +1,81 @@
+package env
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+// netnsTarget is the network namespace of a workload, given by the pid of one of its processes or by the namespace path
+type netnsTarget struct {
+	pid  int
+	path string
+}
+
+func newNetnsTarget(pid int, path string) (netnsTarget, error) {
+	if path == "" && pid <= 0 {
+		return netnsTarget{}, errors.New("either a pid or a network namespace path is required")
+	}
+	return netnsTarget{pid: pid, path: path}, nil
+}
+
+// newNetnsTargetFromFd returns the namespace referred by the file descriptor fd of the process pid
+func newNetnsTargetFromFd(pid int, fd int) (netnsTarget, error) {
+	if pid <= 0 || fd < 0 {
+		return netnsTarget{}, errors.New("a namespace file descriptor requires the pid of the process holding it")
+	}
+	return netnsTarget{path: fmt.Sprintf("/proc/%d/fd/%d", pid, fd)}, nil
+}
+
+// validate checks that the target refers to a network namespace.
+// A path to a regular file or to a different namespace type is rejected before any link is moved.
+func (t netnsTarget) validate() error {
+	ns, err := t.open()
+	if err != nil {
+		return fmt.Errorf("unable to open the namespace %s: %v", t, err)
+	}
+	defer ns.Close()
+	var stat unix.Statfs_t
+	if err := unix.Fstatfs(int(ns), &stat); err != nil {
+		return err
+	}
+	if stat.Type != unix.NSFS_MAGIC {
+		return fmt.Errorf("%s is not a namespace", t)
+	}
+	nstype, err := unix.IoctlRetInt(int(ns), unix.NS_GET_NSTYPE)
+	if err == nil && nstype != unix.CLONE_NEWNET {
+		return fmt.Errorf("%s is not a network namespace", t)
+	}
+	return nil
+}
+
+// open returns a handle to the namespace, to be closed by the caller
+func (t netnsTarget) open() (netns.NsHandle, error) {
+	if t.path != "" {
+		return netns.GetFromPath(t.path)
+	}
+	return netns.GetFromPid(t.pid)
+}
+
+// moveLink moves the link from the current namespace into the target one
+func (t netnsTarget) moveLink(link netlink.Link) error {
+	if t.path == "" {
+		return netlink.LinkSetNsPid(link, t.pid)
+	}
+	ns, err := t.open()
+	if err != nil {
+		return err
+	}
+	defer ns.Close()
+	return netlink.LinkSetNsFd(link, int(ns))
+}
+
+func (t netnsTarget) String() string {
+	if t.path != "" {
+		return t.path
+	}
+	return fmt.Sprintf("pid %d", t.pid)
+}
@@ -0,0 +1,138 @@
+package env
+
+import (
+	"NetManager/logger"
+	"NetManager/network"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"sync"
+)
+
+// ErrInstanceConflict is returned when an instance is deployed again somewhere else, e.g. in another namespace
+var ErrInstanceConflict = errors.New("instance already deployed")
+
+// publishedPorts are the port mappings and public exposures of a deployed instance, replaced in place by a new deployment request
+type publishedPorts struct {
+	mappings  network.PortMappings
+	exposures network.PublicExposures
+	lock      sync.Mutex
+}
+
+func newPublishedPorts(request DeploymentRequest) *publishedPorts {
+	return &publishedPorts{mappings: request.PortMappings, exposures: request.PublicExposures}
+}
+
+func (p *publishedPorts) get() (network.PortMappings, network.PublicExposures) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.mappings, p.exposures
+}
+
+func (p *publishedPorts) set(mappings network.PortMappings, exposures network.PublicExposures) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.mappings, p.exposures = mappings, exposures
+}
+
+// DeployedInstance is a service instance with its network on this node
+type DeployedInstance struct {
+	Runtime        string
+	ServiceName    string
+	Instancenumber int
+}
+
+// DeployedInstances returns the instances deployed by the runtimes, the ones of the Docker network plugin are left to Docker
+func (env *Environment) DeployedInstances() []DeployedInstance {
+	env.deployedServicesLock.RLock()
+	defer env.deployedServicesLock.RUnlock()
+	instances := make([]DeployedInstance, 0, len(env.deployedServices))
+	for _, s := range env.deployedServices {
+		if s.runtime == "" {
+			continue
+		}
+		instances = append(instances, DeployedInstance{Runtime: s.runtime, ServiceName: s.sname, Instancenumber: s.instance})
+	}
+	return instances
+}
+
+// redeploy answers a deployment request for an instance already deployed under key.
+// The same request returns the existing addresses, new port mappings or public exposures are applied in place.
+// A request for another namespace is rejected. deployed is false when the instance is not deployed yet.
+func (env *Environment) redeploy(key string, netns string, request DeploymentRequest) (ip net.IP, ipv6 net.IP, deployed bool, err error) {
+	env.deployedServicesLock.RLock()
+	s, deployed := env.deployedServices[key]
+	env.deployedServicesLock.RUnlock()
+	if !deployed {
+		return nil, nil, false, nil
+	}
+	if s.netns != netns {
+		return nil, nil, true, fmt.Errorf("%w: %s is attached to %s", ErrInstanceConflict, key, s.netns)
+	}
+	if err := env.updatePublishedPorts(s, request); err != nil {
+		return nil, nil, true, err
+	}
+	return s.ip, s.ipv6, true, nil
+}
+
+// updatePublishedPorts replaces the port mappings and public exposures of the instance, the previous ones are restored on failure
+func (env *Environment) updatePublishedPorts(s service, request DeploymentRequest) error {
+	mappings, exposures := s.ports.get()
+	if samePorts(mappings, request.PortMappings) && sameExposures(exposures, request.PublicExposures) {
+		return nil
+	}
+	logger.InfoLogger().Printf("Updating the ports of %s from %s to %s", s.owner, mappings, request.PortMappings)
+	if err := env.publishPorts(s, mappings, exposures, network.ClosePorts); err != nil {
+		logger.ErrorLogger().Printf("Unable to close the previous ports of %s: %v", s.owner, err)
+	}
+	if err := env.publishPorts(s, request.PortMappings, request.PublicExposures, network.OpenPorts); err != nil {
+		if restoreErr := env.publishPorts(s, mappings, exposures, network.OpenPorts); restoreErr != nil {
+			logger.ErrorLogger().Printf("Unable to restore the previous ports of %s: %v", s.owner, restoreErr)
+		}
+		return err
+	}
+	s.ports.set(request.PortMappings, request.PublicExposures)
+	return nil
+}
+
+// publishPorts opens the mappings and exposures on the addresses of the instance, all of them or none, or closes them
+func (env *Environment) publishPorts(s service, mappings network.PortMappings, exposures network.PublicExposures, operation network.PortOperation) error {
+	ops := env.vethOps
+	addresses := []net.IP{s.ip}
+	if s.ipv6 != nil {
+		addresses = append(addresses, s.ipv6)
+	}
+	if operation == network.ClosePorts {
+		err := ops.exposePublicly(s.owner, exposures, s.ip, s.ipv6, network.ClosePorts)
+		for _, ip := range addresses {
+			if portsErr := ops.managePorts(s.owner, ip, mappings, network.ClosePorts); err == nil {
+				err = portsErr
+			}
+		}
+		return err
+	}
+	for i, ip := range addresses {
+		if err := ops.managePorts(s.owner, ip, mappings, network.OpenPorts); err != nil {
+			for _, opened := range addresses[:i] {
+				_ = ops.managePorts(s.owner, opened, mappings, network.ClosePorts)
+			}
+			return err
+		}
+	}
+	if err := ops.exposePublicly(s.owner, exposures, s.ip, s.ipv6, network.OpenPorts); err != nil {
+		for _, ip := range addresses {
+			_ = ops.managePorts(s.owner, ip, mappings, network.ClosePorts)
+		}
+		return err
+	}
+	return nil
+}
+
+func samePorts(a network.PortMappings, b network.PortMappings) bool {
+	return (len(a) == 0 && len(b) == 0) || reflect.DeepEqual(a, b)
+}
+
+func sameExposures(a network.PublicExposures, b network.PublicExposures) bool {
+	return (len(a) == 0 && len(b) == 0) || reflect.DeepEqual(a, b)
+}
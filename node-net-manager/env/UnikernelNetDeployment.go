@@ -1,9 +1,11 @@
 package env
 
 import (
+	"NetManager/events"
 	"NetManager/logger"
 	"NetManager/network"
 	"fmt"
+	"io"
 	"net"
 	"os/exec"
 	"runtime/debug"
@@ -31,26 +33,38 @@ func InitUnikernelDeployment(env *Environment) {
 	}
 }
 
-func (h *UnikernelDeyplomentHandler) DeployNetwork(pid int, sname string, instancenumber int, portmapping string) (net.IP, net.IP, error) {
+func (h *UnikernelDeyplomentHandler) DeployNetwork(request DeploymentRequest) (net.IP, net.IP, bool, error) {
 	env := h.env
-	name := sname
-	sname = fmt.Sprintf("%s.instance.%d", sname, instancenumber)
+	name := request.ServiceName
+	portmapping := request.PortMappings
+	sname := fmt.Sprintf("%s.instance.%d", name, request.Instancenumber)
+	owner := network.InstanceRuleOwner(name, request.Instancenumber)
+	if ip, ipv6, deployed, err := env.redeploy(sname, "", request); deployed {
+		return ip, ipv6, false, err
+	}
+
+	plan, err := planUnikernelTopology(request.Unikernel, sname)
+	if err != nil {
+		return nil, nil, false, err
+	}
 
 	cleanup := func(veth *netlink.Veth) {
 		_ = netlink.LinkDel(veth)
 	}
 
 	logger.DebugLogger().Println("Creating veth pair for unikernel deployment")
-	vethIfce, err := env.createVethsPairAndAttachToBridge(sname, env.mtusize)
+	vethIfce, _, err := env.createBookedVeth(func() (*netlink.Veth, error) {
+		return env.createVethsPairAndAttachToBridge(sname, env.mtusize)
+	})
 	if err != nil {
 		cleanup(vethIfce)
-		return nil, nil, err
+		return nil, nil, false, err
 	}
 
 	peerVeth, err := netlink.LinkByName(vethIfce.PeerName)
 	if err != nil {
 		cleanup(vethIfce)
-		return nil, nil, err
+		return nil, nil, false, err
 	}
 
 	logger.DebugLogger().Printf("Creating Namespace for unikernel (%s)", sname)
@@ -59,12 +73,12 @@ func (h *UnikernelDeyplomentHandler) DeployNetwork(pid int, sname string, instan
 	// ns, err := netns.NewNamed(sname) ## Changes Namespace of current application
 	if err != nil {
 		cleanup(vethIfce)
-		return nil, nil, err
+		return nil, nil, false, err
 	}
 	ns, err := netns.GetFromName(sname)
 	if err != nil {
 		logger.DebugLogger().Printf("Unable to find namespace: %v", err)
-		return nil, nil, err
+		return nil, nil, false, err
 	}
 
 	cleanup = func(veth *netlink.Veth) {
@@ -79,31 +93,54 @@ func (h *UnikernelDeyplomentHandler) DeployNetwork(pid int, sname string, instan
 	if err := netlink.LinkSetNsFd(peerVeth, int(ns)); err != nil {
 		logger.DebugLogger().Printf("Error %s: %v", peerVeth.Attrs().Name, err)
 		cleanup(vethIfce)
-		return nil, nil, err
+		return nil, nil, false, err
 	}
 
 	// Get IP for veth interface
 	ip, err := env.generateAddress()
 	if err != nil {
 		cleanup(vethIfce)
-		return nil, nil, err
+		return nil, nil, false, err
 	}
 
-	if err := env.addPeerLinkNetworkByNsName(sname, ip.String()+env.config.HostBridgeMask, vethIfce.PeerName); err != nil {
-		logger.DebugLogger().Println("Unable to configure Peer")
+	ipv6, err := env.generateIPv6Address()
+	if err != nil {
 		cleanup(vethIfce)
 		env.freeContainerAddress(ip)
-		return nil, nil, err
+		return nil, nil, false, err
 	}
 
-	// Create Bridge and tap within Ns
-	logger.DebugLogger().Println("Creating Bridge and Tap inside of Ns")
+	release := func() {
+		cleanup(vethIfce)
+		env.freeContainerAddress(ip)
+		env.freeContainerAddress(ipv6)
+	}
+
+	// disabled before creating the bridge and tap as well, which inherit the default
+	logger.DebugLogger().Println("Disabling DAD for IPv6")
+	if err := env.disableDADByNsName(sname, vethIfce.PeerName); err != nil {
+		logger.DebugLogger().Println("Unable to disable DAD")
+		release()
+		return nil, nil, false, err
+	}
+
+	if err := env.addPeerLinkNetworkByNsName(sname, ip.String()+env.config.HostBridgeMask, vethIfce.PeerName); err != nil {
+		logger.DebugLogger().Println("Unable to configure Peer")
+		release()
+		return nil, nil, false, err
+	}
+
+	if err := env.addPeerLinkNetworkByNsName(sname, ipv6.String()+env.config.HostBridgeIPv6Prefix, vethIfce.PeerName); err != nil {
+		logger.DebugLogger().Println("Unable to configure Peer IPv6")
+		release()
+		return nil, nil, false, err
+	}
+
+	// Create Bridge and taps within Ns
+	logger.DebugLogger().Printf("Creating Bridge and %d Taps inside of Ns", len(plan.nics))
 	labr := netlink.NewLinkAttrs()
-	labr.Name = "virbr0"
+	labr.Name = UNIKERNEL_BRIDGE
 	bridge := &netlink.Bridge{LinkAttrs: labr}
-	lat := netlink.NewLinkAttrs()
-	lat.Name = "tap0"
-	tap := &netlink.Tuntap{LinkAttrs: lat, Mode: netlink.TUNTAP_MODE_TAP}
 	err = env.execInsideNsByName(sname, func() error {
 		// Create Bridge
 		err := netlink.LinkAdd(bridge)
@@ -112,33 +149,47 @@ func (h *UnikernelDeyplomentHandler) DeployNetwork(pid int, sname string, instan
 			return err
 		}
 		// Set IP on Bridge
-		addrbr, _ := netlink.ParseAddr("192.168.1.1/30")
+		addrbr, _ := netlink.ParseAddr(plan.gateway.String() + plan.mask())
 		err = netlink.AddrAdd(bridge, addrbr)
 		if err != nil {
 			logger.DebugLogger().Printf("Unable to add ip address to bridge: %v\n", err)
 			return err
 		}
-		// Create tap for Qemu
-		err = netlink.LinkAdd(tap)
+		addrbrv6, _ := netlink.ParseAddr(plan.gatewayv6.String() + plan.prefixv6())
+		err = netlink.AddrAdd(bridge, addrbrv6)
 		if err != nil {
-			logger.DebugLogger().Printf("Unable to create Tap: %v\n", err)
-			return err
-		}
-		// Attach tap to Bridge
-		if netlink.LinkSetMaster(tap, bridge) != nil {
-			logger.DebugLogger().Printf("Unable to set master to tap: %v\n", err)
+			logger.DebugLogger().Printf("Unable to add ipv6 address to bridge: %v\n", err)
 			return err
 		}
-
-		// ip link set up virbr0/tap0
-		cmd := exec.Command("ip", "link", "set", "up", "dev", "virbr0")
+		cmd := exec.Command("ip", "link", "set", "up", "dev", UNIKERNEL_BRIDGE)
 		err = cmd.Run()
 		if err != nil {
 			return err
 		}
-		cmd = exec.Command("ip", "link", "set", "up", "dev", "tap0")
-		err = cmd.Run()
-		if err != nil {
+		for _, nic := range plan.nics {
+			// Create tap for Qemu
+			lat := netlink.NewLinkAttrs()
+			lat.Name = nic.tap
+			tap := &netlink.Tuntap{LinkAttrs: lat, Mode: netlink.TUNTAP_MODE_TAP}
+			err = netlink.LinkAdd(tap)
+			if err != nil {
+				logger.DebugLogger().Printf("Unable to create Tap: %v\n", err)
+				return err
+			}
+			// Attach tap to Bridge
+			if err = netlink.LinkSetMaster(tap, bridge); err != nil {
+				logger.DebugLogger().Printf("Unable to set master to tap: %v\n", err)
+				return err
+			}
+			cmd = exec.Command("ip", "link", "set", "up", "dev", nic.tap)
+			err = cmd.Run()
+			if err != nil {
+				return err
+			}
+		}
+
+		// Route the IPv6 traffic between virbr0 and the veth
+		if err = network.WriteSysctl("net/ipv6/conf/all/forwarding", "1"); err != nil {
 			return err
 		}
 
@@ -158,64 +209,169 @@ func (h *UnikernelDeyplomentHandler) DeployNetwork(pid int, sname string, instan
 			return err
 		}
 
-		// Set NAT for Unikernel
-		cmd = exec.Command("iptables", "-t", "nat", "-A", "POSTROUTING", "-o", vethIfce.PeerName, "-j", "SNAT", "--to", ip.String())
-		err = cmd.Run()
+		dstv6, err := netlink.ParseIPNet("::/0")
 		if err != nil {
 			return err
 		}
-		cmd = exec.Command("iptables", "-t", "nat", "-A", "PREROUTING", "-i", vethIfce.PeerName, "-j", "DNAT", "--to", "192.168.1.2")
-		err = cmd.Run()
+
+		err = netlink.RouteAdd(&netlink.Route{
+			LinkIndex: peerVeth.Attrs().Index,
+			Dst:       dstv6,
+			Gw:        net.ParseIP(env.config.HostBridgeIPv6),
+		})
 		if err != nil {
+			logger.DebugLogger().Printf("Failed to set IPv6 route in Ns: %v", err)
+			return err
+		}
+
+		// Set NAT for Unikernel
+		if err := network.SetNamespaceNat(vethIfce.PeerName, ip, plan.nics[0].ip); err != nil {
+			return err
+		}
+		if err := network.SetNamespaceNat(vethIfce.PeerName, ipv6, plan.nics[0].ipv6); err != nil {
 			return err
 		}
 		return nil
 	})
 	if err != nil {
 		logger.DebugLogger().Printf("Failed to configure Ns for Unikernel\n")
+		release()
+		return nil, nil, false, err
+	}
+
+	responders := make([]io.Closer, 0)
+	if plan.dhcp {
+		logger.DebugLogger().Println("Starting DHCP and router advertisement responders inside of Ns")
+		responders, err = env.startUnikernelResponders(sname, plan)
+		if err != nil {
+			logger.DebugLogger().Printf("Failed to start the responders: %v\n", err)
+			release()
+			return nil, nil, false, err
+		}
+	}
+	release = func() {
+		for _, responder := range responders {
+			_ = responder.Close()
+		}
 		cleanup(vethIfce)
 		env.freeContainerAddress(ip)
-		return nil, nil, err
+		env.freeContainerAddress(ipv6)
 	}
 
-	env.BookVethNumber()
+	if err = env.setVethFirewallRules(owner, vethIfce.Name); err != nil {
+		release()
+		return nil, nil, false, err
+	}
 
-	if err = env.setVethFirewallRules(vethIfce.Name); err != nil {
-		cleanup(vethIfce)
-		env.freeContainerAddress(ip)
-		return nil, nil, err
+	if err = network.ManageContainerPortMappings(owner, ip, portmapping, network.OpenPorts); err != nil {
+		debug.PrintStack()
+		_ = network.ReleaseRules(owner)
+		release()
+		return nil, nil, false, err
 	}
 
-	if err = network.ManageContainerPorts(ip, portmapping, network.OpenPorts); err != nil {
+	if err = network.ManageContainerPortMappings(owner, ipv6, portmapping, network.OpenPorts); err != nil {
 		debug.PrintStack()
-		cleanup(vethIfce)
-		env.freeContainerAddress(ip)
-		return nil, nil, err
+		_ = network.ReleaseRules(owner)
+		release()
+		return nil, nil, false, err
 	}
 
-	env.deployedServicesLock.Lock()
-	env.deployedServices[sname] = service{
-		ip:          ip,
-		sname:       name,
-		portmapping: portmapping,
-		veth:        vethIfce,
+	if err = network.ManagePublicExposures(owner, request.PublicExposures, ip, ipv6, network.OpenPorts); err != nil {
+		_ = network.ReleaseRules(owner)
+		release()
+		return nil, nil, false, err
+	}
+
+	deployed := service{
+		ip:         ip,
+		ipv6:       ipv6,
+		sname:      name,
+		runtime:    request.Runtime,
+		instance:   request.Instancenumber,
+		ports:      newPublishedPorts(request),
+		owner:      owner,
+		veth:       vethIfce,
+		unikernel:  plan.network(),
+		responders: responders,
 	}
+	env.deployedServicesLock.Lock()
+	env.deployedServices[sname] = deployed
 	env.deployedServicesLock.Unlock()
+	emitServiceEvent(events.ServiceDeployed, deployed)
 	logger.DebugLogger().Println("Successful Network creation for Unikernel")
-	return ip, nil, nil
+	return ip, ipv6, true, nil
 }
 
-func (env *Environment) DeleteUnikernelNamespace(sname string, instance int) {
+// DeleteUnikernelNamespace removes the network and namespace of the instance, returns false if the instance is not deployed
+func (env *Environment) DeleteUnikernelNamespace(sname string, instance int) bool {
 	name := fmt.Sprintf("%s.instance.%d", sname, instance)
+	env.deployedServicesLock.RLock()
 	s, ok := env.deployedServices[name]
+	env.deployedServicesLock.RUnlock()
 	if ok {
 		_ = env.translationTable.RemoveByNsip(s.ip)
 		env.deployedServicesLock.Lock()
 		delete(env.deployedServices, name)
 		env.deployedServicesLock.Unlock()
 		env.freeContainerAddress(s.ip)
-		_ = network.ManageContainerPorts(s.ip, s.portmapping, network.ClosePorts)
+		env.freeContainerAddress(s.ipv6)
+		_ = network.ReleaseRules(s.owner)
+		for _, responder := range s.responders {
+			_ = responder.Close()
+		}
 		_ = netlink.LinkDel(s.veth)
 		_ = netns.DeleteNamed(name)
+		emitServiceEvent(events.ServiceUndeployed, s)
+	}
+	return ok
+}
+
+// GetUnikernelNetwork returns the network deployed inside the namespace of the unikernel instance
+func (env *Environment) GetUnikernelNetwork(sname string, instance int) (*UnikernelNetwork, bool) {
+	env.deployedServicesLock.RLock()
+	defer env.deployedServicesLock.RUnlock()
+	s, ok := env.deployedServices[fmt.Sprintf("%s.instance.%d", sname, instance)]
+	if !ok || s.unikernel == nil {
+		return nil, false
+	}
+	return s.unikernel, true
+}
+
+// startUnikernelResponders serves the addresses of the plan to the guests with DHCP and the router advertisements.
+// The sockets are opened inside the namespace, the responders stop when closed.
+func (env *Environment) startUnikernelResponders(NsName string, plan *unikernelPlan) ([]io.Closer, error) {
+	var dhcp *network.DhcpServer
+	var advertiser *network.RouterAdvertiser
+	err := env.execInsideNsByName(NsName, func() error {
+		leases := make([]network.DhcpLease, len(plan.nics))
+		for i, nic := range plan.nics {
+			leases[i] = network.DhcpLease{MAC: nic.mac, IP: nic.ip}
+		}
+		conn, err := network.ListenDhcp(UNIKERNEL_BRIDGE)
+		if err != nil {
+			return err
+		}
+		dhcp = network.NewDhcpServer(conn, network.DhcpConfiguration{
+			ServerIP: plan.gateway,
+			Mask:     plan.subnet.Mask,
+			Router:   plan.gateway,
+			MTU:      env.mtusize,
+			Leases:   leases,
+		})
+		advertiser, err = network.NewRouterAdvertiser(UNIKERNEL_BRIDGE, network.RouterAdvertisement{
+			Prefix: plan.subnetv6,
+			MTU:    env.mtusize,
+		})
+		if err != nil {
+			_ = dhcp.Close()
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
 	}
+	go dhcp.Serve()
+	go advertiser.Serve()
+	return []io.Closer{dhcp, advertiser}, nil
 }
@@ -0,0 +1,209 @@
+package env
+
+import (
+	"NetManager/network"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"math/bits"
+	"net"
+)
+
+const (
+	// UNIKERNEL_BRIDGE is the bridge inside the unikernel namespace, the taps of the guest NICs are attached to it
+	UNIKERNEL_BRIDGE = "virbr0"
+	// DEFAULT_UNIKERNEL_SUBNET is the guest subnet of a single NIC unikernel: 192.168.1.1 for the bridge, 192.168.1.2 for the guest
+	DEFAULT_UNIKERNEL_SUBNET = "192.168.1.0/30"
+	// DEFAULT_UNIKERNEL_SUBNETV6 is the guest IPv6 subnet of a single NIC unikernel: fdff:1::1 for the bridge, fdff:1::2 for the guest
+	DEFAULT_UNIKERNEL_SUBNETV6 = "fdff:1::/126"
+	// DEFAULT_UNIKERNEL_SLAAC_SUBNETV6 is the guest IPv6 subnet when the guests configure themselves with the router advertisements
+	DEFAULT_UNIKERNEL_SLAAC_SUBNETV6 = "fdff:1::/64"
+	MAX_UNIKERNEL_TAPS               = 16
+)
+
+// UnikernelTopology is the network requested inside the namespace of a unikernel
+type UnikernelTopology struct {
+	// number of taps attached to the bridge, one for each guest NIC
+	Taps int `json:"taps"`
+	// MAC addresses of the guest NICs, generated for the missing ones
+	MACs []string `json:"macs"`
+	// guest IPv4 subnet, the first address is assigned to the bridge and the following ones to the NICs
+	Subnet string `json:"subnet"`
+	// guest IPv6 subnet, MUST be a /64 when DHCP is enabled
+	Subnetv6 string `json:"subnetv6"`
+	// run a DHCPv4 and router advertisement responder on the bridge
+	DHCP bool `json:"dhcp"`
+}
+
+// UnikernelNic is a guest NIC. The traffic towards the namespace address is forwarded to the first NIC.
+type UnikernelNic struct {
+	Tap  string `json:"tap"`
+	MAC  string `json:"mac"`
+	IP   string `json:"ip"`
+	IPv6 string `json:"ipv6"`
+}
+
+// UnikernelNetwork is the network deployed inside the namespace of a unikernel
+type UnikernelNetwork struct {
+	Bridge    string         `json:"bridge"`
+	Gateway   string         `json:"gateway"`
+	Gatewayv6 string         `json:"gatewayv6"`
+	Subnet    string         `json:"subnet"`
+	Subnetv6  string         `json:"subnetv6"`
+	DHCP      bool           `json:"dhcp"`
+	Nics      []UnikernelNic `json:"nics"`
+}
+
+type unikernelNic struct {
+	tap  string
+	mac  net.HardwareAddr
+	ip   net.IP
+	ipv6 net.IP
+}
+
+// unikernelPlan is the validated topology with all the addresses assigned
+type unikernelPlan struct {
+	subnet    *net.IPNet
+	subnetv6  *net.IPNet
+	gateway   net.IP
+	gatewayv6 net.IP
+	dhcp      bool
+	nics      []unikernelNic
+}
+
+// Validate checks the topology before any deployment
+func (t *UnikernelTopology) Validate() error {
+	_, err := planUnikernelTopology(t, "")
+	return err
+}
+
+// planUnikernelTopology validates the topology, a nil topology is the single NIC default, and assigns the addresses.
+// The generated MAC addresses only depend on the namespace name, so that a redeployed instance gets the same ones.
+func planUnikernelTopology(topology *UnikernelTopology, nsName string) (*unikernelPlan, error) {
+	if topology == nil {
+		topology = &UnikernelTopology{}
+	}
+	taps := topology.Taps
+	if taps == 0 {
+		taps = 1
+	}
+	if taps < 0 || taps > MAX_UNIKERNEL_TAPS {
+		return nil, fmt.Errorf("invalid number of taps %d, max %d", taps, MAX_UNIKERNEL_TAPS)
+	}
+	if len(topology.MACs) > taps {
+		return nil, fmt.Errorf("%d MAC addresses for %d taps", len(topology.MACs), taps)
+	}
+
+	subnet := topology.Subnet
+	if subnet == "" {
+		subnet = defaultUnikernelSubnet(taps)
+	}
+	_, subnetNet, err := net.ParseCIDR(subnet)
+	if err != nil || subnetNet.IP.To4() == nil {
+		return nil, fmt.Errorf("invalid guest subnet %s", subnet)
+	}
+	ones, size := subnetNet.Mask.Size()
+	// network, bridge, guests and broadcast addresses
+	if size-ones < 31 && 1<<(size-ones) < taps+3 {
+		return nil, fmt.Errorf("guest subnet %s too small for %d taps", subnet, taps)
+	}
+
+	subnetv6 := topology.Subnetv6
+	if subnetv6 == "" {
+		subnetv6 = DEFAULT_UNIKERNEL_SUBNETV6
+		if topology.DHCP || taps > 1 {
+			subnetv6 = DEFAULT_UNIKERNEL_SLAAC_SUBNETV6
+		}
+	}
+	_, subnetv6Net, err := net.ParseCIDR(subnetv6)
+	if err != nil || subnetv6Net.IP.To4() != nil {
+		return nil, fmt.Errorf("invalid guest IPv6 subnet %s", subnetv6)
+	}
+	onesv6, _ := subnetv6Net.Mask.Size()
+	if topology.DHCP && onesv6 != 64 {
+		return nil, errors.New("the router advertisements require a /64 guest IPv6 subnet")
+	}
+	if onesv6 > 64 && 1<<(128-onesv6) < taps+2 {
+		return nil, fmt.Errorf("guest IPv6 subnet %s too small for %d taps", subnetv6, taps)
+	}
+
+	plan := &unikernelPlan{
+		subnet:    subnetNet,
+		subnetv6:  subnetv6Net,
+		gateway:   network.NextIPv4(subnetNet.IP, 1),
+		gatewayv6: network.NextIPv6(subnetv6Net.IP, 1),
+		dhcp:      topology.DHCP,
+		nics:      make([]unikernelNic, taps),
+	}
+	for i := range plan.nics {
+		var mac net.HardwareAddr
+		if i < len(topology.MACs) {
+			mac, err = net.ParseMAC(topology.MACs[i])
+			if err != nil || len(mac) != 6 || mac[0]&0x01 != 0 {
+				return nil, fmt.Errorf("invalid MAC address %s", topology.MACs[i])
+			}
+		} else {
+			mac = generateUnikernelMAC(nsName, i)
+		}
+		nic := unikernelNic{
+			tap: fmt.Sprintf("tap%d", i),
+			mac: mac,
+			ip:  network.NextIPv4(subnetNet.IP, uint(i+2)),
+		}
+		if plan.dhcp {
+			nic.ipv6 = network.SlaacAddress(subnetv6Net, mac)
+		} else {
+			nic.ipv6 = network.NextIPv6(subnetv6Net.IP, uint(i+2))
+		}
+		plan.nics[i] = nic
+	}
+	return plan, nil
+}
+
+// defaultUnikernelSubnet returns the smallest subnet in 192.168.1.0/24 fitting the taps
+func defaultUnikernelSubnet(taps int) string {
+	if taps == 1 {
+		return DEFAULT_UNIKERNEL_SUBNET
+	}
+	return fmt.Sprintf("192.168.1.0/%d", 32-bits.Len(uint(taps+2)))
+}
+
+// generateUnikernelMAC returns a locally administered unicast MAC address
+func generateUnikernelMAC(nsName string, index int) net.HardwareAddr {
+	hash := sha1.Sum([]byte(fmt.Sprintf("%s,%d", nsName, index)))
+	mac := net.HardwareAddr{0x02, hash[0], hash[1], hash[2], hash[3], hash[4]}
+	return mac
+}
+
+// mask returns the guest subnet mask in the /xx notation
+func (p *unikernelPlan) mask() string {
+	ones, _ := p.subnet.Mask.Size()
+	return fmt.Sprintf("/%d", ones)
+}
+
+// prefixv6 returns the guest IPv6 prefix in the /xx notation
+func (p *unikernelPlan) prefixv6() string {
+	ones, _ := p.subnetv6.Mask.Size()
+	return fmt.Sprintf("/%d", ones)
+}
+
+func (p *unikernelPlan) network() *UnikernelNetwork {
+	result := &UnikernelNetwork{
+		Bridge:    UNIKERNEL_BRIDGE,
+		Gateway:   p.gateway.String(),
+		Gatewayv6: p.gatewayv6.String(),
+		Subnet:    p.subnet.String(),
+		Subnetv6:  p.subnetv6.String(),
+		DHCP:      p.dhcp,
+		Nics:      make([]UnikernelNic, len(p.nics)),
+	}
+	for i, nic := range p.nics {
+		result.Nics[i] = UnikernelNic{
+			Tap:  nic.tap,
+			MAC:  nic.mac.String(),
+			IP:   nic.ip.String(),
+			IPv6: nic.ipv6.String(),
+		}
+	}
+	return result
+}
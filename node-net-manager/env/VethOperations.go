@@ -0,0 +1,82 @@
+package env
+
+import (
+	"NetManager/network"
+	"net"
+
+	"github.com/vishvananda/netlink"
+)
+
+// vethOperations are the host changes of a veth deployment, replaced by a fake in the tests
+type vethOperations interface {
+	// createVeth creates the veth pair attached to the bridge
+	createVeth(sname string) (*netlink.Veth, error)
+	deleteVeth(veth *netlink.Veth)
+	moveLink(target netnsTarget, name string) error
+	renameLink(target netnsTarget, name string, ifname string) error
+	addAddress(target netnsTarget, addr string, ifname string) error
+	disableDAD(target netnsTarget, ifname string) error
+	setRoutes(target netnsTarget, ifname string) error
+	setIPv6Routes(target netnsTarget, ifname string) error
+	setFirewallRules(owner network.RuleOwner, vethName string) error
+	removeFirewallRules(owner network.RuleOwner, vethName string)
+	managePorts(owner network.RuleOwner, ip net.IP, portmapping network.PortMappings, operation network.PortOperation) error
+	exposePublicly(owner network.RuleOwner, exposures network.PublicExposures, ip net.IP, ipv6 net.IP, operation network.PortOperation) error
+}
+
+// hostVethOperations changes the host network
+type hostVethOperations struct {
+	env *Environment
+}
+
+func (o hostVethOperations) createVeth(sname string) (*netlink.Veth, error) {
+	return o.env.createVethsPairAndAttachToBridge(sname, o.env.mtusize)
+}
+
+func (o hostVethOperations) deleteVeth(veth *netlink.Veth) {
+	_ = netlink.LinkDel(veth)
+}
+
+func (o hostVethOperations) moveLink(target netnsTarget, name string) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return err
+	}
+	return target.moveLink(link)
+}
+
+func (o hostVethOperations) renameLink(target netnsTarget, name string, ifname string) error {
+	return o.env.renamePeerLink(target, name, ifname)
+}
+
+func (o hostVethOperations) addAddress(target netnsTarget, addr string, ifname string) error {
+	return o.env.addPeerLinkNetwork(target, addr, ifname)
+}
+
+func (o hostVethOperations) disableDAD(target netnsTarget, ifname string) error {
+	return o.env.disableDAD(target, ifname)
+}
+
+func (o hostVethOperations) setRoutes(target netnsTarget, ifname string) error {
+	return o.env.setContainerRoutes(target, ifname)
+}
+
+func (o hostVethOperations) setIPv6Routes(target netnsTarget, ifname string) error {
+	return o.env.setIPv6ContainerRoutes(target, ifname)
+}
+
+func (o hostVethOperations) setFirewallRules(owner network.RuleOwner, vethName string) error {
+	return o.env.setVethFirewallRules(owner, vethName)
+}
+
+func (o hostVethOperations) removeFirewallRules(owner network.RuleOwner, vethName string) {
+	_ = o.env.removeVethFirewallRules(owner, vethName)
+}
+
+func (o hostVethOperations) managePorts(owner network.RuleOwner, ip net.IP, portmapping network.PortMappings, operation network.PortOperation) error {
+	return network.ManageContainerPortMappings(owner, ip, portmapping, operation)
+}
+
+func (o hostVethOperations) exposePublicly(owner network.RuleOwner, exposures network.PublicExposures, ip net.IP, ipv6 net.IP, operation network.PortOperation) error {
+	return network.ManagePublicExposures(owner, exposures, ip, ipv6, operation)
+}
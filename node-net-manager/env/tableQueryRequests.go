@@ -7,16 +7,16 @@ import (
 	"log"
 	"net"
 	"strings"
+	"time"
 )
 
 /*
 Asks the MQTT client for a table query and parses the result
 */
-func tableQueryByIP(ip net.IP, force_optional ...bool) ([]TableEntryCache.TableEntry, error) {
+func (env *Environment) tableQueryByIP(ip net.IP, force_optional ...bool) ([]TableEntryCache.TableEntry, error) {
 	log.Println("[MQTT TABLE QUERY] sip:", ip.String())
-	var mqttTablequery mqttifce.TablequeryMqttInterface = mqttifce.GetTableQueryRequestCacheInstance()
 
-	responseStruct, err := mqttTablequery.TableQueryByIpRequestBlocking(ip.String(), force_optional...)
+	responseStruct, err := env.tableQuery.TableQueryByIpRequestBlocking(ip.String(), force_optional...)
 	if err != nil {
 		return nil, err
 	}
@@ -27,12 +27,11 @@ func tableQueryByIP(ip net.IP, force_optional ...bool) ([]TableEntryCache.TableE
 /*
 Asks the MQTT client for a table query and parses the result
 */
-func tableQueryByJobName(jobname string, force_optional ...bool) ([]TableEntryCache.TableEntry, error) {
+func (env *Environment) tableQueryByJobName(jobname string, force_optional ...bool) ([]TableEntryCache.TableEntry, error) {
 
 	log.Println("[MQTT TABLE QUERY] sname:", jobname)
-	var mqttTablequery mqttifce.TablequeryMqttInterface = mqttifce.GetTableQueryRequestCacheInstance()
 
-	responseStruct, err := mqttTablequery.TableQueryByJobNameRequestBlocking(jobname, force_optional...)
+	responseStruct, err := env.tableQuery.TableQueryByJobNameRequestBlocking(jobname, force_optional...)
 	if err != nil {
 		return nil, err
 	}
@@ -53,7 +52,10 @@ func responseParser(responseStruct mqttifce.TableQueryResponse) ([]TableEntryCac
 		sipList := make([]TableEntryCache.ServiceIP, 0)
 
 		for _, ip := range instance.ServiceIp {
-			sipList = append(sipList, toServiceIP(ip.Type, ip.Address, ip.Address_v6))
+			sip := toServiceIP(ip.Type, ip.Address, ip.Address_v6)
+			sip.Affinity = toAffinityMode(ip.Affinity)
+			sip.AffinityTTL = time.Duration(ip.AffinityTTL) * time.Second
+			sipList = append(sipList, sip)
 		}
 
 		entry := TableEntryCache.TableEntry{
@@ -64,11 +66,16 @@ func responseParser(responseStruct mqttifce.TableQueryResponse) ([]TableEntryCac
 			Servicenamespace: appCompleteName[3],
 			Instancenumber:   instance.InstanceNumber,
 			Cluster:          0,
+			Nodeid:           instance.WorkerID,
 			Nodeip:           net.ParseIP(instance.HostIp),
 			Nodeport:         instance.HostPort,
 			Nsip:             net.ParseIP(instance.NamespaceIp),
 			Nsipv6:           net.ParseIP(instance.NamespaceIpv6),
 			ServiceIP:        sipList,
+			Weight:           instance.Weight,
+		}
+		if instance.LoadHint != nil {
+			entry.LoadHint = *instance.LoadHint
 		}
 
 		result = append(result, entry)
@@ -96,3 +103,13 @@ func toServiceIP(Type string, Addr string, Addr_v6 string) TableEntryCache.Servi
 
 	return ip
 }
+
+func toAffinityMode(mode string) TableEntryCache.AffinityMode {
+	switch mode {
+	case "SourceInstance":
+		return TableEntryCache.AffinitySourceInstance
+	case "SourceIPDestPort":
+		return TableEntryCache.AffinitySourceIPDestPort
+	}
+	return TableEntryCache.AffinityNone
+}
@@ -1,36 +1,73 @@
 package events
 
 import (
-	"errors"
+	"path"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type EventManager interface {
+	// Emit delivers a copy of the event to every subscription matching it, following the back-pressure policy of each subscription
 	Emit(event Event)
-	Register(eventType EventType, eventTarget string) (chan Event, error)
-	DeRegister(eventType EventType, eventTarget string)
+	// Subscribe returns a new subscription to the events matching the filter
+	Subscribe(filter Filter, options SubscriptionOptions) *Subscription
+	// Unsubscribe stops the deliveries and closes the channel of the subscription, it can be called more than once
+	Unsubscribe(subscription *Subscription)
 }
 
-type Events struct {
-	//map of event target to event kind
-	eventTableQueryChannelQueue map[string]chan Event
+// BackPressurePolicy is what Emit does when the buffer of a subscription is full
+type BackPressurePolicy int
+
+const (
+	// DropNewest discards the emitted event, the buffered ones are kept
+	DropNewest BackPressurePolicy = iota
+	// DropOldest discards the oldest buffered event to make room for the emitted one
+	DropOldest
+	// Block makes Emit wait for the subscriber, up to the BlockTimeout of the subscription when set
+	Block
+)
+
+// SUBSCRIPTION_BUFFER is the buffer of the subscriptions not giving their own
+const SUBSCRIPTION_BUFFER = 256
+
+// Filter selects the events of a subscription
+type Filter struct {
+	// Types of the events, all of them when empty
+	Types []EventType
+	// Target of the events, all of them when empty. Matched as a path.Match pattern, e.g. "app.app.*"
+	Target string
 }
 
-type Event struct {
-	EventType    EventType
-	EventTarget  string
-	EventMessage string
+// SubscriptionOptions are the buffer and back-pressure policy of a subscription, the zero value drops the newest events of a SUBSCRIPTION_BUFFER
+type SubscriptionOptions struct {
+	Buffer       int
+	Policy       BackPressurePolicy
+	BlockTimeout time.Duration
 }
 
-type EventType int
+// Subscription receives the events matching its filter on Events, closed by Unsubscribe
+type Subscription struct {
+	Events  <-chan Event
+	events  chan Event
+	types   map[EventType]bool
+	target  string
+	options SubscriptionOptions
+	dropped atomic.Uint64
+	// closed once unsubscribed, wakes up the blocked deliveries
+	done chan struct{}
+	// held for reading by the deliveries, the channel is closed once they are over
+	deliveries sync.RWMutex
+	closed     bool
+}
 
-const (
-	TableQuery EventType = iota
-)
+type Events struct {
+	subscriptions map[*Subscription]bool
+	rwlock        sync.RWMutex
+}
 
 /* ------------- singleton instance ------- */
 var once sync.Once
-var rwlock sync.RWMutex
 var (
 	eventInstance EventManager
 )
@@ -39,52 +76,133 @@ var (
 
 func GetInstance() EventManager {
 	once.Do(func() {
-		eventInstance = &Events{
-			eventTableQueryChannelQueue: make(map[string]chan Event, 0),
-		}
+		eventInstance = NewEventManager()
 	})
 	return eventInstance
 }
 
+// NewEventManager returns an event manager independent of the singleton
+func NewEventManager() *Events {
+	return &Events{subscriptions: make(map[*Subscription]bool)}
+}
+
 func (e *Events) Emit(event Event) {
-	rwlock.RLock()
-	defer rwlock.RUnlock()
-	switch event.EventType {
-	case TableQuery:
-		channel := e.eventTableQueryChannelQueue[event.EventTarget]
-		if channel != nil {
-			//check channel buffer capacity to prevent blocking. If this is false, probably no receiver is active.
-			if len(channel) < cap(channel) {
-				channel <- event
-			}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	// the deliveries can block, they don't hold the lock of the manager
+	e.rwlock.RLock()
+	matching := make([]*Subscription, 0, len(e.subscriptions))
+	for subscription := range e.subscriptions {
+		if subscription.matches(event) {
+			matching = append(matching, subscription)
 		}
 	}
+	e.rwlock.RUnlock()
+	for _, subscription := range matching {
+		subscription.deliver(event)
+	}
 }
 
-func (e *Events) Register(eventType EventType, eventTarget string) (chan Event, error) {
-	rwlock.Lock()
-	defer rwlock.Unlock()
-	switch eventType {
-	case TableQuery:
-		channel := e.eventTableQueryChannelQueue[eventTarget]
-		if channel == nil {
-			channel = make(chan Event, 10)
+func (e *Events) Subscribe(filter Filter, options SubscriptionOptions) *Subscription {
+	if options.Buffer <= 0 {
+		options.Buffer = SUBSCRIPTION_BUFFER
+	}
+	subscription := &Subscription{
+		events:  make(chan Event, options.Buffer),
+		target:  filter.Target,
+		options: options,
+		done:    make(chan struct{}),
+	}
+	subscription.Events = subscription.events
+	if len(filter.Types) > 0 {
+		subscription.types = make(map[EventType]bool, len(filter.Types))
+		for _, eventType := range filter.Types {
+			subscription.types[eventType] = true
 		}
-		e.eventTableQueryChannelQueue[eventTarget] = channel
-		return channel, nil
 	}
-	return nil, errors.New("Invalid EventType")
+	e.rwlock.Lock()
+	defer e.rwlock.Unlock()
+	e.subscriptions[subscription] = true
+	return subscription
 }
 
-func (e *Events) DeRegister(eventType EventType, eventTarget string) {
-	rwlock.Lock()
-	defer rwlock.Unlock()
-	switch eventType {
-	case TableQuery:
-		channel := e.eventTableQueryChannelQueue[eventTarget]
-		if channel != nil {
-			e.eventTableQueryChannelQueue[eventTarget] = nil
-			close(channel)
+func (e *Events) Unsubscribe(subscription *Subscription) {
+	e.rwlock.Lock()
+	_, subscribed := e.subscriptions[subscription]
+	delete(e.subscriptions, subscription)
+	e.rwlock.Unlock()
+	if subscribed {
+		subscription.close()
+	}
+}
+
+// Dropped is the number of events discarded because the subscriber was too slow
+func (s *Subscription) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+func (s *Subscription) matches(event Event) bool {
+	if s.types != nil && !s.types[event.EventType] {
+		return false
+	}
+	if s.target == "" || s.target == event.EventTarget {
+		return true
+	}
+	matched, err := path.Match(s.target, event.EventTarget)
+	return err == nil && matched
+}
+
+func (s *Subscription) deliver(event Event) {
+	s.deliveries.RLock()
+	defer s.deliveries.RUnlock()
+	if s.closed {
+		return
+	}
+	select {
+	case s.events <- event:
+		return
+	default:
+	}
+
+	switch s.options.Policy {
+	case DropOldest:
+		// the subscriber and the concurrent deliveries can take the room first, retry until the event is delivered
+		for {
+			select {
+			case <-s.events:
+				s.dropped.Add(1)
+			default:
+			}
+			select {
+			case s.events <- event:
+				return
+			default:
+			}
 		}
+	case Block:
+		var timeout <-chan time.Time
+		if s.options.BlockTimeout > 0 {
+			timer := time.NewTimer(s.options.BlockTimeout)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		select {
+		case s.events <- event:
+		case <-s.done:
+		case <-timeout:
+			s.dropped.Add(1)
+		}
+	default:
+		s.dropped.Add(1)
 	}
 }
+
+// close waits for the deliveries in progress, the blocked ones give up
+func (s *Subscription) close() {
+	close(s.done)
+	s.deliveries.Lock()
+	defer s.deliveries.Unlock()
+	s.closed = true
+	close(s.events)
+}
@@ -0,0 +1,111 @@
+package events
+
+import (
+	"fmt"
+	"time"
+)
+
+type Event struct {
+	EventType    EventType
+	EventTarget  string
+	EventMessage string
+	// Payload is the typed body of the event, e.g. ServiceEvent for ServiceDeployed
+	Payload interface{}
+	// Time is set by Emit when zero
+	Time time.Time
+}
+
+type EventType int
+
+const (
+	TableQuery EventType = iota
+	ServiceDeployed
+	ServiceUndeployed
+	TableEntryAdded
+	TableEntryRemoved
+	InterestRegistered
+	InterestExpired
+	PeerUnreachable
+	MqttConnectionState
+)
+
+var eventTypeNames = map[EventType]string{
+	TableQuery:          "table-query",
+	ServiceDeployed:     "service-deployed",
+	ServiceUndeployed:   "service-undeployed",
+	TableEntryAdded:     "table-entry-added",
+	TableEntryRemoved:   "table-entry-removed",
+	InterestRegistered:  "interest-registered",
+	InterestExpired:     "interest-expired",
+	PeerUnreachable:     "peer-unreachable",
+	MqttConnectionState: "mqtt-connection-state",
+}
+
+func (t EventType) String() string {
+	if name, ok := eventTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("event-type-%d", int(t))
+}
+
+func (t EventType) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+// EventTypes are all the event types
+func EventTypes() []EventType {
+	eventTypes := make([]EventType, 0, len(eventTypeNames))
+	for eventType := TableQuery; eventType <= MqttConnectionState; eventType++ {
+		eventTypes = append(eventTypes, eventType)
+	}
+	return eventTypes
+}
+
+// ParseEventType is the event type with the given name, e.g. service-deployed
+func ParseEventType(name string) (EventType, error) {
+	for eventType, eventName := range eventTypeNames {
+		if eventName == name {
+			return eventType, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown event type %q", name)
+}
+
+// ServiceEvent is the payload of ServiceDeployed and ServiceUndeployed
+type ServiceEvent struct {
+	ServiceName string `json:"serviceName"`
+	Instance    int    `json:"instanceNumber"`
+	// empty for the instances of the Docker network plugin
+	Runtime   string `json:"runtime,omitempty"`
+	Address   string `json:"nsAddress,omitempty"`
+	Addressv6 string `json:"nsAddressv6,omitempty"`
+}
+
+// TableEntryEvent is the payload of TableEntryAdded and TableEntryRemoved
+type TableEntryEvent struct {
+	JobName  string `json:"jobName"`
+	Instance int    `json:"instanceNumber"`
+	Nsip     string `json:"nsip"`
+	Nsipv6   string `json:"nsipv6,omitempty"`
+	Nodeip   string `json:"nodeip"`
+}
+
+// InterestEvent is the payload of InterestRegistered and InterestExpired
+type InterestEvent struct {
+	// job name, or the ServiceIP looked up
+	Name string `json:"name"`
+}
+
+// PeerEvent is the payload of PeerUnreachable
+type PeerEvent struct {
+	Peer    string `json:"peer"`
+	Address string `json:"address,omitempty"`
+	Reason  string `json:"reason"`
+}
+
+// MqttConnectionEvent is the payload of MqttConnectionState
+type MqttConnectionEvent struct {
+	Connected bool   `json:"connected"`
+	Broker    string `json:"broker"`
+	Error     string `json:"error,omitempty"`
+}
@@ -1,16 +1,19 @@
 package events
 
 import (
+	"fmt"
+	"sync"
 	"testing"
 	"time"
 )
 
 func handlers(done chan bool, job string) {
 	eventManager := GetInstance()
-	eventchannel, _ := eventManager.Register(TableQuery, job)
+	subscription := eventManager.Subscribe(Filter{Types: []EventType{TableQuery}, Target: job}, SubscriptionOptions{})
+	defer eventManager.Unsubscribe(subscription)
 	done <- true
 	select {
-	case _ = <-eventchannel:
+	case _ = <-subscription.Events:
 		done <- true
 	case <-time.After(1 * time.Second):
 		done <- false
@@ -26,12 +29,13 @@ func TestSimpleEventEmit(t *testing.T) {
 	})
 }
 
-func TestSimpleEventRegistration(t *testing.T) {
+func TestSimpleEventSubscription(t *testing.T) {
 	eventManager := GetInstance()
-	_, err := eventManager.Register(TableQuery, "regtest")
-	if err != nil {
-		t.Error("Invalid registration result")
+	subscription := eventManager.Subscribe(Filter{Types: []EventType{TableQuery}, Target: "regtest"}, SubscriptionOptions{})
+	if subscription == nil || subscription.Events == nil {
+		t.Error("Invalid subscription")
 	}
+	eventManager.Unsubscribe(subscription)
 }
 
 func TestRegisterAndEmit(t *testing.T) {
@@ -106,3 +110,226 @@ func TestRegisterMultipleAndEmit(t *testing.T) {
 	}
 
 }
+
+func TestSubscribeFiltersAndCopies(t *testing.T) {
+	eventManager := NewEventManager()
+	deployed := eventManager.Subscribe(Filter{Types: []EventType{ServiceDeployed}}, SubscriptionOptions{})
+	all := eventManager.Subscribe(Filter{}, SubscriptionOptions{})
+	defer eventManager.Unsubscribe(deployed)
+
+	eventManager.Emit(Event{EventType: TableQuery, EventTarget: "app.app.svc.svc"})
+	eventManager.Emit(Event{EventType: PeerUnreachable, Payload: PeerEvent{Peer: "node"}})
+	eventManager.Emit(Event{EventType: ServiceDeployed, Payload: ServiceEvent{ServiceName: "app.app.svc.svc"}})
+
+	event := <-deployed.Events
+	if event.EventType != ServiceDeployed || event.Time.IsZero() {
+		t.Errorf("Unexpected event %v", event)
+	}
+	if len(deployed.Events) != 0 {
+		t.Error("Received an event of another type")
+	}
+	for _, expected := range []EventType{TableQuery, PeerUnreachable, ServiceDeployed} {
+		if event := <-all.Events; event.EventType != expected {
+			t.Errorf("Received %s instead of %s", event.EventType, expected)
+		}
+	}
+
+	eventManager.Unsubscribe(all)
+	eventManager.Unsubscribe(all)
+	if _, open := <-all.Events; open {
+		t.Error("Subscription not closed")
+	}
+	eventManager.Emit(Event{EventType: ServiceDeployed})
+}
+
+func TestFanOut(t *testing.T) {
+	eventManager := NewEventManager()
+	subscriptions := make([]*Subscription, 5)
+	for i := range subscriptions {
+		subscriptions[i] = eventManager.Subscribe(Filter{Types: []EventType{TableQuery}, Target: "job"}, SubscriptionOptions{})
+	}
+	eventManager.Emit(Event{EventType: TableQuery, EventTarget: "job"})
+	for i, subscription := range subscriptions {
+		select {
+		case event := <-subscription.Events:
+			if event.EventTarget != "job" {
+				t.Errorf("Subscriber %d received %v", i, event)
+			}
+		default:
+			t.Errorf("Subscriber %d did not receive its copy", i)
+		}
+		eventManager.Unsubscribe(subscription)
+	}
+}
+
+func TestWildcardTarget(t *testing.T) {
+	eventManager := NewEventManager()
+	subscription := eventManager.Subscribe(Filter{Target: "app.app.*"}, SubscriptionOptions{})
+	defer eventManager.Unsubscribe(subscription)
+
+	for _, target := range []string{"app.app.svc.svc", "other.app.svc.svc", "", "app.app.db.db"} {
+		eventManager.Emit(Event{EventType: ServiceDeployed, EventTarget: target})
+	}
+	for _, expected := range []string{"app.app.svc.svc", "app.app.db.db"} {
+		if event := <-subscription.Events; event.EventTarget != expected {
+			t.Errorf("Received %s instead of %s", event.EventTarget, expected)
+		}
+	}
+	if len(subscription.Events) != 0 {
+		t.Error("Received an event of another target")
+	}
+}
+
+func TestDropNewest(t *testing.T) {
+	eventManager := NewEventManager()
+	subscription := eventManager.Subscribe(Filter{}, SubscriptionOptions{Buffer: 2, Policy: DropNewest})
+	defer eventManager.Unsubscribe(subscription)
+
+	for i := 0; i < 5; i++ {
+		eventManager.Emit(Event{EventType: TableQuery, EventMessage: fmt.Sprint(i)})
+	}
+	if subscription.Dropped() != 3 {
+		t.Errorf("Dropped %d events instead of 3", subscription.Dropped())
+	}
+	for _, expected := range []string{"0", "1"} {
+		if event := <-subscription.Events; event.EventMessage != expected {
+			t.Errorf("Received %s instead of %s", event.EventMessage, expected)
+		}
+	}
+}
+
+func TestDropOldest(t *testing.T) {
+	eventManager := NewEventManager()
+	subscription := eventManager.Subscribe(Filter{}, SubscriptionOptions{Buffer: 2, Policy: DropOldest})
+	defer eventManager.Unsubscribe(subscription)
+
+	for i := 0; i < 5; i++ {
+		eventManager.Emit(Event{EventType: TableQuery, EventMessage: fmt.Sprint(i)})
+	}
+	if subscription.Dropped() != 3 {
+		t.Errorf("Dropped %d events instead of 3", subscription.Dropped())
+	}
+	for _, expected := range []string{"3", "4"} {
+		if event := <-subscription.Events; event.EventMessage != expected {
+			t.Errorf("Received %s instead of %s", event.EventMessage, expected)
+		}
+	}
+}
+
+func TestBlockDeliversEverything(t *testing.T) {
+	eventManager := NewEventManager()
+	subscription := eventManager.Subscribe(Filter{}, SubscriptionOptions{Buffer: 1, Policy: Block})
+	const count = 100
+
+	go func() {
+		for i := 0; i < count; i++ {
+			eventManager.Emit(Event{EventType: TableQuery, EventMessage: fmt.Sprint(i)})
+		}
+		eventManager.Unsubscribe(subscription)
+	}()
+	received := 0
+	for event := range subscription.Events {
+		if event.EventMessage != fmt.Sprint(received) {
+			t.Errorf("Received %s instead of %d", event.EventMessage, received)
+		}
+		received++
+	}
+	if received != count || subscription.Dropped() != 0 {
+		t.Errorf("Received %d events, dropped %d", received, subscription.Dropped())
+	}
+}
+
+func TestBlockTimeout(t *testing.T) {
+	eventManager := NewEventManager()
+	subscription := eventManager.Subscribe(Filter{}, SubscriptionOptions{Buffer: 1, Policy: Block, BlockTimeout: 10 * time.Millisecond})
+	defer eventManager.Unsubscribe(subscription)
+
+	eventManager.Emit(Event{EventType: TableQuery})
+	start := time.Now()
+	eventManager.Emit(Event{EventType: TableQuery})
+	if time.Since(start) < 10*time.Millisecond {
+		t.Error("Emit did not wait for the subscriber")
+	}
+	if subscription.Dropped() != 1 {
+		t.Errorf("Dropped %d events instead of 1", subscription.Dropped())
+	}
+}
+
+func TestUnsubscribeReleasesBlockedEmit(t *testing.T) {
+	eventManager := NewEventManager()
+	subscription := eventManager.Subscribe(Filter{}, SubscriptionOptions{Buffer: 1, Policy: Block})
+	eventManager.Emit(Event{EventType: TableQuery})
+
+	emitted := make(chan bool)
+	go func() {
+		eventManager.Emit(Event{EventType: TableQuery})
+		emitted <- true
+	}()
+	time.Sleep(10 * time.Millisecond)
+	eventManager.Unsubscribe(subscription)
+	select {
+	case <-emitted:
+	case <-time.After(time.Second):
+		t.Fatal("Emit still blocked after Unsubscribe")
+	}
+}
+
+func TestConcurrentEmitAndSubscribe(t *testing.T) {
+	eventManager := NewEventManager()
+	policies := []BackPressurePolicy{DropNewest, DropOldest, Block}
+	stop := make(chan struct{})
+	var emitters sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		emitters.Add(1)
+		go func(i int) {
+			defer emitters.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					eventManager.Emit(Event{EventType: TableQuery, EventTarget: fmt.Sprintf("job%d", i%2)})
+				}
+			}
+		}(i)
+	}
+
+	var subscribers sync.WaitGroup
+	for i := 0; i < 30; i++ {
+		subscribers.Add(1)
+		go func(i int) {
+			defer subscribers.Done()
+			subscription := eventManager.Subscribe(
+				Filter{Target: "job*"},
+				SubscriptionOptions{Buffer: 2, Policy: policies[i%len(policies)], BlockTimeout: time.Millisecond},
+			)
+			for received := 0; received < 10; received++ {
+				<-subscription.Events
+			}
+			// left unread on purpose, the blocked deliveries give up
+			eventManager.Unsubscribe(subscription)
+			eventManager.Unsubscribe(subscription)
+		}(i)
+	}
+	subscribers.Wait()
+	close(stop)
+	emitters.Wait()
+
+	eventManager.rwlock.RLock()
+	defer eventManager.rwlock.RUnlock()
+	if len(eventManager.subscriptions) != 0 {
+		t.Errorf("%d subscriptions left", len(eventManager.subscriptions))
+	}
+}
+
+func TestParseEventType(t *testing.T) {
+	for eventType, name := range eventTypeNames {
+		parsed, err := ParseEventType(name)
+		if err != nil || parsed != eventType || eventType.String() != name {
+			t.Errorf("%s parsed as %v, %v", name, parsed, err)
+		}
+	}
+	if _, err := ParseEventType("unknown"); err == nil {
+		t.Error("Unknown event type parsed")
+	}
+}
@@ -42,14 +42,31 @@ func (m *ContainerManager) Register(Env *env.Environment, WorkerID *string, Node
 /*
 Endpoint: /container/deploy
 Usage: used to assign a network to a generic container. This method can be used only after the registration
-Method: POST
+Method: POST, ?async=true answers at once with the task of the deployment, see /tasks/{id}
 Request Json:
 
 	{
 		pid:string #pid of container's task
+		netns:string #network namespace path, alternative to the pid
+		ifname:string #name of the interface inside the container, optional
 		appName:string
 		instanceNumber:int
-		portMapppings: map[int]int (host port, container port)
+		timeout:int # optional, deadline in seconds of the deployment, rolled back when exceeded
+		portMappings: [{ # or the legacy string "host:container/protocol;..."
+			hostIP:string # optional, all the node addresses by default
+			hostPort:int
+			hostPortEnd:int # optional, last port of a host port range
+			containerPort:int # optional, the host port by default
+			protocols:[string] # tcp, udp or both, tcp by default
+			family:string # optional, ipv4 or ipv6 only
+		}]
+		publicExposures: [{ # optional, nodes with PublicIPNetworking only
+			mode:string # address: the public address is assigned to the node and mapped to the instance, node: ports of the node public address
+			address:string # public IPv4 or IPv6 address, address mode only
+			prefixLength:int # optional, of the address assigned to the interface
+			interface:string # optional, the interface of the default route by default
+			ports:[portMapping] # exposed ports, all of them in the address mode when empty
+		}]
 	}
 
 Response Json:
@@ -57,6 +74,9 @@ Response Json:
 	{
 		serviceName:    string
 		nsAddress:  	string # address assigned to this container
+		nsAddressv6:  	string # ipv6 address assigned to this container
+		gateway:  	string # bridge address with the node subnet prefix, e.g. 10.19.1.1/26
+		gatewayv6:  	string
 	}
 */
 func (m *ContainerManager) containerDeploy(writer http.ResponseWriter, request *http.Request) {
@@ -68,18 +88,27 @@ func (m *ContainerManager) containerDeploy(writer http.ResponseWriter, request *
 		return
 	}
 
-	reqBody, _ := io.ReadAll(request.Body)
+	reqBody, err := io.ReadAll(request.Body)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
 	log.Println("ReqBody received :", reqBody)
 	var deployTask ContainerDeployTask
-	err := json.Unmarshal(reqBody, &deployTask)
+	err = json.Unmarshal(reqBody, &deployTask)
 	if err != nil {
-		writer.WriteHeader(http.StatusBadRequest)
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
 	}
 	deployTask.Runtime = env.CONTAINER_RUNTIME
 	deployTask.PublicAddr = m.Configuration.NodePublicAddress
 	deployTask.PublicPort = m.Configuration.NodePublicPort
 	deployTask.Env = m.Env
 	deployTask.Writer = &writer
+	if asyncRequested(request) {
+		acceptDeployTask(writer, &deployTask, "/tasks/")
+		return
+	}
 	deployTask.Finish = make(chan TaskReady)
 
 	logger.DebugLogger().Println(deployTask)
@@ -87,16 +116,12 @@ func (m *ContainerManager) containerDeploy(writer http.ResponseWriter, request *
 
 	result := <-deployTask.Finish
 	if result.Err != nil {
-		writer.WriteHeader(http.StatusInternalServerError)
+		http.Error(writer, result.Err.Error(), deployErrorStatus(result.Err))
 		return
 	}
 
 	//if deploy succesfull -> answer the caller
-	response := DeployResponse{
-		ServiceName: deployTask.ServiceName,
-		NsAddress:   result.IP.String(),
-		NsAddressv6: result.IPv6.String(),
-	}
+	response := deployResponse(&deployTask, result)
 
 	logger.InfoLogger().Println("Response to /container/deploy: ", response)
 
@@ -118,7 +143,7 @@ Request Json:
 		instance:int
 	}
 
-Response: 200 OK or Failure code
+Response: 200 OK, 404 if the instance is not deployed, e.g. already undeployed, or Failure code
 */
 func (m *ContainerManager) containerUndeploy(writer http.ResponseWriter, request *http.Request) {
 	log.Println("Received HTTP request - /container/undeploy ")
@@ -129,16 +154,24 @@ func (m *ContainerManager) containerUndeploy(writer http.ResponseWriter, request
 		return
 	}
 
-	reqBody, _ := io.ReadAll(request.Body)
+	reqBody, err := io.ReadAll(request.Body)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
 	var requestStruct undeployRequest
-	err := json.Unmarshal(reqBody, &requestStruct)
+	err = json.Unmarshal(reqBody, &requestStruct)
 	if err != nil {
 		writer.WriteHeader(http.StatusBadRequest)
+		return
 	}
 
 	log.Println(requestStruct)
 
-	m.Env.DetachContainer(requestStruct.Servicename, requestStruct.Instancenumber)
+	if !undeployInstance(m.Env, env.CONTAINER_RUNTIME, requestStruct.Servicename, requestStruct.Instancenumber) {
+		// nothing left to remove, e.g. a repeated undeploy. The /v1 undeploy stays idempotent, /v2 answers 404
+		logger.InfoLogger().Printf("%s.%d is not deployed", requestStruct.Servicename, requestStruct.Instancenumber)
+	}
 
 	writer.WriteHeader(http.StatusOK)
 }
@@ -0,0 +1,467 @@
+package handlers
+
+import (
+	"NetManager/env"
+	"NetManager/logger"
+	"NetManager/model"
+	"NetManager/mqtt"
+	"NetManager/network"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	DOCKER_PLUGIN_RUNTIME = "docker-plugin"
+	// DOCKER_PLUGIN_SOCKET is discovered by Docker as the plugin named env.DOCKER_DRIVER_NAME
+	DOCKER_PLUGIN_SOCKET = "/run/docker/plugins/" + env.DOCKER_DRIVER_NAME + ".sock"
+	dockerPluginMimeType = "application/vnd.docker.plugins.v1.2+json"
+)
+
+// Driver options identifying the service instance of the container, e.g.
+// docker run --network name=oakestra,driver-opt=oakestra.serviceName=app.app.svc.svc,driver-opt=oakestra.instanceNumber=0
+const (
+	DOCKER_OPTION_SERVICE_NAME  = "oakestra.serviceName"
+	DOCKER_OPTION_INSTANCE      = "oakestra.instanceNumber"
+	DOCKER_OPTION_PORT_MAPPINGS = "oakestra.portMappings"
+	dockerGenericOptions        = "com.docker.network.generic"
+	dockerPortMapOption         = "com.docker.network.portmap"
+	dockerGatewayRequest        = "com.docker.network.gateway"
+	dockerRequestAddressType    = "RequestAddressType"
+	dockerPoolIDv4              = "oakestra-v4"
+	dockerPoolIDv6              = "oakestra-v6"
+)
+
+// DockerNetworkBackend attaches the containers to the node network, implemented by env.Environment
+type DockerNetworkBackend interface {
+	BridgeAddress(v6 bool) *net.IPNet
+	RequestDockerAddress(v6 bool) (net.IP, error)
+	ReleaseDockerAddress(ip net.IP)
+	CreateDockerEndpoint(endpointID string, ip net.IP, ipv6 net.IP) error
+	JoinDockerEndpoint(endpointID string, request env.DeploymentRequest) (string, error)
+	LeaveDockerEndpoint(endpointID string) error
+	DeleteDockerEndpoint(endpointID string) error
+}
+
+// DockerPluginManager serves the libnetwork remote network driver and IPAM driver API,
+// so that `docker run --network oakestra` attaches the containers like /container/deploy does.
+type DockerPluginManager struct {
+	Env           *env.Environment
+	WorkerID      *string
+	Configuration netConfiguration
+	backend       DockerNetworkBackend
+	// notifies the cluster about the deployed instance
+	deployed  func(request env.DeploymentRequest, ip net.IP, ipv6 net.IP) error
+	endpoints map[string]*dockerPluginEndpoint
+	lock      sync.Mutex
+}
+
+type dockerPluginEndpoint struct {
+	request env.DeploymentRequest
+	ip      net.IP
+	ipv6    net.IP
+}
+
+var dockerPluginManager *DockerPluginManager
+
+func init() {
+	AvailableRuntimes[DOCKER_PLUGIN_RUNTIME] = GetDockerPluginManager
+	dockerPluginManager = &DockerPluginManager{}
+}
+
+func GetDockerPluginManager() ManagerInterface {
+	return dockerPluginManager
+}
+
+func (m *DockerPluginManager) Register(Env *env.Environment, WorkerID *string, NodePublicAddress string, NodePublicPort string, Router *mux.Router) {
+	m.Env = Env
+	m.WorkerID = WorkerID
+	m.Configuration = netConfiguration{NodePublicAddress: NodePublicAddress, NodePublicPort: NodePublicPort}
+	m.backend = Env
+	m.deployed = m.notifyDeployment
+	m.endpoints = make(map[string]*dockerPluginEndpoint)
+
+	if !model.NetConfig.DockerNetworkPlugin {
+		return
+	}
+	go func() {
+		if err := m.serve(DOCKER_PLUGIN_SOCKET); err != nil {
+			logger.ErrorLogger().Println("Docker network plugin stopped:", err)
+		}
+	}()
+}
+
+func (m *DockerPluginManager) serve(socket string) error {
+	_ = os.MkdirAll(filepath.Dir(socket), 0755)
+	_ = os.Remove(socket)
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		return err
+	}
+	logger.InfoLogger().Println("Serving the Docker network plugin on ", socket)
+	router := mux.NewRouter()
+	m.RegisterPluginRoutes(router)
+	return http.Serve(listener, router)
+}
+
+// RegisterPluginRoutes adds the plugin API to the router
+func (m *DockerPluginManager) RegisterPluginRoutes(router *mux.Router) {
+	routes := map[string]func(*http.Request) (interface{}, error){
+		"/Plugin.Activate":                           m.activate,
+		"/NetworkDriver.GetCapabilities":             m.networkCapabilities,
+		"/NetworkDriver.CreateNetwork":               m.empty,
+		"/NetworkDriver.DeleteNetwork":               m.empty,
+		"/NetworkDriver.CreateEndpoint":              m.createEndpoint,
+		"/NetworkDriver.EndpointOperInfo":            m.endpointInfo,
+		"/NetworkDriver.DeleteEndpoint":              m.deleteEndpoint,
+		"/NetworkDriver.Join":                        m.join,
+		"/NetworkDriver.Leave":                       m.leave,
+		"/NetworkDriver.DiscoverNew":                 m.empty,
+		"/NetworkDriver.DiscoverDelete":              m.empty,
+		"/NetworkDriver.ProgramExternalConnectivity": m.empty,
+		"/NetworkDriver.RevokeExternalConnectivity":  m.empty,
+		"/IpamDriver.GetCapabilities":                m.ipamCapabilities,
+		"/IpamDriver.GetDefaultAddressSpaces":        m.addressSpaces,
+		"/IpamDriver.RequestPool":                    m.requestPool,
+		"/IpamDriver.ReleasePool":                    m.empty,
+		"/IpamDriver.RequestAddress":                 m.requestAddress,
+		"/IpamDriver.ReleaseAddress":                 m.releaseAddress,
+	}
+	for path, handler := range routes {
+		router.HandleFunc(path, pluginHandler(path, handler)).Methods("POST")
+	}
+}
+
+// pluginHandler encodes the result of the handler, errors are reported in the Err field
+func pluginHandler(path string, handler func(*http.Request) (interface{}, error)) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		logger.DebugLogger().Println("Received Docker plugin request - ", path)
+		result, err := handler(request)
+		writer.Header().Set("Content-Type", dockerPluginMimeType)
+		if err != nil {
+			logger.ErrorLogger().Printf("Docker plugin request %s failed: %v", path, err)
+			writer.WriteHeader(http.StatusInternalServerError)
+			result = map[string]string{"Err": err.Error()}
+		}
+		_ = json.NewEncoder(writer).Encode(result)
+	}
+}
+
+func decodePluginRequest(request *http.Request, v interface{}) error {
+	if err := json.NewDecoder(request.Body).Decode(v); err != nil {
+		return fmt.Errorf("invalid request: %v", err)
+	}
+	return nil
+}
+
+func (m *DockerPluginManager) initialized() error {
+	if m.WorkerID == nil || *m.WorkerID == "" {
+		return errors.New("node not initialized")
+	}
+	return nil
+}
+
+func (m *DockerPluginManager) activate(*http.Request) (interface{}, error) {
+	return map[string][]string{"Implements": {"NetworkDriver", "IpamDriver"}}, nil
+}
+
+func (m *DockerPluginManager) empty(*http.Request) (interface{}, error) {
+	return struct{}{}, nil
+}
+
+func (m *DockerPluginManager) networkCapabilities(*http.Request) (interface{}, error) {
+	return map[string]string{"Scope": "local", "ConnectivityScope": "local"}, nil
+}
+
+func (m *DockerPluginManager) ipamCapabilities(*http.Request) (interface{}, error) {
+	return map[string]bool{"RequiresMACAddress": false}, nil
+}
+
+func (m *DockerPluginManager) addressSpaces(*http.Request) (interface{}, error) {
+	return map[string]string{
+		"LocalDefaultAddressSpace":  env.DOCKER_DRIVER_NAME,
+		"GlobalDefaultAddressSpace": env.DOCKER_DRIVER_NAME,
+	}, nil
+}
+
+// requestPool returns the node subnet, the only pool available
+func (m *DockerPluginManager) requestPool(request *http.Request) (interface{}, error) {
+	var req struct {
+		Pool string
+		V6   bool
+	}
+	if err := decodePluginRequest(request, &req); err != nil {
+		return nil, err
+	}
+	if err := m.initialized(); err != nil {
+		return nil, err
+	}
+	gateway := m.backend.BridgeAddress(req.V6)
+	if gateway == nil {
+		return nil, errors.New("node subnet not available")
+	}
+	pool := &net.IPNet{IP: gateway.IP.Mask(gateway.Mask), Mask: gateway.Mask}
+	if req.Pool != "" && req.Pool != pool.String() {
+		return nil, fmt.Errorf("pool %s not available, the node subnet is %s", req.Pool, pool)
+	}
+	poolID := dockerPoolIDv4
+	if req.V6 {
+		poolID = dockerPoolIDv6
+	}
+	return map[string]interface{}{
+		"PoolID": poolID,
+		"Pool":   pool.String(),
+		"Data":   map[string]string{},
+	}, nil
+}
+
+func (m *DockerPluginManager) requestAddress(request *http.Request) (interface{}, error) {
+	var req struct {
+		PoolID  string
+		Address string
+		Options map[string]string
+	}
+	if err := decodePluginRequest(request, &req); err != nil {
+		return nil, err
+	}
+	if err := m.initialized(); err != nil {
+		return nil, err
+	}
+	v6 := req.PoolID == dockerPoolIDv6
+	gateway := m.backend.BridgeAddress(v6)
+	if gateway == nil {
+		return nil, errors.New("node subnet not available")
+	}
+	if req.Options[dockerRequestAddressType] == dockerGatewayRequest || (req.Address != "" && net.ParseIP(req.Address).Equal(gateway.IP)) {
+		// the bridge is the gateway of the containers
+		return map[string]interface{}{"Address": gateway.String(), "Data": map[string]string{}}, nil
+	}
+	if req.Address != "" {
+		return nil, errors.New("static container addresses are not supported")
+	}
+	ip, err := m.backend.RequestDockerAddress(v6)
+	if err != nil {
+		return nil, err
+	}
+	address := &net.IPNet{IP: ip, Mask: gateway.Mask}
+	return map[string]interface{}{"Address": address.String(), "Data": map[string]string{}}, nil
+}
+
+func (m *DockerPluginManager) releaseAddress(request *http.Request) (interface{}, error) {
+	var req struct {
+		PoolID  string
+		Address string
+	}
+	if err := decodePluginRequest(request, &req); err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(req.Address)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid address %s", req.Address)
+	}
+	if gateway := m.backend.BridgeAddress(req.PoolID == dockerPoolIDv6); gateway != nil && gateway.IP.Equal(ip) {
+		return struct{}{}, nil
+	}
+	m.backend.ReleaseDockerAddress(ip)
+	return struct{}{}, nil
+}
+
+func (m *DockerPluginManager) createEndpoint(request *http.Request) (interface{}, error) {
+	var req struct {
+		EndpointID string
+		Interface  struct {
+			Address     string
+			AddressIPv6 string
+		}
+		Options map[string]interface{}
+	}
+	if err := decodePluginRequest(request, &req); err != nil {
+		return nil, err
+	}
+	if err := m.initialized(); err != nil {
+		return nil, err
+	}
+	deployment, err := dockerDeploymentRequest(req.Options)
+	if err != nil {
+		return nil, err
+	}
+	ip, _, err := net.ParseCIDR(req.Interface.Address)
+	if err != nil {
+		return nil, fmt.Errorf("the endpoint needs an address from the %s IPAM driver", env.DOCKER_DRIVER_NAME)
+	}
+	var ipv6 net.IP
+	if req.Interface.AddressIPv6 != "" {
+		if ipv6, _, err = net.ParseCIDR(req.Interface.AddressIPv6); err != nil {
+			return nil, err
+		}
+	}
+	if err := m.backend.CreateDockerEndpoint(req.EndpointID, ip, ipv6); err != nil {
+		return nil, err
+	}
+	m.lock.Lock()
+	m.endpoints[req.EndpointID] = &dockerPluginEndpoint{request: deployment, ip: ip, ipv6: ipv6}
+	m.lock.Unlock()
+	// the addresses were assigned by the IPAM driver, nothing to add to the interface
+	return map[string]interface{}{}, nil
+}
+
+func (m *DockerPluginManager) endpointInfo(*http.Request) (interface{}, error) {
+	return map[string]interface{}{"Value": map[string]string{}}, nil
+}
+
+func (m *DockerPluginManager) deleteEndpoint(request *http.Request) (interface{}, error) {
+	var req struct {
+		EndpointID string
+	}
+	if err := decodePluginRequest(request, &req); err != nil {
+		return nil, err
+	}
+	m.lock.Lock()
+	delete(m.endpoints, req.EndpointID)
+	m.lock.Unlock()
+	return struct{}{}, m.backend.DeleteDockerEndpoint(req.EndpointID)
+}
+
+func (m *DockerPluginManager) join(request *http.Request) (interface{}, error) {
+	var req struct {
+		EndpointID string
+	}
+	if err := decodePluginRequest(request, &req); err != nil {
+		return nil, err
+	}
+	m.lock.Lock()
+	endpoint, exist := m.endpoints[req.EndpointID]
+	m.lock.Unlock()
+	if !exist {
+		return nil, fmt.Errorf("unknown endpoint %s", req.EndpointID)
+	}
+	ifname, err := m.backend.JoinDockerEndpoint(req.EndpointID, endpoint.request)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.deployed(endpoint.request, endpoint.ip, endpoint.ipv6); err != nil {
+		_ = m.backend.LeaveDockerEndpoint(req.EndpointID)
+		return nil, err
+	}
+	response := map[string]interface{}{
+		"InterfaceName": map[string]string{"SrcName": ifname, "DstPrefix": "eth"},
+		"Gateway":       m.backend.BridgeAddress(false).IP.String(),
+	}
+	if endpoint.ipv6 != nil {
+		response["GatewayIPv6"] = m.backend.BridgeAddress(true).IP.String()
+	}
+	return response, nil
+}
+
+func (m *DockerPluginManager) leave(request *http.Request) (interface{}, error) {
+	var req struct {
+		EndpointID string
+	}
+	if err := decodePluginRequest(request, &req); err != nil {
+		return nil, err
+	}
+	return struct{}{}, m.backend.LeaveDockerEndpoint(req.EndpointID)
+}
+
+// dockerDeploymentRequest reads the service instance from the driver options of the endpoint
+func dockerDeploymentRequest(options map[string]interface{}) (env.DeploymentRequest, error) {
+	values := make(map[string]string)
+	collect := func(options map[string]interface{}) {
+		for key, value := range options {
+			if str, ok := value.(string); ok {
+				values[key] = str
+			}
+		}
+	}
+	collect(options)
+	if generic, ok := options[dockerGenericOptions].(map[string]interface{}); ok {
+		collect(generic)
+	}
+
+	request := env.DeploymentRequest{
+		ServiceName: values[DOCKER_OPTION_SERVICE_NAME],
+	}
+	if len(strings.Split(request.ServiceName, ".")) != 4 {
+		return request, fmt.Errorf("invalid or missing %s driver option: %s", DOCKER_OPTION_SERVICE_NAME, request.ServiceName)
+	}
+	instance, err := strconv.Atoi(values[DOCKER_OPTION_INSTANCE])
+	if err != nil {
+		return request, fmt.Errorf("invalid or missing %s driver option", DOCKER_OPTION_INSTANCE)
+	}
+	request.Instancenumber = instance
+	request.PortMappings, err = network.ParsePortMappings(values[DOCKER_OPTION_PORT_MAPPINGS])
+	if err != nil {
+		return request, fmt.Errorf("invalid %s driver option: %v", DOCKER_OPTION_PORT_MAPPINGS, err)
+	}
+	if len(request.PortMappings) == 0 {
+		request.PortMappings = dockerPortMappings(options[dockerPortMapOption])
+	}
+	return request, nil
+}
+
+// dockerPortMappings converts the ports published with docker run -p to the NetManager port mappings
+func dockerPortMappings(portmap interface{}) network.PortMappings {
+	bindings, ok := portmap.([]interface{})
+	if !ok {
+		return nil
+	}
+	mappings := make(network.PortMappings, 0, len(bindings))
+	for _, binding := range bindings {
+		fields, ok := binding.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		port, _ := fields["Port"].(float64)
+		hostPort, _ := fields["HostPort"].(float64)
+		proto, _ := fields["Proto"].(float64)
+		hostIP, _ := fields["HostIP"].(string)
+		if port == 0 || hostPort == 0 {
+			continue
+		}
+		protocol := "tcp"
+		if proto == 17 {
+			protocol = "udp"
+		}
+		mapping := network.PortMapping{HostPort: int(hostPort), ContainerPort: int(port), Protocols: []string{protocol}}
+		if ip := net.ParseIP(hostIP); ip != nil && !ip.IsUnspecified() {
+			mapping.HostIP = ip.String()
+		}
+		mappings = append(mappings, mapping)
+	}
+	return mappings
+}
+
+// notifyDeployment notifies the cluster and refreshes the proxy tables, like the deploy task queue
+func (m *DockerPluginManager) notifyDeployment(request env.DeploymentRequest, ip net.IP, ipv6 net.IP) error {
+	nsipv6 := ""
+	if ipv6 != nil {
+		nsipv6 = ipv6.String()
+	}
+	err := mqtt.NotifyDeploymentStatus(
+		request.ServiceName,
+		"DEPLOYED",
+		request.Instancenumber,
+		ip.String(),
+		nsipv6,
+		model.GetNodePublicAddress(),
+		model.NetConfig.NodePublicPort,
+	)
+	if err != nil {
+		return err
+	}
+	go updateInternalProxyDataStructures(&ContainerDeployTask{
+		ServiceName:    request.ServiceName,
+		Instancenumber: request.Instancenumber,
+		Env:            m.Env,
+	})
+	return nil
+}
@@ -0,0 +1,198 @@
+package handlers
+
+import (
+	"NetManager/env"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"gotest.tools/assert"
+)
+
+// fakeDockerBackend records the endpoints instead of configuring the host
+type fakeDockerBackend struct {
+	next      int
+	released  []string
+	endpoints map[string]string
+	joined    map[string]env.DeploymentRequest
+}
+
+func (b *fakeDockerBackend) BridgeAddress(v6 bool) *net.IPNet {
+	if v6 {
+		return &net.IPNet{IP: net.ParseIP("fc00::1"), Mask: net.CIDRMask(120, 128)}
+	}
+	return &net.IPNet{IP: net.ParseIP("10.19.1.1").To4(), Mask: net.CIDRMask(26, 32)}
+}
+
+func (b *fakeDockerBackend) RequestDockerAddress(v6 bool) (net.IP, error) {
+	b.next++
+	if v6 {
+		return nil, errors.New("IPv6 not enabled")
+	}
+	return net.IPv4(10, 19, 1, byte(1+b.next)).To4(), nil
+}
+
+func (b *fakeDockerBackend) ReleaseDockerAddress(ip net.IP) {
+	b.released = append(b.released, ip.String())
+}
+
+func (b *fakeDockerBackend) CreateDockerEndpoint(endpointID string, ip net.IP, ipv6 net.IP) error {
+	b.endpoints[endpointID] = ip.String()
+	return nil
+}
+
+func (b *fakeDockerBackend) JoinDockerEndpoint(endpointID string, request env.DeploymentRequest) (string, error) {
+	b.joined[endpointID] = request
+	return "veth01" + endpointID, nil
+}
+
+func (b *fakeDockerBackend) LeaveDockerEndpoint(endpointID string) error {
+	delete(b.joined, endpointID)
+	return nil
+}
+
+func (b *fakeDockerBackend) DeleteDockerEndpoint(endpointID string) error {
+	delete(b.endpoints, endpointID)
+	return nil
+}
+
+// fakeLibnetwork is the client side of the plugin API, as used by the Docker daemon
+type fakeLibnetwork struct {
+	t      *testing.T
+	server *httptest.Server
+}
+
+func (c *fakeLibnetwork) call(method string, request interface{}, response interface{}) (int, string) {
+	payload, _ := json.Marshal(request)
+	resp, err := http.Post(c.server.URL+"/"+method, dockerPluginMimeType, bytes.NewReader(payload))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body := map[string]interface{}{}
+	raw := new(bytes.Buffer)
+	_, _ = raw.ReadFrom(resp.Body)
+	_ = json.Unmarshal(raw.Bytes(), &body)
+	if response != nil {
+		_ = json.Unmarshal(raw.Bytes(), response)
+	}
+	errMsg, _ := body["Err"].(string)
+	return resp.StatusCode, errMsg
+}
+
+func newTestDockerPlugin(t *testing.T, workerID string) (*fakeLibnetwork, *fakeDockerBackend, *[]env.DeploymentRequest) {
+	backend := &fakeDockerBackend{
+		endpoints: make(map[string]string),
+		joined:    make(map[string]env.DeploymentRequest),
+	}
+	notified := make([]env.DeploymentRequest, 0)
+	manager := &DockerPluginManager{
+		WorkerID: &workerID,
+		backend:  backend,
+		deployed: func(request env.DeploymentRequest, ip net.IP, ipv6 net.IP) error {
+			notified = append(notified, request)
+			return nil
+		},
+		endpoints: make(map[string]*dockerPluginEndpoint),
+	}
+	router := mux.NewRouter()
+	manager.RegisterPluginRoutes(router)
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+	return &fakeLibnetwork{t: t, server: server}, backend, &notified
+}
+
+func TestDockerPluginAttach(t *testing.T) {
+	client, backend, notified := newTestDockerPlugin(t, "worker")
+
+	activate := struct{ Implements []string }{}
+	status, _ := client.call("Plugin.Activate", nil, &activate)
+	assert.Equal(t, status, http.StatusOK)
+	assert.DeepEqual(t, activate.Implements, []string{"NetworkDriver", "IpamDriver"})
+
+	pool := struct{ PoolID, Pool string }{}
+	status, errMsg := client.call("IpamDriver.RequestPool", map[string]interface{}{"AddressSpace": "oakestra"}, &pool)
+	assert.Equal(t, status, http.StatusOK, errMsg)
+	assert.Equal(t, pool.Pool, "10.19.1.0/26")
+
+	address := struct{ Address string }{}
+	client.call("IpamDriver.RequestAddress", map[string]interface{}{
+		"PoolID":  pool.PoolID,
+		"Options": map[string]string{"RequestAddressType": "com.docker.network.gateway"},
+	}, &address)
+	assert.Equal(t, address.Address, "10.19.1.1/26")
+
+	client.call("IpamDriver.RequestAddress", map[string]interface{}{"PoolID": pool.PoolID}, &address)
+	assert.Equal(t, address.Address, "10.19.1.2/26")
+
+	status, _ = client.call("NetworkDriver.CreateNetwork", map[string]interface{}{"NetworkID": "net"}, nil)
+	assert.Equal(t, status, http.StatusOK)
+
+	status, errMsg = client.call("NetworkDriver.CreateEndpoint", map[string]interface{}{
+		"NetworkID":  "net",
+		"EndpointID": "ep1",
+		"Interface":  map[string]string{"Address": address.Address},
+		"Options": map[string]interface{}{
+			"oakestra.serviceName":       "app.app.svc.svc",
+			"oakestra.instanceNumber":    "2",
+			"com.docker.network.portmap": []map[string]int{{"Proto": 17, "Port": 53, "HostPort": 5353}},
+		},
+	}, nil)
+	assert.Equal(t, status, http.StatusOK, errMsg)
+	assert.Equal(t, backend.endpoints["ep1"], "10.19.1.2")
+
+	join := struct {
+		InterfaceName struct{ SrcName, DstPrefix string }
+		Gateway       string
+		GatewayIPv6   string
+	}{}
+	status, errMsg = client.call("NetworkDriver.Join", map[string]interface{}{"NetworkID": "net", "EndpointID": "ep1", "SandboxKey": "/var/run/docker/netns/x"}, &join)
+	assert.Equal(t, status, http.StatusOK, errMsg)
+	assert.Equal(t, join.InterfaceName.SrcName, "veth01ep1")
+	assert.Equal(t, join.InterfaceName.DstPrefix, "eth")
+	assert.Equal(t, join.Gateway, "10.19.1.1")
+	assert.Equal(t, join.GatewayIPv6, "")
+	assert.Equal(t, backend.joined["ep1"].ServiceName, "app.app.svc.svc")
+	assert.Equal(t, backend.joined["ep1"].Instancenumber, 2)
+	assert.Equal(t, backend.joined["ep1"].PortMappings.String(), "5353:53/udp")
+	assert.Equal(t, len(*notified), 1)
+
+	client.call("NetworkDriver.Leave", map[string]interface{}{"NetworkID": "net", "EndpointID": "ep1"}, nil)
+	assert.Equal(t, len(backend.joined), 0)
+	client.call("NetworkDriver.DeleteEndpoint", map[string]interface{}{"NetworkID": "net", "EndpointID": "ep1"}, nil)
+	assert.Equal(t, len(backend.endpoints), 0)
+
+	// the gateway is not released
+	client.call("IpamDriver.ReleaseAddress", map[string]interface{}{"PoolID": pool.PoolID, "Address": "10.19.1.1"}, nil)
+	client.call("IpamDriver.ReleaseAddress", map[string]interface{}{"PoolID": pool.PoolID, "Address": "10.19.1.2"}, nil)
+	assert.DeepEqual(t, backend.released, []string{"10.19.1.2"})
+}
+
+func TestDockerPluginErrors(t *testing.T) {
+	client, _, _ := newTestDockerPlugin(t, "worker")
+
+	status, errMsg := client.call("IpamDriver.RequestPool", map[string]interface{}{"Pool": "172.17.0.0/16"}, nil)
+	assert.Equal(t, status, http.StatusInternalServerError)
+	assert.Assert(t, errMsg != "")
+
+	status, errMsg = client.call("NetworkDriver.CreateEndpoint", map[string]interface{}{
+		"EndpointID": "ep1",
+		"Interface":  map[string]string{"Address": "10.19.1.2/26"},
+		"Options":    map[string]interface{}{"oakestra.instanceNumber": "0"},
+	}, nil)
+	assert.Equal(t, status, http.StatusInternalServerError)
+	assert.Assert(t, errMsg != "")
+
+	status, _ = client.call("NetworkDriver.Join", map[string]interface{}{"EndpointID": "unknown"}, nil)
+	assert.Equal(t, status, http.StatusInternalServerError)
+
+	uninitialized, _, _ := newTestDockerPlugin(t, "")
+	status, errMsg = uninitialized.call("IpamDriver.RequestPool", map[string]interface{}{}, nil)
+	assert.Equal(t, status, http.StatusInternalServerError)
+	assert.Equal(t, errMsg, "node not initialized")
+}
@@ -20,10 +20,17 @@ type DeployResponse struct {
 	ServiceName string `json:"serviceName"`
 	NsAddress   string `json:"nsAddress"`
 	NsAddressv6 string `json:"nsAddressv6"`
+	// bridge addresses with the node subnet prefix, the gateways of the namespace
+	Gateway   string `json:"gateway,omitempty"`
+	Gatewayv6 string `json:"gatewayv6,omitempty"`
+	// network inside the namespace, unikernel runtime only
+	Unikernel *env.UnikernelNetwork `json:"unikernel,omitempty"`
 }
 
 var AvailableRuntimes = make(map[string]func() ManagerInterface)
 
+var servicesManager = &ServicesManager{}
+
 type ManagerInterface interface {
 	Register(Env *env.Environment, WorkerID *string, NodePublicAddress string, NodePublicPort string, Router *mux.Router)
 }
@@ -39,4 +46,8 @@ func RegisterAllManagers(Env *env.Environment, WorkerID *string, NodePublicAddre
 	for _, getfunc := range AvailableRuntimes {
 		getfunc().Register(Env, WorkerID, NodePublicAddress, NodePublicPort, Router)
 	}
+	servicesManager.Register(Env, WorkerID, NodePublicAddress, NodePublicPort, Router)
+	registerTaskHandlers(Router)
+	registerEventHandlers(Router)
+	v2API.Register(Env, WorkerID, NodePublicAddress, NodePublicPort, Router)
 }
@@ -0,0 +1,174 @@
+package handlers
+
+import (
+	"NetManager/env"
+	"NetManager/logger"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+type NamespaceManager struct {
+	Env           *env.Environment
+	WorkerID      *string
+	Configuration netConfiguration
+}
+
+var namespaceManager *NamespaceManager
+
+func init() {
+	AvailableRuntimes[env.NAMESPACE_RUNTIME] = GetNamespaceManager
+	namespaceManager = &NamespaceManager{}
+}
+
+func GetNamespaceManager() ManagerInterface {
+	return namespaceManager
+}
+
+func (m *NamespaceManager) Register(Env *env.Environment, WorkerID *string, NodePublicAddress string, NodePublicPort string, Router *mux.Router) {
+	m.Env = Env
+	m.WorkerID = WorkerID
+	m.Configuration = netConfiguration{NodePublicAddress: NodePublicAddress, NodePublicPort: NodePublicPort}
+
+	env.InitNamespaceDeployment(Env)
+	Router.HandleFunc("/namespace/deploy", m.namespaceDeploy).Methods("POST")
+	Router.HandleFunc("/namespace/undeploy", m.namespaceUndeploy).Methods("POST")
+}
+
+/*
+Endpoint: /namespace/deploy
+Usage: used to attach a pre-created network namespace, e.g. of a Kata, gVisor or crun sandbox. This method can be used only after the registration
+Method: POST, ?async=true answers at once with the task of the deployment, see /tasks/{id}
+Request Json:
+
+	{
+		netns:string #network namespace path, e.g. /var/run/netns/x or /proc/<pid>/ns/net
+		netnsFd:int #alternative to the path, file descriptor of the namespace held by the process pid
+		pid:int #process holding netnsFd
+		ifname:string #name of the interface inside the namespace, optional
+		serviceName:string
+		instanceNumber:int
+		timeout:int # optional, deadline in seconds of the deployment, rolled back when exceeded
+		portMappings: [{ # or the legacy string "host:container/protocol;..."
+			hostIP:string # optional, all the node addresses by default
+			hostPort:int
+			hostPortEnd:int # optional, last port of a host port range
+			containerPort:int # optional, the host port by default
+			protocols:[string] # tcp, udp or both, tcp by default
+			family:string # optional, ipv4 or ipv6 only
+		}]
+		publicExposures: [{ # optional, nodes with PublicIPNetworking only
+			mode:string # address: the public address is assigned to the node and mapped to the instance, node: ports of the node public address
+			address:string # public IPv4 or IPv6 address, address mode only
+			prefixLength:int # optional, of the address assigned to the interface
+			interface:string # optional, the interface of the default route by default
+			ports:[portMapping] # exposed ports, all of them in the address mode when empty
+		}]
+	}
+
+Response Json:
+
+	{
+		serviceName:    string
+		nsAddress:  	string # address assigned to the namespace
+		nsAddressv6:  	string # ipv6 address assigned to the namespace
+		gateway:  	string # bridge address with the node subnet prefix, e.g. 10.19.1.1/26
+		gatewayv6:  	string
+	}
+*/
+func (m *NamespaceManager) namespaceDeploy(writer http.ResponseWriter, request *http.Request) {
+	log.Println("Received HTTP request - /namespace/deploy ")
+
+	if *m.WorkerID == "" {
+		log.Printf("[ERROR] Node not initialized")
+		writer.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	reqBody, err := io.ReadAll(request.Body)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var deployTask ContainerDeployTask
+	err = json.Unmarshal(reqBody, &deployTask)
+	if err != nil || (deployTask.Netns == "" && deployTask.NetnsFd == nil) {
+		log.Printf("[ERROR] Invalid namespace deploy request")
+		writer.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	deployTask.Runtime = env.NAMESPACE_RUNTIME
+	deployTask.PublicAddr = m.Configuration.NodePublicAddress
+	deployTask.PublicPort = m.Configuration.NodePublicPort
+	deployTask.Env = m.Env
+	deployTask.Writer = &writer
+	if asyncRequested(request) {
+		acceptDeployTask(writer, &deployTask, "/tasks/")
+		return
+	}
+	deployTask.Finish = make(chan TaskReady)
+
+	logger.DebugLogger().Println(deployTask)
+	NewDeployTaskQueue().NewTask(&deployTask)
+
+	result := <-deployTask.Finish
+	if result.Err != nil {
+		http.Error(writer, result.Err.Error(), deployErrorStatus(result.Err))
+		return
+	}
+
+	response := deployResponse(&deployTask, result)
+
+	logger.InfoLogger().Println("Response to /namespace/deploy: ", response)
+
+	writer.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(writer).Encode(response)
+	if err != nil {
+		writer.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+/*
+Endpoint: /namespace/undeploy
+Usage: used to remove the network from a namespace. The namespace itself is left to the runtime
+Method: POST
+Request Json:
+
+	{
+		serviceName:string #name used to register the service in the first place
+		instanceNumber:int
+	}
+
+Response: 200 OK, 404 if the instance is not deployed, e.g. already undeployed, or Failure code
+*/
+func (m *NamespaceManager) namespaceUndeploy(writer http.ResponseWriter, request *http.Request) {
+	log.Println("Received HTTP request - /namespace/undeploy ")
+
+	if *m.WorkerID == "" {
+		log.Printf("[ERROR] Node not initialized")
+		writer.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	reqBody, err := io.ReadAll(request.Body)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var requestStruct undeployRequest
+	err = json.Unmarshal(reqBody, &requestStruct)
+	if err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if !undeployInstance(m.Env, env.NAMESPACE_RUNTIME, requestStruct.Servicename, requestStruct.Instancenumber) {
+		// nothing left to remove, e.g. a repeated undeploy. The /v1 undeploy stays idempotent, /v2 answers 404
+		logger.InfoLogger().Printf("%s.%d is not deployed", requestStruct.Servicename, requestStruct.Instancenumber)
+	}
+
+	writer.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,26 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestNamespaceDeployValidation(t *testing.T) {
+	workerID := "worker"
+	manager := &NamespaceManager{WorkerID: &workerID}
+
+	for _, body := range []string{`{`, `{"serviceName":"app.app.svc.svc","instanceNumber":0}`} {
+		recorder := httptest.NewRecorder()
+		manager.namespaceDeploy(recorder, httptest.NewRequest(http.MethodPost, "/namespace/deploy", strings.NewReader(body)))
+		assert.Equal(t, recorder.Code, http.StatusBadRequest, body)
+	}
+
+	workerID = ""
+	recorder := httptest.NewRecorder()
+	manager.namespaceDeploy(recorder, httptest.NewRequest(http.MethodPost, "/namespace/deploy", strings.NewReader(`{"netns":"/var/run/netns/x"}`)))
+	assert.Equal(t, recorder.Code, http.StatusBadRequest)
+}
@@ -41,16 +41,50 @@ func (m *UnikernelManager) Register(Env *env.Environment, WorkerID *string, Node
 
 /*
 Endpoint: /unikernel/delpoy
-Usage: used to create the network for the unikernel. Including a namespace, bridge and tap device
-Method: POST
+Usage: used to create the network for the unikernel. Including a namespace, bridge and tap devices
+Method: POST, ?async=true answers at once with the task of the deployment, see /tasks/{id}
 Request Json:
 
 	{
-		client_id:string # id of the worker node
-		#TODO
+		serviceName:string
+		instanceNumber:int
+		timeout:int # optional, deadline in seconds of the deployment, rolled back when exceeded
+		portMappings: [{ # or the legacy string "host:unikernel/protocol;..."
+			hostIP:string # optional, all the node addresses by default
+			hostPort:int
+			hostPortEnd:int # optional, last port of a host port range
+			containerPort:int # optional, the host port by default
+			protocols:[string] # tcp, udp or both, tcp by default
+			family:string # optional, ipv4 or ipv6 only
+		}]
+		publicExposures: [{ # optional, nodes with PublicIPNetworking only
+			mode:string # address: the public address is assigned to the node and mapped to the instance, node: ports of the node public address
+			address:string # public IPv4 or IPv6 address, address mode only
+			prefixLength:int # optional, of the address assigned to the interface
+			interface:string # optional, the interface of the default route by default
+			ports:[portMapping] # exposed ports, all of them in the address mode when empty
+		}]
+		unikernel: { # optional, a single tap with the static addresses 192.168.1.2 and fdff:1::2 by default
+			taps:int # number of guest NICs
+			macs:[]string # MAC addresses of the guest NICs, generated for the missing ones
+			subnet:string # guest subnet, the first address is the bridge
+			subnetv6:string # guest IPv6 subnet, a /64 with DHCP
+			dhcp:bool # serve the addresses with DHCPv4 and router advertisements
+		}
 	}
 
-Response: 200 or Failure code
+Response Json:
+
+	{
+		serviceName:    string
+		nsAddress:  	string # address assigned to the namespace, forwarded to the first guest NIC
+		nsAddressv6:  	string # ipv6 address assigned to the namespace, forwarded to the first guest NIC
+		unikernel: {
+			bridge, gateway, gatewayv6, subnet, subnetv6: string
+			dhcp: bool
+			nics: [{tap, mac, ip, ipv6: string}] # the guest NIC attached to each tap
+		}
+	}
 */
 func (m *UnikernelManager) CreateUnikernelNamesapce(writer http.ResponseWriter, request *http.Request) {
 	log.Println("Received HTTP request - /unikernel/deploy")
@@ -61,34 +95,39 @@ func (m *UnikernelManager) CreateUnikernelNamesapce(writer http.ResponseWriter,
 		return
 	}
 
-	reqBody, _ := io.ReadAll(request.Body)
+	reqBody, err := io.ReadAll(request.Body)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
 	log.Printf("ReqBody received :%s", reqBody)
 	var requestStruct ContainerDeployTask
-	err := json.Unmarshal(reqBody, &requestStruct)
+	err = json.Unmarshal(reqBody, &requestStruct)
 	if err != nil {
-		writer.WriteHeader(http.StatusBadRequest)
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
 	}
 	requestStruct.Runtime = env.UNIKERNEL_RUNTIME
 	requestStruct.PublicAddr = m.Configuration.NodePublicAddress
 	requestStruct.PublicPort = m.Configuration.NodePublicPort
 	requestStruct.Env = m.Env
 	requestStruct.Writer = &writer
+	if asyncRequested(request) {
+		acceptDeployTask(writer, &requestStruct, "/tasks/")
+		return
+	}
 	requestStruct.Finish = make(chan TaskReady, 0)
 	logger.DebugLogger().Println(requestStruct)
 	NewDeployTaskQueue().NewTask(&requestStruct)
 	result := <-requestStruct.Finish
 	if result.Err != nil {
-		writer.WriteHeader(http.StatusInternalServerError)
+		http.Error(writer, result.Err.Error(), deployErrorStatus(result.Err))
 		return
 	}
 
-	response := DeployResponse{
-		ServiceName: requestStruct.ServiceName,
-		NsAddress:   result.IP.String(),
-		NsAddressv6: result.IPv6.String(),
-	}
+	response := deployResponse(&requestStruct, result)
 
-	logger.InfoLogger().Println("Response to /container/deploy: ", response)
+	logger.InfoLogger().Println("Response to /unikernel/deploy: ", response)
 
 	writer.Header().Set("Content-Type", "application/json")
 	err = json.NewEncoder(writer).Encode(response)
@@ -107,7 +146,7 @@ Request Json:
 		serviceName:string #name used to register the service in a unikernel deploy request
 	}
 
-Response: 200 or Failure code
+Response: 200 OK, 404 if the instance is not deployed, e.g. already undeployed, or Failure code
 */
 func (m *UnikernelManager) DeleteUnikernelNamespace(writer http.ResponseWriter, request *http.Request) {
 	log.Println("Received HTTP request - /unikernel/undeploy")
@@ -118,16 +157,24 @@ func (m *UnikernelManager) DeleteUnikernelNamespace(writer http.ResponseWriter,
 		return
 	}
 
-	reqBody, _ := io.ReadAll(request.Body)
+	reqBody, err := io.ReadAll(request.Body)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
 	var requestStruct undeployRequest
-	err := json.Unmarshal(reqBody, &requestStruct)
+	err = json.Unmarshal(reqBody, &requestStruct)
 	if err != nil {
 		writer.WriteHeader(http.StatusBadRequest)
+		return
 	}
 
 	log.Println(requestStruct)
 
-	m.Env.DeleteUnikernelNamespace(requestStruct.Servicename, requestStruct.Instancenumber)
+	if !undeployInstance(m.Env, env.UNIKERNEL_RUNTIME, requestStruct.Servicename, requestStruct.Instancenumber) {
+		// nothing left to remove, e.g. a repeated undeploy. The /v1 undeploy stays idempotent, /v2 answers 404
+		logger.InfoLogger().Printf("%s.%d is not deployed", requestStruct.Servicename, requestStruct.Instancenumber)
+	}
 
 	writer.WriteHeader(http.StatusOK)
 }
@@ -5,24 +5,45 @@ import (
 	"NetManager/logger"
 	"NetManager/model"
 	"NetManager/mqtt"
+	"NetManager/network"
+	"context"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
-	"strings"
 	"sync"
+	"time"
 )
 
 type ContainerDeployTask struct {
 	Pid            int    `json:"pid"`
+	Netns          string `json:"netns"`
+	NetnsFd        *int   `json:"netnsFd"`
+	Ifname         string `json:"ifname"`
 	ServiceName    string `json:"serviceName"`
 	Instancenumber int    `json:"instanceNumber"`
-	PortMappings   string `json:"portMappings"`
-	Runtime        string
-	PublicAddr     string
-	PublicPort     string
-	Env            *env.Environment
-	Writer         *http.ResponseWriter
-	Finish         chan TaskReady
+	// structured port mappings, or the legacy "host:container/protocol;..." string
+	PortMappings network.PortMappings `json:"portMappings"`
+	// public addresses of the instance, PublicIPNetworking only
+	PublicExposures network.PublicExposures `json:"publicExposures"`
+	// network inside the namespace, unikernel runtime only
+	Unikernel *env.UnikernelTopology `json:"unikernel"`
+	// deadline of the deployment in seconds, rolled back when exceeded. DEFAULT_TASK_TIMEOUT when zero
+	Timeout    int `json:"timeout"`
+	Runtime    string
+	PublicAddr string
+	PublicPort string
+	Env        *env.Environment
+	Writer     *http.ResponseWriter
+	Finish     chan TaskReady
+	// set by the task queue
+	ID       string `json:"-"`
+	ctx      context.Context
+	cancel   context.CancelFunc
+	status   string
+	created  time.Time
+	finished time.Time
+	result   TaskReady
 }
 
 type TaskReady struct {
@@ -31,68 +52,197 @@ type TaskReady struct {
 	Err  error
 }
 
+// deployTaskQueue runs the deployments of different service instances concurrently, those of the same instance one at a time
 type deployTaskQueue struct {
-	newTask chan *ContainerDeployTask
+	tasks map[string]*ContainerDeployTask
+	// a slot for each service instance with deployments in progress
+	instances map[string]*instanceSlot
+	// bounds the deployments running at the same time
+	workers chan struct{}
+	lock    sync.Mutex
+	// deploy sets up the network of the task, afterDeploy runs once the caller has the result
+	deploy      func(task *ContainerDeployTask) (net.IP, net.IP, error)
+	afterDeploy func(task *ContainerDeployTask)
+}
+
+// instanceSlot is held by the running deployment of a service instance
+type instanceSlot struct {
+	held  chan struct{}
+	users int
 }
 
 type DeployTaskQueue interface {
 	NewTask(request *ContainerDeployTask)
+	Task(id string) (TaskStatus, bool)
+	CancelTask(id string) (TaskStatus, error)
 }
 
 var (
 	once      sync.Once
-	taskQueue deployTaskQueue
+	taskQueue *deployTaskQueue
 )
 
 func NewDeployTaskQueue() DeployTaskQueue {
+	return getDeployTaskQueue()
+}
+
+func getDeployTaskQueue() *deployTaskQueue {
 	once.Do(func() {
-		taskQueue = deployTaskQueue{
-			newTask: make(chan *ContainerDeployTask, 50),
-		}
-		go taskQueue.taskExecutor()
+		taskQueue = newDeployTaskQueue(deploymentHandler, updateInternalProxyDataStructures)
 	})
-	return &taskQueue
+	return taskQueue
+}
+
+func newDeployTaskQueue(deploy func(task *ContainerDeployTask) (net.IP, net.IP, error), afterDeploy func(task *ContainerDeployTask)) *deployTaskQueue {
+	return &deployTaskQueue{
+		tasks:       make(map[string]*ContainerDeployTask),
+		instances:   make(map[string]*instanceSlot),
+		workers:     make(chan struct{}, MAX_CONCURRENT_DEPLOYMENTS),
+		deploy:      deploy,
+		afterDeploy: afterDeploy,
+	}
 }
 
+// NewTask starts the deployment, the result is sent to the Finish channel of the request if any and kept for the task queries
 func (t *deployTaskQueue) NewTask(request *ContainerDeployTask) {
-	t.newTask <- request
-}
-
-func (t *deployTaskQueue) taskExecutor() {
-	for {
-		select {
-		case task := <-t.newTask:
-			// deploy the network stack in the container
-			addr, addrv6, err := deploymentHandler(task)
-			if err != nil {
-				logger.ErrorLogger().Println("[ERROR]: ", err)
-			}
-			task.Finish <- TaskReady{
-				IP:   addr,
-				IPv6: addrv6,
-				Err:  err,
-			}
-			// asynchronously update proxy tables
-			updateInternalProxyDataStructures(task)
+	timeout := DEFAULT_TASK_TIMEOUT
+	if request.Timeout > 0 {
+		timeout = time.Duration(request.Timeout) * time.Second
+	}
+	request.ctx, request.cancel = context.WithTimeout(context.Background(), timeout)
+
+	t.lock.Lock()
+	t.purgeFinishedTasks()
+	request.ID = newTaskID()
+	request.status = TASK_PENDING
+	request.created = time.Now()
+	t.tasks[request.ID] = request
+	t.lock.Unlock()
+
+	go t.execute(request)
+}
+
+func (t *deployTaskQueue) execute(task *ContainerDeployTask) {
+	defer task.cancel()
+	var addr, addrv6 net.IP
+	release, err := t.acquire(task)
+	if err == nil {
+		t.setStatus(task, TASK_RUNNING)
+		// deploy the network stack in the container
+		addr, addrv6, err = t.deploy(task)
+		release()
+	}
+	if err != nil && task.ctx.Err() != nil {
+		err = taskContextError(task.ctx.Err())
+	}
+	if err != nil {
+		logger.ErrorLogger().Println("[ERROR]: ", err)
+	}
+	result := TaskReady{
+		IP:   addr,
+		IPv6: addrv6,
+		Err:  err,
+	}
+	ran := t.finish(task, result)
+	if task.Finish != nil {
+		task.Finish <- result
+	}
+	if ran {
+		// asynchronously update proxy tables
+		t.afterDeploy(task)
+	}
+}
+
+// acquire waits for the slot of the service instance and for a worker, unless the task is cancelled or times out
+func (t *deployTaskQueue) acquire(task *ContainerDeployTask) (func(), error) {
+	leave, err := t.holdInstance(task.ctx, instanceKey(task.ServiceName, task.Instancenumber))
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case t.workers <- struct{}{}:
+	case <-task.ctx.Done():
+		leave()
+		return nil, task.ctx.Err()
+	}
+	return func() {
+		<-t.workers
+		leave()
+	}, nil
+}
+
+// holdInstance waits for the slot of the service instance, the deployments and undeployments of an instance run one at a time
+func (t *deployTaskQueue) holdInstance(ctx context.Context, key string) (func(), error) {
+	t.lock.Lock()
+	slot, ok := t.instances[key]
+	if !ok {
+		slot = &instanceSlot{held: make(chan struct{}, 1)}
+		t.instances[key] = slot
+	}
+	slot.users++
+	t.lock.Unlock()
+
+	leave := func() {
+		t.lock.Lock()
+		slot.users--
+		if slot.users == 0 {
+			delete(t.instances, key)
 		}
+		t.lock.Unlock()
+	}
+	select {
+	case slot.held <- struct{}{}:
+	case <-ctx.Done():
+		leave()
+		return nil, ctx.Err()
 	}
+	return func() {
+		<-slot.held
+		leave()
+	}, nil
+}
+
+// undeploy runs detach once the deployments of the instance in progress are over, returns false if the instance is not deployed
+func (t *deployTaskQueue) undeploy(serviceName string, instance int, detach func() bool) bool {
+	release, _ := t.holdInstance(context.Background(), instanceKey(serviceName, instance))
+	defer release()
+	return detach()
 }
 
 func deploymentHandler(requestStruct *ContainerDeployTask) (net.IP, net.IP, error) {
-	// get app full name
-	appCompleteName := strings.Split(requestStruct.ServiceName, ".")
-	if len(appCompleteName) != 4 {
-		return nil, nil, fmt.Errorf("invalid app name: %s", appCompleteName)
+	// the app full name is app.app.svc.svc
+	if err := validateServiceName(requestStruct.ServiceName); err != nil {
+		return nil, nil, fmt.Errorf("invalid app name: %v", err)
 	}
 
 	// attach network to the container
 	netHandler := env.GetNetDeployment(requestStruct.Runtime)
 	logger.DebugLogger().Printf("Got netHandler: %v", netHandler)
-	addr, addrv6, err := netHandler.DeployNetwork(requestStruct.Pid, requestStruct.ServiceName, requestStruct.Instancenumber, requestStruct.PortMappings)
+	addr, addrv6, created, err := netHandler.DeployNetwork(env.DeploymentRequest{
+		Runtime:         requestStruct.Runtime,
+		Pid:             requestStruct.Pid,
+		NetnsPath:       requestStruct.Netns,
+		NetnsFd:         requestStruct.NetnsFd,
+		Ifname:          requestStruct.Ifname,
+		ServiceName:     requestStruct.ServiceName,
+		Instancenumber:  requestStruct.Instancenumber,
+		PortMappings:    requestStruct.PortMappings,
+		PublicExposures: requestStruct.PublicExposures,
+		Unikernel:       requestStruct.Unikernel,
+		Context:         requestStruct.ctx,
+	})
 	if err != nil {
 		logger.ErrorLogger().Println("[ERROR]:", err)
 		return nil, nil, err
 	}
+	// cancelled or timed out while deploying, the cluster is not told about the instance.
+	// An instance already running before this task is left as it is.
+	if err := requestStruct.ctx.Err(); err != nil {
+		if created {
+			undeployNetwork(requestStruct)
+		}
+		return nil, nil, err
+	}
 
 	// notify to net-component
 	err = mqtt.NotifyDeploymentStatus(
@@ -101,17 +251,75 @@ func deploymentHandler(requestStruct *ContainerDeployTask) (net.IP, net.IP, erro
 		requestStruct.Instancenumber,
 		addr.String(),
 		addrv6.String(),
-		model.NetConfig.NodePublicAddress,
+		model.GetNodePublicAddress(),
 		model.NetConfig.NodePublicPort,
 	)
 	if err != nil {
 		logger.ErrorLogger().Println("[ERROR]:", err)
 		return nil, nil, err
 	}
+	if len(requestStruct.PublicExposures) > 0 {
+		notifyPublicExposure(requestStruct)
+	}
 
 	return addr, addrv6, nil
 }
 
+// undeployNetwork removes the network of a deployment cancelled once completed, the task holds the slot of the instance
+func undeployNetwork(requestStruct *ContainerDeployTask) {
+	detachInstance(requestStruct.Env, requestStruct.Runtime, requestStruct.ServiceName, requestStruct.Instancenumber)
+}
+
+// undeployInstance removes the network of the instance deployed by the runtime, returns false if it is not deployed.
+// It waits for the deployment of the instance in progress, if any.
+func undeployInstance(Env *env.Environment, runtime string, serviceName string, instance int) bool {
+	return getDeployTaskQueue().undeploy(serviceName, instance, func() bool {
+		return detachInstance(Env, runtime, serviceName, instance)
+	})
+}
+
+// detachInstance removes the network of the instance, the slot of the instance MUST be held by the caller
+func detachInstance(Env *env.Environment, runtime string, serviceName string, instance int) bool {
+	if runtime == env.UNIKERNEL_RUNTIME {
+		return Env.DeleteUnikernelNamespace(serviceName, instance)
+	}
+	return Env.DetachContainer(serviceName, instance)
+}
+
+// notifyPublicExposure tells the cluster the public addresses of the instance, the instance is deployed anyway
+func notifyPublicExposure(requestStruct *ContainerDeployTask) {
+	exposures := make([]mqtt.PublicExposureNotification, 0, len(requestStruct.PublicExposures))
+	for _, exposure := range requestStruct.PublicExposures {
+		exposures = append(exposures, mqtt.PublicExposureNotification{
+			Mode:    exposure.Mode,
+			Address: exposure.PublicAddress(),
+			Ports:   exposure.Ports.String(),
+		})
+	}
+	err := mqtt.NotifyPublicExposure(requestStruct.ServiceName, requestStruct.Instancenumber, exposures)
+	if err != nil {
+		logger.ErrorLogger().Println("[ERROR]: unable to notify the public exposure:", err)
+	}
+}
+
+// deployErrorStatus is the HTTP status of a failed deployment, 409 when the host ports are used by another deployment,
+// the instance is deployed elsewhere or the task is cancelled, 400 for the public exposures the node can't satisfy and 504 when the task times out
+func deployErrorStatus(err error) int {
+	if errors.Is(err, network.ErrHostPortConflict) || errors.Is(err, env.ErrInstanceConflict) {
+		return http.StatusConflict
+	}
+	if errors.Is(err, network.ErrInvalidPublicExposure) || errors.Is(err, network.ErrPublicIPNetworkingDisabled) {
+		return http.StatusBadRequest
+	}
+	if errors.Is(err, ErrTaskTimeout) {
+		return http.StatusGatewayTimeout
+	}
+	if errors.Is(err, ErrTaskCancelled) {
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
 func updateInternalProxyDataStructures(requestStruct *ContainerDeployTask) {
 	// Update internal table entry if an interest has not been set already.
 	// Otherwise, do nothing, the net will autonomously update.
@@ -0,0 +1,127 @@
+package handlers
+
+import (
+	"NetManager/events"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// EVENT_STREAM_HEARTBEAT is the interval of the comments keeping an idle event stream open through the proxies
+const EVENT_STREAM_HEARTBEAT = 15 * time.Second
+
+// streamedEvent is the data of a Server-Sent Event
+type streamedEvent struct {
+	Type    events.EventType `json:"type"`
+	Target  string           `json:"target,omitempty"`
+	Message string           `json:"message,omitempty"`
+	Time    time.Time        `json:"time"`
+	Payload interface{}      `json:"payload,omitempty"`
+}
+
+func registerEventHandlers(Router *mux.Router) {
+	Router.HandleFunc("/events", streamEvents).Methods("GET")
+}
+
+// eventTypesFilter parses the ?type=service-deployed,peer-unreachable filter, repeated or comma separated, and checks the ?target pattern
+func eventTypesFilter(request *http.Request) ([]events.EventType, []FieldError) {
+	eventTypes := make([]events.EventType, 0)
+	fields := make([]FieldError, 0)
+	for _, value := range request.URL.Query()["type"] {
+		for _, name := range strings.Split(value, ",") {
+			eventType, err := events.ParseEventType(strings.TrimSpace(name))
+			if err != nil {
+				fields = append(fields, FieldError{Field: "type", Reason: err.Error()})
+				continue
+			}
+			eventTypes = append(eventTypes, eventType)
+		}
+	}
+	if _, err := path.Match(request.URL.Query().Get("target"), ""); err != nil {
+		fields = append(fields, FieldError{Field: "target", Reason: err.Error()})
+	}
+	return eventTypes, fields
+}
+
+/*
+Endpoint: /events
+Usage: used to follow the network changes of the node as Server-Sent Events, e.g. with curl -N or an EventSource.
+Each event is named after its type and carries the JSON
+{type, target, message, time, payload}, see the events package for the payload of each type.
+Method: GET, ?type=service-deployed,service-undeployed,table-entry-added,table-entry-removed,interest-registered,
+interest-expired,peer-unreachable,mqtt-connection-state selects the types, all of them by default.
+?target=app.app.* selects the targets, e.g. the service name, with * and ? wildcards.
+Response: 200 OK with a text/event-stream, 422 validation-failed for unknown types or invalid target patterns.
+The events emitted while the client is too slow to read them are dropped.
+*/
+func streamEvents(writer http.ResponseWriter, request *http.Request) {
+	log.Println("Received HTTP request - /events ")
+
+	eventTypes, fields := eventTypesFilter(request)
+	if len(fields) > 0 {
+		WriteProblem(writer, request, http.StatusUnprocessableEntity, PROBLEM_VALIDATION_FAILED, "", fields...)
+		return
+	}
+	flusher, ok := writer.(http.Flusher)
+	if !ok {
+		http.Error(writer, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	if len(eventTypes) == 0 {
+		// the table queries are internal, one for each new flow
+		for _, eventType := range events.EventTypes() {
+			if eventType != events.TableQuery {
+				eventTypes = append(eventTypes, eventType)
+			}
+		}
+	}
+	eventManager := events.GetInstance()
+	subscription := eventManager.Subscribe(events.Filter{Types: eventTypes, Target: request.URL.Query().Get("target")}, events.SubscriptionOptions{})
+	defer eventManager.Unsubscribe(subscription)
+
+	writer.Header().Set("Content-Type", "text/event-stream")
+	writer.Header().Set("Cache-Control", "no-cache")
+	writer.Header().Set("Connection", "keep-alive")
+	writer.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(EVENT_STREAM_HEARTBEAT)
+	defer heartbeat.Stop()
+	id := 0
+	for {
+		select {
+		case <-request.Context().Done():
+			return
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(writer, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case event, open := <-subscription.Events:
+			if !open {
+				return
+			}
+			data, err := json.Marshal(streamedEvent{
+				Type:    event.EventType,
+				Target:  event.EventTarget,
+				Message: event.EventMessage,
+				Time:    event.Time,
+				Payload: event.Payload,
+			})
+			if err != nil {
+				continue
+			}
+			id++
+			if _, err := fmt.Fprintf(writer, "id: %d\nevent: %s\ndata: %s\n\n", id, event.EventType, data); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,79 @@
+package handlers
+
+import (
+	"NetManager/events"
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestStreamEventsFilter(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(streamEvents))
+	defer server.Close()
+
+	response, err := http.Get(server.URL + "/events?type=service-deployed&type=peer-unreachable")
+	assert.NilError(t, err)
+	defer response.Body.Close()
+	assert.Equal(t, response.StatusCode, http.StatusOK)
+	assert.Equal(t, response.Header.Get("Content-Type"), "text/event-stream")
+
+	// subscribed once the headers are received
+	eventManager := events.GetInstance()
+	eventManager.Emit(events.Event{EventType: events.TableEntryAdded, EventTarget: "app.app.svc.svc"})
+	eventManager.Emit(events.Event{
+		EventType:   events.ServiceDeployed,
+		EventTarget: "app.app.svc.svc.0",
+		Payload:     events.ServiceEvent{ServiceName: "app.app.svc.svc", Runtime: "container", Address: "10.19.1.3"},
+	})
+	eventManager.Emit(events.Event{EventType: events.PeerUnreachable, Payload: events.PeerEvent{Peer: "node", Reason: "timeout"}})
+
+	reader := bufio.NewReader(response.Body)
+	readEvent := func() (string, string, map[string]interface{}) {
+		var id, name string
+		var data map[string]interface{}
+		for {
+			line, err := reader.ReadString('\n')
+			assert.NilError(t, err)
+			line = strings.TrimSuffix(line, "\n")
+			switch {
+			case line == "":
+				return id, name, data
+			case strings.HasPrefix(line, "id: "):
+				id = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "event: "):
+				name = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				assert.NilError(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &data))
+			}
+		}
+	}
+
+	id, name, data := readEvent()
+	assert.Equal(t, id, "1")
+	assert.Equal(t, name, "service-deployed")
+	assert.Equal(t, data["type"], "service-deployed")
+	assert.Equal(t, data["target"], "app.app.svc.svc.0")
+	assert.DeepEqual(t, data["payload"], map[string]interface{}{
+		"serviceName": "app.app.svc.svc", "instanceNumber": float64(0), "runtime": "container", "nsAddress": "10.19.1.3",
+	})
+
+	id, name, data = readEvent()
+	assert.Equal(t, id, "2")
+	assert.Equal(t, name, "peer-unreachable")
+	assert.Equal(t, data["payload"].(map[string]interface{})["reason"], "timeout")
+}
+
+func TestStreamEventsUnknownType(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	streamEvents(recorder, httptest.NewRequest(http.MethodGet, "/events?type=service-deployed,unknown", nil))
+	assert.Equal(t, recorder.Code, http.StatusUnprocessableEntity)
+	var problem Problem
+	assert.NilError(t, json.Unmarshal(recorder.Body.Bytes(), &problem))
+	assert.Equal(t, problem.Code, PROBLEM_VALIDATION_FAILED)
+	assert.Equal(t, len(problem.Errors), 1)
+}
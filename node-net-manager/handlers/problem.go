@@ -0,0 +1,113 @@
+package handlers
+
+import (
+	"NetManager/env"
+	"NetManager/logger"
+	"NetManager/network"
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+// PROBLEM_MIME_TYPE is the content type of the /v2 error bodies, RFC 7807
+const PROBLEM_MIME_TYPE = "application/problem+json"
+
+// Stable codes of the /v2 errors, the type of a problem is PROBLEM_TYPE_PREFIX followed by the code
+const (
+	PROBLEM_TYPE_PREFIX = "urn:oakestra:netmanager:problem:"
+
+	PROBLEM_INVALID_JSON            = "invalid-json"
+	PROBLEM_VALIDATION_FAILED       = "validation-failed"
+	PROBLEM_NODE_NOT_REGISTERED     = "node-not-registered"
+	PROBLEM_NODE_ALREADY_REGISTERED = "node-already-registered"
+	PROBLEM_INSTANCE_NOT_FOUND      = "instance-not-found"
+	PROBLEM_INSTANCE_CONFLICT       = "instance-conflict"
+	PROBLEM_HOST_PORT_CONFLICT      = "host-port-conflict"
+	PROBLEM_PUBLIC_IP_DISABLED      = "public-ip-networking-disabled"
+	PROBLEM_TASK_NOT_FOUND          = "task-not-found"
+	PROBLEM_TASK_FINISHED           = "task-finished"
+	PROBLEM_DEPLOYMENT_CANCELLED    = "deployment-cancelled"
+	PROBLEM_DEPLOYMENT_TIMEOUT      = "deployment-timeout"
+	PROBLEM_DEPLOYMENT_FAILED       = "deployment-failed"
+	PROBLEM_UNAUTHORIZED            = "unauthorized"
+	PROBLEM_FORBIDDEN               = "forbidden"
+)
+
+var problemTitles = map[string]string{
+	PROBLEM_INVALID_JSON:            "The request body is not valid JSON for this endpoint",
+	PROBLEM_VALIDATION_FAILED:       "The request has invalid fields",
+	PROBLEM_NODE_NOT_REGISTERED:     "The NetManager is not registered to the cluster yet",
+	PROBLEM_NODE_ALREADY_REGISTERED: "The NetManager is registered with another worker ID",
+	PROBLEM_INSTANCE_NOT_FOUND:      "The service instance is not deployed",
+	PROBLEM_INSTANCE_CONFLICT:       "The service instance is deployed elsewhere",
+	PROBLEM_HOST_PORT_CONFLICT:      "The host ports are used by another deployment",
+	PROBLEM_PUBLIC_IP_DISABLED:      "PublicIPNetworking is disabled on this node",
+	PROBLEM_TASK_NOT_FOUND:          "No such deployment task",
+	PROBLEM_TASK_FINISHED:           "The deployment task is already finished",
+	PROBLEM_DEPLOYMENT_CANCELLED:    "The deployment was cancelled",
+	PROBLEM_DEPLOYMENT_TIMEOUT:      "The deployment timed out",
+	PROBLEM_DEPLOYMENT_FAILED:       "The deployment failed",
+	PROBLEM_UNAUTHORIZED:            "The request carries no valid credentials",
+	PROBLEM_FORBIDDEN:               "The caller is not allowed to use the API",
+}
+
+// Problem is an RFC 7807 error body
+type Problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+	// Code is the stable code of the problem, the last part of the type
+	Code string `json:"code"`
+	// Errors are the invalid fields, validation-failed only
+	Errors []FieldError `json:"errors,omitempty"`
+}
+
+// FieldError is an invalid field of a request, Field is its JSON path
+type FieldError struct {
+	Field  string `json:"field"`
+	Reason string `json:"reason"`
+}
+
+// WriteProblem answers the request with the problem of the given code
+func WriteProblem(writer http.ResponseWriter, request *http.Request, status int, code string, detail string, fields ...FieldError) {
+	problem := Problem{
+		Type:     PROBLEM_TYPE_PREFIX + code,
+		Title:    problemTitles[code],
+		Status:   status,
+		Detail:   detail,
+		Instance: request.URL.Path,
+		Code:     code,
+		Errors:   fields,
+	}
+	writer.Header().Set("Content-Type", PROBLEM_MIME_TYPE)
+	writer.WriteHeader(status)
+	if err := json.NewEncoder(writer).Encode(problem); err != nil {
+		logger.ErrorLogger().Println("[ERROR]: unable to encode the problem:", err)
+	}
+}
+
+// writeDeployProblem answers with the problem of a failed deployment
+func writeDeployProblem(writer http.ResponseWriter, request *http.Request, err error) {
+	WriteProblem(writer, request, deployErrorStatus(err), deployProblemCode(err), err.Error())
+}
+
+// deployProblemCode is the code of a failed deployment, matching deployErrorStatus
+func deployProblemCode(err error) string {
+	switch {
+	case errors.Is(err, network.ErrHostPortConflict):
+		return PROBLEM_HOST_PORT_CONFLICT
+	case errors.Is(err, env.ErrInstanceConflict):
+		return PROBLEM_INSTANCE_CONFLICT
+	case errors.Is(err, network.ErrInvalidPublicExposure):
+		return PROBLEM_VALIDATION_FAILED
+	case errors.Is(err, network.ErrPublicIPNetworkingDisabled):
+		return PROBLEM_PUBLIC_IP_DISABLED
+	case errors.Is(err, ErrTaskTimeout):
+		return PROBLEM_DEPLOYMENT_TIMEOUT
+	case errors.Is(err, ErrTaskCancelled):
+		return PROBLEM_DEPLOYMENT_CANCELLED
+	}
+	return PROBLEM_DEPLOYMENT_FAILED
+}
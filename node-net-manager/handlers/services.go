@@ -0,0 +1,244 @@
+package handlers
+
+import (
+	"NetManager/env"
+	"NetManager/logger"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	INSTANCE_DEPLOYED = "deployed"
+	INSTANCE_REMOVED  = "removed"
+	INSTANCE_FAILED   = "failed"
+)
+
+// ServicesManager reconciles the instances deployed on the node with the ones the NodeEngine runs
+type ServicesManager struct {
+	Env           *env.Environment
+	WorkerID      *string
+	Configuration netConfiguration
+	// the instances of the node, those of Env and the deploy task queue when nil
+	node nodeInstances
+}
+
+// nodeInstances deploys and undeploys the instances of the node
+type nodeInstances interface {
+	DeployedInstances() []env.DeployedInstance
+	// Undeploy returns false if the instance is not deployed
+	Undeploy(instance env.DeployedInstance) bool
+	// Deploy starts the deployment, the result is sent to the Finish channel of the task
+	Deploy(task *ContainerDeployTask)
+}
+
+// envInstances are the instances of the environment, deployed through the deploy task queue
+type envInstances struct {
+	env *env.Environment
+}
+
+func (i envInstances) DeployedInstances() []env.DeployedInstance {
+	return i.env.DeployedInstances()
+}
+
+func (i envInstances) Undeploy(instance env.DeployedInstance) bool {
+	return undeployInstance(i.env, instance.Runtime, instance.ServiceName, instance.Instancenumber)
+}
+
+func (i envInstances) Deploy(task *ContainerDeployTask) {
+	NewDeployTaskQueue().NewTask(task)
+}
+
+// desiredInstance is a deploy request of the runtime
+type desiredInstance struct {
+	ContainerDeployTask
+	Runtime string `json:"runtime"`
+}
+
+type servicesRequest struct {
+	Instances []desiredInstance `json:"instances"`
+}
+
+type InstanceResult struct {
+	ServiceName    string `json:"serviceName"`
+	Instancenumber int    `json:"instanceNumber"`
+	Runtime        string `json:"runtime"`
+	Status         string `json:"status"`
+	Error          string `json:"error,omitempty"`
+	NsAddress      string `json:"nsAddress,omitempty"`
+	NsAddressv6    string `json:"nsAddressv6,omitempty"`
+}
+
+type servicesResponse struct {
+	Instances []InstanceResult `json:"instances"`
+}
+
+func (m *ServicesManager) Register(Env *env.Environment, WorkerID *string, NodePublicAddress string, NodePublicPort string, Router *mux.Router) {
+	m.Env = Env
+	m.WorkerID = WorkerID
+	m.Configuration = netConfiguration{NodePublicAddress: NodePublicAddress, NodePublicPort: NodePublicPort}
+
+	Router.HandleFunc("/services", m.reconcileServices).Methods("PUT")
+}
+
+func instanceKey(serviceName string, instance int) string {
+	return fmt.Sprintf("%s.%d", serviceName, instance)
+}
+
+/*
+Endpoint: /services
+Usage: used to reconcile the network of the node with all the instances the NodeEngine runs.
+The missing instances are deployed, the deployed ones updated in place, e.g. with new port mappings,
+and the ones not listed are undeployed. The instances of the Docker network plugin are left to Docker.
+Method: PUT
+Request Json:
+
+	{
+		instances: [{
+			runtime:string # container, namespace or unikernel
+			... # the deploy request of the runtime
+		}]
+	}
+
+Response Json:
+
+	{
+		instances: [{
+			serviceName:string
+			instanceNumber:int
+			runtime:string
+			status:string # deployed, removed or failed
+			error:string # failed instances
+			nsAddress:string # deployed instances
+			nsAddressv6:string
+		}]
+	}
+
+Response: 200 OK once all the instances are reconciled, 400 for invalid requests, or the status of the first failed deployment
+*/
+func (m *ServicesManager) reconcileServices(writer http.ResponseWriter, request *http.Request) {
+	log.Println("Received HTTP request - /services ")
+
+	if *m.WorkerID == "" {
+		log.Printf("[ERROR] Node not initialized")
+		writer.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	reqBody, err := io.ReadAll(request.Body)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var requestStruct servicesRequest
+	if err := json.Unmarshal(reqBody, &requestStruct); err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+	desired := make(map[string]*ContainerDeployTask, len(requestStruct.Instances))
+	tasks := make([]*ContainerDeployTask, 0, len(requestStruct.Instances))
+	for i := range requestStruct.Instances {
+		task := &requestStruct.Instances[i].ContainerDeployTask
+		task.Runtime = requestStruct.Instances[i].Runtime
+		if err := validateDesiredInstance(task); err != nil {
+			http.Error(writer, err.Error(), http.StatusBadRequest)
+			return
+		}
+		key := instanceKey(task.ServiceName, task.Instancenumber)
+		if _, exist := desired[key]; exist {
+			http.Error(writer, fmt.Sprintf("instance %s listed twice", key), http.StatusBadRequest)
+			return
+		}
+		desired[key] = task
+		tasks = append(tasks, task)
+	}
+
+	response, failure := m.reconcile(desired, tasks)
+
+	status := http.StatusOK
+	if failure != nil {
+		status = deployErrorStatus(failure)
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	if err := json.NewEncoder(writer).Encode(response); err != nil {
+		logger.ErrorLogger().Println("[ERROR]: unable to encode the reconciliation:", err)
+	}
+}
+
+// reconcile undeploys the instances not desired and deploys the desired ones, failure is the error of the first failed deployment
+func (m *ServicesManager) reconcile(desired map[string]*ContainerDeployTask, tasks []*ContainerDeployTask) (response servicesResponse, failure error) {
+	node := m.node
+	if node == nil {
+		node = envInstances{env: m.Env}
+	}
+	response = servicesResponse{Instances: make([]InstanceResult, 0, len(tasks))}
+	// the instances no longer running, or running with another runtime
+	removed := make([]InstanceResult, 0)
+	for _, instance := range node.DeployedInstances() {
+		task, ok := desired[instanceKey(instance.ServiceName, instance.Instancenumber)]
+		if ok && task.Runtime == instance.Runtime {
+			continue
+		}
+		logger.InfoLogger().Printf("Reconciling: undeploying %s.%d", instance.ServiceName, instance.Instancenumber)
+		node.Undeploy(instance)
+		if !ok {
+			removed = append(removed, InstanceResult{
+				ServiceName:    instance.ServiceName,
+				Instancenumber: instance.Instancenumber,
+				Runtime:        instance.Runtime,
+				Status:         INSTANCE_REMOVED,
+			})
+		}
+	}
+
+	// the deployments of the same instance are idempotent, they run concurrently
+	for _, task := range tasks {
+		task.PublicAddr = m.Configuration.NodePublicAddress
+		task.PublicPort = m.Configuration.NodePublicPort
+		task.Env = m.Env
+		task.Finish = make(chan TaskReady, 1)
+		node.Deploy(task)
+	}
+	for _, task := range tasks {
+		result := <-task.Finish
+		instance := InstanceResult{
+			ServiceName:    task.ServiceName,
+			Instancenumber: task.Instancenumber,
+			Runtime:        task.Runtime,
+			Status:         INSTANCE_DEPLOYED,
+		}
+		if result.Err != nil {
+			instance.Status = INSTANCE_FAILED
+			instance.Error = result.Err.Error()
+			if failure == nil {
+				failure = result.Err
+			}
+		} else {
+			instance.NsAddress = result.IP.String()
+			instance.NsAddressv6 = result.IPv6.String()
+		}
+		response.Instances = append(response.Instances, instance)
+	}
+	response.Instances = append(response.Instances, removed...)
+
+	return response, failure
+}
+
+// validateDesiredInstance checks the runtime and the fields it requires
+func validateDesiredInstance(task *ContainerDeployTask) error {
+	switch task.Runtime {
+	case env.CONTAINER_RUNTIME, env.UNIKERNEL_RUNTIME:
+	case env.NAMESPACE_RUNTIME:
+		if task.Netns == "" && task.NetnsFd == nil {
+			return fmt.Errorf("%s.%d: either a network namespace path or file descriptor is required", task.ServiceName, task.Instancenumber)
+		}
+	default:
+		return fmt.Errorf("%s.%d: unknown runtime %q", task.ServiceName, task.Instancenumber, task.Runtime)
+	}
+	return nil
+}
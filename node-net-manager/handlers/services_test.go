@@ -0,0 +1,165 @@
+package handlers
+
+import (
+	"NetManager/env"
+	"NetManager/network"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestReconcileServicesValidation(t *testing.T) {
+	workerID := "worker"
+	manager := &ServicesManager{WorkerID: &workerID}
+
+	for _, body := range []string{
+		`{`,
+		`{"instances":[{"runtime":"vm","serviceName":"app.app.svc.svc","instanceNumber":0}]}`,
+		`{"instances":[{"runtime":"namespace","serviceName":"app.app.svc.svc","instanceNumber":0}]}`,
+		`{"instances":[{"runtime":"container","serviceName":"app.app.svc.svc","instanceNumber":0,"pid":1},
+			{"runtime":"unikernel","serviceName":"app.app.svc.svc","instanceNumber":0}]}`,
+	} {
+		recorder := httptest.NewRecorder()
+		manager.reconcileServices(recorder, httptest.NewRequest(http.MethodPut, "/services", strings.NewReader(body)))
+		assert.Equal(t, recorder.Code, http.StatusBadRequest, body)
+	}
+
+	workerID = ""
+	recorder := httptest.NewRecorder()
+	manager.reconcileServices(recorder, httptest.NewRequest(http.MethodPut, "/services", strings.NewReader(`{"instances":[]}`)))
+	assert.Equal(t, recorder.Code, http.StatusBadRequest)
+}
+
+// fakeNodeInstances records the reconciliation, the deployments fail with the error given for their instance
+type fakeNodeInstances struct {
+	deployed   []env.DeployedInstance
+	failures   map[string]error
+	lock       sync.Mutex
+	undeployed []string
+	deploys    []string
+}
+
+func (n *fakeNodeInstances) DeployedInstances() []env.DeployedInstance {
+	return n.deployed
+}
+
+func (n *fakeNodeInstances) Undeploy(instance env.DeployedInstance) bool {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.undeployed = append(n.undeployed, fmt.Sprintf("%s/%s", instanceKey(instance.ServiceName, instance.Instancenumber), instance.Runtime))
+	return true
+}
+
+func (n *fakeNodeInstances) Deploy(task *ContainerDeployTask) {
+	n.lock.Lock()
+	n.deploys = append(n.deploys, fmt.Sprintf("%s/%s", instanceKey(task.ServiceName, task.Instancenumber), task.Runtime))
+	n.lock.Unlock()
+	if err := n.failures[instanceKey(task.ServiceName, task.Instancenumber)]; err != nil {
+		task.Finish <- TaskReady{Err: err}
+		return
+	}
+	task.Finish <- TaskReady{IP: net.ParseIP(fmt.Sprintf("10.19.1.%d", task.Instancenumber+2)), IPv6: net.ParseIP("fc00::2")}
+}
+
+func TestReconcileServices(t *testing.T) {
+	deployed := func(runtime string, instance int) env.DeployedInstance {
+		return env.DeployedInstance{Runtime: runtime, ServiceName: "app.app.svc.svc", Instancenumber: instance}
+	}
+	desired := func(runtime string, instance int) *ContainerDeployTask {
+		return &ContainerDeployTask{Runtime: runtime, ServiceName: "app.app.svc.svc", Instancenumber: instance, Pid: 1}
+	}
+	tests := []struct {
+		name       string
+		deployed   []env.DeployedInstance
+		desired    []*ContainerDeployTask
+		failures   map[string]error
+		undeployed []string
+		deploys    []string
+		statuses   []string
+		failure    error
+	}{
+		{
+			name:     "nothing deployed",
+			desired:  []*ContainerDeployTask{desired(env.CONTAINER_RUNTIME, 0), desired(env.UNIKERNEL_RUNTIME, 1)},
+			deploys:  []string{"app.app.svc.svc.0/container", "app.app.svc.svc.1/unikernel"},
+			statuses: []string{"app.app.svc.svc.0 deployed 10.19.1.2", "app.app.svc.svc.1 deployed 10.19.1.3"},
+		},
+		{
+			// the desired instances are deployed again in place, the others are removed
+			name:       "instances no longer running",
+			deployed:   []env.DeployedInstance{deployed(env.CONTAINER_RUNTIME, 0), deployed(env.CONTAINER_RUNTIME, 1), deployed(env.NAMESPACE_RUNTIME, 2)},
+			desired:    []*ContainerDeployTask{desired(env.CONTAINER_RUNTIME, 0)},
+			undeployed: []string{"app.app.svc.svc.1/container", "app.app.svc.svc.2/namespace"},
+			deploys:    []string{"app.app.svc.svc.0/container"},
+			statuses:   []string{"app.app.svc.svc.0 deployed 10.19.1.2", "app.app.svc.svc.1 removed", "app.app.svc.svc.2 removed"},
+		},
+		{
+			// the instance is undeployed first, but not reported as removed
+			name:       "runtime changed",
+			deployed:   []env.DeployedInstance{deployed(env.CONTAINER_RUNTIME, 0)},
+			desired:    []*ContainerDeployTask{desired(env.UNIKERNEL_RUNTIME, 0)},
+			undeployed: []string{"app.app.svc.svc.0/container"},
+			deploys:    []string{"app.app.svc.svc.0/unikernel"},
+			statuses:   []string{"app.app.svc.svc.0 deployed 10.19.1.2"},
+		},
+		{
+			// the other instances are reconciled anyway
+			name:       "partial failure",
+			deployed:   []env.DeployedInstance{deployed(env.CONTAINER_RUNTIME, 0), deployed(env.CONTAINER_RUNTIME, 3)},
+			desired:    []*ContainerDeployTask{desired(env.CONTAINER_RUNTIME, 0), desired(env.CONTAINER_RUNTIME, 1), desired(env.CONTAINER_RUNTIME, 2)},
+			failures:   map[string]error{"app.app.svc.svc.1": network.ErrHostPortConflict},
+			undeployed: []string{"app.app.svc.svc.3/container"},
+			deploys:    []string{"app.app.svc.svc.0/container", "app.app.svc.svc.1/container", "app.app.svc.svc.2/container"},
+			statuses: []string{
+				"app.app.svc.svc.0 deployed 10.19.1.2",
+				"app.app.svc.svc.1 failed host port conflict",
+				"app.app.svc.svc.2 deployed 10.19.1.4",
+				"app.app.svc.svc.3 removed",
+			},
+			failure: network.ErrHostPortConflict,
+		},
+	}
+	for _, test := range tests {
+		node := &fakeNodeInstances{deployed: test.deployed, failures: test.failures}
+		manager := &ServicesManager{node: node}
+		desiredInstances := make(map[string]*ContainerDeployTask)
+		for _, task := range test.desired {
+			desiredInstances[instanceKey(task.ServiceName, task.Instancenumber)] = task
+		}
+
+		response, failure := manager.reconcile(desiredInstances, test.desired)
+		assert.Assert(t, errors.Is(failure, test.failure), "%s: %v", test.name, failure)
+		statuses := make([]string, 0, len(response.Instances))
+		for _, instance := range response.Instances {
+			status := fmt.Sprintf("%s %s %s%s", instanceKey(instance.ServiceName, instance.Instancenumber), instance.Status, instance.NsAddress, instance.Error)
+			statuses = append(statuses, strings.TrimSpace(status))
+		}
+		sort.Strings(statuses)
+		sort.Strings(node.undeployed)
+		sort.Strings(node.deploys)
+		assert.DeepEqual(t, statuses, test.statuses)
+		assert.DeepEqual(t, node.undeployed, test.undeployed)
+		assert.DeepEqual(t, node.deploys, test.deploys)
+	}
+}
+
+func TestReconcileServicesFailureStatus(t *testing.T) {
+	workerID := "worker"
+	node := &fakeNodeInstances{failures: map[string]error{"app.app.svc.svc.1": network.ErrHostPortConflict}}
+	manager := &ServicesManager{WorkerID: &workerID, node: node}
+	recorder := httptest.NewRecorder()
+	manager.reconcileServices(recorder, httptest.NewRequest(http.MethodPut, "/services", strings.NewReader(
+		`{"instances":[{"runtime":"container","serviceName":"app.app.svc.svc","instanceNumber":0,"pid":1},
+			{"runtime":"container","serviceName":"app.app.svc.svc","instanceNumber":1,"pid":1}]}`)))
+	assert.Equal(t, recorder.Code, http.StatusConflict)
+	assert.Assert(t, strings.Contains(recorder.Body.String(), `"status":"failed"`))
+	assert.Assert(t, strings.Contains(recorder.Body.String(), `"nsAddress":"10.19.1.2"`))
+}
@@ -0,0 +1,250 @@
+package handlers
+
+import (
+	"NetManager/env"
+	"NetManager/logger"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	TASK_PENDING   = "pending"
+	TASK_RUNNING   = "running"
+	TASK_SUCCEEDED = "succeeded"
+	TASK_FAILED    = "failed"
+	TASK_CANCELLED = "cancelled"
+
+	// DEFAULT_TASK_TIMEOUT is the deadline of the deployments not giving their own
+	DEFAULT_TASK_TIMEOUT = 2 * time.Minute
+	// TASK_RETENTION is for how long the finished tasks can be queried
+	TASK_RETENTION = 10 * time.Minute
+	// MAX_CONCURRENT_DEPLOYMENTS bounds the deployments running at the same time
+	MAX_CONCURRENT_DEPLOYMENTS = 8
+)
+
+var (
+	ErrTaskCancelled = errors.New("deployment cancelled")
+	ErrTaskTimeout   = errors.New("deployment timed out")
+	ErrTaskFinished  = errors.New("deployment already finished")
+	ErrTaskNotFound  = errors.New("no such task")
+)
+
+// TaskStatus is the state of a deployment task
+type TaskStatus struct {
+	ID             string    `json:"id"`
+	Status         string    `json:"status"`
+	ServiceName    string    `json:"serviceName"`
+	Instancenumber int       `json:"instanceNumber"`
+	Runtime        string    `json:"runtime"`
+	Created        time.Time `json:"created"`
+	// set once the task is succeeded, failed or cancelled
+	Finished *time.Time `json:"finished,omitempty"`
+	Error    string     `json:"error,omitempty"`
+	// the deploy response, succeeded tasks only
+	Result *DeployResponse `json:"result,omitempty"`
+}
+
+func newTaskID() string {
+	id := make([]byte, 16)
+	_, _ = rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// taskContextError is the error of a task whose context is done
+func taskContextError(err error) error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return ErrTaskTimeout
+	}
+	return ErrTaskCancelled
+}
+
+func (t *deployTaskQueue) setStatus(task *ContainerDeployTask, status string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	task.status = status
+}
+
+// finish records the result of the task, returns whether the deployment ran
+func (t *deployTaskQueue) finish(task *ContainerDeployTask, result TaskReady) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	ran := task.status == TASK_RUNNING
+	task.result = result
+	task.finished = time.Now()
+	switch {
+	case result.Err == nil:
+		task.status = TASK_SUCCEEDED
+	case errors.Is(result.Err, ErrTaskCancelled):
+		task.status = TASK_CANCELLED
+	default:
+		task.status = TASK_FAILED
+	}
+	return ran
+}
+
+// purgeFinishedTasks forgets the tasks finished since more than TASK_RETENTION, the lock MUST be held by the caller
+func (t *deployTaskQueue) purgeFinishedTasks() {
+	for id, task := range t.tasks {
+		if !task.finished.IsZero() && time.Since(task.finished) > TASK_RETENTION {
+			delete(t.tasks, id)
+		}
+	}
+}
+
+// Task returns the state of the task
+func (t *deployTaskQueue) Task(id string) (TaskStatus, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	task, ok := t.tasks[id]
+	if !ok {
+		return TaskStatus{}, false
+	}
+	return task.taskStatus(), true
+}
+
+// CancelTask stops a pending or running task, the applied steps of the deployment are rolled back
+func (t *deployTaskQueue) CancelTask(id string) (TaskStatus, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	task, ok := t.tasks[id]
+	if !ok {
+		return TaskStatus{}, ErrTaskNotFound
+	}
+	if !task.finished.IsZero() {
+		return task.taskStatus(), ErrTaskFinished
+	}
+	task.cancel()
+	return task.taskStatus(), nil
+}
+
+// taskStatus the lock of the queue MUST be held by the caller
+func (task *ContainerDeployTask) taskStatus() TaskStatus {
+	status := TaskStatus{
+		ID:             task.ID,
+		Status:         task.status,
+		ServiceName:    task.ServiceName,
+		Instancenumber: task.Instancenumber,
+		Runtime:        task.Runtime,
+		Created:        task.created,
+	}
+	if task.finished.IsZero() {
+		return status
+	}
+	finished := task.finished
+	status.Finished = &finished
+	if task.result.Err != nil {
+		status.Error = task.result.Err.Error()
+	} else {
+		response := deployResponse(task, task.result)
+		status.Result = &response
+	}
+	return status
+}
+
+// deployResponse is the answer to a successful deployment
+func deployResponse(task *ContainerDeployTask, result TaskReady) DeployResponse {
+	response := DeployResponse{
+		ServiceName: task.ServiceName,
+		NsAddress:   result.IP.String(),
+		NsAddressv6: result.IPv6.String(),
+	}
+	if task.Env == nil {
+		return response
+	}
+	if task.Runtime == env.UNIKERNEL_RUNTIME {
+		if unikernel, ok := task.Env.GetUnikernelNetwork(task.ServiceName, task.Instancenumber); ok {
+			response.Unikernel = unikernel
+		}
+		return response
+	}
+	if gateway := task.Env.BridgeAddress(false); gateway != nil {
+		response.Gateway = gateway.String()
+	}
+	if gatewayv6 := task.Env.BridgeAddress(true); gatewayv6 != nil {
+		response.Gatewayv6 = gatewayv6.String()
+	}
+	return response
+}
+
+// asyncRequested tells whether the caller wants the task instead of waiting for the deployment, with ?async=true
+func asyncRequested(request *http.Request) bool {
+	return request.URL.Query().Get("async") == "true"
+}
+
+// acceptDeployTask starts the deployment and answers at once with the task, 202 Accepted, located under tasksPath
+func acceptDeployTask(writer http.ResponseWriter, task *ContainerDeployTask, tasksPath string) {
+	task.Writer = nil
+	task.Finish = nil
+	queue := NewDeployTaskQueue()
+	queue.NewTask(task)
+	status, _ := queue.Task(task.ID)
+	writer.Header().Set("Location", tasksPath+task.ID)
+	writeTaskStatus(writer, status, http.StatusAccepted)
+}
+
+func writeTaskStatus(writer http.ResponseWriter, status TaskStatus, code int) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(code)
+	if err := json.NewEncoder(writer).Encode(status); err != nil {
+		logger.ErrorLogger().Println("[ERROR]: unable to encode the task:", err)
+	}
+}
+
+func registerTaskHandlers(Router *mux.Router) {
+	Router.HandleFunc("/tasks/{id}", getTask).Methods("GET")
+	Router.HandleFunc("/tasks/{id}", cancelTask).Methods("DELETE")
+}
+
+/*
+Endpoint: /tasks/{id}
+Usage: used to poll a deployment started with ?async=true
+Method: GET
+Response Json:
+
+	{
+		id:string
+		status:string # pending, running, succeeded, failed or cancelled
+		serviceName:string
+		instanceNumber:int
+		runtime:string
+		created:string
+		finished:string # once the task is over
+		error:string # failed and cancelled tasks
+		result:{} # the deploy response, succeeded tasks
+	}
+
+Response: 200 OK or 404 once the task is forgotten, TASK_RETENTION after it finished
+*/
+func getTask(writer http.ResponseWriter, request *http.Request) {
+	status, ok := NewDeployTaskQueue().Task(mux.Vars(request)["id"])
+	if !ok {
+		http.Error(writer, ErrTaskNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	writeTaskStatus(writer, status, http.StatusOK)
+}
+
+/*
+Endpoint: /tasks/{id}
+Usage: used to cancel a pending or running deployment, the applied steps are rolled back
+Method: DELETE
+Response: 202 Accepted with the task, 404 for unknown tasks, 409 if the deployment is already over. Use the undeploy endpoints then.
+*/
+func cancelTask(writer http.ResponseWriter, request *http.Request) {
+	status, err := NewDeployTaskQueue().CancelTask(mux.Vars(request)["id"])
+	switch {
+	case errors.Is(err, ErrTaskNotFound):
+		http.Error(writer, err.Error(), http.StatusNotFound)
+	case errors.Is(err, ErrTaskFinished):
+		writeTaskStatus(writer, status, http.StatusConflict)
+	default:
+		writeTaskStatus(writer, status, http.StatusAccepted)
+	}
+}
@@ -0,0 +1,170 @@
+package handlers
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gotest.tools/assert"
+)
+
+// blockingDeploy holds the deployments until released or cancelled
+type blockingDeploy struct {
+	started  chan string
+	release  chan struct{}
+	finished chan string
+}
+
+func newBlockingDeploy() *blockingDeploy {
+	return &blockingDeploy{
+		started:  make(chan string, 10),
+		release:  make(chan struct{}),
+		finished: make(chan string, 10),
+	}
+}
+
+func (d *blockingDeploy) deploy(task *ContainerDeployTask) (net.IP, net.IP, error) {
+	d.started <- task.ID
+	select {
+	case <-d.release:
+		return net.ParseIP("10.19.1.2"), net.ParseIP("fc00::2"), nil
+	case <-task.ctx.Done():
+		return nil, nil, task.ctx.Err()
+	}
+}
+
+func (d *blockingDeploy) afterDeploy(task *ContainerDeployTask) {
+	d.finished <- task.ID
+}
+
+func waitTask(t *testing.T, queue *deployTaskQueue, id string, status string) TaskStatus {
+	t.Helper()
+	for i := 0; i < 200; i++ {
+		if task, _ := queue.Task(id); task.Status == status {
+			return task
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	task, _ := queue.Task(id)
+	t.Fatalf("task %s is %s instead of %s", id, task.Status, status)
+	return task
+}
+
+func TestDeployTaskConcurrency(t *testing.T) {
+	deploy := newBlockingDeploy()
+	queue := newDeployTaskQueue(deploy.deploy, deploy.afterDeploy)
+
+	first := &ContainerDeployTask{ServiceName: "app.app.svc.svc", Instancenumber: 0}
+	same := &ContainerDeployTask{ServiceName: "app.app.svc.svc", Instancenumber: 0, Finish: make(chan TaskReady, 1)}
+	other := &ContainerDeployTask{ServiceName: "app.app.svc.svc", Instancenumber: 1}
+	queue.NewTask(first)
+	<-deploy.started
+	queue.NewTask(same)
+	queue.NewTask(other)
+
+	// another instance runs at once, the same instance waits for the first deployment
+	assert.Equal(t, <-deploy.started, other.ID)
+	waitTask(t, queue, first.ID, TASK_RUNNING)
+	waitTask(t, queue, same.ID, TASK_PENDING)
+
+	deploy.release <- struct{}{}
+	deploy.release <- struct{}{}
+	assert.Equal(t, <-deploy.started, same.ID)
+	deploy.release <- struct{}{}
+	result := <-same.Finish
+	assert.NilError(t, result.Err)
+	assert.Equal(t, result.IP.String(), "10.19.1.2")
+
+	status := waitTask(t, queue, first.ID, TASK_SUCCEEDED)
+	assert.Equal(t, status.Result.NsAddress, "10.19.1.2")
+	assert.Equal(t, status.Result.NsAddressv6, "fc00::2")
+	assert.Assert(t, status.Finished != nil)
+	for i := 0; i < 3; i++ {
+		<-deploy.finished
+	}
+	assert.Equal(t, len(queue.instances), 0)
+}
+
+func TestDeployTaskCancel(t *testing.T) {
+	deploy := newBlockingDeploy()
+	queue := newDeployTaskQueue(deploy.deploy, deploy.afterDeploy)
+
+	running := &ContainerDeployTask{ServiceName: "app.app.svc.svc", Instancenumber: 0}
+	pending := &ContainerDeployTask{ServiceName: "app.app.svc.svc", Instancenumber: 0}
+	queue.NewTask(running)
+	<-deploy.started
+	queue.NewTask(pending)
+	waitTask(t, queue, pending.ID, TASK_PENDING)
+
+	// a pending task never runs
+	_, err := queue.CancelTask(pending.ID)
+	assert.NilError(t, err)
+	status := waitTask(t, queue, pending.ID, TASK_CANCELLED)
+	assert.Equal(t, status.Error, ErrTaskCancelled.Error())
+
+	// a running task is rolled back
+	_, err = queue.CancelTask(running.ID)
+	assert.NilError(t, err)
+	waitTask(t, queue, running.ID, TASK_CANCELLED)
+	assert.Equal(t, <-deploy.finished, running.ID)
+	assert.Equal(t, len(deploy.finished), 0)
+
+	_, err = queue.CancelTask(running.ID)
+	assert.Assert(t, errors.Is(err, ErrTaskFinished))
+	_, err = queue.CancelTask("unknown")
+	assert.Assert(t, errors.Is(err, ErrTaskNotFound))
+}
+
+func TestDeployTaskTimeout(t *testing.T) {
+	deploy := newBlockingDeploy()
+	queue := newDeployTaskQueue(deploy.deploy, deploy.afterDeploy)
+
+	task := &ContainerDeployTask{ServiceName: "app.app.svc.svc", Instancenumber: 0, Timeout: 1, Finish: make(chan TaskReady, 1)}
+	queue.NewTask(task)
+	result := <-task.Finish
+	assert.Assert(t, errors.Is(result.Err, ErrTaskTimeout))
+	assert.Equal(t, deployErrorStatus(result.Err), http.StatusGatewayTimeout)
+	status, _ := queue.Task(task.ID)
+	assert.Equal(t, status.Status, TASK_FAILED)
+}
+
+func TestUndeployWaitsForDeployment(t *testing.T) {
+	deploy := newBlockingDeploy()
+	queue := newDeployTaskQueue(deploy.deploy, deploy.afterDeploy)
+
+	task := &ContainerDeployTask{ServiceName: "app.app.svc.svc", Instancenumber: 0, Finish: make(chan TaskReady, 1)}
+	queue.NewTask(task)
+	<-deploy.started
+	detached := make(chan bool, 2)
+	go func() {
+		detached <- queue.undeploy("app.app.svc.svc", 0, func() bool { return true })
+	}()
+	// another instance is not held back
+	assert.Assert(t, !queue.undeploy("app.app.svc.svc", 1, func() bool { return false }))
+
+	select {
+	case <-detached:
+		t.Fatal("the instance was undeployed during its deployment")
+	case <-time.After(50 * time.Millisecond):
+	}
+	deploy.release <- struct{}{}
+	assert.NilError(t, (<-task.Finish).Err)
+	assert.Assert(t, <-detached)
+	<-deploy.finished
+	assert.Equal(t, len(queue.instances), 0)
+}
+
+func TestTaskEndpoints(t *testing.T) {
+	router := mux.NewRouter()
+	registerTaskHandlers(router)
+
+	for _, method := range []string{http.MethodGet, http.MethodDelete} {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(method, "/tasks/unknown", nil))
+		assert.Equal(t, recorder.Code, http.StatusNotFound, method)
+	}
+}
@@ -0,0 +1,302 @@
+package handlers
+
+import (
+	"NetManager/env"
+	"NetManager/logger"
+	"NetManager/network"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// V2_PREFIX is the path prefix of the validated API, the /v1 routes are unchanged
+const V2_PREFIX = "/v2"
+
+//go:embed openapi.json
+var openAPIDocument []byte
+
+// V2API serves the /v2 routes: typed requests, validated before any deployment, and problem+json errors
+type V2API struct {
+	Env           *env.Environment
+	WorkerID      *string
+	Configuration netConfiguration
+	services      *ServicesManager
+}
+
+var v2API = &V2API{}
+
+// deployRequestV2 is the deploy request of all the runtimes, unknown fields are rejected
+type deployRequestV2 struct {
+	Pid             int                     `json:"pid"`
+	Netns           string                  `json:"netns"`
+	NetnsFd         *int                    `json:"netnsFd"`
+	Ifname          string                  `json:"ifname"`
+	ServiceName     string                  `json:"serviceName"`
+	InstanceNumber  int                     `json:"instanceNumber"`
+	PortMappings    network.PortMappings    `json:"portMappings"`
+	PublicExposures network.PublicExposures `json:"publicExposures"`
+	Unikernel       *env.UnikernelTopology  `json:"unikernel"`
+	Timeout         int                     `json:"timeout"`
+}
+
+type undeployRequestV2 struct {
+	ServiceName    string `json:"serviceName"`
+	InstanceNumber int    `json:"instanceNumber"`
+}
+
+type desiredInstanceV2 struct {
+	deployRequestV2
+	Runtime string `json:"runtime"`
+}
+
+type servicesRequestV2 struct {
+	Instances []desiredInstanceV2 `json:"instances"`
+}
+
+func (r deployRequestV2) task(runtime string) *ContainerDeployTask {
+	return &ContainerDeployTask{
+		Pid:             r.Pid,
+		Netns:           r.Netns,
+		NetnsFd:         r.NetnsFd,
+		Ifname:          r.Ifname,
+		ServiceName:     r.ServiceName,
+		Instancenumber:  r.InstanceNumber,
+		PortMappings:    r.PortMappings,
+		PublicExposures: r.PublicExposures,
+		Unikernel:       r.Unikernel,
+		Timeout:         r.Timeout,
+		Runtime:         runtime,
+	}
+}
+
+func (a *V2API) Register(Env *env.Environment, WorkerID *string, NodePublicAddress string, NodePublicPort string, Router *mux.Router) {
+	a.Env = Env
+	a.WorkerID = WorkerID
+	a.Configuration = netConfiguration{NodePublicAddress: NodePublicAddress, NodePublicPort: NodePublicPort}
+	a.services = &ServicesManager{Env: Env, WorkerID: WorkerID, Configuration: a.Configuration}
+
+	v2 := Router.PathPrefix(V2_PREFIX).Subrouter()
+	for _, runtime := range []string{env.CONTAINER_RUNTIME, env.NAMESPACE_RUNTIME, env.UNIKERNEL_RUNTIME} {
+		v2.HandleFunc(fmt.Sprintf("/%s/deploy", runtime), a.deploy(runtime)).Methods("POST")
+		v2.HandleFunc(fmt.Sprintf("/%s/undeploy", runtime), a.undeploy(runtime)).Methods("POST")
+	}
+	v2.HandleFunc("/services", a.reconcileServices).Methods("PUT")
+	v2.HandleFunc("/tasks/{id}", a.getTask).Methods("GET")
+	v2.HandleFunc("/tasks/{id}", a.cancelTask).Methods("DELETE")
+	v2.HandleFunc("/events", streamEvents).Methods("GET")
+	v2.HandleFunc("/openapi.json", a.openAPI).Methods("GET")
+}
+
+// registered answers with node-not-registered until the NetManager is registered to the cluster
+func (a *V2API) registered(writer http.ResponseWriter, request *http.Request) bool {
+	if *a.WorkerID == "" {
+		log.Printf("[ERROR] Node not initialized")
+		WriteProblem(writer, request, http.StatusServiceUnavailable, PROBLEM_NODE_NOT_REGISTERED, "register the NetManager with POST /v2/register first")
+		return false
+	}
+	return true
+}
+
+/*
+Endpoint: /v2/{container,namespace,unikernel}/deploy
+Usage: used to assign a network to an instance of the runtime, the request is validated before any deployment.
+Method: POST, ?async=true answers at once with the task of the deployment, see /v2/tasks/{id}
+Request Json: the deploy request of the runtime, see /v2/openapi.json. Unknown fields are rejected.
+Response Json: the deploy response of the runtime
+Response: 200 OK, 202 Accepted with ?async=true, or a problem+json body: 400 invalid-json, 422 validation-failed,
+409 host-port-conflict or instance-conflict, 503 node-not-registered, 504 deployment-timeout, 500 deployment-failed
+*/
+func (a *V2API) deploy(runtime string) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		log.Printf("Received HTTP request - %s ", request.URL.Path)
+		if !a.registered(writer, request) {
+			return
+		}
+
+		var deployRequest deployRequestV2
+		if err := DecodeRequest(request, &deployRequest); err != nil {
+			WriteDecodeProblem(writer, request, err)
+			return
+		}
+		if fields := deployRequest.validate(runtime); len(fields) > 0 {
+			WriteProblem(writer, request, http.StatusUnprocessableEntity, PROBLEM_VALIDATION_FAILED, "", fields...)
+			return
+		}
+		task := deployRequest.task(runtime)
+		task.PublicAddr = a.Configuration.NodePublicAddress
+		task.PublicPort = a.Configuration.NodePublicPort
+		task.Env = a.Env
+		if asyncRequested(request) {
+			acceptDeployTask(writer, task, V2_PREFIX+"/tasks/")
+			return
+		}
+		task.Finish = make(chan TaskReady, 1)
+
+		logger.DebugLogger().Println(task)
+		NewDeployTaskQueue().NewTask(task)
+		result := <-task.Finish
+		if result.Err != nil {
+			writeDeployProblem(writer, request, result.Err)
+			return
+		}
+		writeJSON(writer, http.StatusOK, deployResponse(task, result))
+	}
+}
+
+/*
+Endpoint: /v2/{container,namespace,unikernel}/undeploy
+Usage: used to remove the network of an instance of the runtime
+Method: POST
+Request Json:
+
+	{
+		serviceName:string
+		instanceNumber:int
+	}
+
+Response: 204 No Content, or a problem+json body: 400 invalid-json, 422 validation-failed, 404 instance-not-found, 503 node-not-registered
+*/
+func (a *V2API) undeploy(runtime string) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		log.Printf("Received HTTP request - %s ", request.URL.Path)
+		if !a.registered(writer, request) {
+			return
+		}
+
+		var undeployRequest undeployRequestV2
+		if err := DecodeRequest(request, &undeployRequest); err != nil {
+			WriteDecodeProblem(writer, request, err)
+			return
+		}
+		if fields := validateInstance(undeployRequest.ServiceName, undeployRequest.InstanceNumber); len(fields) > 0 {
+			WriteProblem(writer, request, http.StatusUnprocessableEntity, PROBLEM_VALIDATION_FAILED, "", fields...)
+			return
+		}
+		if !undeployInstance(a.Env, runtime, undeployRequest.ServiceName, undeployRequest.InstanceNumber) {
+			WriteProblem(writer, request, http.StatusNotFound, PROBLEM_INSTANCE_NOT_FOUND,
+				fmt.Sprintf("%s.%d is not deployed", undeployRequest.ServiceName, undeployRequest.InstanceNumber))
+			return
+		}
+		writer.WriteHeader(http.StatusNoContent)
+	}
+}
+
+/*
+Endpoint: /v2/services
+Usage: used to reconcile the network of the node with all the instances the NodeEngine runs, see /services
+Method: PUT
+Request Json: {instances: [{runtime:string, ... the deploy request of the runtime}]}
+Response Json: {instances: [{serviceName, instanceNumber, runtime, status, error, nsAddress, nsAddressv6}]}
+Response: 200 OK once all the instances are reconciled, or a problem+json body: 400 invalid-json, 422 validation-failed,
+503 node-not-registered. The problem of the first failed deployment lists the failed instances in its errors.
+*/
+func (a *V2API) reconcileServices(writer http.ResponseWriter, request *http.Request) {
+	log.Println("Received HTTP request - /v2/services ")
+	if !a.registered(writer, request) {
+		return
+	}
+
+	var requestStruct servicesRequestV2
+	if err := DecodeRequest(request, &requestStruct); err != nil {
+		WriteDecodeProblem(writer, request, err)
+		return
+	}
+	fields := make([]FieldError, 0)
+	desired := make(map[string]*ContainerDeployTask, len(requestStruct.Instances))
+	tasks := make([]*ContainerDeployTask, 0, len(requestStruct.Instances))
+	for i, instance := range requestStruct.Instances {
+		prefix := fmt.Sprintf("instances[%d].", i)
+		switch instance.Runtime {
+		case env.CONTAINER_RUNTIME, env.NAMESPACE_RUNTIME, env.UNIKERNEL_RUNTIME:
+		default:
+			fields = append(fields, FieldError{Field: prefix + "runtime", Reason: fmt.Sprintf("unknown runtime %q", instance.Runtime)})
+			continue
+		}
+		for _, field := range instance.validate(instance.Runtime) {
+			fields = append(fields, FieldError{Field: prefix + field.Field, Reason: field.Reason})
+		}
+		key := instanceKey(instance.ServiceName, instance.InstanceNumber)
+		if _, exist := desired[key]; exist {
+			fields = append(fields, FieldError{Field: prefix + "serviceName", Reason: fmt.Sprintf("instance %s listed twice", key)})
+			continue
+		}
+		task := instance.task(instance.Runtime)
+		desired[key] = task
+		tasks = append(tasks, task)
+	}
+	if len(fields) > 0 {
+		WriteProblem(writer, request, http.StatusUnprocessableEntity, PROBLEM_VALIDATION_FAILED, "", fields...)
+		return
+	}
+
+	response, failure := a.services.reconcile(desired, tasks)
+	if failure != nil {
+		failed := make([]FieldError, 0)
+		for i, instance := range response.Instances {
+			if instance.Status == INSTANCE_FAILED {
+				failed = append(failed, FieldError{Field: fmt.Sprintf("instances[%d]", i), Reason: instance.Error})
+			}
+		}
+		WriteProblem(writer, request, deployErrorStatus(failure), deployProblemCode(failure), failure.Error(), failed...)
+		return
+	}
+	writeJSON(writer, http.StatusOK, response)
+}
+
+/*
+Endpoint: /v2/tasks/{id}
+Usage: used to poll a deployment started with ?async=true
+Method: GET
+Response Json: the task, see /tasks/{id}
+Response: 200 OK or a problem+json body: 404 task-not-found
+*/
+func (a *V2API) getTask(writer http.ResponseWriter, request *http.Request) {
+	status, ok := NewDeployTaskQueue().Task(mux.Vars(request)["id"])
+	if !ok {
+		WriteProblem(writer, request, http.StatusNotFound, PROBLEM_TASK_NOT_FOUND, ErrTaskNotFound.Error())
+		return
+	}
+	writeTaskStatus(writer, status, http.StatusOK)
+}
+
+/*
+Endpoint: /v2/tasks/{id}
+Usage: used to cancel a pending or running deployment, the applied steps are rolled back
+Method: DELETE
+Response: 202 Accepted with the task, or a problem+json body: 404 task-not-found, 409 task-finished
+*/
+func (a *V2API) cancelTask(writer http.ResponseWriter, request *http.Request) {
+	status, err := NewDeployTaskQueue().CancelTask(mux.Vars(request)["id"])
+	switch {
+	case errors.Is(err, ErrTaskNotFound):
+		WriteProblem(writer, request, http.StatusNotFound, PROBLEM_TASK_NOT_FOUND, err.Error())
+	case errors.Is(err, ErrTaskFinished):
+		WriteProblem(writer, request, http.StatusConflict, PROBLEM_TASK_FINISHED, fmt.Sprintf("task %s is %s", status.ID, status.Status))
+	default:
+		writeTaskStatus(writer, status, http.StatusAccepted)
+	}
+}
+
+/*
+Endpoint: /v2/openapi.json
+Usage: used to fetch the OpenAPI 3 description of the /v2 API
+Method: GET
+Response: 200 OK
+*/
+func (a *V2API) openAPI(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Content-Type", "application/json")
+	_, _ = writer.Write(openAPIDocument)
+}
+
+func writeJSON(writer http.ResponseWriter, status int, v interface{}) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	if err := json.NewEncoder(writer).Encode(v); err != nil {
+		logger.ErrorLogger().Println("[ERROR]: unable to encode the response:", err)
+	}
+}
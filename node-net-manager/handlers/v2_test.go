@@ -0,0 +1,183 @@
+package handlers
+
+import (
+	"NetManager/env"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"gotest.tools/assert"
+)
+
+func newTestV2Router(workerID *string) *mux.Router {
+	router := mux.NewRouter()
+	api := &V2API{}
+	api.Register(&env.Environment{}, workerID, "127.0.0.1", "50103", router)
+	return router
+}
+
+func serveV2(router *mux.Router, method string, path string, body string) (*httptest.ResponseRecorder, Problem) {
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(method, path, strings.NewReader(body)))
+	var problem Problem
+	if recorder.Header().Get("Content-Type") == PROBLEM_MIME_TYPE {
+		_ = json.Unmarshal(recorder.Body.Bytes(), &problem)
+	}
+	return recorder, problem
+}
+
+func TestV2NodeNotRegistered(t *testing.T) {
+	workerID := ""
+	router := newTestV2Router(&workerID)
+
+	recorder, problem := serveV2(router, http.MethodPost, "/v2/container/deploy", `{}`)
+	assert.Equal(t, recorder.Code, http.StatusServiceUnavailable)
+	assert.Equal(t, problem.Code, PROBLEM_NODE_NOT_REGISTERED)
+	assert.Equal(t, problem.Type, PROBLEM_TYPE_PREFIX+PROBLEM_NODE_NOT_REGISTERED)
+	assert.Equal(t, problem.Status, http.StatusServiceUnavailable)
+	assert.Equal(t, problem.Instance, "/v2/container/deploy")
+}
+
+func TestV2InvalidJSON(t *testing.T) {
+	workerID := "worker"
+	router := newTestV2Router(&workerID)
+
+	for _, body := range []string{
+		`{`,
+		`{"serviceName":"app.app.svc.svc","unknown":1}`,
+		`{"serviceName":"app.app.svc.svc"} {}`,
+		`{"instanceNumber":"0"}`,
+	} {
+		recorder, problem := serveV2(router, http.MethodPost, "/v2/namespace/deploy", body)
+		assert.Equal(t, recorder.Code, http.StatusBadRequest, body)
+		assert.Equal(t, problem.Code, PROBLEM_INVALID_JSON, body)
+	}
+}
+
+func TestV2DeployValidation(t *testing.T) {
+	workerID := "worker"
+	router := newTestV2Router(&workerID)
+
+	tests := []struct {
+		path   string
+		body   string
+		fields []string
+	}{
+		{"/v2/container/deploy", `{"serviceName":"app.svc","instanceNumber":0,"pid":1}`, []string{"serviceName"}},
+		{"/v2/container/deploy", `{"serviceName":"app..svc.svc","instanceNumber":-1,"pid":1}`, []string{"serviceName", "instanceNumber"}},
+		{"/v2/container/deploy", `{"serviceName":"app.app.svc.svc","instanceNumber":0}`, []string{"pid"}},
+		{"/v2/container/deploy", `{"serviceName":"app.app.svc.svc","instanceNumber":0,"pid":1,"ifname":"a-much-too-long-name"}`, []string{"ifname"}},
+		{"/v2/container/deploy", `{"serviceName":"app.app.svc.svc","instanceNumber":0,"pid":1,"timeout":-1}`, []string{"timeout"}},
+		{"/v2/container/deploy", `{"serviceName":"app.app.svc.svc","instanceNumber":0,"pid":1,"unikernel":{"taps":2}}`, []string{"unikernel"}},
+		{"/v2/container/deploy", `{"serviceName":"app.app.svc.svc","instanceNumber":0,"pid":1,"portMappings":[{"hostPort":0}]}`, []string{}},
+		{"/v2/namespace/deploy", `{"serviceName":"app.app.svc.svc","instanceNumber":0}`, []string{"netns"}},
+		{"/v2/namespace/deploy", `{"serviceName":"app.app.svc.svc","instanceNumber":0,"netnsFd":3}`, []string{"netnsFd"}},
+		{"/v2/unikernel/deploy", `{"serviceName":"app.app.svc.svc","instanceNumber":0,"unikernel":{"taps":-1}}`, []string{"unikernel"}},
+		{"/v2/unikernel/deploy", `{"serviceName":"app.app.svc.svc","instanceNumber":0,"publicExposures":[{"mode":"node"}]}`, []string{"publicExposures"}},
+	}
+	for _, test := range tests {
+		recorder, problem := serveV2(router, http.MethodPost, test.path, test.body)
+		assert.Equal(t, recorder.Code, http.StatusUnprocessableEntity, test.body)
+		assert.Equal(t, problem.Code, PROBLEM_VALIDATION_FAILED, test.body)
+		fields := make([]string, 0, len(problem.Errors))
+		for _, field := range problem.Errors {
+			fields = append(fields, field.Field)
+		}
+		assert.DeepEqual(t, fields, test.fields)
+	}
+}
+
+func TestV2UndeployNotFound(t *testing.T) {
+	workerID := "worker"
+	router := newTestV2Router(&workerID)
+
+	recorder, problem := serveV2(router, http.MethodPost, "/v2/container/undeploy", `{"serviceName":"app.app.svc.svc","instanceNumber":0}`)
+	assert.Equal(t, recorder.Code, http.StatusNotFound)
+	assert.Equal(t, problem.Code, PROBLEM_INSTANCE_NOT_FOUND)
+
+	recorder, problem = serveV2(router, http.MethodPost, "/v2/container/undeploy", `{"serviceName":"app","instanceNumber":0}`)
+	assert.Equal(t, recorder.Code, http.StatusUnprocessableEntity)
+	assert.Equal(t, problem.Code, PROBLEM_VALIDATION_FAILED)
+}
+
+func TestV1UndeployNotDeployed(t *testing.T) {
+	workerID := "worker"
+	router := mux.NewRouter()
+	environment := &env.Environment{}
+	(&ContainerManager{}).Register(environment, &workerID, "127.0.0.1", "50103", router)
+	(&NamespaceManager{}).Register(environment, &workerID, "127.0.0.1", "50103", router)
+	(&UnikernelManager{}).Register(environment, &workerID, "127.0.0.1", "50103", router)
+
+	// the /v1 undeploy stays idempotent
+	for _, path := range []string{"/container/undeploy", "/docker/undeploy", "/namespace/undeploy", "/unikernel/undeploy"} {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, path, strings.NewReader(`{"serviceName":"app.app.svc.svc","instanceNumber":0}`)))
+		assert.Equal(t, recorder.Code, http.StatusOK, path)
+	}
+}
+
+func TestV2ServicesValidation(t *testing.T) {
+	workerID := "worker"
+	router := newTestV2Router(&workerID)
+
+	recorder, problem := serveV2(router, http.MethodPut, "/v2/services", `{"instances":[
+		{"runtime":"vm","serviceName":"app.app.svc.svc","instanceNumber":0},
+		{"runtime":"container","serviceName":"app.app.svc.svc","instanceNumber":1,"pid":1},
+		{"runtime":"unikernel","serviceName":"app.app.svc.svc","instanceNumber":1}]}`)
+	assert.Equal(t, recorder.Code, http.StatusUnprocessableEntity)
+	assert.Equal(t, problem.Code, PROBLEM_VALIDATION_FAILED)
+	assert.DeepEqual(t, problem.Errors, []FieldError{
+		{Field: "instances[0].runtime", Reason: `unknown runtime "vm"`},
+		{Field: "instances[2].serviceName", Reason: "instance app.app.svc.svc.1 listed twice"},
+	})
+}
+
+func TestV2Tasks(t *testing.T) {
+	workerID := "worker"
+	router := newTestV2Router(&workerID)
+
+	recorder, problem := serveV2(router, http.MethodGet, "/v2/tasks/unknown", "")
+	assert.Equal(t, recorder.Code, http.StatusNotFound)
+	assert.Equal(t, problem.Code, PROBLEM_TASK_NOT_FOUND)
+
+	recorder, problem = serveV2(router, http.MethodDelete, "/v2/tasks/unknown", "")
+	assert.Equal(t, recorder.Code, http.StatusNotFound)
+	assert.Equal(t, problem.Code, PROBLEM_TASK_NOT_FOUND)
+}
+
+func TestV2OpenAPI(t *testing.T) {
+	workerID := ""
+	router := newTestV2Router(&workerID)
+
+	recorder, _ := serveV2(router, http.MethodGet, "/v2/openapi.json", "")
+	assert.Equal(t, recorder.Code, http.StatusOK)
+	var document struct {
+		OpenAPI string                            `json:"openapi"`
+		Paths   map[string]map[string]interface{} `json:"paths"`
+	}
+	assert.NilError(t, json.Unmarshal(recorder.Body.Bytes(), &document))
+	assert.Equal(t, document.OpenAPI, "3.0.3")
+
+	// every /v2 route is documented
+	err := router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		path, err := route.GetPathTemplate()
+		if err != nil || path == V2_PREFIX {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil
+		}
+		operations, ok := document.Paths[path]
+		assert.Assert(t, ok, path)
+		for _, method := range methods {
+			_, ok := operations[strings.ToLower(method)]
+			assert.Assert(t, ok, "%s %s", method, path)
+		}
+		return nil
+	})
+	assert.NilError(t, err)
+}
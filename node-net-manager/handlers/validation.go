@@ -0,0 +1,126 @@
+package handlers
+
+import (
+	"NetManager/env"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const (
+	// MAX_REQUEST_SIZE bounds the /v2 request bodies
+	MAX_REQUEST_SIZE = 1 << 20
+	// MAX_IFNAME_LENGTH is the longest interface name accepted by the kernel
+	MAX_IFNAME_LENGTH = 15
+)
+
+// ErrInvalidJSON is returned by DecodeRequest for the bodies which are not valid JSON for the request
+var ErrInvalidJSON = errors.New("invalid JSON body")
+
+// DecodeRequest reads the JSON body into v, rejecting the unknown fields and any data after the JSON value.
+// The errors of malformed bodies wrap ErrInvalidJSON, the other ones are values rejected by their type, e.g. invalid port mappings.
+func DecodeRequest(request *http.Request, v interface{}) error {
+	body, err := io.ReadAll(io.LimitReader(request.Body, MAX_REQUEST_SIZE+1))
+	if err != nil {
+		return fmt.Errorf("%w: unable to read the request: %v", ErrInvalidJSON, err)
+	}
+	if len(body) > MAX_REQUEST_SIZE {
+		return fmt.Errorf("%w: request larger than %d bytes", ErrInvalidJSON, MAX_REQUEST_SIZE)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		var syntaxErr *json.SyntaxError
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) || errors.Is(err, io.EOF) ||
+			errors.Is(err, io.ErrUnexpectedEOF) || strings.HasPrefix(err.Error(), "json: ") {
+			return fmt.Errorf("%w: %v", ErrInvalidJSON, err)
+		}
+		return err
+	}
+	if decoder.More() {
+		return fmt.Errorf("%w: unexpected data after the JSON body", ErrInvalidJSON)
+	}
+	return nil
+}
+
+// WriteDecodeProblem answers a request DecodeRequest failed to decode, invalid-json or validation-failed
+func WriteDecodeProblem(writer http.ResponseWriter, request *http.Request, err error) {
+	if errors.Is(err, ErrInvalidJSON) {
+		WriteProblem(writer, request, http.StatusBadRequest, PROBLEM_INVALID_JSON, err.Error())
+		return
+	}
+	WriteProblem(writer, request, http.StatusUnprocessableEntity, PROBLEM_VALIDATION_FAILED, err.Error())
+}
+
+// validateServiceName checks the app.app.svc.svc format of the service names
+func validateServiceName(name string) error {
+	parts := strings.Split(name, ".")
+	if len(parts) != 4 {
+		return fmt.Errorf("%q is not in the app.app.svc.svc format", name)
+	}
+	for _, part := range parts {
+		if part == "" {
+			return fmt.Errorf("%q has an empty part", name)
+		}
+	}
+	return nil
+}
+
+// validateInstance checks the fields identifying a service instance
+func validateInstance(serviceName string, instance int) []FieldError {
+	fields := make([]FieldError, 0)
+	if err := validateServiceName(serviceName); err != nil {
+		fields = append(fields, FieldError{Field: "serviceName", Reason: err.Error()})
+	}
+	if instance < 0 {
+		fields = append(fields, FieldError{Field: "instanceNumber", Reason: "must not be negative"})
+	}
+	return fields
+}
+
+// validate checks the deploy request of the runtime
+func (r deployRequestV2) validate(runtime string) []FieldError {
+	fields := validateInstance(r.ServiceName, r.InstanceNumber)
+	if r.Timeout < 0 {
+		fields = append(fields, FieldError{Field: "timeout", Reason: "must not be negative"})
+	}
+	if len(r.Ifname) > MAX_IFNAME_LENGTH || strings.ContainsAny(r.Ifname, "/ \t\n") {
+		fields = append(fields, FieldError{Field: "ifname", Reason: fmt.Sprintf("%q is not a valid interface name", r.Ifname)})
+	}
+	if err := r.PortMappings.Validate(); err != nil {
+		fields = append(fields, FieldError{Field: "portMappings", Reason: err.Error()})
+	}
+	if err := r.PublicExposures.Validate(); err != nil {
+		fields = append(fields, FieldError{Field: "publicExposures", Reason: err.Error()})
+	}
+
+	switch runtime {
+	case env.CONTAINER_RUNTIME:
+		if r.Pid <= 0 && r.Netns == "" {
+			fields = append(fields, FieldError{Field: "pid", Reason: "either a pid or a network namespace path is required"})
+		}
+	case env.NAMESPACE_RUNTIME:
+		if r.Netns == "" && r.NetnsFd == nil {
+			fields = append(fields, FieldError{Field: "netns", Reason: "either a network namespace path or file descriptor is required"})
+		}
+		if r.NetnsFd != nil && (*r.NetnsFd < 0 || r.Pid <= 0) {
+			fields = append(fields, FieldError{Field: "netnsFd", Reason: "a file descriptor requires the pid of the process holding it"})
+		}
+	case env.UNIKERNEL_RUNTIME:
+		if err := r.Unikernel.Validate(); err != nil {
+			fields = append(fields, FieldError{Field: "unikernel", Reason: err.Error()})
+		}
+	}
+	if runtime != env.NAMESPACE_RUNTIME && r.NetnsFd != nil {
+		fields = append(fields, FieldError{Field: "netnsFd", Reason: "namespace runtime only"})
+	}
+	if runtime != env.UNIKERNEL_RUNTIME && r.Unikernel != nil {
+		fields = append(fields, FieldError{Field: "unikernel", Reason: "unikernel runtime only"})
+	}
+	return fields
+}
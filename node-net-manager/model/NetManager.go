@@ -1,5 +1,7 @@
 package model
 
+import "sync"
+
 type NetConfiguration struct {
 	NodePublicAddress  string
 	NodePublicPort     string
@@ -10,7 +12,50 @@ type NetConfiguration struct {
 	PublicIPNetworking bool
 	MqttCert           string
 	MqttKey            string
+	// seconds the existing flows can keep using a removed instance, negative to disable draining
+	DrainingGracePeriod int
+	// UDP hole punching towards the nodes behind NAT, signalled through the MQTT broker
+	NatTraversal bool
+	// tunnel endpoint (host:port) of the node relaying the traffic when the hole punching fails
+	NatRelayAddress string
+	// worker id of the relay node, the registrations to the relay are authenticated with the keys exchanged through the cluster
+	NatRelayID string
+	// this node relays the traffic of the nodes behind NAT
+	NatRelay bool
+	// serve the Docker network and IPAM driver API, containers started with --network oakestra are attached to the node
+	DockerNetworkPlugin bool
+	// iptables or nftables, detected when empty
+	FirewallBackend string
+	// certificate and key of the HTTP API, the TCP listener is served over TLS when set
+	ApiCert string
+	ApiKey  string
+	// CA of the client certificates, the TCP listener requires a client certificate signed by it (mTLS)
+	ApiClientCa string
+	// SHA-256 fingerprints (hex) of the accepted client certificates, pinned on top of ApiClientCa if set
+	ApiClientCertPins []string
+	// bearer tokens accepted on the TCP listener, any request without one is rejected when set
+	ApiTokens []string
+	// peer UIDs and GIDs allowed on the unix socket, checked through SO_PEERCRED. Root and anyone when both are empty.
+	ApiSocketUids []int
+	ApiSocketGids []int
 }
 
 var NetConfig NetConfiguration
 var WorkerID string
+
+// the node public address follows the node address changes, it is read and written through the accessors once loaded
+var nodePublicAddressLock sync.RWMutex
+
+// GetNodePublicAddress returns the current public address of the node
+func GetNodePublicAddress() string {
+	nodePublicAddressLock.RLock()
+	defer nodePublicAddressLock.RUnlock()
+	return NetConfig.NodePublicAddress
+}
+
+// SetNodePublicAddress updates the public address of the node
+func SetNodePublicAddress(address string) {
+	nodePublicAddressLock.Lock()
+	defer nodePublicAddressLock.Unlock()
+	NetConfig.NodePublicAddress = address
+}
@@ -44,10 +44,14 @@ func (jut *jobUpdatesTimer) startSelfDestructTimeout() {
 	*/
 	log.Printf("self destruction timeout started for job %s", jut.job)
 	eventManager := events.GetInstance()
-	eventChan, _ := eventManager.Register(events.TableQuery, jut.job)
+	// a pending usage event is enough to reset the timer, the following ones are redundant
+	usage := eventManager.Subscribe(
+		events.Filter{Types: []events.EventType{events.TableQuery}, Target: jut.job},
+		events.SubscriptionOptions{Buffer: 1, Policy: events.DropNewest},
+	)
 	for true {
 		select {
-		case <-eventChan:
+		case <-usage.Events:
 			//event received, reset timer
 			logger.DebugLogger().Printf("received packet event from: %s", jut.job)
 			continue
@@ -60,8 +64,13 @@ func (jut *jobUpdatesTimer) startSelfDestructTimeout() {
 				runningHandlersLock.Lock()
 				runningHandlers.RemoveElem(jut.job)
 				runningHandlersLock.Unlock()
-				eventManager.DeRegister(events.TableQuery, jut.job)
+				eventManager.Unsubscribe(usage)
 				jut.env.RemoveServiceEntries(jut.job)
+				eventManager.Emit(events.Event{
+					EventType:   events.InterestExpired,
+					EventTarget: jut.job,
+					Payload:     events.InterestEvent{Name: jut.job},
+				})
 				return
 			}
 			continue
@@ -100,6 +109,11 @@ func MqttRegisterInterest(jobName string, env jobEnvironmentManagerActions, inst
 	log.Printf("MQTT - Subscribed to %s ", jobTimer.topic)
 	runningHandlers.Add(jobTimer.job)
 	go jobTimer.startSelfDestructTimeout()
+	jobTimer.eventManager.Emit(events.Event{
+		EventType:   events.InterestRegistered,
+		EventTarget: jobName,
+		Payload:     events.InterestEvent{Name: jobName},
+	})
 }
 
 func MqttIsInterestRegistered(jobName string) bool {
@@ -1,10 +1,12 @@
 package mqtt
 
 import (
+	"NetManager/events"
 	"NetManager/logger"
 	"crypto/tls"
 	"fmt"
 	"log"
+	"net"
 	"strings"
 	"sync"
 	"time"
@@ -74,11 +76,13 @@ func InitNetMqttClient(clientid string, brokerurl string, brokerport string, mqt
 			tqtoken := client.SubscribeMultiple(topicsQosMap, subscribeHandlerDispatcher)
 			tqtoken.Wait()
 			log.Printf("Subscribed to topics \n")
+			emitConnectionState(true, nil)
 
 		}
 
 		var connectLostHandler mqtt.ConnectionLostHandler = func(client mqtt.Client, err error) {
 			logger.ErrorLogger().Printf("Connect lost: %v", err)
+			emitConnectionState(false, err)
 		}
 
 		netMqttClient.topics[fmt.Sprintf("nodes/%s/net/tablequery/result", netMqttClient.clientID)] =
@@ -113,6 +117,18 @@ func InitNetMqttClient(clientid string, brokerurl string, brokerport string, mqt
 	return &netMqttClient
 }
 
+// emitConnectionState tells the event subscribers whether the client is connected to the broker
+func emitConnectionState(connected bool, err error) {
+	payload := events.MqttConnectionEvent{
+		Connected: connected,
+		Broker:    net.JoinHostPort(netMqttClient.brokerUrl, netMqttClient.brokerPort),
+	}
+	if err != nil {
+		payload.Error = err.Error()
+	}
+	events.GetInstance().Emit(events.Event{EventType: events.MqttConnectionState, EventTarget: payload.Broker, Payload: payload})
+}
+
 func GetNetMqttClient() *NetMqttClient {
 	return &netMqttClient
 }
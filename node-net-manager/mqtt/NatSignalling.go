@@ -0,0 +1,64 @@
+package mqtt
+
+import (
+	"NetManager/logger"
+	"encoding/json"
+	"fmt"
+	"net"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// mqttHolePunchingRequest is published by this node on its own topic, the cluster forwards it to the peer
+type mqttHolePunchingRequest struct {
+	Peer      string   `json:"peer"`
+	Endpoints []string `json:"endpoints"`
+	Key       []byte   `json:"key"`
+}
+
+// mqttHolePunchingForward is the request forwarded by the cluster, the worker id is the node that published it
+type mqttHolePunchingForward struct {
+	WorkerID  string   `json:"worker_id"`
+	Endpoints []string `json:"endpoints"`
+	Key       []byte   `json:"key"`
+}
+
+// NatSignalling delivers the hole punching requests to the other worker nodes through the cluster.
+// The cluster forwards the requests between the nodes it knows, identified by the topic they publish to.
+type NatSignalling struct{}
+
+// RequestHolePunching asks the peer node to send the hole punching probes towards the given endpoints
+func (NatSignalling) RequestHolePunching(peer string, endpoints []*net.UDPAddr, key []byte) error {
+	request := mqttHolePunchingRequest{
+		Peer:      peer,
+		Endpoints: make([]string, 0, len(endpoints)),
+		Key:       key,
+	}
+	for _, endpoint := range endpoints {
+		request.Endpoints = append(request.Endpoints, endpoint.String())
+	}
+	jsonreq, _ := json.Marshal(request)
+	return GetNetMqttClient().PublishToBroker("nat/punch/request", string(jsonreq))
+}
+
+// RegisterHolePunchingHandler subscribes to the hole punching requests forwarded to this node by the cluster
+func RegisterHolePunchingHandler(handler func(peer string, endpoints []*net.UDPAddr, key []byte)) {
+	netmqtt := GetNetMqttClient()
+	netmqtt.RegisterTopic(fmt.Sprintf("nodes/%s/net/nat/punch", netmqtt.clientID), func(_ mqtt.Client, msg mqtt.Message) {
+		request := mqttHolePunchingForward{}
+		err := json.Unmarshal(msg.Payload(), &request)
+		if err != nil {
+			logger.ErrorLogger().Println("Invalid hole punching request:", err)
+			return
+		}
+		endpoints := make([]*net.UDPAddr, 0, len(request.Endpoints))
+		for _, endpoint := range request.Endpoints {
+			addr, err := net.ResolveUDPAddr("udp", endpoint)
+			if err != nil {
+				continue
+			}
+			endpoints = append(endpoints, addr)
+		}
+		handler(request.WorkerID, endpoints, request.Key)
+	})
+}
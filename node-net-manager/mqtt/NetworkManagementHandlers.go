@@ -14,6 +14,8 @@ var subnetworkResponseChannel chan mqttSubnetworkResponse
 type mqttSubnetworkResponse struct {
 	Address    string `json:"address"`
 	Address_v6 string `json:"addressv6"`
+	// the cluster answers the batched table queries, unset by the older cluster managers
+	TablequeryBatch bool `json:"tablequery_batch"`
 }
 type mqttSubnetworkRequest struct {
 	METHOD string `json:"METHOD"`
@@ -28,6 +30,23 @@ type mqttDeployNotification struct {
 	Hostip         string `json:"host_ip"`
 }
 
+// PublicExposureNotification is a public address an instance is reachable at
+type PublicExposureNotification struct {
+	Mode    string `json:"mode"`
+	Address string `json:"address"`
+	// Ports exposed as "host:container/protocols;...", all of them when empty
+	Ports string `json:"ports"`
+}
+type mqttExposureNotification struct {
+	Appname        string                       `json:"appname"`
+	Instancenumber int                          `json:"instance_number"`
+	Exposures      []PublicExposureNotification `json:"exposures"`
+}
+type mqttNodeAddressNotification struct {
+	Hostport string `json:"host_port"`
+	Hostip   string `json:"host_ip"`
+}
+
 func subnetworkAssignmentMqttHandler(_ mqtt.Client, msg mqtt.Message) {
 	responseStruct := mqttSubnetworkResponse{}
 	err := json.Unmarshal(msg.Payload(), &responseStruct)
@@ -53,6 +72,7 @@ func RequestSubnetworkMqttBlocking() (mqttSubnetworkResponse, error) {
 	select {
 	case result := <-subnetworkResponseChannel:
 		if result.Address != "" || result.Address_v6 != "" {
+			GetTableQueryRequestCacheInstance().SetBatching(result.TablequeryBatch)
 			return result, nil
 		}
 	case <-time.After(10 * time.Second):
@@ -76,14 +96,23 @@ func NotifyDeploymentStatus(appname string, status string, instance int, nsip st
 	return GetNetMqttClient().PublishToBroker("service/deployed", string(jsonreq))
 }
 
-// Update cluster about new node adress
-func NotifyAddressChange(appname string, instance int, hostip string, hostport string) error {
-	request := mqttDeployNotification{
+// NotifyNodeAddressChange updates the cluster about the new node address, once for all the instances of the node
+func NotifyNodeAddressChange(hostip string, hostport string) error {
+	request := mqttNodeAddressNotification{
+		Hostip:   hostip,
+		Hostport: hostport,
+	}
+	jsonreq, _ := json.Marshal(request)
+	return GetNetMqttClient().PublishToBroker("address-changed", string(jsonreq))
+}
+
+// NotifyPublicExposure updates the cluster about the public addresses of a deployed instance
+func NotifyPublicExposure(appname string, instance int, exposures []PublicExposureNotification) error {
+	request := mqttExposureNotification{
 		Appname:        appname,
 		Instancenumber: instance,
-		Hostip:         hostip,
-		Hostport:       hostport,
+		Exposures:      exposures,
 	}
 	jsonreq, _ := json.Marshal(request)
-	return GetNetMqttClient().PublishToBroker("service/address-changed", string(jsonreq))
+	return GetNetMqttClient().PublishToBroker("service/exposed", string(jsonreq))
 }
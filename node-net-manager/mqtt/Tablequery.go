@@ -15,11 +15,20 @@ import (
 /*---- Singleton cache instance  ----*/
 var once sync.Once
 var (
-	tableQueryRequestCacheInstance TableQueryRequestCache
+	tableQueryRequestCacheInstance *TableQueryRequestCache
 )
 
 /*-----------------------------------*/
 
+const (
+	// TABLE_QUERY_BATCH_WINDOW is how long a query waits for others to be published with it in a single request
+	TABLE_QUERY_BATCH_WINDOW = 10 * time.Millisecond
+	// TABLE_QUERY_BATCH_SIZE is the maximum number of queries of a request, a full batch is published right away
+	TABLE_QUERY_BATCH_SIZE = 64
+	// TABLE_QUERY_TIMEOUT is how long the callers wait for the response of the cluster
+	TABLE_QUERY_TIMEOUT = 5 * time.Second
+)
+
 /*----- Mqtt Table query cache classes and interfaces -----*/
 type TablequeryMqttInterface interface {
 	TableQueryByIpRequestBlocking(sip string, force_optional ...bool) (TableQueryResponse, error)
@@ -27,8 +36,24 @@ type TablequeryMqttInterface interface {
 }
 
 type TableQueryRequestCache struct {
-	siprequests map[string]*[]chan TableQueryResponse
-	requestadd  sync.RWMutex
+	// in-flight queries by query key, oldest first. The concurrent callers of a key wait for the same response
+	pending map[string][]*tableQueryCall
+	// queries waiting for the batch window to be published
+	batch      []tableQueryRequest
+	batchTimer *time.Timer
+	// the cluster answers the batched requests, otherwise each query is published on its own
+	batching   bool
+	requestadd sync.Mutex
+	publish    func(topic string, payload string) error
+	window     time.Duration
+	timeout    time.Duration
+}
+
+// tableQueryCall is a query shared by all the callers asking for its key until the response arrives
+type tableQueryCall struct {
+	done      chan struct{}
+	response  TableQueryResponse
+	published bool
 }
 
 /*---------------------------------------------------------*/
@@ -41,23 +66,30 @@ type TableQueryResponse struct {
 }
 
 type ServiceInstance struct {
-	InstanceNumber int    `json:"instance_number"`
-	NamespaceIp    string `json:"namespace_ip"`
-	NamespaceIpv6  string `json:"namespace_ip_v6"`
-	HostIp         string `json:"host_ip"`
-	HostPort       int    `json:"host_port"`
-	ServiceIp      []Sip  `json:"service_ip"`
+	InstanceNumber int      `json:"instance_number"`
+	NamespaceIp    string   `json:"namespace_ip"`
+	NamespaceIpv6  string   `json:"namespace_ip_v6"`
+	WorkerID       string   `json:"worker_id"`
+	HostIp         string   `json:"host_ip"`
+	HostPort       int      `json:"host_port"`
+	ServiceIp      []Sip    `json:"service_ip"`
+	Weight         *int     `json:"weight,omitempty"`
+	LoadHint       *float64 `json:"load_hint,omitempty"`
 }
 
 type Sip struct {
-	Type       string `json:"IpType"`
-	Address    string `json:"Address"`
-	Address_v6 string `json:"Address_v6"`
+	Type        string `json:"IpType"`
+	Address     string `json:"Address"`
+	Address_v6  string `json:"Address_v6"`
+	Affinity    string `json:"Affinity,omitempty"`
+	AffinityTTL int    `json:"AffinityTTL,omitempty"`
 }
 
 type tableQueryRequest struct {
 	Sname string `json:"sname"`
 	Sip   string `json:"sip"`
+	// Queries of a batched request, answered with one result each
+	Queries []tableQueryRequest `json:"queries,omitempty"`
 }
 
 /*------------------------------------------------------*/
@@ -67,19 +99,27 @@ returns a singleton pointer to an instance instance of the TableQueryRequestCach
 */
 func GetTableQueryRequestCacheInstance() *TableQueryRequestCache {
 	once.Do(func() { // <-- atomic, does not allow repeating
-
-		tableQueryRequestCacheInstance = TableQueryRequestCache{
-			siprequests: make(map[string]*[]chan TableQueryResponse),
-			requestadd:  sync.RWMutex{},
-		}
-
+		tableQueryRequestCacheInstance = newTableQueryRequestCache(func(topic string, payload string) error {
+			return GetNetMqttClient().PublishToBroker(topic, payload)
+		}, TABLE_QUERY_BATCH_WINDOW, TABLE_QUERY_TIMEOUT)
 	})
-	return &tableQueryRequestCacheInstance
+	return tableQueryRequestCacheInstance
+}
+
+func newTableQueryRequestCache(publish func(topic string, payload string) error, window time.Duration, timeout time.Duration) *TableQueryRequestCache {
+	return &TableQueryRequestCache{
+		pending: make(map[string][]*tableQueryCall),
+		publish: publish,
+		window:  window,
+		timeout: timeout,
+	}
 }
 
 /*
-Perform a table query by ServiceIp to the cluster manager
-The call is blocking and awaits the response for a maximum of 10 seconds
+Perform a table query by ServiceIp or ServiceName to the cluster manager
+The call is blocking and awaits the response for a maximum of 5 seconds. The concurrent callers asking for the same address
+wait for the same response. When the cluster supports it, the queries of different addresses asked within the batch window
+are published in a single request.
 set the force value to force the table query even in the event of interest already registered. Used in case of incoming updates notification.
 */
 func (cache *TableQueryRequestCache) tableQueryRequestBlocking(sip string, sname string, force_optional ...bool) (TableQueryResponse, error) {
@@ -95,40 +135,117 @@ func (cache *TableQueryRequestCache) tableQueryRequestBlocking(sip string, sname
 		return TableQueryResponse{}, errors.New("interest already registered")
 	}
 
-	responseChannel := make(chan TableQueryResponse, 10)
-	var updatedRequests []chan TableQueryResponse
-
-	//appending response channel used by the Mqtt handler
 	cache.requestadd.Lock()
-	siprequests := cache.siprequests[reqname]
-	if siprequests != nil {
+	var call *tableQueryCall
+	if calls := cache.pending[reqname]; len(calls) > 0 {
+		call = calls[len(calls)-1]
+	}
+	// a forced query follows an update, the requests already published may miss it
+	if call == nil || (force && call.published) {
+		call = &tableQueryCall{done: make(chan struct{})}
+		cache.pending[reqname] = append(cache.pending[reqname], call)
+		cache.batch = append(cache.batch, tableQueryRequest{Sname: sname, Sip: sip})
+		if !cache.batching || len(cache.batch) >= TABLE_QUERY_BATCH_SIZE {
+			cache.stopBatchTimer()
+			batch := cache.takeBatch()
+			cache.requestadd.Unlock()
+			cache.publishBatch(batch)
+		} else {
+			if cache.batchTimer == nil {
+				cache.batchTimer = time.AfterFunc(cache.window, cache.flushBatch)
+			}
+			cache.requestadd.Unlock()
+		}
+	} else {
 		cache.requestadd.Unlock()
-		return TableQueryResponse{}, errors.New("Table query already happening for this address")
-		//updatedRequests = *siprequests
+		logger.DebugLogger().Printf("TableQuery - waiting for the query already happening for %s", reqname)
 	}
-	updatedRequests = append(updatedRequests, responseChannel)
-	cache.siprequests[reqname] = &updatedRequests
-	cache.requestadd.Unlock()
-
-	//publishing mqtt message
-	jsonreq, _ := json.Marshal(tableQueryRequest{
-		Sname: sname,
-		Sip:   sip,
-	})
-	_ = GetNetMqttClient().PublishToBroker("tablequery/request", string(jsonreq))
 
 	//waiting for maximum 5 seconds the mqtt handler to receive a response. Otherwise fail the tableQuery.
 	log.Printf("waiting for table query %s", reqname)
+	timeout := time.NewTimer(cache.timeout)
+	defer timeout.Stop()
 	select {
-	case result := <-responseChannel:
-		return result, nil
-	case <-time.After(5 * time.Second):
+	case <-call.done:
+		return call.response, nil
+	case <-timeout.C:
 		logger.ErrorLogger().Printf("TIMEOUT - Table query without response, quitting goroutine")
 	}
 
+	// the next callers ask again
+	cache.requestadd.Lock()
+	cache.removeCall(reqname, call)
+	cache.requestadd.Unlock()
 	return TableQueryResponse{}, net.UnknownNetworkError("Mqtt Timeout")
 }
 
+// SetBatching enables the batched requests, only once the cluster advertised that it answers them
+func (cache *TableQueryRequestCache) SetBatching(batching bool) {
+	cache.requestadd.Lock()
+	defer cache.requestadd.Unlock()
+	cache.batching = batching
+}
+
+// flushBatch publishes the queries gathered during the batch window
+func (cache *TableQueryRequestCache) flushBatch() {
+	cache.requestadd.Lock()
+	cache.batchTimer = nil
+	batch := cache.takeBatch()
+	cache.requestadd.Unlock()
+	cache.publishBatch(batch)
+}
+
+// takeBatch empties the batch and marks its calls as published, requires the lock
+func (cache *TableQueryRequestCache) takeBatch() []tableQueryRequest {
+	batch := cache.batch
+	cache.batch = nil
+	for _, request := range batch {
+		if calls := cache.pending[request.Sip+request.Sname]; len(calls) > 0 {
+			calls[len(calls)-1].published = true
+		}
+	}
+	return batch
+}
+
+// removeCall forgets a call of the key, requires the lock
+func (cache *TableQueryRequestCache) removeCall(key string, call *tableQueryCall) {
+	calls := cache.pending[key]
+	for i, candidate := range calls {
+		if candidate == call {
+			calls = append(calls[:i:i], calls[i+1:]...)
+			break
+		}
+	}
+	if len(calls) == 0 {
+		delete(cache.pending, key)
+		return
+	}
+	cache.pending[key] = calls
+}
+
+// stopBatchTimer cancels the publication of the batch window, requires the lock
+func (cache *TableQueryRequestCache) stopBatchTimer() {
+	if cache.batchTimer != nil {
+		cache.batchTimer.Stop()
+		cache.batchTimer = nil
+	}
+}
+
+// publishBatch sends a single query as before the batching, so that the older cluster managers still answer it
+func (cache *TableQueryRequestCache) publishBatch(batch []tableQueryRequest) {
+	if len(batch) == 0 {
+		return
+	}
+	request := batch[0]
+	if len(batch) > 1 {
+		request = tableQueryRequest{Queries: batch}
+	}
+	jsonreq, _ := json.Marshal(request)
+	if err := cache.publish("tablequery/request", string(jsonreq)); err != nil {
+		logger.ErrorLogger().Printf("[ERROR]: unable to publish the table query: %v", err)
+	}
+}
+
 /*
 Perform a table query by ServiceIp to the cluster manager
 The call is blocking and awaits the response for a maximum of 5 seconds
@@ -170,18 +287,23 @@ func (cache *TableQueryRequestCache) TablequeryResultMqttHandler(client mqtt.Cli
 		}
 	}
 
-	//notify hanging channels for each query key
+	//notify the callers waiting for each query key
+	cache.requestadd.Lock()
+	defer cache.requestadd.Unlock()
+	notified := make(map[string]bool)
 	for _, key := range querykeys {
-		cache.requestadd.Lock()
-		channelList := cache.siprequests[key]
-		if channelList != nil {
-			for _, channel := range *channelList {
-				logger.DebugLogger().Printf("TableQuery response - notifying a channel regarding %s", key)
-				channel <- responseStruct
-				logger.DebugLogger().Printf("TableQuery response - channel notified")
-			}
+		if key == "" || notified[key] {
+			continue
 		}
-		cache.siprequests[key] = nil
-		cache.requestadd.Unlock()
+		notified[key] = true
+		// the responses come in the order of the requests, the oldest published call is answered
+		calls := cache.pending[key]
+		if len(calls) == 0 || !calls[0].published {
+			continue
+		}
+		logger.DebugLogger().Printf("TableQuery response - notifying the callers regarding %s", key)
+		calls[0].response = responseStruct
+		close(calls[0].done)
+		cache.removeCall(key, calls[0])
 	}
 }
@@ -0,0 +1,230 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+type fakeMessage struct {
+	topic   string
+	payload []byte
+}
+
+func (m fakeMessage) Duplicate() bool   { return false }
+func (m fakeMessage) Qos() byte         { return 1 }
+func (m fakeMessage) Retained() bool    { return false }
+func (m fakeMessage) Topic() string     { return m.topic }
+func (m fakeMessage) MessageID() uint16 { return 0 }
+func (m fakeMessage) Payload() []byte   { return m.payload }
+func (m fakeMessage) Ack()              {}
+
+// fakeBroker records the published table queries and answers them like the cluster service manager when autoAnswer is set
+type fakeBroker struct {
+	cache      *TableQueryRequestCache
+	autoAnswer bool
+	lock       sync.Mutex
+	requests   []tableQueryRequest
+	published  chan tableQueryRequest
+}
+
+func newFakeBroker(autoAnswer bool, window time.Duration, timeout time.Duration) *fakeBroker {
+	broker := &fakeBroker{autoAnswer: autoAnswer, published: make(chan tableQueryRequest, 100)}
+	broker.cache = newTableQueryRequestCache(broker.publish, window, timeout)
+	// the cluster service manager advertises the batched requests in the subnetwork response
+	broker.cache.SetBatching(true)
+	return broker
+}
+
+func (b *fakeBroker) publish(topic string, payload string) error {
+	if topic != "tablequery/request" {
+		return fmt.Errorf("unexpected topic %s", topic)
+	}
+	var request tableQueryRequest
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		return err
+	}
+	b.lock.Lock()
+	b.requests = append(b.requests, request)
+	autoAnswer := b.autoAnswer
+	b.lock.Unlock()
+	b.published <- request
+	if autoAnswer {
+		go b.answer(request)
+	}
+	return nil
+}
+
+// answer publishes one result for each query of the request
+func (b *fakeBroker) answer(request tableQueryRequest) {
+	queries := request.Queries
+	if len(queries) == 0 {
+		queries = []tableQueryRequest{request}
+	}
+	for _, query := range queries {
+		response := TableQueryResponse{JobName: "app.app.svc.svc", QueryKey: query.Sip + query.Sname}
+		if query.Sname != "" {
+			response.JobName = query.Sname
+		}
+		payload, _ := json.Marshal(response)
+		b.cache.TablequeryResultMqttHandler(nil, fakeMessage{topic: "nodes/node/net/tablequery/result", payload: payload})
+	}
+}
+
+func (b *fakeBroker) requestCount() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return len(b.requests)
+}
+
+func TestTableQueryCoalescing(t *testing.T) {
+	broker := newFakeBroker(false, 50*time.Millisecond, time.Second)
+	const callers = 20
+	responses := make(chan TableQueryResponse, callers)
+	errs := make(chan error, callers)
+	for i := 0; i < callers; i++ {
+		go func() {
+			response, err := broker.cache.TableQueryByIpRequestBlocking("10.30.0.1")
+			responses <- response
+			errs <- err
+		}()
+	}
+
+	request := <-broker.published
+	assert.Equal(t, request.Sip, "10.30.0.1")
+	assert.Equal(t, len(request.Queries), 0)
+	time.Sleep(20 * time.Millisecond)
+	broker.answer(request)
+
+	for i := 0; i < callers; i++ {
+		assert.NilError(t, <-errs)
+		assert.Equal(t, (<-responses).QueryKey, "10.30.0.1")
+	}
+	assert.Equal(t, broker.requestCount(), 1)
+	assert.Equal(t, len(broker.cache.pending), 0)
+}
+
+func TestTableQueryBatching(t *testing.T) {
+	broker := newFakeBroker(true, 50*time.Millisecond, time.Second)
+	keys := []string{"10.30.0.1", "10.30.0.2", "10.30.0.3", "10.30.0.4", "app.app.db.db"}
+	var wg sync.WaitGroup
+	for _, key := range keys {
+		for i := 0; i < 3; i++ {
+			wg.Add(1)
+			go func(key string) {
+				defer wg.Done()
+				var response TableQueryResponse
+				var err error
+				if key == "app.app.db.db" {
+					response, err = broker.cache.TableQueryByJobNameRequestBlocking(key)
+				} else {
+					response, err = broker.cache.TableQueryByIpRequestBlocking(key)
+				}
+				assert.NilError(t, err)
+				assert.Equal(t, response.QueryKey, key)
+			}(key)
+		}
+	}
+	wg.Wait()
+
+	assert.Equal(t, broker.requestCount(), 1)
+	request := <-broker.published
+	assert.Equal(t, len(request.Queries), len(keys))
+	queried := make(map[string]bool)
+	for _, query := range request.Queries {
+		queried[query.Sip+query.Sname] = true
+	}
+	for _, key := range keys {
+		assert.Assert(t, queried[key], key)
+	}
+}
+
+func TestTableQueryWithoutBatching(t *testing.T) {
+	// an older cluster manager, each query is published on its own without waiting for the window
+	broker := newFakeBroker(true, time.Hour, time.Second)
+	broker.cache.SetBatching(false)
+	keys := []string{"10.30.0.1", "10.30.0.2", "10.30.0.3"}
+	var wg sync.WaitGroup
+	for _, key := range keys {
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			response, err := broker.cache.TableQueryByIpRequestBlocking(key)
+			assert.NilError(t, err)
+			assert.Equal(t, response.QueryKey, key)
+		}(key)
+	}
+	wg.Wait()
+
+	assert.Equal(t, broker.requestCount(), len(keys))
+	for range keys {
+		request := <-broker.published
+		assert.Equal(t, len(request.Queries), 0)
+	}
+}
+
+func TestTableQueryFullBatch(t *testing.T) {
+	// the window never ends, the full batch is published right away
+	broker := newFakeBroker(true, time.Hour, time.Second)
+	var wg sync.WaitGroup
+	for i := 0; i < TABLE_QUERY_BATCH_SIZE; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := broker.cache.TableQueryByIpRequestBlocking(fmt.Sprintf("10.30.1.%d", i))
+			assert.NilError(t, err)
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, broker.requestCount(), 1)
+	assert.Equal(t, len((<-broker.published).Queries), TABLE_QUERY_BATCH_SIZE)
+}
+
+func TestTableQueryTimeout(t *testing.T) {
+	broker := newFakeBroker(false, time.Millisecond, 50*time.Millisecond)
+	_, err := broker.cache.TableQueryByJobNameRequestBlocking("app.app.svc.svc")
+	assert.ErrorContains(t, err, "Mqtt Timeout")
+	assert.Equal(t, len(broker.cache.pending), 0)
+
+	// the next caller asks again
+	broker.lock.Lock()
+	broker.autoAnswer = true
+	broker.lock.Unlock()
+	response, err := broker.cache.TableQueryByJobNameRequestBlocking("app.app.svc.svc")
+	assert.NilError(t, err)
+	assert.Equal(t, response.JobName, "app.app.svc.svc")
+	assert.Equal(t, broker.requestCount(), 2)
+}
+
+func TestForcedTableQueryAfterPublished(t *testing.T) {
+	broker := newFakeBroker(false, time.Millisecond, time.Second)
+	first := make(chan error, 1)
+	go func() {
+		_, err := broker.cache.TableQueryByJobNameRequestBlocking("app.app.svc.svc")
+		first <- err
+	}()
+	request := <-broker.published
+
+	// the update may be missed by the published request, the forced query is published again
+	forced := make(chan error, 1)
+	go func() {
+		_, err := broker.cache.TableQueryByJobNameRequestBlocking("app.app.svc.svc", true)
+		forced <- err
+	}()
+	<-broker.published
+
+	broker.answer(request)
+	assert.NilError(t, <-first)
+	select {
+	case <-forced:
+		t.Fatal("forced query answered with the response of the previous request")
+	case <-time.After(20 * time.Millisecond):
+	}
+	broker.answer(request)
+	assert.NilError(t, <-forced)
+	assert.Equal(t, broker.requestCount(), 2)
+}
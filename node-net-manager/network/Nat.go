@@ -1,14 +1,15 @@
 package network
 
 import (
+	"NetManager/model"
 	"errors"
-	"fmt"
 	"log"
 	"net"
 	"os/exec"
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/coreos/go-iptables/iptables"
 )
@@ -20,117 +21,130 @@ const (
 	ClosePorts PortOperation = "-D"
 )
 
+const (
+	FIREWALL_BACKEND_IPTABLES = "iptables"
+	FIREWALL_BACKEND_NFTABLES = "nftables"
+)
+
 var (
-	chain    = "OAKESTRA"
-	iptable  = NewOakestraIPTable(iptables.ProtocolIPv4)
-	ip6table = NewOakestraIPTable(iptables.ProtocolIPv6)
+	chain = "OAKESTRA"
+	// snatChain holds the source NAT of the publicly exposed instances, evaluated before the masquerading
+	snatChain    = "OAKESTRA-SNAT"
+	iptable      IpTable
+	ip6table     IpTable
+	ipTablesOnce sync.Once
+	// lookPath finds the iptables binary for the backend detection, replaced in the tests
+	lookPath = exec.LookPath
 )
 
-func IptableFlushAll() {
-	_ = iptable.DeleteChain("nat", chain)
-	_ = iptable.Delete("nat", "PREROUTING", "-j", chain)
-	_ = iptable.Delete("nat", "POSTROUTING", "-j", chain)
-	_ = ip6table.DeleteChain("nat", chain)
-	_ = ip6table.Delete("nat", "PREROUTING", "-j", chain)
-	_ = ip6table.Delete("nat", "PREROUTING", "-j", chain)
+// ipv4Table returns the IPv4 table of the firewall backend, created at the first use once the configuration is loaded
+func ipv4Table() IpTable {
+	ipTablesOnce.Do(initIpTables)
+	return iptable
 }
 
-func DisableReversePathFiltering(bridgeName string) {
-	log.Println("disabling reverse path filtering")
-	cmd := exec.Command("echo", "0", ">", "/proc/sys/net/ipv4/conf/all/rp_filter")
-	err := cmd.Run()
-	if err != nil {
-		log.Fatal(err.Error())
-	}
-	log.Println("enabling IP forwarding")
-	cmd = exec.Command("sysctl", "-w", "net.ipv4.ip_forward=1")
-	err = cmd.Run()
-	if err != nil {
-		log.Fatal(err.Error())
-	}
+// ipv6Table returns the IPv6 table of the firewall backend
+func ipv6Table() IpTable {
+	ipTablesOnce.Do(initIpTables)
+	return ip6table
+}
 
-	cmd = exec.Command("sysctl", "-w", "net.ipv6.conf.all.forwarding=1")
-	err = cmd.Run()
-	if err != nil {
-		log.Fatal(err.Error())
+func initIpTables() {
+	backend := FirewallBackend()
+	log.Printf("using the %s firewall backend", backend)
+	if iptable == nil {
+		iptable = newIpTable(backend, iptables.ProtocolIPv4)
 	}
-
-	cmd = exec.Command("echo", "0", ">", "/proc/sys/net/ipv4/conf/"+bridgeName+"/rp_filter")
-	err = cmd.Run()
-	if err != nil {
-		log.Fatal(err.Error())
+	if ip6table == nil {
+		ip6table = newIpTable(backend, iptables.ProtocolIPv6)
 	}
 }
 
-func EnableForwarding(bridgeName string, proxyName string) {
-	log.Println("enabling tun device forwarding")
-	err := iptable.AppendUnique("filter", "FORWARD", "-i", bridgeName, "-o", proxyName, "-j", "ACCEPT")
-	if err != nil {
-		log.Fatal(err.Error())
+// FirewallBackend returns the configured firewall backend or, if not configured, nftables on the hosts without the iptables binary
+func FirewallBackend() string {
+	switch model.NetConfig.FirewallBackend {
+	case FIREWALL_BACKEND_IPTABLES, FIREWALL_BACKEND_NFTABLES:
+		return model.NetConfig.FirewallBackend
+	case "":
+	default:
+		log.Printf("unknown firewall backend %s, detecting it", model.NetConfig.FirewallBackend)
 	}
-	err = iptable.AppendUnique("filter", "FORWARD", "-o", bridgeName, "-i", proxyName, "-j", "ACCEPT")
-	if err != nil {
-		log.Fatal(err.Error())
-	}
-	err = iptable.AppendUnique("filter", "FORWARD", "-o", bridgeName, "-j", "ACCEPT")
-	if err != nil {
-		log.Fatal(err.Error())
-	}
-	err = iptable.AppendUnique("filter", "FORWARD", "-i", bridgeName, "-j", "ACCEPT")
-	if err != nil {
-		log.Fatal(err.Error())
+	if _, err := lookPath("iptables"); err != nil {
+		return FIREWALL_BACKEND_NFTABLES
 	}
+	return FIREWALL_BACKEND_IPTABLES
+}
 
-	err = ip6table.AppendUnique("filter", "FORWARD", "-i", bridgeName, "-o", proxyName, "-j", "ACCEPT")
-	if err != nil {
-		log.Fatal(err.Error())
-	}
-	err = ip6table.AppendUnique("filter", "FORWARD", "-o", bridgeName, "-i", proxyName, "-j", "ACCEPT")
-	if err != nil {
-		log.Fatal(err.Error())
-	}
-	err = ip6table.AppendUnique("filter", "FORWARD", "-o", bridgeName, "-j", "ACCEPT")
-	if err != nil {
-		log.Fatal(err.Error())
-	}
-	err = ip6table.AppendUnique("filter", "FORWARD", "-i", bridgeName, "-j", "ACCEPT")
-	if err != nil {
-		log.Fatal(err.Error())
+// newIpTable returns a table of the backend in the current network namespace
+func newIpTable(backend string, protocol iptables.Protocol) IpTable {
+	if backend == FIREWALL_BACKEND_NFTABLES {
+		table, err := NewOakestraNfTable(protocol)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		return table
 	}
+	return NewOakestraIPTable(protocol)
+}
 
-	_ = iptable.DeleteChain("nat", chain)
-	_ = iptable.AddChain("nat", chain)
-
-	_ = ip6table.DeleteChain("nat", chain)
-	_ = ip6table.AddChain("nat", chain)
+// IptableFlushAll removes the chains of the NetManager left by a previous run, together with the jumps to them
+func IptableFlushAll() {
+	for _, table := range []IpTable{ipv4Table(), ipv6Table()} {
+		_ = table.Delete("nat", "PREROUTING", "-j", chain)
+		_ = table.Delete("nat", "OUTPUT", "-j", chain)
+		_ = table.DeleteChain("nat", chain)
+		_ = table.Delete("nat", "POSTROUTING", "-j", snatChain)
+		_ = table.DeleteChain("nat", snatChain)
+	}
+}
 
-	err = iptable.AppendUnique("nat", "PREROUTING", "-j", chain)
-	if err != nil {
-		log.Fatal(err.Error())
+func EnableForwarding(bridgeName string, proxyName string) {
+	log.Println("enabling tun device forwarding")
+	rules := make([]Rule, 0)
+	for _, ipv6 := range []bool{false, true} {
+		rules = append(rules,
+			Rule{IPv6: ipv6, Table: "filter", Chain: "FORWARD", Params: []string{"-i", bridgeName, "-o", proxyName, "-j", "ACCEPT"}},
+			Rule{IPv6: ipv6, Table: "filter", Chain: "FORWARD", Params: []string{"-o", bridgeName, "-i", proxyName, "-j", "ACCEPT"}},
+			Rule{IPv6: ipv6, Table: "filter", Chain: "FORWARD", Params: []string{"-o", bridgeName, "-j", "ACCEPT"}},
+			Rule{IPv6: ipv6, Table: "filter", Chain: "FORWARD", Params: []string{"-i", bridgeName, "-j", "ACCEPT"}},
+		)
 	}
-	err = iptable.AppendUnique("nat", "OUTPUT", "-j", chain)
+	err := InstallRules(NODE_RULE_OWNER, rules...)
 	if err != nil {
 		log.Fatal(err.Error())
 	}
 
-	err = ip6table.AppendUnique("nat", "PREROUTING", "-j", chain)
-	if err != nil {
-		log.Fatal(err.Error())
+	rules = make([]Rule, 0)
+	for _, ipv6 := range []bool{false, true} {
+		if err := CreateChain(ipv6, "nat", chain); err != nil {
+			log.Fatal(err.Error())
+		}
+		rules = append(rules,
+			Rule{IPv6: ipv6, Table: "nat", Chain: "PREROUTING", Params: []string{"-j", chain}},
+			Rule{IPv6: ipv6, Table: "nat", Chain: "OUTPUT", Params: []string{"-j", chain}},
+		)
 	}
-	err = ip6table.AppendUnique("nat", "OUTPUT", "-j", chain)
+	err = InstallRules(NODE_RULE_OWNER, rules...)
 	if err != nil {
 		log.Fatal(err.Error())
 	}
 }
 
 func EnableMasquerading(address string, mask string, addressipv6 string, ipv6prefix string, bridgeName string, internetIfce string) {
-	log.Printf("add NAT ip MASQUERADING towards %s\n", internetIfce)
-	err := iptable.AppendUnique("nat", "POSTROUTING", "-s", address+mask, "-o", internetIfce, "-j", "MASQUERADE")
-	if err != nil {
+	// the source NAT of the exposed instances goes first
+	rules := make([]Rule, 0)
+	for _, ipv6 := range []bool{false, true} {
+		if err := CreateChain(ipv6, "nat", snatChain); err != nil {
+			log.Fatal(err.Error())
+		}
+		rules = append(rules, Rule{IPv6: ipv6, Table: "nat", Chain: "POSTROUTING", Params: []string{"-j", snatChain}})
+	}
+	if err := InstallRules(NODE_RULE_OWNER, rules...); err != nil {
 		log.Fatal(err.Error())
 	}
 
-	err = ip6table.AppendUnique("nat", "POSTROUTING", "-s", addressipv6+ipv6prefix, "-o", internetIfce, "-j", "MASQUERADE")
+	log.Printf("add NAT ip MASQUERADING towards %s\n", internetIfce)
+	err := InstallRules(NODE_RULE_OWNER, masqueradingRules(address+mask, addressipv6+ipv6prefix, internetIfce)...)
 	if err != nil {
 		log.Fatal(err.Error())
 	}
@@ -142,12 +156,7 @@ func EnableMasquerading(address string, mask string, addressipv6 string, ipv6pre
 		for _, pattern := range ifaces {
 			if ifc.Name != internetIfce && strings.Contains(ifc.Name, pattern) {
 				log.Printf("add additional NAT ip MASQUERADING towards %s\n", ifc.Name)
-				err := iptable.AppendUnique("nat", "POSTROUTING", "-s", address+mask, "-o", ifc.Name, "-j", "MASQUERADE")
-				if err != nil {
-					log.Fatal(err.Error())
-				}
-
-				err = ip6table.AppendUnique("nat", "POSTROUTING", "-s", addressipv6+ipv6prefix, "-o", ifc.Name, "-j", "MASQUERADE")
+				err := InstallRules(NODE_RULE_OWNER, masqueradingRules(address+mask, addressipv6+ipv6prefix, ifc.Name)...)
 				if err != nil {
 					log.Fatal(err.Error())
 				}
@@ -156,68 +165,100 @@ func EnableMasquerading(address string, mask string, addressipv6 string, ipv6pre
 	}
 }
 
-// ManageContainerPorts open or close container port with the nat rules
-func ManageContainerPorts(localContainerAddress net.IP, portmapping string, operation PortOperation) error {
-	if portmapping == "" {
+func masqueradingRules(subnet string, subnetv6 string, ifaceName string) []Rule {
+	return []Rule{
+		{Table: "nat", Chain: "POSTROUTING", Params: []string{"-s", subnet, "-o", ifaceName, "-j", "MASQUERADE"}},
+		{IPv6: true, Table: "nat", Chain: "POSTROUTING", Params: []string{"-s", subnetv6, "-o", ifaceName, "-j", "MASQUERADE"}},
+	}
+}
+
+// ManageContainerPortMappings open or close the ports exposed towards the container address, reserving the host ports for the owner.
+// The ports of a container are opened all together or none of them, while closing goes on past the missing rules.
+func ManageContainerPortMappings(owner RuleOwner, localContainerAddress net.IP, mappings PortMappings, operation PortOperation) error {
+	if len(mappings) == 0 {
 		return nil
 	}
+	if localContainerAddress.To16() == nil {
+		return errors.New("invalid container address")
+	}
+	if err := mappings.Validate(); err != nil {
+		return err
+	}
 	runtime.LockOSThread()
 	defer runtime.UnlockOSThread()
 
-	mappings := strings.Split(portmapping, ";")
-
-	for _, portmap := range mappings {
+	ipv6 := localContainerAddress.To4() == nil
+	rules := make([]Rule, 0)
+	claims := make([]hostPortClaim, 0)
+	for _, mapping := range mappings {
+		rules = append(rules, mapping.rules(localContainerAddress)...)
+		claims = append(claims, mapping.claims(owner, ipv6)...)
+	}
 
-		portType := "tcp"
-		if strings.Contains(portmap, "/udp") {
-			portmap = strings.Replace(portmap, "/udp", "", -1)
-			portType = "udp"
-		} else {
-			portmap = strings.Replace(portmap, "/tcp", "", -1)
-		}
-		ports := strings.Split(portmap, ":")
-		hostPort := ports[0]
-		containerPort := ports[0]
-		if len(ports) > 1 {
-			containerPort = ports[1]
+	var err error
+	switch operation {
+	case OpenPorts:
+		if err = hostPorts.reserve(claims); err != nil {
+			break
 		}
-		if !isValidPort(hostPort) || !isValidPort(containerPort) {
-			return errors.New("invalid Port Mapping")
+		if err = InstallRules(owner, rules...); err != nil {
+			hostPorts.release(claims)
 		}
-		var destination string
+	case ClosePorts:
+		hostPorts.release(claims)
+		err = RemoveRules(owner, rules...)
+	default:
+		err = errors.New("invalid Operation")
+	}
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		return err
+	}
+	log.Printf("Changed ports %s status toward %s\n", mappings, localContainerAddress)
+	return nil
+}
 
-		if ok4 := localContainerAddress.To4(); ok4 != nil {
-			destination = fmt.Sprintf("%s:%s", localContainerAddress, containerPort)
-		} else if ok6 := localContainerAddress.To16(); ok6 != nil {
-			destination = fmt.Sprintf("[%s]:%s", localContainerAddress, containerPort)
-		}
-		args := []string{"-p", portType, "--dport", hostPort, "-j", "DNAT", "--to-destination", destination}
+// manageRules installs the rules of the owner all together, or removes them one by one returning the first error
+func manageRules(owner RuleOwner, operation PortOperation, rules []Rule) error {
+	switch operation {
+	case OpenPorts:
+		return InstallRules(owner, rules...)
+	case ClosePorts:
+		return RemoveRules(owner, rules...)
+	}
+	return errors.New("invalid Operation")
+}
 
-		err := errors.New("invalid Operation")
-		// Make operation on table according to IP address version
-		if ok4 := localContainerAddress.To4(); ok4 != nil {
-			if operation == OpenPorts {
-				err = iptable.Append("nat", chain, args...)
-			}
-			if operation == ClosePorts {
-				err = iptable.Delete("nat", chain, args...)
-			}
-		} else if ok6 := localContainerAddress.To16(); ok6 != nil {
-			if operation == OpenPorts {
-				err = ip6table.Append("nat", chain, args...)
-			}
-			if operation == ClosePorts {
-				err = ip6table.Delete("nat", chain, args...)
-			}
-		}
-		if err != nil {
-			log.Printf("ERROR: %v", err)
-			return err
-		}
-		log.Printf("Changed port %s status toward destination %s\n", hostPort, destination)
+// ManageVethForwarding accepts, or stops accepting, the traffic between the bridge and the veth of a workload
+func ManageVethForwarding(owner RuleOwner, bridgeName string, vethName string, operation PortOperation) error {
+	return manageRules(owner, operation, []Rule{
+		{Table: "filter", Chain: "FORWARD", Params: []string{"-o", bridgeName, "-i", vethName, "-j", "ACCEPT"}},
+		{Table: "filter", Chain: "FORWARD", Params: []string{"-i", bridgeName, "-o", vethName, "-j", "ACCEPT"}},
+	})
+}
 
+// AcceptEstablishedInput accepts the incoming traffic of the connections established through the interface
+func AcceptEstablishedInput(ifaceName string) error {
+	rules := make([]Rule, 0)
+	for _, ipv6 := range []bool{false, true} {
+		rules = append(rules, Rule{IPv6: ipv6, Table: "filter", Chain: "INPUT", Params: []string{"-i", ifaceName, "-m", "state", "--state", "RELATED,ESTABLISHED", "-j", "ACCEPT"}})
 	}
-	return nil
+	return InstallRules(NODE_RULE_OWNER, rules...)
+}
+
+// SetNamespaceNat translates the traffic of the namespace interface from and to the guest address.
+// MUST be called inside the namespace, the rules are installed in the tables of the current network namespace.
+func SetNamespaceNat(ifaceName string, address net.IP, guestAddress net.IP) error {
+	protocol := iptables.ProtocolIPv4
+	if address.To4() == nil {
+		protocol = iptables.ProtocolIPv6
+	}
+	return newIpTable(FirewallBackend(), protocol).Transaction(func(tx IpTable) error {
+		if err := tx.Append("nat", "POSTROUTING", "-o", ifaceName, "-j", "SNAT", "--to", address.String()); err != nil {
+			return err
+		}
+		return tx.Append("nat", "PREROUTING", "-i", ifaceName, "-j", "DNAT", "--to", guestAddress.String())
+	})
 }
 
 // check if the string is a valid network port
@@ -11,6 +11,7 @@ import (
 	"math/big"
 	"net"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/vishvananda/netlink"
@@ -130,35 +131,63 @@ func defaultRoute() (*netlink.Link, error) {
 
 // GetOutboundIP finds the preferred outbound ip of this machine
 func GetOutboundIP() net.IP {
-	conn, err := net.Dial("udp", "8.8.8.8:80")
+	ip, err := OutboundIP()
 	if err != nil {
 		log.Fatalf("Unable to dial DNS: %s", err)
 	}
-	defer conn.Close()
+	return ip
+}
+
+// OutboundIP finds the preferred outbound ip of this machine, the public one when PublicIPNetworking is enabled
+func OutboundIP() (net.IP, error) {
+	local, err := LocalOutboundIP()
+	if err != nil {
+		return nil, err
+	}
 
 	if model.NetConfig.PublicIPNetworking {
 		// get public ip (nat ip)
-		req, err := http.Get("https://ifconfig.co")
-		if err != nil {
-			logger.ErrorLogger().Printf("%v", err.Error())
-		}
-		defer func(Body io.ReadCloser) {
-			err := Body.Close()
-			if err != nil {
-				logger.ErrorLogger().Printf("%v", err.Error())
-			}
-		}(req.Body)
-
-		body, err := io.ReadAll(req.Body)
+		public, err := publicIP()
 		if err == nil {
-			logger.InfoLogger().Println("Using public IP address: ", string(body))
-			return net.ParseIP(string(body[:len(body)-1]))
+			logger.InfoLogger().Println("Using public IP address: ", public.String())
+			return public, nil
 		}
 		logger.ErrorLogger().Printf("%v", err.Error())
 	}
 
-	// get local outbound ip
-	addr := conn.LocalAddr().(*net.UDPAddr)
-	logger.InfoLogger().Println("Using private IP address: ", addr.String())
-	return addr.IP
+	logger.InfoLogger().Println("Using private IP address: ", local.String())
+	return local, nil
+}
+
+// LocalOutboundIP finds the address of the interface this machine uses to reach the internet
+func LocalOutboundIP() (net.IP, error) {
+	conn, err := net.Dial("udp", "8.8.8.8:80")
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
+
+func publicIP() (net.IP, error) {
+	req, err := http.Get("https://ifconfig.co")
+	if err != nil {
+		return nil, err
+	}
+	defer func(Body io.ReadCloser) {
+		err := Body.Close()
+		if err != nil {
+			logger.ErrorLogger().Printf("%v", err.Error())
+		}
+	}(req.Body)
+
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(strings.TrimSpace(string(body)))
+	if ip == nil {
+		return nil, fmt.Errorf("invalid public IP address %q", string(body))
+	}
+	return ip, nil
 }
@@ -1,17 +1,21 @@
 package network
 
 import (
+	"encoding/json"
+	"errors"
 	"net"
 	"testing"
 
 	"gotest.tools/assert"
 )
 
+var testOwner = InstanceRuleOwner("app.app.svc.svc", 0)
+
 func TestPortMappingEmpty(t *testing.T) {
 	mock := &mockiptable{}
 	iptable = mock
-	// empty string
-	err := ManageContainerPorts(net.ParseIP("0.0.0.0"), "", OpenPorts)
+	// no mappings
+	err := ManageContainerPortMappings(testOwner, net.ParseIP("0.0.0.0"), nil, OpenPorts)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -22,7 +26,7 @@ func TestPortMappingUdp(t *testing.T) {
 	mock := &mockiptable{}
 	iptable = mock
 	// udp 80
-	err := ManageContainerPorts(net.ParseIP("0.0.0.0"), "80:80/udp", OpenPorts)
+	err := ManageContainerPortMappings(testOwner, net.ParseIP("0.0.0.0"), PortMappings{{HostPort: 80, ContainerPort: 80, Protocols: []string{"udp"}}}, OpenPorts)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -30,7 +34,10 @@ func TestPortMappingUdp(t *testing.T) {
 		assert.Equal(t, arg, mock.CalledWith[i])
 	}
 	// udp 80 and 90
-	err = ManageContainerPorts(net.ParseIP("0.0.0.0"), "80:80/udp;90:100/udp", OpenPorts)
+	err = ManageContainerPortMappings(testOwner, net.ParseIP("0.0.0.0"), PortMappings{
+		{HostPort: 80, ContainerPort: 80, Protocols: []string{"udp"}},
+		{HostPort: 90, ContainerPort: 100, Protocols: []string{"udp"}},
+	}, OpenPorts)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -43,7 +50,7 @@ func TestPortMappingTcp(t *testing.T) {
 	mock := &mockiptable{}
 	iptable = mock
 	// tcp 80
-	err := ManageContainerPorts(net.ParseIP("0.0.0.0"), "80", OpenPorts)
+	err := ManageContainerPortMappings(testOwner, net.ParseIP("0.0.0.0"), PortMappings{{HostPort: 80}}, OpenPorts)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -51,7 +58,7 @@ func TestPortMappingTcp(t *testing.T) {
 		assert.Equal(t, arg, mock.CalledWith[i])
 	}
 	// tcp 80:80
-	err = ManageContainerPorts(net.ParseIP("0.0.0.0"), "80:80", OpenPorts)
+	err = ManageContainerPortMappings(testOwner, net.ParseIP("0.0.0.0"), PortMappings{{HostPort: 80, ContainerPort: 80}}, OpenPorts)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -59,7 +66,10 @@ func TestPortMappingTcp(t *testing.T) {
 		assert.Equal(t, arg, mock.CalledWith[i])
 	}
 	// tcp 80 and 90
-	err = ManageContainerPorts(net.ParseIP("0.0.0.0"), "80:80/tcp;90:100/tcp", OpenPorts)
+	err = ManageContainerPortMappings(testOwner, net.ParseIP("0.0.0.0"), PortMappings{
+		{HostPort: 80, ContainerPort: 80, Protocols: []string{"tcp"}},
+		{HostPort: 90, ContainerPort: 100, Protocols: []string{"tcp"}},
+	}, OpenPorts)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -72,20 +82,134 @@ func TestPortMappingInvalid(t *testing.T) {
 	mock := &mockiptable{}
 	iptable = mock
 
-	err := ManageContainerPorts(net.ParseIP("0.0.0.0"), "80:80-80", OpenPorts)
+	err := ManageContainerPortMappings(testOwner, net.ParseIP("0.0.0.0"), PortMappings{{HostPort: 80, HostPortEnd: 70}}, OpenPorts)
 	if err == nil {
-		t.Fatal("80:80-80 must be invalid")
+		t.Fatal("80-70 must be invalid")
 	}
 
-	err = ManageContainerPorts(net.ParseIP("0.0.0.0"), " ", OpenPorts)
+	err = ManageContainerPortMappings(testOwner, net.ParseIP("0.0.0.0"), PortMappings{{HostPort: 80, Protocols: []string{"hello"}}}, OpenPorts)
 	if err == nil {
-		t.Fatal("space must be invalid")
+		t.Fatal("hello must be invalid")
 	}
+	assert.Equal(t, len(mock.CalledWith), 0)
 
-	err = ManageContainerPorts(net.ParseIP("0.0.0.0"), "hello", OpenPorts)
-	if err == nil {
-		t.Fatal("hello must be invalid")
+	for _, portmapping := range []string{"80:80-80", " ", "hello", "80:80:80", "[fc00::1:80", "80-90:80-85", "80/sctp"} {
+		_, err = ParsePortMappings(portmapping)
+		if err == nil {
+			t.Fatalf("%q must be invalid", portmapping)
+		}
+	}
+}
+
+func TestParsePortMappings(t *testing.T) {
+	mappings, err := ParsePortMappings("80;8080:80/udp;53/tcp,udp;10.0.0.1:9000-9010:80/tcp;[fc00::1]:7000-7001:90-91/udp")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, mappings, PortMappings{
+		{HostPort: 80, ContainerPort: 80, Protocols: []string{"tcp"}},
+		{HostPort: 8080, ContainerPort: 80, Protocols: []string{"udp"}},
+		{HostPort: 53, ContainerPort: 53, Protocols: []string{"tcp", "udp"}},
+		{HostIP: "10.0.0.1", HostPort: 9000, HostPortEnd: 9010, ContainerPort: 80, Protocols: []string{"tcp"}},
+		{HostIP: "fc00::1", HostPort: 7000, HostPortEnd: 7001, ContainerPort: 90, Protocols: []string{"udp"}},
+	})
+
+	// String returns the mappings as they are parsed
+	parsed, err := ParsePortMappings(mappings.String())
+	assert.NilError(t, err)
+	assert.DeepEqual(t, parsed, mappings)
+}
+
+func TestPortMappingsJSON(t *testing.T) {
+	var mappings PortMappings
+	assert.NilError(t, json.Unmarshal([]byte(`"8080:80/tcp;53/udp"`), &mappings))
+	assert.DeepEqual(t, mappings, PortMappings{
+		{HostPort: 8080, ContainerPort: 80, Protocols: []string{"tcp"}},
+		{HostPort: 53, ContainerPort: 53, Protocols: []string{"udp"}},
+	})
+	assert.Equal(t, mappings.String(), "8080:80/tcp;53:53/udp")
+
+	assert.NilError(t, json.Unmarshal([]byte(`[{"hostIP":"fc00::1","hostPort":9000,"hostPortEnd":9010,"containerPort":80,"protocols":["tcp","udp"]}]`), &mappings))
+	assert.Equal(t, mappings.String(), "[fc00::1]:9000-9010:80-90/tcp,udp")
+	// the ranges keeping the container ports need a single rule whatever their size
+	assert.NilError(t, json.Unmarshal([]byte(`[{"hostPort":1,"hostPortEnd":65535},{"hostPort":8000,"hostPortEnd":8255,"containerPort":80,"protocols":["udp"]}]`), &mappings))
+
+	invalid := []string{
+		`[{"hostPort":0}]`,
+		`[{"hostPort":9000,"hostPortEnd":8000}]`,
+		`[{"hostPort":65000,"hostPortEnd":65010,"containerPort":65530}]`,
+		`[{"hostPort":1,"hostPortEnd":65535,"containerPort":2}]`,
+		`[{"hostPort":8000,"hostPortEnd":8256,"containerPort":80}]`,
+		`[{"hostPort":80,"protocols":["sctp"]}]`,
+		`[{"hostPort":80,"protocols":["tcp","tcp"]}]`,
+		`[{"hostPort":80,"family":"ipv5"}]`,
+		`[{"hostPort":80,"hostIP":"10.0.0.1","family":"ipv6"}]`,
+		`[{"hostPort":80},{"hostPort":70,"hostPortEnd":90}]`,
+		`"80:80:80"`,
+	}
+	for _, data := range invalid {
+		assert.Assert(t, json.Unmarshal([]byte(data), &mappings) != nil, data)
+	}
+	// the same port with different protocols or families
+	assert.NilError(t, json.Unmarshal([]byte(`[{"hostPort":80},{"hostPort":80,"protocols":["udp"]}]`), &mappings))
+	assert.NilError(t, json.Unmarshal([]byte(`[{"hostPort":80,"family":"ipv4"},{"hostPort":80,"containerPort":8080,"family":"ipv6"}]`), &mappings))
+}
+
+func TestPortMappingRules(t *testing.T) {
+	v4, v6 := useFakeTables()
+	assert.NilError(t, CreateChain(false, "nat", chain))
+	assert.NilError(t, CreateChain(true, "nat", chain))
+	mappings := PortMappings{
+		{HostPort: 9000, HostPortEnd: 9002, Protocols: []string{"udp"}},
+		{HostPort: 8000, HostPortEnd: 8001, ContainerPort: 80},
+		{HostIP: "192.168.1.10", HostPort: 53, Protocols: []string{"tcp", "udp"}},
+		{HostPort: 443, Family: PORT_FAMILY_IPV6},
 	}
+	assert.NilError(t, ManageContainerPortMappings(testOwner, net.ParseIP("10.19.1.2"), mappings, OpenPorts))
+	assert.DeepEqual(t, v4.chains["nat/"+chain], []string{
+		"-p udp --dport 9000:9002 -j DNAT --to-destination 10.19.1.2",
+		"-p tcp --dport 8000 -j DNAT --to-destination 10.19.1.2:80",
+		"-p tcp --dport 8001 -j DNAT --to-destination 10.19.1.2:81",
+		"-p tcp --dport 53 -d 192.168.1.10 -j DNAT --to-destination 10.19.1.2:53",
+		"-p udp --dport 53 -d 192.168.1.10 -j DNAT --to-destination 10.19.1.2:53",
+	})
+	assert.NilError(t, ManageContainerPortMappings(testOwner, net.ParseIP("fc00::2"), mappings, OpenPorts))
+	assert.Equal(t, len(v6.chains["nat/"+chain]), 4)
+	assert.Equal(t, v6.chains["nat/"+chain][3], "-p tcp --dport 443 -j DNAT --to-destination [fc00::2]:443")
+
+	assert.NilError(t, ManageContainerPortMappings(testOwner, net.ParseIP("10.19.1.2"), mappings, ClosePorts))
+	assert.NilError(t, ManageContainerPortMappings(testOwner, net.ParseIP("fc00::2"), mappings, ClosePorts))
+	assert.Equal(t, v4.rules()+v6.rules(), 0)
+	assert.Equal(t, len(hostPorts.claims), 0)
+}
+
+func TestHostPortConflicts(t *testing.T) {
+	v4, _ := useFakeTables()
+	assert.NilError(t, CreateChain(false, "nat", chain))
+	assert.NilError(t, CreateChain(true, "nat", chain))
+	other := InstanceRuleOwner("app.app.svc.svc", 1)
+	mappings := PortMappings{{HostPort: 8000, HostPortEnd: 8010, ContainerPort: 80}}
+	assert.NilError(t, ManageContainerPortMappings(testOwner, net.ParseIP("10.19.1.2"), mappings, OpenPorts))
+
+	err := ManageContainerPortMappings(other, net.ParseIP("10.19.1.3"), PortMappings{{HostPort: 8005}, {HostPort: 7000}}, OpenPorts)
+	assert.Assert(t, errors.Is(err, ErrHostPortConflict))
+	assert.ErrorContains(t, err, "8000-8010/tcp on all the addresses (ipv4) is used by instance/app.app.svc.svc/0")
+	assert.Equal(t, v4.rules(), 11)
+
+	// other protocols, families and the same owner don't conflict
+	assert.NilError(t, ManageContainerPortMappings(other, net.ParseIP("10.19.1.3"), PortMappings{{HostPort: 8005, Protocols: []string{"udp"}}}, OpenPorts))
+	assert.NilError(t, ManageContainerPortMappings(other, net.ParseIP("fc00::3"), PortMappings{{HostPort: 8005}}, OpenPorts))
+	assert.NilError(t, ManageContainerPortMappings(testOwner, net.ParseIP("10.19.1.2"), PortMappings{{HostPort: 8005}}, OpenPorts))
+
+	// the ports bound to an address conflict with the ones bound to all the addresses
+	err = ManageContainerPortMappings(other, net.ParseIP("10.19.1.3"), PortMappings{{HostIP: "192.168.1.10", HostPort: 8010}}, OpenPorts)
+	assert.Assert(t, errors.Is(err, ErrHostPortConflict))
+	assert.NilError(t, ManageContainerPortMappings(other, net.ParseIP("10.19.1.3"), PortMappings{{HostIP: "192.168.1.10", HostPort: 8011}}, OpenPorts))
+	err = ManageContainerPortMappings(testOwner, net.ParseIP("10.19.1.2"), PortMappings{{HostIP: "192.168.1.10", HostPort: 8011}}, OpenPorts)
+	assert.Assert(t, errors.Is(err, ErrHostPortConflict))
+	assert.NilError(t, ManageContainerPortMappings(testOwner, net.ParseIP("10.19.1.2"), PortMappings{{HostIP: "192.168.1.11", HostPort: 8011}}, OpenPorts))
+
+	// the ports are free again once the owner is gone
+	assert.NilError(t, ReleaseRules(testOwner))
+	assert.NilError(t, ManageContainerPortMappings(other, net.ParseIP("10.19.1.3"), PortMappings{{HostPort: 8005}}, OpenPorts))
 }
 
 func TestIncIP_simple(t *testing.T) {
@@ -109,8 +233,7 @@ func (t *mockiptable) Append(s string, s2 string, s3 ...string) error {
 }
 
 func (t *mockiptable) AppendUnique(s string, s2 string, s3 ...string) error {
-	// TODO implement me
-	panic("implement me")
+	return t.Append(s, s2, s3...)
 }
 
 func (t *mockiptable) Delete(s string, s2 string, s3 ...string) error {
@@ -127,3 +250,15 @@ func (t *mockiptable) AddChain(s string, s2 string) error {
 	// TODO implement me
 	panic("implement me")
 }
+
+func (t *mockiptable) Transaction(fn func(IpTable) error) error {
+	return fn(t)
+}
+
+func (t *mockiptable) Exists(s string, s2 string, s3 ...string) (bool, error) {
+	return false, nil
+}
+
+func (t *mockiptable) ChainExists(s string, s2 string) (bool, error) {
+	return true, nil
+}
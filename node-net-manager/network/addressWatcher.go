@@ -0,0 +1,136 @@
+package network
+
+import (
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/vishvananda/netlink"
+)
+
+// ADDRESS_CHANGE_DEBOUNCE groups the netlink updates of a single network change, e.g. a new address followed by its routes
+const ADDRESS_CHANGE_DEBOUNCE = 2 * time.Second
+
+// ADDRESS_RESYNC_INTERVAL is how often the address is resolved without any netlink update,
+// e.g. to follow the public address of a node behind NAT
+const ADDRESS_RESYNC_INTERVAL = 2 * time.Minute
+
+// AddressWatcher follows the address of the node, reacting to the netlink address and route updates
+type AddressWatcher struct {
+	current  net.IP
+	resolve  func() (net.IP, error)
+	onChange func(net.IP)
+	debounce time.Duration
+	resync   time.Duration
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// WatchNodeAddress calls onChange with the new address of the node every time it changes,
+// the address is resolved with OutboundIP when the addresses or the routes of the node change
+func WatchNodeAddress(current net.IP, onChange func(net.IP)) (*AddressWatcher, error) {
+	watcher := newAddressWatcher(current, OutboundIP, onChange)
+	updates, err := subscribeNetworkUpdates(watcher.stop)
+	if err != nil {
+		watcher.Stop()
+		return nil, err
+	}
+	go watcher.run(updates)
+	return watcher, nil
+}
+
+func newAddressWatcher(current net.IP, resolve func() (net.IP, error), onChange func(net.IP)) *AddressWatcher {
+	return &AddressWatcher{
+		current:  current,
+		resolve:  resolve,
+		onChange: onChange,
+		debounce: ADDRESS_CHANGE_DEBOUNCE,
+		resync:   ADDRESS_RESYNC_INTERVAL,
+		stop:     make(chan struct{}),
+	}
+}
+
+// Stop ends the netlink subscriptions
+func (w *AddressWatcher) Stop() {
+	w.stopOnce.Do(func() { close(w.stop) })
+}
+
+// subscribeNetworkUpdates merges the netlink address and route updates in a single channel
+func subscribeNetworkUpdates(done chan struct{}) (<-chan struct{}, error) {
+	addrUpdates := make(chan netlink.AddrUpdate, 64)
+	routeUpdates := make(chan netlink.RouteUpdate, 64)
+	onError := func(err error) {
+		log.Printf("ERROR: netlink subscription: %v", err)
+	}
+	if err := netlink.AddrSubscribeWithOptions(addrUpdates, done, netlink.AddrSubscribeOptions{ErrorCallback: onError}); err != nil {
+		return nil, err
+	}
+	if err := netlink.RouteSubscribeWithOptions(routeUpdates, done, netlink.RouteSubscribeOptions{ErrorCallback: onError}); err != nil {
+		return nil, err
+	}
+	updates := make(chan struct{}, 1)
+	notify := func() {
+		select {
+		case updates <- struct{}{}:
+		default:
+		}
+	}
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case _, ok := <-addrUpdates:
+				if !ok {
+					log.Printf("ERROR: netlink address subscription closed, following the address every %s", ADDRESS_RESYNC_INTERVAL)
+					return
+				}
+				notify()
+			case _, ok := <-routeUpdates:
+				if !ok {
+					log.Printf("ERROR: netlink route subscription closed, following the address every %s", ADDRESS_RESYNC_INTERVAL)
+					return
+				}
+				notify()
+			}
+		}
+	}()
+	return updates, nil
+}
+
+// run resolves the address after each burst of updates, and every resync interval
+func (w *AddressWatcher) run(updates <-chan struct{}) {
+	resync := time.NewTicker(w.resync)
+	defer resync.Stop()
+	var settle <-chan time.Time
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-updates:
+			// wait for the network to settle, the following updates restart the wait
+			settle = time.After(w.debounce)
+		case <-settle:
+			settle = nil
+			w.check()
+		case <-resync.C:
+			w.check()
+		}
+	}
+}
+
+func (w *AddressWatcher) check() {
+	address, err := w.resolve()
+	if err != nil {
+		// e.g. no default route while the node is moving between networks, the next update tells when it is back
+		log.Printf("unable to resolve the node address: %v", err)
+		return
+	}
+	if address.Equal(w.current) {
+		return
+	}
+	log.Printf("node address changed from %s to %s", w.current, address)
+	w.current = address
+	w.onChange(address)
+}
@@ -0,0 +1,63 @@
+package network
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+func TestAddressWatcherDebounce(t *testing.T) {
+	var lock sync.Mutex
+	address := net.ParseIP("10.0.0.1")
+	var resolveErr error
+	resolved := 0
+	resolve := func() (net.IP, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		resolved++
+		return address, resolveErr
+	}
+	changes := make(chan net.IP, 10)
+	watcher := newAddressWatcher(net.ParseIP("10.0.0.1"), resolve, func(ip net.IP) { changes <- ip })
+	watcher.debounce = 50 * time.Millisecond
+	updates := make(chan struct{})
+	go watcher.run(updates)
+	defer watcher.Stop()
+
+	// a burst of updates is resolved once, after the network settles
+	lock.Lock()
+	address = net.ParseIP("192.168.1.7")
+	lock.Unlock()
+	for i := 0; i < 5; i++ {
+		updates <- struct{}{}
+	}
+	select {
+	case ip := <-changes:
+		assert.Equal(t, ip.String(), "192.168.1.7")
+	case <-time.After(time.Second):
+		t.Fatal("address change not notified")
+	}
+	lock.Lock()
+	assert.Equal(t, resolved, 1)
+	lock.Unlock()
+
+	// no notification without a change, or while the address can't be resolved
+	updates <- struct{}{}
+	time.Sleep(100 * time.Millisecond)
+	lock.Lock()
+	resolveErr = errors.New("network is unreachable")
+	lock.Unlock()
+	updates <- struct{}{}
+	select {
+	case ip := <-changes:
+		t.Fatalf("unexpected change to %s", ip)
+	case <-time.After(200 * time.Millisecond):
+	}
+	lock.Lock()
+	assert.Equal(t, resolved, 3)
+	lock.Unlock()
+}
@@ -0,0 +1,313 @@
+package network
+
+import (
+	"NetManager/logger"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	DHCP_SERVER_PORT = 67
+	DHCP_CLIENT_PORT = 68
+	// DEFAULT_DHCP_LEASE_TIME is the lease time offered to the guests, renewed by the clients at half of it
+	DEFAULT_DHCP_LEASE_TIME = 24 * time.Hour
+)
+
+const (
+	dhcpBootRequest = 1
+	dhcpBootReply   = 2
+	dhcpHeaderSize  = 240
+	dhcpMagicCookie = 0x63825363
+)
+
+// DHCP message types
+const (
+	dhcpDiscover = 1
+	dhcpOffer    = 2
+	dhcpRequest  = 3
+	dhcpAck      = 5
+	dhcpNak      = 6
+)
+
+// DHCP options
+const (
+	dhcpOptionPad         = 0
+	dhcpOptionSubnetMask  = 1
+	dhcpOptionRouter      = 3
+	dhcpOptionMTU         = 26
+	dhcpOptionRequestedIP = 50
+	dhcpOptionLeaseTime   = 51
+	dhcpOptionMessageType = 53
+	dhcpOptionServerID    = 54
+	dhcpOptionEnd         = 255
+)
+
+// DhcpLease binds a guest MAC address to its IPv4 address
+type DhcpLease struct {
+	MAC net.HardwareAddr
+	IP  net.IP
+}
+
+// DhcpConfiguration is the addressing handed out by the DhcpServer.
+// Only the clients with a static lease get an address, the others are ignored.
+type DhcpConfiguration struct {
+	ServerIP  net.IP
+	Mask      net.IPMask
+	Router    net.IP
+	MTU       int
+	LeaseTime time.Duration
+	Leases    []DhcpLease
+}
+
+// DhcpServer is a minimal DHCPv4 responder serving static leases on a single link
+type DhcpServer struct {
+	conn   net.PacketConn
+	config DhcpConfiguration
+}
+
+type dhcpOption struct {
+	code byte
+	data []byte
+}
+
+type dhcpMessage struct {
+	op      byte
+	xid     uint32
+	flags   uint16
+	ciaddr  net.IP
+	yiaddr  net.IP
+	siaddr  net.IP
+	chaddr  net.HardwareAddr
+	options []dhcpOption
+}
+
+// ListenDhcp opens the DHCP server socket bound to the interface.
+// The socket belongs to the network namespace of the calling thread.
+func ListenDhcp(iface string) (net.PacketConn, error) {
+	config := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				sockErr = unix.SetsockoptString(int(fd), unix.SOL_SOCKET, unix.SO_BINDTODEVICE, iface)
+				if sockErr == nil {
+					sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_BROADCAST, 1)
+				}
+			})
+			if err != nil {
+				return err
+			}
+			return sockErr
+		},
+	}
+	return config.ListenPacket(context.Background(), "udp4", fmt.Sprintf("0.0.0.0:%d", DHCP_SERVER_PORT))
+}
+
+// NewDhcpServer creates a DHCP server answering on conn, see ListenDhcp
+func NewDhcpServer(conn net.PacketConn, config DhcpConfiguration) *DhcpServer {
+	if config.LeaseTime == 0 {
+		config.LeaseTime = DEFAULT_DHCP_LEASE_TIME
+	}
+	return &DhcpServer{
+		conn:   conn,
+		config: config,
+	}
+}
+
+// Serve answers the DHCP requests until the server is closed
+func (s *DhcpServer) Serve() {
+	buffer := make([]byte, 1500)
+	broadcast := &net.UDPAddr{IP: net.IPv4bcast, Port: DHCP_CLIENT_PORT}
+	for {
+		n, _, err := s.conn.ReadFrom(buffer)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			logger.DebugLogger().Printf("DHCP read error: %v", err)
+			continue
+		}
+		request, err := parseDhcpMessage(buffer[:n])
+		if err != nil {
+			logger.DebugLogger().Printf("Invalid DHCP message: %v", err)
+			continue
+		}
+		reply := s.handle(request)
+		if reply == nil {
+			continue
+		}
+		// the client has no address yet, the reply is broadcasted on the link
+		if _, err := s.conn.WriteTo(reply.marshal(), broadcast); err != nil {
+			logger.DebugLogger().Printf("DHCP write error: %v", err)
+		}
+	}
+}
+
+// Close stops the server
+func (s *DhcpServer) Close() error {
+	return s.conn.Close()
+}
+
+// handle returns the reply to the request, or nil if the server must not answer
+func (s *DhcpServer) handle(request *dhcpMessage) *dhcpMessage {
+	if request.op != dhcpBootRequest {
+		return nil
+	}
+	lease, found := s.lease(request.chaddr)
+	if !found {
+		return nil
+	}
+	switch request.messageType() {
+	case dhcpDiscover:
+		return s.reply(request, dhcpOffer, lease.IP)
+	case dhcpRequest:
+		if serverID := request.option(dhcpOptionServerID); serverID != nil && !net.IP(serverID).Equal(s.config.ServerIP) {
+			// the client selected another server
+			return nil
+		}
+		requested := net.IP(request.option(dhcpOptionRequestedIP))
+		if requested == nil {
+			// renewing
+			requested = request.ciaddr
+		}
+		if !requested.Equal(lease.IP) {
+			return s.reply(request, dhcpNak, nil)
+		}
+		return s.reply(request, dhcpAck, lease.IP)
+	}
+	return nil
+}
+
+func (s *DhcpServer) lease(mac net.HardwareAddr) (DhcpLease, bool) {
+	for _, lease := range s.config.Leases {
+		if bytes.Equal(lease.MAC, mac) {
+			return lease, true
+		}
+	}
+	return DhcpLease{}, false
+}
+
+func (s *DhcpServer) reply(request *dhcpMessage, messageType byte, ip net.IP) *dhcpMessage {
+	reply := &dhcpMessage{
+		op:     dhcpBootReply,
+		xid:    request.xid,
+		flags:  request.flags,
+		ciaddr: net.IPv4zero,
+		yiaddr: net.IPv4zero,
+		siaddr: net.IPv4zero,
+		chaddr: request.chaddr,
+	}
+	reply.addOption(dhcpOptionMessageType, []byte{messageType})
+	reply.addOption(dhcpOptionServerID, s.config.ServerIP.To4())
+	if messageType == dhcpNak {
+		return reply
+	}
+	reply.yiaddr = ip
+	reply.siaddr = s.config.ServerIP
+	leaseTime := make([]byte, 4)
+	binary.BigEndian.PutUint32(leaseTime, uint32(s.config.LeaseTime.Seconds()))
+	reply.addOption(dhcpOptionLeaseTime, leaseTime)
+	reply.addOption(dhcpOptionSubnetMask, s.config.Mask)
+	if s.config.Router != nil {
+		reply.addOption(dhcpOptionRouter, s.config.Router.To4())
+	}
+	if s.config.MTU > 0 {
+		mtu := make([]byte, 2)
+		binary.BigEndian.PutUint16(mtu, uint16(s.config.MTU))
+		reply.addOption(dhcpOptionMTU, mtu)
+	}
+	return reply
+}
+
+func parseDhcpMessage(b []byte) (*dhcpMessage, error) {
+	if len(b) < dhcpHeaderSize {
+		return nil, errors.New("DHCP message too short")
+	}
+	if binary.BigEndian.Uint32(b[236:240]) != dhcpMagicCookie {
+		return nil, errors.New("missing DHCP magic cookie")
+	}
+	// only ethernet hardware addresses
+	if b[1] != 1 || b[2] != 6 {
+		return nil, errors.New("unsupported hardware address type")
+	}
+	msg := &dhcpMessage{
+		op:      b[0],
+		xid:     binary.BigEndian.Uint32(b[4:8]),
+		flags:   binary.BigEndian.Uint16(b[10:12]),
+		ciaddr:  net.IP(append([]byte{}, b[12:16]...)),
+		yiaddr:  net.IP(append([]byte{}, b[16:20]...)),
+		siaddr:  net.IP(append([]byte{}, b[20:24]...)),
+		chaddr:  net.HardwareAddr(append([]byte{}, b[28:34]...)),
+		options: make([]dhcpOption, 0),
+	}
+	options := b[dhcpHeaderSize:]
+	for len(options) > 0 {
+		code := options[0]
+		if code == dhcpOptionEnd {
+			break
+		}
+		if code == dhcpOptionPad {
+			options = options[1:]
+			continue
+		}
+		if len(options) < 2 || len(options) < 2+int(options[1]) {
+			return nil, errors.New("truncated DHCP option")
+		}
+		length := int(options[1])
+		msg.addOption(code, append([]byte{}, options[2:2+length]...))
+		options = options[2+length:]
+	}
+	return msg, nil
+}
+
+func (msg *dhcpMessage) marshal() []byte {
+	b := make([]byte, dhcpHeaderSize, 300)
+	b[0] = msg.op
+	b[1] = 1
+	b[2] = 6
+	binary.BigEndian.PutUint32(b[4:8], msg.xid)
+	binary.BigEndian.PutUint16(b[10:12], msg.flags)
+	copy(b[12:16], msg.ciaddr.To4())
+	copy(b[16:20], msg.yiaddr.To4())
+	copy(b[20:24], msg.siaddr.To4())
+	copy(b[28:44], msg.chaddr)
+	binary.BigEndian.PutUint32(b[236:240], dhcpMagicCookie)
+	for _, option := range msg.options {
+		b = append(b, option.code, byte(len(option.data)))
+		b = append(b, option.data...)
+	}
+	b = append(b, dhcpOptionEnd)
+	// pad to the minimum BOOTP message size
+	for len(b) < 300 {
+		b = append(b, dhcpOptionPad)
+	}
+	return b
+}
+
+func (msg *dhcpMessage) addOption(code byte, data []byte) {
+	msg.options = append(msg.options, dhcpOption{code: code, data: data})
+}
+
+func (msg *dhcpMessage) option(code byte) []byte {
+	for _, option := range msg.options {
+		if option.code == code {
+			return option.data
+		}
+	}
+	return nil
+}
+
+func (msg *dhcpMessage) messageType() byte {
+	messageType := msg.option(dhcpOptionMessageType)
+	if len(messageType) != 1 {
+		return 0
+	}
+	return messageType[0]
+}
@@ -0,0 +1,135 @@
+package network
+
+import (
+	"net"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func testDhcpServer() *DhcpServer {
+	mac, _ := net.ParseMAC("02:00:00:00:00:01")
+	return NewDhcpServer(nil, DhcpConfiguration{
+		ServerIP: net.ParseIP("192.168.1.1"),
+		Mask:     net.CIDRMask(29, 32),
+		Router:   net.ParseIP("192.168.1.1"),
+		MTU:      1400,
+		Leases:   []DhcpLease{{MAC: mac, IP: net.ParseIP("192.168.1.2")}},
+	})
+}
+
+func dhcpClientMessage(mac string, messageType byte, options ...dhcpOption) *dhcpMessage {
+	hwaddr, _ := net.ParseMAC(mac)
+	msg := &dhcpMessage{
+		op:      dhcpBootRequest,
+		xid:     0xcafe,
+		ciaddr:  net.IPv4zero,
+		yiaddr:  net.IPv4zero,
+		siaddr:  net.IPv4zero,
+		chaddr:  hwaddr,
+		options: []dhcpOption{{code: dhcpOptionMessageType, data: []byte{messageType}}},
+	}
+	msg.options = append(msg.options, options...)
+	return msg
+}
+
+// exchange sends the request to the server through the wire format and parses the reply
+func exchange(t *testing.T, server *DhcpServer, request *dhcpMessage) *dhcpMessage {
+	parsed, err := parseDhcpMessage(request.marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := server.handle(parsed)
+	if reply == nil {
+		return nil
+	}
+	parsedReply, err := parseDhcpMessage(reply.marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsedReply
+}
+
+func TestDhcpLease(t *testing.T) {
+	server := testDhcpServer()
+
+	offer := exchange(t, server, dhcpClientMessage("02:00:00:00:00:01", dhcpDiscover))
+	assert.Assert(t, offer != nil)
+	assert.Equal(t, offer.messageType(), byte(dhcpOffer))
+	assert.Equal(t, offer.xid, uint32(0xcafe))
+	assert.Equal(t, offer.yiaddr.String(), "192.168.1.2")
+	assert.Equal(t, net.IP(offer.option(dhcpOptionRouter)).String(), "192.168.1.1")
+	assert.Equal(t, net.IPMask(offer.option(dhcpOptionSubnetMask)).String(), net.CIDRMask(29, 32).String())
+	assert.DeepEqual(t, offer.option(dhcpOptionMTU), []byte{0x05, 0x78})
+
+	ack := exchange(t, server, dhcpClientMessage("02:00:00:00:00:01", dhcpRequest,
+		dhcpOption{code: dhcpOptionRequestedIP, data: net.ParseIP("192.168.1.2").To4()},
+		dhcpOption{code: dhcpOptionServerID, data: net.ParseIP("192.168.1.1").To4()},
+	))
+	assert.Assert(t, ack != nil)
+	assert.Equal(t, ack.messageType(), byte(dhcpAck))
+	assert.Equal(t, ack.yiaddr.String(), "192.168.1.2")
+
+	// renewal, the address is in ciaddr
+	renew := dhcpClientMessage("02:00:00:00:00:01", dhcpRequest)
+	renew.ciaddr = net.ParseIP("192.168.1.2")
+	ack = exchange(t, server, renew)
+	assert.Assert(t, ack != nil)
+	assert.Equal(t, ack.messageType(), byte(dhcpAck))
+}
+
+func TestDhcpWrongRequest(t *testing.T) {
+	server := testDhcpServer()
+
+	nak := exchange(t, server, dhcpClientMessage("02:00:00:00:00:01", dhcpRequest,
+		dhcpOption{code: dhcpOptionRequestedIP, data: net.ParseIP("192.168.1.3").To4()},
+	))
+	assert.Assert(t, nak != nil)
+	assert.Equal(t, nak.messageType(), byte(dhcpNak))
+	assert.Equal(t, nak.yiaddr.String(), "0.0.0.0")
+
+	// another server was selected
+	reply := exchange(t, server, dhcpClientMessage("02:00:00:00:00:01", dhcpRequest,
+		dhcpOption{code: dhcpOptionRequestedIP, data: net.ParseIP("192.168.1.2").To4()},
+		dhcpOption{code: dhcpOptionServerID, data: net.ParseIP("192.168.1.5").To4()},
+	))
+	assert.Assert(t, reply == nil)
+
+	// no lease for the client
+	reply = exchange(t, server, dhcpClientMessage("02:00:00:00:00:02", dhcpDiscover))
+	assert.Assert(t, reply == nil)
+}
+
+func TestDhcpInvalidMessage(t *testing.T) {
+	msg := dhcpClientMessage("02:00:00:00:00:01", dhcpDiscover).marshal()
+	_, err := parseDhcpMessage(msg[:100])
+	assert.Assert(t, err != nil)
+
+	msg[236] = 0
+	_, err = parseDhcpMessage(msg)
+	assert.Assert(t, err != nil)
+}
+
+func TestRouterAdvertisement(t *testing.T) {
+	_, prefix, _ := net.ParseCIDR("fdff:1::/64")
+	msg := RouterAdvertisement{Prefix: prefix, MTU: 1400}.marshal()
+
+	assert.Equal(t, len(msg), 16+32+8)
+	assert.Equal(t, msg[0], byte(134))
+	// router lifetime of 30 minutes
+	assert.DeepEqual(t, msg[6:8], []byte{0x07, 0x08})
+	// prefix information
+	assert.Equal(t, msg[16], byte(raOptionPrefixInformation))
+	assert.Equal(t, msg[18], byte(64))
+	assert.Equal(t, msg[19], byte(raPrefixFlags))
+	assert.Equal(t, net.IP(msg[32:48]).String(), "fdff:1::")
+	// mtu
+	assert.Equal(t, msg[48], byte(raOptionMTU))
+	assert.DeepEqual(t, msg[52:56], []byte{0, 0, 0x05, 0x78})
+}
+
+func TestSlaacAddress(t *testing.T) {
+	_, prefix, _ := net.ParseCIDR("fdff:1::/64")
+	mac, _ := net.ParseMAC("52:54:00:12:34:56")
+	assert.Equal(t, SlaacAddress(prefix, mac).String(), "fdff:1::5054:ff:fe12:3456")
+}
@@ -16,6 +16,10 @@ type IpTable interface {
 	Delete(string, string, ...string) error
 	DeleteChain(string, string) error
 	AddChain(string, string) error
+	Exists(string, string, ...string) (bool, error)
+	ChainExists(string, string) (bool, error)
+	// Transaction applies all the rule changes made by fn, or none of them if fn fails
+	Transaction(fn func(IpTable) error) error
 }
 
 func NewOakestraIPTable(protocol iptables.Protocol) IpTable {
@@ -48,3 +52,91 @@ func (t *oakestraIpTable) DeleteChain(table string, chain string) error {
 func (t *oakestraIpTable) AddChain(table string, chain string) error {
 	return t.iptable.NewChain(table, chain)
 }
+
+func (t *oakestraIpTable) Exists(table string, chain string, params ...string) (bool, error) {
+	return t.iptable.Exists(table, chain, params...)
+}
+
+func (t *oakestraIpTable) ChainExists(table string, chain string) (bool, error) {
+	return t.iptable.ChainExists(table, chain)
+}
+
+// Transaction applies the changes one by one, iptables has no atomic update of single rules.
+// When fn fails the rules appended or deleted so far are restored.
+func (t *oakestraIpTable) Transaction(fn func(IpTable) error) error {
+	tx := &iptablesTransaction{table: t}
+	err := fn(tx)
+	if err != nil {
+		tx.rollback()
+	}
+	return err
+}
+
+type iptablesChange struct {
+	appended bool
+	table    string
+	chain    string
+	params   []string
+}
+
+// iptablesTransaction records the changes to undo them
+type iptablesTransaction struct {
+	table   *oakestraIpTable
+	changes []iptablesChange
+}
+
+func (tx *iptablesTransaction) Append(table string, chain string, params ...string) error {
+	if err := tx.table.Append(table, chain, params...); err != nil {
+		return err
+	}
+	tx.changes = append(tx.changes, iptablesChange{appended: true, table: table, chain: chain, params: params})
+	return nil
+}
+
+func (tx *iptablesTransaction) AppendUnique(table string, chain string, params ...string) error {
+	exists, err := tx.table.Exists(table, chain, params...)
+	if err != nil || exists {
+		return err
+	}
+	return tx.Append(table, chain, params...)
+}
+
+func (tx *iptablesTransaction) Delete(table string, chain string, params ...string) error {
+	if err := tx.table.Delete(table, chain, params...); err != nil {
+		return err
+	}
+	tx.changes = append(tx.changes, iptablesChange{appended: false, table: table, chain: chain, params: params})
+	return nil
+}
+
+// DeleteChain is not undone
+func (tx *iptablesTransaction) DeleteChain(table string, chain string) error {
+	return tx.table.DeleteChain(table, chain)
+}
+
+func (tx *iptablesTransaction) AddChain(table string, chain string) error {
+	return tx.table.AddChain(table, chain)
+}
+
+func (tx *iptablesTransaction) Exists(table string, chain string, params ...string) (bool, error) {
+	return tx.table.Exists(table, chain, params...)
+}
+
+func (tx *iptablesTransaction) ChainExists(table string, chain string) (bool, error) {
+	return tx.table.ChainExists(table, chain)
+}
+
+func (tx *iptablesTransaction) Transaction(fn func(IpTable) error) error {
+	return fn(tx)
+}
+
+func (tx *iptablesTransaction) rollback() {
+	for i := len(tx.changes) - 1; i >= 0; i-- {
+		change := tx.changes[i]
+		if change.appended {
+			_ = tx.table.Delete(change.table, change.chain, change.params...)
+		} else {
+			_ = tx.table.Append(change.table, change.chain, change.params...)
+		}
+	}
+}
@@ -0,0 +1,461 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/coreos/go-iptables/iptables"
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/google/nftables/userdata"
+	"golang.org/x/sys/unix"
+)
+
+// NFTABLES_TABLE holds all the chains and rules of the NetManager, one table for each IP family
+const NFTABLES_TABLE = "oakestra"
+
+type nftBaseChain struct {
+	name      string
+	chainType nftables.ChainType
+	hook      *nftables.ChainHook
+	priority  *nftables.ChainPriority
+}
+
+// nftBaseChains maps the iptables table/chain pairs to the base chains of the oakestra table
+var nftBaseChains = map[string]nftBaseChain{
+	"nat/PREROUTING":  {"prerouting", nftables.ChainTypeNAT, nftables.ChainHookPrerouting, nftables.ChainPriorityNATDest},
+	"nat/OUTPUT":      {"output", nftables.ChainTypeNAT, nftables.ChainHookOutput, nftables.ChainPriorityNATDest},
+	"nat/POSTROUTING": {"postrouting", nftables.ChainTypeNAT, nftables.ChainHookPostrouting, nftables.ChainPriorityNATSource},
+	"filter/FORWARD":  {"forward", nftables.ChainTypeFilter, nftables.ChainHookForward, nftables.ChainPriorityFilter},
+	"filter/INPUT":    {"input", nftables.ChainTypeFilter, nftables.ChainHookInput, nftables.ChainPriorityFilter},
+}
+
+// oakestraNfTable implements IpTable with nftables rules, translating the iptables parameters used by the NetManager.
+// Each rule carries its iptables parameters as comment, used to find it again for AppendUnique and Delete.
+type oakestraNfTable struct {
+	family nftables.TableFamily
+	table  *nftables.Table
+	// connection options, replaced in the tests
+	options []nftables.ConnOption
+	lock    sync.Mutex
+}
+
+// NewOakestraNfTable creates the oakestra table and its base chains in the current network namespace
+func NewOakestraNfTable(protocol iptables.Protocol, options ...nftables.ConnOption) (IpTable, error) {
+	family := nftables.TableFamilyIPv4
+	if protocol == iptables.ProtocolIPv6 {
+		family = nftables.TableFamilyIPv6
+	}
+	t := &oakestraNfTable{
+		family:  family,
+		table:   &nftables.Table{Name: NFTABLES_TABLE, Family: family},
+		options: options,
+	}
+	conn, err := nftables.New(t.options...)
+	if err != nil {
+		return nil, err
+	}
+	conn.AddTable(t.table)
+	for _, base := range nftBaseChains {
+		conn.AddChain(t.baseChain(base))
+	}
+	if err := conn.Flush(); err != nil {
+		return nil, fmt.Errorf("unable to create the nftables table %s: %v", NFTABLES_TABLE, err)
+	}
+	return t, nil
+}
+
+func (t *oakestraNfTable) baseChain(base nftBaseChain) *nftables.Chain {
+	return &nftables.Chain{
+		Name:     base.name,
+		Table:    t.table,
+		Type:     base.chainType,
+		Hooknum:  base.hook,
+		Priority: base.priority,
+	}
+}
+
+// chain returns the base chain for the iptables built-in chains, a regular chain otherwise
+func (t *oakestraNfTable) chain(table string, chain string) *nftables.Chain {
+	if base, ok := nftBaseChains[table+"/"+chain]; ok {
+		return t.baseChain(base)
+	}
+	return &nftables.Chain{Name: chain, Table: t.table}
+}
+
+func (t *oakestraNfTable) Append(table string, chain string, params ...string) error {
+	return t.Transaction(func(tx IpTable) error {
+		return tx.Append(table, chain, params...)
+	})
+}
+
+func (t *oakestraNfTable) AppendUnique(table string, chain string, params ...string) error {
+	return t.Transaction(func(tx IpTable) error {
+		return tx.AppendUnique(table, chain, params...)
+	})
+}
+
+func (t *oakestraNfTable) Delete(table string, chain string, params ...string) error {
+	return t.Transaction(func(tx IpTable) error {
+		return tx.Delete(table, chain, params...)
+	})
+}
+
+// DeleteChain flushes the chain, then deletes it. The chain is left empty if still referenced, like iptables -X.
+func (t *oakestraNfTable) DeleteChain(table string, chain string) error {
+	if err := t.Transaction(func(tx IpTable) error {
+		tx.(*nftTransaction).conn.FlushChain(t.chain(table, chain))
+		return nil
+	}); err != nil {
+		return err
+	}
+	return t.Transaction(func(tx IpTable) error {
+		tx.(*nftTransaction).conn.DelChain(t.chain(table, chain))
+		return nil
+	})
+}
+
+func (t *oakestraNfTable) AddChain(table string, chain string) error {
+	return t.Transaction(func(tx IpTable) error {
+		return tx.AddChain(table, chain)
+	})
+}
+
+func (t *oakestraNfTable) Exists(table string, chain string, params ...string) (bool, error) {
+	exists := false
+	err := t.Transaction(func(tx IpTable) error {
+		var err error
+		exists, err = tx.Exists(table, chain, params...)
+		return err
+	})
+	return exists, err
+}
+
+func (t *oakestraNfTable) ChainExists(table string, chain string) (bool, error) {
+	exists := false
+	err := t.Transaction(func(tx IpTable) error {
+		var err error
+		exists, err = tx.ChainExists(table, chain)
+		return err
+	})
+	return exists, err
+}
+
+// Transaction sends all the changes made by fn in a single nftables batch, applied atomically by the kernel
+func (t *oakestraNfTable) Transaction(fn func(IpTable) error) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	conn, err := nftables.New(t.options...)
+	if err != nil {
+		return err
+	}
+	tx := &nftTransaction{table: t, conn: conn, added: make(map[string]bool)}
+	if err := fn(tx); err != nil {
+		// the queued messages are never sent
+		return err
+	}
+	return conn.Flush()
+}
+
+// nftTransaction queues the changes on a connection flushed by Transaction
+type nftTransaction struct {
+	table *oakestraNfTable
+	conn  *nftables.Conn
+	// comments of the rules appended in this transaction
+	added map[string]bool
+}
+
+func (tx *nftTransaction) Append(table string, chain string, params ...string) error {
+	exprs, err := nftRuleExprs(tx.table.family, params)
+	if err != nil {
+		return err
+	}
+	comment := strings.Join(params, " ")
+	tx.conn.AddRule(&nftables.Rule{
+		Table:    tx.table.table,
+		Chain:    tx.table.chain(table, chain),
+		Exprs:    exprs,
+		UserData: userdata.AppendString(nil, userdata.TypeComment, comment),
+	})
+	tx.added[table+"/"+chain+"/"+comment] = true
+	return nil
+}
+
+func (tx *nftTransaction) AppendUnique(table string, chain string, params ...string) error {
+	if tx.added[table+"/"+chain+"/"+strings.Join(params, " ")] {
+		return nil
+	}
+	rule, err := tx.find(table, chain, params)
+	if err != nil || rule != nil {
+		return err
+	}
+	return tx.Append(table, chain, params...)
+}
+
+func (tx *nftTransaction) Delete(table string, chain string, params ...string) error {
+	rule, err := tx.find(table, chain, params)
+	if err != nil {
+		return err
+	}
+	if rule == nil {
+		return fmt.Errorf("rule %q not found in %s %s", strings.Join(params, " "), table, chain)
+	}
+	return tx.conn.DelRule(rule)
+}
+
+func (tx *nftTransaction) DeleteChain(table string, chain string) error {
+	tx.conn.FlushChain(tx.table.chain(table, chain))
+	tx.conn.DelChain(tx.table.chain(table, chain))
+	return nil
+}
+
+// AddChain also adds the table, so that the base chains are restored if the whole table was removed
+func (tx *nftTransaction) AddChain(table string, chain string) error {
+	tx.conn.AddTable(tx.table.table)
+	tx.conn.AddChain(tx.table.chain(table, chain))
+	return nil
+}
+
+func (tx *nftTransaction) Exists(table string, chain string, params ...string) (bool, error) {
+	if tx.added[table+"/"+chain+"/"+strings.Join(params, " ")] {
+		return true, nil
+	}
+	rule, err := tx.find(table, chain, params)
+	return rule != nil, err
+}
+
+func (tx *nftTransaction) ChainExists(table string, chain string) (bool, error) {
+	_, err := tx.conn.ListChain(tx.table.table, tx.table.chain(table, chain).Name)
+	if errors.Is(err, unix.ENOENT) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (tx *nftTransaction) Transaction(fn func(IpTable) error) error {
+	return fn(tx)
+}
+
+// find returns the installed rule with the given parameters, nil if missing
+func (tx *nftTransaction) find(table string, chain string, params []string) (*nftables.Rule, error) {
+	rules, err := tx.conn.GetRules(tx.table.table, tx.table.chain(table, chain))
+	if err != nil {
+		if errors.Is(err, unix.ENOENT) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	comment := strings.Join(params, " ")
+	for _, rule := range rules {
+		if existing, ok := userdata.GetString(rule.UserData, userdata.TypeComment); ok && existing == comment {
+			return rule, nil
+		}
+	}
+	return nil, nil
+}
+
+// nftRuleExprs translates the iptables parameters used by the NetManager into nftables expressions.
+// Supported: -i, -o, -s, -d, -p tcp|udp, --dport port|first:last, -m state|conntrack --state|--ctstate, and the targets
+// ACCEPT, MASQUERADE, DNAT --to-destination|--to, SNAT --to-source|--to and the jumps to the other chains.
+func nftRuleExprs(family nftables.TableFamily, params []string) ([]expr.Any, error) {
+	exprs := make([]expr.Any, 0)
+	var target []expr.Any
+	protocol := ""
+	for i := 0; i < len(params); i += 2 {
+		if i+1 >= len(params) {
+			return nil, fmt.Errorf("missing value for %s", params[i])
+		}
+		option, value := params[i], params[i+1]
+		switch option {
+		case "-i":
+			exprs = append(exprs,
+				&expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 1},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ifnameData(value)},
+			)
+		case "-o":
+			exprs = append(exprs,
+				&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ifnameData(value)},
+			)
+		case "-s", "-d":
+			match, err := nftAddressMatch(family, value, option == "-s")
+			if err != nil {
+				return nil, err
+			}
+			exprs = append(exprs, match...)
+		case "-p":
+			proto := map[string]byte{"tcp": unix.IPPROTO_TCP, "udp": unix.IPPROTO_UDP}
+			number, ok := proto[value]
+			if !ok {
+				return nil, fmt.Errorf("unsupported protocol %s", value)
+			}
+			protocol = value
+			exprs = append(exprs,
+				&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{number}},
+			)
+		case "--dport":
+			if protocol == "" {
+				return nil, errors.New("--dport requires -p")
+			}
+			first, last, isRange := strings.Cut(value, ":")
+			if !isRange {
+				last = first
+			}
+			port, err := strconv.ParseUint(first, 10, 16)
+			lastPort, lastErr := strconv.ParseUint(last, 10, 16)
+			if err != nil || lastErr != nil || lastPort < port {
+				return nil, fmt.Errorf("invalid port %s", value)
+			}
+			exprs = append(exprs, &expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2})
+			if isRange {
+				exprs = append(exprs, &expr.Range{
+					Op:       expr.CmpOpEq,
+					Register: 1,
+					FromData: binaryutil.BigEndian.PutUint16(uint16(port)),
+					ToData:   binaryutil.BigEndian.PutUint16(uint16(lastPort)),
+				})
+			} else {
+				exprs = append(exprs, &expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.BigEndian.PutUint16(uint16(port))})
+			}
+		case "-m":
+			// the match modules are implied by their options
+		case "--state", "--ctstate":
+			bits := map[string]uint32{
+				"INVALID":     expr.CtStateBitINVALID,
+				"ESTABLISHED": expr.CtStateBitESTABLISHED,
+				"RELATED":     expr.CtStateBitRELATED,
+				"NEW":         expr.CtStateBitNEW,
+			}
+			mask := uint32(0)
+			for _, state := range strings.Split(value, ",") {
+				bit, ok := bits[state]
+				if !ok {
+					return nil, fmt.Errorf("unsupported state %s", state)
+				}
+				mask |= bit
+			}
+			exprs = append(exprs,
+				&expr.Ct{Register: 1, Key: expr.CtKeySTATE},
+				&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 4, Mask: binaryutil.NativeEndian.PutUint32(mask), Xor: make([]byte, 4)},
+				&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: make([]byte, 4)},
+			)
+		case "-j":
+			switch value {
+			case "ACCEPT":
+				target = []expr.Any{&expr.Verdict{Kind: expr.VerdictAccept}}
+			case "MASQUERADE":
+				target = []expr.Any{&expr.Masq{}}
+			case "DNAT", "SNAT":
+				if i+3 >= len(params) || !isNatAddressOption(value, params[i+2]) {
+					return nil, fmt.Errorf("missing %s address", value)
+				}
+				natExprs, err := nftNat(family, value, params[i+3])
+				if err != nil {
+					return nil, err
+				}
+				target = natExprs
+				i += 2
+			default:
+				target = []expr.Any{&expr.Verdict{Kind: expr.VerdictJump, Chain: value}}
+			}
+		default:
+			return nil, fmt.Errorf("unsupported option %s", option)
+		}
+	}
+	if target == nil {
+		return nil, errors.New("missing target")
+	}
+	return append(exprs, target...), nil
+}
+
+func isNatAddressOption(nat string, option string) bool {
+	return option == "--to" || (nat == "DNAT" && option == "--to-destination") || (nat == "SNAT" && option == "--to-source")
+}
+
+// ifnameData is an interface name as compared by nftables
+func ifnameData(name string) []byte {
+	data := make([]byte, unix.IFNAMSIZ)
+	copy(data, name+"\x00")
+	return data
+}
+
+func nftAddressMatch(family nftables.TableFamily, value string, source bool) ([]expr.Any, error) {
+	if !strings.Contains(value, "/") {
+		if family == nftables.TableFamilyIPv4 {
+			value += "/32"
+		} else {
+			value += "/128"
+		}
+	}
+	_, subnet, err := net.ParseCIDR(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address %s", value)
+	}
+	ip := subnet.IP.To4()
+	offset := uint32(12)
+	if !source {
+		offset = 16
+	}
+	if family == nftables.TableFamilyIPv6 {
+		ip = subnet.IP.To16()
+		offset = 8
+		if !source {
+			offset = 24
+		}
+	}
+	if ip == nil || (family == nftables.TableFamilyIPv6) != (subnet.IP.To4() == nil) {
+		return nil, fmt.Errorf("address %s of the wrong family", value)
+	}
+	result := []expr.Any{
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: offset, Len: uint32(len(ip))},
+	}
+	if ones, bits := subnet.Mask.Size(); ones != bits {
+		result = append(result, &expr.Bitwise{
+			SourceRegister: 1,
+			DestRegister:   1,
+			Len:            uint32(len(ip)),
+			Mask:           []byte(subnet.Mask),
+			Xor:            make([]byte, len(ip)),
+		})
+	}
+	return append(result, &expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte(ip)}), nil
+}
+
+// nftNat returns the expressions of the DNAT or SNAT to address[:port], e.g. 10.19.1.2:80 or [fc00::2]:80
+func nftNat(family nftables.TableFamily, nat string, to string) ([]expr.Any, error) {
+	address, port := to, ""
+	if host, p, err := net.SplitHostPort(to); err == nil {
+		address, port = host, p
+	}
+	ip := net.ParseIP(address)
+	if ip == nil || (family == nftables.TableFamilyIPv6) != (ip.To4() == nil) {
+		return nil, fmt.Errorf("invalid %s address %s", nat, to)
+	}
+	natFamily := uint32(unix.NFPROTO_IPV4)
+	data := []byte(ip.To4())
+	if family == nftables.TableFamilyIPv6 {
+		natFamily = unix.NFPROTO_IPV6
+		data = []byte(ip.To16())
+	}
+	result := []expr.Any{&expr.Immediate{Register: 1, Data: data}}
+	natExpr := &expr.NAT{Type: expr.NATTypeDestNAT, Family: natFamily, RegAddrMin: 1}
+	if nat == "SNAT" {
+		natExpr.Type = expr.NATTypeSourceNAT
+	}
+	if port != "" {
+		number, err := strconv.ParseUint(port, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s port %s", nat, port)
+		}
+		result = append(result, &expr.Immediate{Register: 2, Data: binaryutil.BigEndian.PutUint16(uint16(number))})
+		natExpr.RegProtoMin = 2
+		natExpr.Specified = true
+	}
+	return append(result, natExpr), nil
+}
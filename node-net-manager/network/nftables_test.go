@@ -0,0 +1,141 @@
+package network
+
+import (
+	"NetManager/model"
+	"errors"
+	"os/exec"
+	"testing"
+
+	"github.com/coreos/go-iptables/iptables"
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+	"gotest.tools/assert"
+)
+
+func TestNftRuleExprsPortMapping(t *testing.T) {
+	exprs, err := nftRuleExprs(nftables.TableFamilyIPv4, []string{"-p", "tcp", "--dport", "8080", "-j", "DNAT", "--to-destination", "10.19.1.2:80"})
+	assert.NilError(t, err)
+	assert.Equal(t, len(exprs), 7)
+	assert.DeepEqual(t, exprs[1], &expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.IPPROTO_TCP}})
+	assert.DeepEqual(t, exprs[3], &expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{0x1f, 0x90}})
+	assert.DeepEqual(t, exprs[4], &expr.Immediate{Register: 1, Data: []byte{10, 19, 1, 2}})
+	assert.DeepEqual(t, exprs[5], &expr.Immediate{Register: 2, Data: []byte{0, 80}})
+	assert.DeepEqual(t, exprs[6], &expr.NAT{Type: expr.NATTypeDestNAT, Family: unix.NFPROTO_IPV4, RegAddrMin: 1, RegProtoMin: 2, Specified: true})
+
+	exprs, err = nftRuleExprs(nftables.TableFamilyIPv4, []string{"-p", "udp", "--dport", "9000:9010", "-d", "192.168.1.10", "-j", "DNAT", "--to-destination", "10.19.1.2"})
+	assert.NilError(t, err)
+	assert.Equal(t, len(exprs), 8)
+	assert.DeepEqual(t, exprs[3], &expr.Range{Op: expr.CmpOpEq, Register: 1, FromData: []byte{0x23, 0x28}, ToData: []byte{0x23, 0x32}})
+	assert.DeepEqual(t, exprs[7], &expr.NAT{Type: expr.NATTypeDestNAT, Family: unix.NFPROTO_IPV4, RegAddrMin: 1})
+}
+
+func TestNftRuleExprsForwarding(t *testing.T) {
+	exprs, err := nftRuleExprs(nftables.TableFamilyIPv4, []string{"-i", "goProxyBridge", "-o", "veth001", "-j", "ACCEPT"})
+	assert.NilError(t, err)
+	assert.Equal(t, len(exprs), 5)
+	assert.DeepEqual(t, exprs[0], &expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 1})
+	assert.DeepEqual(t, exprs[1], &expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ifnameData("goProxyBridge")})
+	assert.DeepEqual(t, exprs[2], &expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1})
+	assert.DeepEqual(t, exprs[4], &expr.Verdict{Kind: expr.VerdictAccept})
+	assert.Equal(t, len(ifnameData("veth001")), unix.IFNAMSIZ)
+
+	exprs, err = nftRuleExprs(nftables.TableFamilyIPv4, []string{"-i", "tun0", "-m", "state", "--state", "ESTABLISHED,RELATED", "-j", "ACCEPT"})
+	assert.NilError(t, err)
+	assert.Equal(t, len(exprs), 6)
+	assert.DeepEqual(t, exprs[2], &expr.Ct{Register: 1, Key: expr.CtKeySTATE})
+}
+
+func TestNftRuleExprsAddresses(t *testing.T) {
+	exprs, err := nftRuleExprs(nftables.TableFamilyIPv4, []string{"-s", "10.19.1.0/26", "-j", "MASQUERADE"})
+	assert.NilError(t, err)
+	assert.Equal(t, len(exprs), 4)
+	assert.DeepEqual(t, exprs[0], &expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 12, Len: 4})
+	assert.DeepEqual(t, exprs[1].(*expr.Bitwise).Mask, []byte{255, 255, 255, 192})
+	assert.DeepEqual(t, exprs[2], &expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{10, 19, 1, 0}})
+	assert.DeepEqual(t, exprs[3], &expr.Masq{})
+
+	exprs, err = nftRuleExprs(nftables.TableFamilyIPv6, []string{"-d", "fc00::2", "-j", "SNAT", "--to", "fc00::1"})
+	assert.NilError(t, err)
+	assert.Equal(t, len(exprs), 4)
+	assert.DeepEqual(t, exprs[0], &expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 24, Len: 16})
+	assert.DeepEqual(t, exprs[3], &expr.NAT{Type: expr.NATTypeSourceNAT, Family: unix.NFPROTO_IPV6, RegAddrMin: 1})
+}
+
+func TestNftRuleExprsErrors(t *testing.T) {
+	invalid := [][]string{
+		{"-p", "tcp", "--sport", "80", "-j", "ACCEPT"},
+		{"--dport", "80", "-p", "tcp", "-j", "ACCEPT"},
+		{"-p", "sctp", "-j", "ACCEPT"},
+		{"-p", "tcp", "--dport", "90:80", "-j", "ACCEPT"},
+		{"-s", "10.19.1.0/26"},
+		{"-s", "fc00::/120", "-j", "ACCEPT"},
+		{"-j", "DNAT", "--to-source", "10.19.1.2"},
+		{"-j", "DNAT", "--to-destination", "[fc00::2]:80"},
+		{"-i"},
+	}
+	for _, params := range invalid {
+		_, err := nftRuleExprs(nftables.TableFamilyIPv4, params)
+		assert.Assert(t, err != nil, params)
+	}
+}
+
+func TestNfTableTransaction(t *testing.T) {
+	newRule := netlink.HeaderType((unix.NFNL_SUBSYS_NFTABLES << 8) | unix.NFT_MSG_NEWRULE)
+	sent := make([]netlink.Message, 0)
+	dial := nftables.WithTestDial(func(req []netlink.Message) ([]netlink.Message, error) {
+		sent = append(sent, req...)
+		return req, nil
+	})
+	// count returns the number of sent messages of the given type
+	count := func(msgType netlink.HeaderType) int {
+		n := 0
+		for _, msg := range sent {
+			if msg.Header.Type == msgType {
+				n++
+			}
+		}
+		return n
+	}
+	table, err := NewOakestraNfTable(iptables.ProtocolIPv4, dial)
+	assert.NilError(t, err)
+	assert.Equal(t, count(unix.NFNL_MSG_BATCH_BEGIN), 1)
+
+	sent = sent[:0]
+	err = table.Transaction(func(tx IpTable) error {
+		if err := tx.Append("nat", "PREROUTING", "-p", "tcp", "--dport", "8080", "-j", "DNAT", "--to-destination", "10.19.1.2:80"); err != nil {
+			return err
+		}
+		return tx.Append("nat", "OUTPUT", "-p", "tcp", "--dport", "8080", "-j", "DNAT", "--to-destination", "10.19.1.2:80")
+	})
+	assert.NilError(t, err)
+	assert.Equal(t, count(unix.NFNL_MSG_BATCH_BEGIN), 1)
+	assert.Equal(t, count(newRule), 2)
+
+	// nothing is sent when a change fails
+	sent = sent[:0]
+	err = table.Transaction(func(tx IpTable) error {
+		if err := tx.Append("nat", "PREROUTING", "-p", "tcp", "--dport", "8080", "-j", "ACCEPT"); err != nil {
+			return err
+		}
+		return tx.Append("nat", "OUTPUT", "-p", "icmp", "-j", "ACCEPT")
+	})
+	assert.ErrorContains(t, err, "unsupported protocol")
+	assert.Equal(t, len(sent), 0)
+}
+
+func TestFirewallBackend(t *testing.T) {
+	defer func() {
+		lookPath = exec.LookPath
+		model.NetConfig.FirewallBackend = ""
+	}()
+	lookPath = func(file string) (string, error) { return "/usr/sbin/" + file, nil }
+	assert.Equal(t, FirewallBackend(), FIREWALL_BACKEND_IPTABLES)
+
+	lookPath = func(file string) (string, error) { return "", errors.New("not found") }
+	assert.Equal(t, FirewallBackend(), FIREWALL_BACKEND_NFTABLES)
+
+	model.NetConfig.FirewallBackend = FIREWALL_BACKEND_IPTABLES
+	assert.Equal(t, FirewallBackend(), FIREWALL_BACKEND_IPTABLES)
+}
@@ -0,0 +1,388 @@
+package network
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	PORT_FAMILY_IPV4 = "ipv4"
+	PORT_FAMILY_IPV6 = "ipv6"
+	// MAX_OFFSET_PORT_RANGE is the maximum size of a host port range mapped to other container ports, each port needs its own DNAT rule
+	MAX_OFFSET_PORT_RANGE = 256
+)
+
+// ErrHostPortConflict is returned when a host port is already used by another deployment
+var ErrHostPortConflict = errors.New("host port conflict")
+
+// PortMapping exposes container ports on the node
+type PortMapping struct {
+	// HostIP binds the mapping to a node address, all the node addresses when empty
+	HostIP   string `json:"hostIP,omitempty"`
+	HostPort int    `json:"hostPort"`
+	// HostPortEnd is the last port of a host port range, mapped to the container ports starting at ContainerPort
+	HostPortEnd int `json:"hostPortEnd,omitempty"`
+	// ContainerPort is the same as HostPort when zero
+	ContainerPort int `json:"containerPort,omitempty"`
+	// Protocols are tcp, udp or both, tcp when empty
+	Protocols []string `json:"protocols,omitempty"`
+	// Family exposes the ports only towards the ipv4 or ipv6 address of the instance, both when empty
+	Family string `json:"family,omitempty"`
+}
+
+// PortMappings are the ports exposed by a service instance.
+// In JSON it is a list of PortMapping or the legacy "host:container/protocol;..." string.
+type PortMappings []PortMapping
+
+func (m *PortMappings) UnmarshalJSON(data []byte) error {
+	var legacy string
+	if err := json.Unmarshal(data, &legacy); err == nil {
+		mappings, err := ParsePortMappings(legacy)
+		if err != nil {
+			return err
+		}
+		*m = mappings
+		return nil
+	}
+	var mappings []PortMapping
+	if err := json.Unmarshal(data, &mappings); err != nil {
+		return err
+	}
+	if err := PortMappings(mappings).Validate(); err != nil {
+		return err
+	}
+	*m = mappings
+	return nil
+}
+
+// ParsePortMappings parses the "host:container/protocols;..." port mappings, e.g. "8080:80/tcp;53/udp".
+// The host ports can be bound to an address and be ranges, e.g. "[fc00::1]:9000-9010:80-90/tcp,udp", like String returns them.
+func ParsePortMappings(portmapping string) (PortMappings, error) {
+	if portmapping == "" {
+		return nil, nil
+	}
+	mappings := make(PortMappings, 0)
+	for _, portmap := range strings.Split(portmapping, ";") {
+		mapping, err := parsePortMapping(portmap)
+		if err != nil {
+			return nil, err
+		}
+		mappings = append(mappings, mapping)
+	}
+	return mappings, mappings.Validate()
+}
+
+// parsePortMapping parses a single "[hostIP:]host[-hostEnd][:container[-containerEnd]][/protocols]" mapping
+func parsePortMapping(portmap string) (PortMapping, error) {
+	invalid := fmt.Errorf("invalid Port Mapping %q", portmap)
+	mapping := PortMapping{Protocols: []string{"tcp"}}
+	if ports, protocols, found := strings.Cut(portmap, "/"); found {
+		portmap = ports
+		mapping.Protocols = strings.Split(protocols, ",")
+	}
+	if strings.HasPrefix(portmap, "[") {
+		hostIP, ports, found := strings.Cut(portmap[1:], "]:")
+		if !found {
+			return mapping, invalid
+		}
+		mapping.HostIP, portmap = hostIP, ports
+	}
+	ports := strings.Split(portmap, ":")
+	if len(ports) == 3 && mapping.HostIP == "" {
+		mapping.HostIP, ports = ports[0], ports[1:]
+	}
+	if len(ports) > 2 {
+		return mapping, invalid
+	}
+	host, hostEnd, hostRange, ok := parsePortRange(ports[0])
+	if !ok {
+		return mapping, invalid
+	}
+	mapping.HostPort = host
+	if hostRange {
+		mapping.HostPortEnd = hostEnd
+	}
+	mapping.ContainerPort = host
+	if len(ports) > 1 {
+		container, containerEnd, containerRange, ok := parsePortRange(ports[1])
+		// a container range maps a host range of the same size
+		if !ok || (containerRange && (!hostRange || containerEnd-container != hostEnd-host)) {
+			return mapping, invalid
+		}
+		mapping.ContainerPort = container
+	}
+	return mapping, nil
+}
+
+// parsePortRange parses a "port" or "first-last" port range
+func parsePortRange(ports string) (first int, last int, isRange bool, ok bool) {
+	firstPort, lastPort, isRange := strings.Cut(ports, "-")
+	if !isValidPort(firstPort) || (isRange && !isValidPort(lastPort)) {
+		return 0, 0, false, false
+	}
+	first, _ = strconv.Atoi(firstPort)
+	last = first
+	if isRange {
+		last, _ = strconv.Atoi(lastPort)
+	}
+	return first, last, isRange, true
+}
+
+// String returns the mappings as ParsePortMappings parses them, the family of the mappings is not part of it
+func (m PortMappings) String() string {
+	result := make([]string, 0, len(m))
+	for _, mapping := range m {
+		host := strconv.Itoa(mapping.HostPort)
+		container := strconv.Itoa(mapping.containerPort())
+		if mapping.HostPortEnd > mapping.HostPort {
+			host += "-" + strconv.Itoa(mapping.HostPortEnd)
+			container += "-" + strconv.Itoa(mapping.containerPort()+mapping.HostPortEnd-mapping.HostPort)
+		}
+		if mapping.HostIP != "" {
+			host = net.JoinHostPort(mapping.HostIP, host)
+		}
+		result = append(result, fmt.Sprintf("%s:%s/%s", host, container, strings.Join(mapping.protocols(), ",")))
+	}
+	return strings.Join(result, ";")
+}
+
+// Validate checks the ports, protocols and addresses, and that the mappings don't overlap each other
+func (m PortMappings) Validate() error {
+	for i, mapping := range m {
+		if err := mapping.validate(); err != nil {
+			return fmt.Errorf("invalid port mapping %s: %v", PortMappings{mapping}, err)
+		}
+		for _, other := range m[:i] {
+			for _, ipv6 := range []bool{false, true} {
+				for _, claim := range mapping.claims("", ipv6) {
+					for _, otherClaim := range other.claims("", ipv6) {
+						if claim.overlaps(otherClaim) {
+							return fmt.Errorf("port mappings %s and %s use the same host ports", PortMappings{other}, PortMappings{mapping})
+						}
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (p PortMapping) validate() error {
+	if p.HostPort < 1 || p.HostPort > 65535 {
+		return fmt.Errorf("host port %d out of range", p.HostPort)
+	}
+	if p.HostPortEnd != 0 && (p.HostPortEnd < p.HostPort || p.HostPortEnd > 65535) {
+		return fmt.Errorf("invalid host port range %d-%d", p.HostPort, p.HostPortEnd)
+	}
+	if p.ContainerPort < 0 || p.containerPort() > 65535 || p.containerPort()+p.lastHostPort()-p.HostPort > 65535 {
+		return fmt.Errorf("container port %d out of range", p.ContainerPort)
+	}
+	if p.containerPort() != p.HostPort && p.lastHostPort()-p.HostPort+1 > MAX_OFFSET_PORT_RANGE {
+		return fmt.Errorf("host port range %d-%d mapped to other container ports exceeds %d ports", p.HostPort, p.lastHostPort(), MAX_OFFSET_PORT_RANGE)
+	}
+	seen := make(map[string]bool)
+	for _, protocol := range p.protocols() {
+		if protocol != "tcp" && protocol != "udp" {
+			return fmt.Errorf("unsupported protocol %s", protocol)
+		}
+		if seen[protocol] {
+			return fmt.Errorf("duplicated protocol %s", protocol)
+		}
+		seen[protocol] = true
+	}
+	switch p.Family {
+	case "", PORT_FAMILY_IPV4, PORT_FAMILY_IPV6:
+	default:
+		return fmt.Errorf("unknown family %s", p.Family)
+	}
+	if p.HostIP != "" {
+		ip := net.ParseIP(p.HostIP)
+		if ip == nil {
+			return fmt.Errorf("invalid host IP %s", p.HostIP)
+		}
+		if p.Family != "" && p.Family != ipFamily(ip) {
+			return fmt.Errorf("host IP %s is not %s", p.HostIP, p.Family)
+		}
+	}
+	return nil
+}
+
+func ipFamily(ip net.IP) string {
+	if ip.To4() != nil {
+		return PORT_FAMILY_IPV4
+	}
+	return PORT_FAMILY_IPV6
+}
+
+func (p PortMapping) containerPort() int {
+	if p.ContainerPort == 0 {
+		return p.HostPort
+	}
+	return p.ContainerPort
+}
+
+func (p PortMapping) lastHostPort() int {
+	if p.HostPortEnd == 0 {
+		return p.HostPort
+	}
+	return p.HostPortEnd
+}
+
+func (p PortMapping) protocols() []string {
+	if len(p.Protocols) == 0 {
+		return []string{"tcp"}
+	}
+	return p.Protocols
+}
+
+// exposed tells if the mapping applies to the instance address of the family
+func (p PortMapping) exposed(ipv6 bool) bool {
+	family := PORT_FAMILY_IPV4
+	if ipv6 {
+		family = PORT_FAMILY_IPV6
+	}
+	if p.HostIP != "" {
+		return ipFamily(net.ParseIP(p.HostIP)) == family
+	}
+	return p.Family == "" || p.Family == family
+}
+
+// rules returns the DNAT rules of the mapping towards the instance address
+func (p PortMapping) rules(address net.IP) []Rule {
+	ipv6 := address.To4() == nil
+	if !p.exposed(ipv6) {
+		return nil
+	}
+	destination := func(port int) string {
+		return net.JoinHostPort(address.String(), strconv.Itoa(port))
+	}
+	match := make([]string, 0)
+	if p.HostIP != "" {
+		match = append(match, "-d", p.HostIP)
+	}
+	rules := make([]Rule, 0)
+	for _, protocol := range p.protocols() {
+		params := func(dport string, to string) []string {
+			params := append([]string{"-p", protocol, "--dport", dport}, match...)
+			return append(params, "-j", "DNAT", "--to-destination", to)
+		}
+		switch {
+		case p.lastHostPort() == p.HostPort:
+			rules = append(rules, Rule{IPv6: ipv6, Table: "nat", Chain: chain, Params: params(strconv.Itoa(p.HostPort), destination(p.containerPort()))})
+		case p.containerPort() == p.HostPort:
+			// the destination port is kept
+			rules = append(rules, Rule{IPv6: ipv6, Table: "nat", Chain: chain, Params: params(fmt.Sprintf("%d:%d", p.HostPort, p.lastHostPort()), address.String())})
+		default:
+			// the DNAT port ranges don't keep the offset, one rule per port
+			for port := p.HostPort; port <= p.lastHostPort(); port++ {
+				rules = append(rules, Rule{IPv6: ipv6, Table: "nat", Chain: chain, Params: params(strconv.Itoa(port), destination(p.containerPort()+port-p.HostPort))})
+			}
+		}
+	}
+	return rules
+}
+
+// hostPortClaim is a range of host ports used by an owner
+type hostPortClaim struct {
+	owner    RuleOwner
+	ipv6     bool
+	protocol string
+	// empty for all the node addresses
+	hostIP string
+	first  int
+	last   int
+}
+
+func (p PortMapping) claims(owner RuleOwner, ipv6 bool) []hostPortClaim {
+	if !p.exposed(ipv6) {
+		return nil
+	}
+	claims := make([]hostPortClaim, 0)
+	for _, protocol := range p.protocols() {
+		claims = append(claims, hostPortClaim{
+			owner:    owner,
+			ipv6:     ipv6,
+			protocol: protocol,
+			hostIP:   p.HostIP,
+			first:    p.HostPort,
+			last:     p.lastHostPort(),
+		})
+	}
+	return claims
+}
+
+func (c hostPortClaim) overlaps(other hostPortClaim) bool {
+	sameAddress := c.hostIP == "" || other.hostIP == "" || net.ParseIP(c.hostIP).Equal(net.ParseIP(other.hostIP))
+	return c.ipv6 == other.ipv6 && c.protocol == other.protocol && sameAddress && c.first <= other.last && other.first <= c.last
+}
+
+func (c hostPortClaim) String() string {
+	ports := strconv.Itoa(c.first)
+	if c.last > c.first {
+		ports += "-" + strconv.Itoa(c.last)
+	}
+	address := c.hostIP
+	if address == "" {
+		address = "all the addresses"
+	}
+	family := PORT_FAMILY_IPV4
+	if c.ipv6 {
+		family = PORT_FAMILY_IPV6
+	}
+	return fmt.Sprintf("%s/%s on %s (%s)", ports, c.protocol, address, family)
+}
+
+// hostPortRegistry holds the host ports used by the deployments of the node
+type hostPortRegistry struct {
+	claims []hostPortClaim
+	lock   sync.Mutex
+}
+
+var hostPorts = &hostPortRegistry{}
+
+// reserve records the claims, none of them if one conflicts with the claims of another owner
+func (r *hostPortRegistry) reserve(claims []hostPortClaim) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, claim := range claims {
+		for _, existing := range r.claims {
+			if existing.owner != claim.owner && existing.overlaps(claim) {
+				return fmt.Errorf("%w: %s is used by %s", ErrHostPortConflict, existing, existing.owner)
+			}
+		}
+	}
+	r.claims = append(r.claims, claims...)
+	return nil
+}
+
+// release removes one record of each claim
+func (r *hostPortRegistry) release(claims []hostPortClaim) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, claim := range claims {
+		for i := len(r.claims) - 1; i >= 0; i-- {
+			if r.claims[i] == claim {
+				r.claims = append(r.claims[:i], r.claims[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// releaseOwner removes all the claims of the owner
+func (r *hostPortRegistry) releaseOwner(owner RuleOwner) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	claims := r.claims[:0]
+	for _, claim := range r.claims {
+		if claim.owner != owner {
+			claims = append(claims, claim)
+		}
+	}
+	r.claims = claims
+}
@@ -0,0 +1,403 @@
+package network
+
+import (
+	"NetManager/model"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// EXPOSURE_MODE_ADDRESS assigns the public address to the node interface and maps its traffic to the instance, 1:1
+	EXPOSURE_MODE_ADDRESS = "address"
+	// EXPOSURE_MODE_NODE maps the ports from the public address of the node
+	EXPOSURE_MODE_NODE = "node"
+)
+
+var (
+	// ErrPublicIPNetworkingDisabled is returned when an exposure is requested on a node without PublicIPNetworking
+	ErrPublicIPNetworkingDisabled = errors.New("PublicIPNetworking is disabled on this node")
+	// ErrInvalidPublicExposure is returned for the malformed exposures
+	ErrInvalidPublicExposure = errors.New("invalid public exposure")
+)
+
+// PublicExposure exposes a service instance on a publicly routable address
+type PublicExposure struct {
+	Mode string `json:"mode"`
+	// Address is the public IPv4 or IPv6 address of the address mode, the node public address is used in the node mode
+	Address string `json:"address,omitempty"`
+	// PrefixLength of the address assigned to the interface, a single address when zero
+	PrefixLength int `json:"prefixLength,omitempty"`
+	// Interface receiving the address, the interface of the default route when empty
+	Interface string `json:"interface,omitempty"`
+	// Ports exposed, all of them in the address mode when empty. Required in the node mode.
+	Ports PortMappings `json:"ports,omitempty"`
+}
+
+// PublicExposures are the public exposures of a service instance
+type PublicExposures []PublicExposure
+
+// PublicAddress returns the address the instance is reachable at
+func (e PublicExposure) PublicAddress() string {
+	if e.Mode == EXPOSURE_MODE_NODE {
+		return model.GetNodePublicAddress()
+	}
+	return e.Address
+}
+
+// Validate checks the modes, addresses and ports of the exposures
+func (e PublicExposures) Validate() error {
+	addresses := make(map[string]bool)
+	for _, exposure := range e {
+		if err := exposure.validate(); err != nil {
+			return fmt.Errorf("%w %s %s: %v", ErrInvalidPublicExposure, exposure.Mode, exposure.Address, err)
+		}
+		if exposure.Mode == EXPOSURE_MODE_ADDRESS {
+			address := net.ParseIP(exposure.Address).String()
+			if addresses[address] {
+				return fmt.Errorf("%w: public address %s exposed twice", ErrInvalidPublicExposure, exposure.Address)
+			}
+			addresses[address] = true
+		}
+	}
+	return nil
+}
+
+func (e PublicExposure) validate() error {
+	switch e.Mode {
+	case EXPOSURE_MODE_NODE:
+		if e.Address != "" || e.Interface != "" {
+			return errors.New("the node mode uses the node public address")
+		}
+		if len(e.Ports) == 0 {
+			return errors.New("the node mode requires the ports")
+		}
+		return e.Ports.Validate()
+	case EXPOSURE_MODE_ADDRESS:
+		ip := net.ParseIP(e.Address)
+		if ip == nil || ip.IsUnspecified() || ip.IsLoopback() {
+			return fmt.Errorf("invalid address %s", e.Address)
+		}
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			bits = 8 * net.IPv4len
+		}
+		if e.PrefixLength < 0 || e.PrefixLength > bits {
+			return fmt.Errorf("invalid prefix length %d", e.PrefixLength)
+		}
+		for _, mapping := range e.Ports {
+			if mapping.HostIP != "" && !net.ParseIP(mapping.HostIP).Equal(ip) {
+				return fmt.Errorf("port mapping %s on another address", PortMappings{mapping})
+			}
+			if mapping.Family != "" && mapping.Family != ipFamily(ip) {
+				return fmt.Errorf("port mapping %s is not %s", PortMappings{mapping}, ipFamily(ip))
+			}
+		}
+		return e.mappings().Validate()
+	}
+	return fmt.Errorf("unknown mode %q", e.Mode)
+}
+
+// mappings returns the ports of the address mode bound to the public address
+func (e PublicExposure) mappings() PortMappings {
+	mappings := make(PortMappings, 0, len(e.Ports))
+	for _, mapping := range e.Ports {
+		mapping.HostIP = e.Address
+		mapping.Family = ""
+		mappings = append(mappings, mapping)
+	}
+	return mappings
+}
+
+// ManagePublicExposures exposes the instance addresses on the public addresses, or removes the exposures.
+// The exposures are opened all together or none of them, while closing goes on past the failures.
+func ManagePublicExposures(owner RuleOwner, exposures PublicExposures, ip net.IP, ipv6 net.IP, operation PortOperation) error {
+	if len(exposures) == 0 {
+		return nil
+	}
+	switch operation {
+	case OpenPorts:
+		if !model.NetConfig.PublicIPNetworking {
+			return ErrPublicIPNetworkingDisabled
+		}
+		if err := exposures.Validate(); err != nil {
+			return err
+		}
+		for i, exposure := range exposures {
+			if err := exposure.open(owner, ip, ipv6); err != nil {
+				for j := i - 1; j >= 0; j-- {
+					_ = exposures[j].close(owner, ip, ipv6)
+				}
+				return err
+			}
+			log.Printf("exposed %s on the public address %s", owner, exposure.PublicAddress())
+		}
+		return nil
+	case ClosePorts:
+		var result error
+		for i := len(exposures) - 1; i >= 0; i-- {
+			if err := exposures[i].close(owner, ip, ipv6); err != nil && result == nil {
+				result = err
+			}
+		}
+		return result
+	}
+	return errors.New("invalid Operation")
+}
+
+func (e PublicExposure) open(owner RuleOwner, ip net.IP, ipv6 net.IP) error {
+	if e.Mode == EXPOSURE_MODE_NODE {
+		if err := ManageContainerPortMappings(owner, ip, e.Ports, OpenPorts); err != nil {
+			return err
+		}
+		if err := ManageContainerPortMappings(owner, ipv6, e.Ports, OpenPorts); err != nil {
+			_ = ManageContainerPortMappings(owner, ip, e.Ports, ClosePorts)
+			return err
+		}
+		return nil
+	}
+
+	public := net.ParseIP(e.Address)
+	target, err := exposureTarget(public, ip, ipv6)
+	if err != nil {
+		return err
+	}
+	if err := publicAddresses.assign(owner, e.Interface, e.addressNet()); err != nil {
+		return err
+	}
+	if err := e.managePorts(owner, public, target, OpenPorts); err != nil {
+		_ = publicAddresses.unassign(owner, public)
+		return err
+	}
+	if err := InstallRules(owner, sourceNatRule(public, target)); err != nil {
+		_ = e.managePorts(owner, public, target, ClosePorts)
+		_ = publicAddresses.unassign(owner, public)
+		return err
+	}
+	return nil
+}
+
+func (e PublicExposure) close(owner RuleOwner, ip net.IP, ipv6 net.IP) error {
+	if e.Mode == EXPOSURE_MODE_NODE {
+		err := ManageContainerPortMappings(owner, ipv6, e.Ports, ClosePorts)
+		if err4 := ManageContainerPortMappings(owner, ip, e.Ports, ClosePorts); err == nil {
+			err = err4
+		}
+		return err
+	}
+
+	public := net.ParseIP(e.Address)
+	target, err := exposureTarget(public, ip, ipv6)
+	if err != nil {
+		return err
+	}
+	err = RemoveRules(owner, sourceNatRule(public, target))
+	if portsErr := e.managePorts(owner, public, target, ClosePorts); err == nil {
+		err = portsErr
+	}
+	if addrErr := publicAddresses.unassign(owner, public); err == nil {
+		err = addrErr
+	}
+	return err
+}
+
+// managePorts maps the ports of the address mode, or all of them, from the public address to the instance
+func (e PublicExposure) managePorts(owner RuleOwner, public net.IP, target net.IP, operation PortOperation) error {
+	if len(e.Ports) > 0 {
+		return ManageContainerPortMappings(owner, target, e.mappings(), operation)
+	}
+	return exposeAllPorts(owner, public, target, operation)
+}
+
+func (e PublicExposure) addressNet() net.IPNet {
+	ip := net.ParseIP(e.Address)
+	bits := 8 * net.IPv6len
+	if ip.To4() != nil {
+		ip = ip.To4()
+		bits = 8 * net.IPv4len
+	}
+	ones := e.PrefixLength
+	if ones == 0 {
+		ones = bits
+	}
+	return net.IPNet{IP: ip, Mask: net.CIDRMask(ones, bits)}
+}
+
+// exposureTarget returns the instance address of the same family as the public address
+func exposureTarget(public net.IP, ip net.IP, ipv6 net.IP) (net.IP, error) {
+	target := ipv6
+	if public.To4() != nil {
+		target = ip
+	}
+	if target == nil {
+		return nil, fmt.Errorf("the instance has no %s address to expose on %s", ipFamily(public), public)
+	}
+	return target, nil
+}
+
+// exposeAllPorts maps the whole traffic of the public address to the instance, reserving all its ports
+func exposeAllPorts(owner RuleOwner, public net.IP, target net.IP, operation PortOperation) error {
+	ipv6 := public.To4() == nil
+	claims := make([]hostPortClaim, 0, 2)
+	for _, protocol := range []string{"tcp", "udp"} {
+		claims = append(claims, hostPortClaim{owner: owner, ipv6: ipv6, protocol: protocol, hostIP: public.String(), first: 1, last: 65535})
+	}
+	rule := Rule{IPv6: ipv6, Table: "nat", Chain: chain, Params: []string{"-d", public.String(), "-j", "DNAT", "--to-destination", target.String()}}
+	switch operation {
+	case OpenPorts:
+		if err := hostPorts.reserve(claims); err != nil {
+			return err
+		}
+		if err := InstallRules(owner, rule); err != nil {
+			hostPorts.release(claims)
+			return err
+		}
+		return nil
+	case ClosePorts:
+		hostPorts.release(claims)
+		return RemoveRules(owner, rule)
+	}
+	return errors.New("invalid Operation")
+}
+
+// sourceNatRule makes the traffic started by the instance leave from the public address
+func sourceNatRule(public net.IP, target net.IP) Rule {
+	return Rule{IPv6: public.To4() == nil, Table: "nat", Chain: snatChain, Params: []string{"-s", target.String(), "-j", "SNAT", "--to-source", public.String()}}
+}
+
+// assignedAddress is a public address assigned to a node interface for an owner
+type assignedAddress struct {
+	owner   RuleOwner
+	link    string
+	address net.IPNet
+	// the address was already on the interface, it is left there
+	preexisting bool
+}
+
+// publicAddressRegistry holds the public addresses assigned to the node interfaces.
+// The same address may be shared by the owners exposing different ports, it is removed with its last owner.
+type publicAddressRegistry struct {
+	addresses []assignedAddress
+	lock      sync.Mutex
+}
+
+var publicAddresses = &publicAddressRegistry{}
+
+// addrAdd and addrDel change the addresses of the node interfaces, replaced in the tests
+var (
+	addrAdd = netlinkAddrAdd
+	addrDel = netlinkAddrDel
+)
+
+func netlinkAddrAdd(linkName string, address net.IPNet) error {
+	link, err := netlink.LinkByName(linkName)
+	if err != nil {
+		return err
+	}
+	addr := &netlink.Addr{IPNet: &address}
+	if address.IP.To4() == nil {
+		// usable at once, the public address is not probed
+		addr.Flags = unix.IFA_F_NODAD
+	}
+	return netlink.AddrAdd(link, addr)
+}
+
+func netlinkAddrDel(linkName string, address net.IPNet) error {
+	link, err := netlink.LinkByName(linkName)
+	if err != nil {
+		return err
+	}
+	return netlink.AddrDel(link, &netlink.Addr{IPNet: &address})
+}
+
+func (r *publicAddressRegistry) assign(owner RuleOwner, linkName string, address net.IPNet) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, assigned := range r.addresses {
+		if assigned.address.IP.Equal(address.IP) {
+			if linkName != "" && assigned.link != linkName {
+				return fmt.Errorf("%w: %s is assigned to %s by %s", ErrHostPortConflict, address.IP, assigned.link, assigned.owner)
+			}
+			r.addresses = append(r.addresses, assignedAddress{owner: owner, link: assigned.link, address: assigned.address, preexisting: assigned.preexisting})
+			return nil
+		}
+	}
+	if linkName == "" {
+		link, err := defaultRoute()
+		if err != nil {
+			return err
+		}
+		if link == nil {
+			return errors.New("no default route to assign the public address to")
+		}
+		linkName = (*link).Attrs().Name
+	}
+	preexisting := false
+	if err := addrAdd(linkName, address); err != nil {
+		if !errors.Is(err, syscall.EEXIST) {
+			return fmt.Errorf("unable to assign %s to %s: %w", address.String(), linkName, err)
+		}
+		preexisting = true
+	}
+	r.addresses = append(r.addresses, assignedAddress{owner: owner, link: linkName, address: address, preexisting: preexisting})
+	return nil
+}
+
+// unassign drops the address of the owner, removing it from the interface if no one else uses it
+func (r *publicAddressRegistry) unassign(owner RuleOwner, ip net.IP) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.remove(func(assigned assignedAddress) bool {
+		return assigned.owner == owner && assigned.address.IP.Equal(ip)
+	}, true)
+}
+
+// releaseOwner removes all the addresses of the owner
+func (r *publicAddressRegistry) releaseOwner(owner RuleOwner) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.remove(func(assigned assignedAddress) bool { return assigned.owner == owner }, false)
+}
+
+// releaseAll removes all the addresses
+func (r *publicAddressRegistry) releaseAll() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.remove(func(assignedAddress) bool { return true }, false)
+}
+
+// remove drops the matching entries, only the first one if once is set, the lock MUST be held by the caller
+func (r *publicAddressRegistry) remove(match func(assignedAddress) bool, once bool) error {
+	var result error
+	for i := len(r.addresses) - 1; i >= 0; i-- {
+		assigned := r.addresses[i]
+		if !match(assigned) {
+			continue
+		}
+		r.addresses = append(r.addresses[:i], r.addresses[i+1:]...)
+		if !assigned.preexisting && !r.used(assigned.address.IP) {
+			if err := addrDel(assigned.link, assigned.address); err != nil && result == nil {
+				result = fmt.Errorf("unable to remove %s from %s: %w", assigned.address.String(), assigned.link, err)
+			}
+		}
+		if once {
+			break
+		}
+	}
+	return result
+}
+
+func (r *publicAddressRegistry) used(ip net.IP) bool {
+	for _, assigned := range r.addresses {
+		if assigned.address.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,177 @@
+package network
+
+import (
+	"NetManager/model"
+	"errors"
+	"net"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+// useFakeAddresses records the addresses assigned to the node interfaces instead of changing them
+func useFakeAddresses(t *testing.T) map[string]string {
+	assigned := make(map[string]string)
+	publicAddresses = &publicAddressRegistry{}
+	addrAdd = func(link string, address net.IPNet) error {
+		assigned[address.String()] = link
+		return nil
+	}
+	addrDel = func(link string, address net.IPNet) error {
+		if assigned[address.String()] != link {
+			return errors.New("no such address")
+		}
+		delete(assigned, address.String())
+		return nil
+	}
+	model.NetConfig.PublicIPNetworking = true
+	t.Cleanup(func() {
+		addrAdd, addrDel = netlinkAddrAdd, netlinkAddrDel
+		model.NetConfig.PublicIPNetworking = false
+	})
+	return assigned
+}
+
+func setupNatChains(t *testing.T) {
+	for _, ipv6 := range []bool{false, true} {
+		assert.NilError(t, CreateChain(ipv6, "nat", chain))
+		assert.NilError(t, CreateChain(ipv6, "nat", snatChain))
+	}
+}
+
+var (
+	exposedIP   = net.ParseIP("10.19.1.2").To4()
+	exposedIPv6 = net.ParseIP("fc00::2")
+)
+
+func TestPublicExposureAddress(t *testing.T) {
+	v4, _ := useFakeTables()
+	assigned := useFakeAddresses(t)
+	setupNatChains(t)
+	exposures := PublicExposures{{Mode: EXPOSURE_MODE_ADDRESS, Address: "203.0.113.7", Interface: "eth0"}}
+
+	assert.NilError(t, ManagePublicExposures(testOwner, exposures, exposedIP, exposedIPv6, OpenPorts))
+	assert.DeepEqual(t, assigned, map[string]string{"203.0.113.7/32": "eth0"})
+	assert.DeepEqual(t, v4.chains["nat/"+chain], []string{"-d 203.0.113.7 -j DNAT --to-destination 10.19.1.2"})
+	assert.DeepEqual(t, v4.chains["nat/"+snatChain], []string{"-s 10.19.1.2 -j SNAT --to-source 203.0.113.7"})
+
+	// all the ports of the public address belong to the instance
+	other := InstanceRuleOwner("app.app.svc.svc", 1)
+	err := ManageContainerPortMappings(other, []byte{10, 19, 1, 3}, PortMappings{{HostIP: "203.0.113.7", HostPort: 8080}}, OpenPorts)
+	assert.Assert(t, errors.Is(err, ErrHostPortConflict))
+
+	assert.NilError(t, ManagePublicExposures(testOwner, exposures, exposedIP, exposedIPv6, ClosePorts))
+	assert.Equal(t, len(assigned), 0)
+	assert.Equal(t, len(v4.chains["nat/"+chain]), 0)
+	assert.Equal(t, len(v4.chains["nat/"+snatChain]), 0)
+	assert.NilError(t, ManageContainerPortMappings(other, []byte{10, 19, 1, 3}, PortMappings{{HostIP: "203.0.113.7", HostPort: 8080}}, OpenPorts))
+}
+
+func TestPublicExposureIPv6Ports(t *testing.T) {
+	v4, v6 := useFakeTables()
+	assigned := useFakeAddresses(t)
+	setupNatChains(t)
+	exposures := PublicExposures{{
+		Mode:         EXPOSURE_MODE_ADDRESS,
+		Address:      "2001:db8::7",
+		PrefixLength: 64,
+		Interface:    "eth0",
+		Ports:        PortMappings{{HostPort: 443, ContainerPort: 8443}},
+	}}
+
+	assert.NilError(t, ManagePublicExposures(testOwner, exposures, exposedIP, exposedIPv6, OpenPorts))
+	assert.DeepEqual(t, assigned, map[string]string{"2001:db8::7/64": "eth0"})
+	assert.Equal(t, len(v4.chains["nat/"+chain]), 0)
+	assert.Equal(t, len(v6.chains["nat/"+chain]), 1)
+	assert.DeepEqual(t, v6.chains["nat/"+snatChain], []string{"-s fc00::2 -j SNAT --to-source 2001:db8::7"})
+
+	// the other ports of the address are still free
+	other := InstanceRuleOwner("app.app.svc.svc", 1)
+	assert.NilError(t, ManageContainerPortMappings(other, net.ParseIP("fc00::3"), PortMappings{{HostIP: "2001:db8::7", HostPort: 80}}, OpenPorts))
+	err := ManageContainerPortMappings(other, net.ParseIP("fc00::3"), PortMappings{{HostPort: 443}}, OpenPorts)
+	assert.Assert(t, errors.Is(err, ErrHostPortConflict))
+
+	// the exposure goes away with the rules of the instance
+	assert.NilError(t, ReleaseRules(testOwner))
+	assert.Equal(t, len(assigned), 0)
+	assert.Equal(t, len(v6.chains["nat/"+snatChain]), 0)
+	assert.Equal(t, len(v6.chains["nat/"+chain]), 1)
+}
+
+func TestPublicExposureSharedAddress(t *testing.T) {
+	useFakeTables()
+	assigned := useFakeAddresses(t)
+	setupNatChains(t)
+	other := InstanceRuleOwner("app.app.svc.svc", 1)
+	first := PublicExposures{{Mode: EXPOSURE_MODE_ADDRESS, Address: "203.0.113.7", Interface: "eth0", Ports: PortMappings{{HostPort: 80}}}}
+	second := PublicExposures{{Mode: EXPOSURE_MODE_ADDRESS, Address: "203.0.113.7", Interface: "eth0", Ports: PortMappings{{HostPort: 443}}}}
+
+	assert.NilError(t, ManagePublicExposures(testOwner, first, exposedIP, nil, OpenPorts))
+	assert.NilError(t, ManagePublicExposures(other, second, []byte{10, 19, 1, 3}, nil, OpenPorts))
+	assert.Assert(t, errors.Is(ManagePublicExposures(other, first, []byte{10, 19, 1, 3}, nil, OpenPorts), ErrHostPortConflict))
+
+	// the address stays on the interface until its last owner is gone
+	assert.NilError(t, ReleaseRules(testOwner))
+	assert.Equal(t, len(assigned), 1)
+	assert.NilError(t, ReleaseRules(other))
+	assert.Equal(t, len(assigned), 0)
+}
+
+func TestPublicExposureRejected(t *testing.T) {
+	v4, v6 := useFakeTables()
+	assigned := useFakeAddresses(t)
+	setupNatChains(t)
+
+	invalid := []PublicExposures{
+		{{Mode: "bridge", Address: "203.0.113.7"}},
+		{{Mode: EXPOSURE_MODE_ADDRESS, Address: "0.0.0.0"}},
+		{{Mode: EXPOSURE_MODE_ADDRESS, Address: "203.0.113.7", PrefixLength: 33}},
+		{{Mode: EXPOSURE_MODE_ADDRESS, Address: "203.0.113.7", Ports: PortMappings{{HostIP: "203.0.113.8", HostPort: 80}}}},
+		{{Mode: EXPOSURE_MODE_NODE, Address: "203.0.113.7", Ports: PortMappings{{HostPort: 80}}}},
+		{{Mode: EXPOSURE_MODE_NODE}},
+		{{Mode: EXPOSURE_MODE_ADDRESS, Address: "203.0.113.7"}, {Mode: EXPOSURE_MODE_ADDRESS, Address: "203.0.113.7"}},
+	}
+	for _, exposures := range invalid {
+		err := ManagePublicExposures(testOwner, exposures, exposedIP, exposedIPv6, OpenPorts)
+		assert.Assert(t, errors.Is(err, ErrInvalidPublicExposure), exposures)
+	}
+
+	// no IPv6 address to expose
+	exposures := PublicExposures{{Mode: EXPOSURE_MODE_ADDRESS, Address: "2001:db8::7", Interface: "eth0"}}
+	assert.ErrorContains(t, ManagePublicExposures(testOwner, exposures, exposedIP, nil, OpenPorts), "no ipv6 address")
+
+	// the exposures are opened all together or none of them
+	exposures = PublicExposures{
+		{Mode: EXPOSURE_MODE_ADDRESS, Address: "203.0.113.7", Interface: "eth0"},
+		{Mode: EXPOSURE_MODE_ADDRESS, Address: "2001:db8::7", Interface: "eth0"},
+	}
+	v6.failAppend = errors.New("injected fault")
+	assert.ErrorContains(t, ManagePublicExposures(testOwner, exposures, exposedIP, exposedIPv6, OpenPorts), "injected fault")
+	assert.Equal(t, len(assigned), 0)
+	assert.Equal(t, v4.rules(), 0)
+	v6.failAppend = nil
+
+	model.NetConfig.PublicIPNetworking = false
+	err := ManagePublicExposures(testOwner, exposures, exposedIP, exposedIPv6, OpenPorts)
+	assert.Assert(t, errors.Is(err, ErrPublicIPNetworkingDisabled))
+}
+
+func TestPublicExposureNode(t *testing.T) {
+	v4, v6 := useFakeTables()
+	assigned := useFakeAddresses(t)
+	setupNatChains(t)
+	exposures := PublicExposures{{Mode: EXPOSURE_MODE_NODE, Ports: PortMappings{{HostPort: 8080, ContainerPort: 80}}}}
+
+	assert.NilError(t, ManagePublicExposures(testOwner, exposures, exposedIP, exposedIPv6, OpenPorts))
+	assert.Equal(t, len(assigned), 0)
+	assert.Equal(t, len(v4.chains["nat/"+chain]), 1)
+	assert.Equal(t, len(v6.chains["nat/"+chain]), 1)
+
+	// the node ports are shared with the plain port mappings
+	err := ManageContainerPortMappings(InstanceRuleOwner("app.app.svc.svc", 1), []byte{10, 19, 1, 3}, PortMappings{{HostPort: 8080}}, OpenPorts)
+	assert.Assert(t, errors.Is(err, ErrHostPortConflict))
+
+	assert.NilError(t, ManagePublicExposures(testOwner, exposures, exposedIP, exposedIPv6, ClosePorts))
+	assert.Equal(t, v4.rules(), 0)
+	assert.Equal(t, v6.rules(), 0)
+}
@@ -0,0 +1,190 @@
+package network
+
+import (
+	"NetManager/logger"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	// DEFAULT_RA_INTERVAL is the interval between the unsolicited router advertisements
+	DEFAULT_RA_INTERVAL = 10 * time.Second
+	// DEFAULT_RA_ROUTER_LIFETIME is the lifetime of the default route learned by the guests
+	DEFAULT_RA_ROUTER_LIFETIME = 30 * time.Minute
+)
+
+const (
+	raOptionPrefixInformation = 3
+	raOptionMTU               = 5
+	// on-link and autonomous address-configuration flags of the prefix information option
+	raPrefixFlags = 0xc0
+)
+
+var allNodesMulticast = net.ParseIP("ff02::1")
+
+// RouterAdvertisement is the content of the advertisements sent on the link
+type RouterAdvertisement struct {
+	// prefix used by the guests for the stateless address autoconfiguration, MUST be a /64
+	Prefix *net.IPNet
+	MTU    int
+	// lifetime of the default route, zero for DEFAULT_RA_ROUTER_LIFETIME
+	RouterLifetime time.Duration
+}
+
+// RouterAdvertiser answers the router solicitations and periodically advertises the router on a link
+type RouterAdvertiser struct {
+	conn     *ipv6.PacketConn
+	iface    *net.Interface
+	message  []byte
+	interval time.Duration
+	done     chan struct{}
+	once     sync.Once
+}
+
+// NewRouterAdvertiser opens the ICMPv6 socket on the interface.
+// The socket belongs to the network namespace of the calling thread.
+func NewRouterAdvertiser(ifaceName string, ra RouterAdvertisement) (*RouterAdvertiser, error) {
+	if ones, bits := ra.Prefix.Mask.Size(); ones != 64 || bits != 128 {
+		return nil, errors.New("router advertisement prefix must be a /64")
+	}
+	iface, err := net.InterfaceByName(ifaceName)
+	if err != nil {
+		return nil, err
+	}
+	listener, err := icmp.ListenPacket("ip6:ipv6-icmp", "::")
+	if err != nil {
+		return nil, err
+	}
+	conn := listener.IPv6PacketConn()
+	// RFC 4861 requires a hop limit of 255 on the neighbor discovery messages
+	err = conn.SetMulticastHopLimit(255)
+	if err == nil {
+		err = conn.SetHopLimit(255)
+	}
+	if err == nil {
+		err = conn.SetControlMessage(ipv6.FlagInterface, true)
+	}
+	if err == nil {
+		filter := ipv6.ICMPFilter{}
+		filter.SetAll(true)
+		filter.Accept(ipv6.ICMPTypeRouterSolicitation)
+		err = conn.SetICMPFilter(&filter)
+	}
+	if err != nil {
+		_ = listener.Close()
+		return nil, err
+	}
+	return &RouterAdvertiser{
+		conn:     conn,
+		iface:    iface,
+		message:  ra.marshal(),
+		interval: DEFAULT_RA_INTERVAL,
+		done:     make(chan struct{}),
+	}, nil
+}
+
+// Serve sends the advertisements until the advertiser is closed
+func (r *RouterAdvertiser) Serve() {
+	go r.advertisePeriodically()
+	buffer := make([]byte, 1500)
+	for {
+		_, cm, _, err := r.conn.ReadFrom(buffer)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			logger.DebugLogger().Printf("Router solicitation read error: %v", err)
+			continue
+		}
+		if cm != nil && cm.IfIndex != r.iface.Index {
+			continue
+		}
+		r.advertise()
+	}
+}
+
+// Close stops the advertiser
+func (r *RouterAdvertiser) Close() error {
+	r.once.Do(func() {
+		close(r.done)
+	})
+	return r.conn.Close()
+}
+
+func (r *RouterAdvertiser) advertisePeriodically() {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	r.advertise()
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-ticker.C:
+			r.advertise()
+		}
+	}
+}
+
+func (r *RouterAdvertiser) advertise() {
+	dst := &net.IPAddr{IP: allNodesMulticast, Zone: r.iface.Name}
+	_, err := r.conn.WriteTo(r.message, &ipv6.ControlMessage{IfIndex: r.iface.Index, HopLimit: 255}, dst)
+	if err != nil {
+		// the link has no link-local address until a guest brings up its NIC
+		logger.DebugLogger().Printf("Router advertisement on %s failed: %v", r.iface.Name, err)
+	}
+}
+
+// marshal returns the ICMPv6 router advertisement message, the checksum is filled in by the kernel
+func (ra RouterAdvertisement) marshal() []byte {
+	lifetime := ra.RouterLifetime
+	if lifetime == 0 {
+		lifetime = DEFAULT_RA_ROUTER_LIFETIME
+	}
+	b := make([]byte, 16, 64)
+	b[0] = byte(ipv6.ICMPTypeRouterAdvertisement)
+	// current hop limit
+	b[4] = 64
+	binary.BigEndian.PutUint16(b[6:8], uint16(lifetime.Seconds()))
+
+	prefix := make([]byte, 32)
+	prefix[0] = raOptionPrefixInformation
+	prefix[1] = 4
+	prefixLength, _ := ra.Prefix.Mask.Size()
+	prefix[2] = byte(prefixLength)
+	prefix[3] = raPrefixFlags
+	// valid and preferred lifetimes
+	binary.BigEndian.PutUint32(prefix[4:8], 0xffffffff)
+	binary.BigEndian.PutUint32(prefix[8:12], 0xffffffff)
+	copy(prefix[16:32], ra.Prefix.IP.Mask(ra.Prefix.Mask).To16())
+	b = append(b, prefix...)
+
+	if ra.MTU > 0 {
+		mtu := make([]byte, 8)
+		mtu[0] = raOptionMTU
+		mtu[1] = 1
+		binary.BigEndian.PutUint32(mtu[4:8], uint32(ra.MTU))
+		b = append(b, mtu...)
+	}
+	return b
+}
+
+// SlaacAddress returns the address the guest with the given MAC configures in the /64 prefix, with the modified EUI-64
+func SlaacAddress(prefix *net.IPNet, mac net.HardwareAddr) net.IP {
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, prefix.IP.Mask(prefix.Mask).To16())
+	ip[8] = mac[0] ^ 0x02
+	ip[9] = mac[1]
+	ip[10] = mac[2]
+	ip[11] = 0xff
+	ip[12] = 0xfe
+	ip[13] = mac[3]
+	ip[14] = mac[4]
+	ip[15] = mac[5]
+	return ip
+}
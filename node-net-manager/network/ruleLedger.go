@@ -0,0 +1,291 @@
+package network
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RuleOwner is who a firewall rule is installed for: the node, a service or a service instance
+type RuleOwner string
+
+// NODE_RULE_OWNER owns the rules installed at startup, removed only when the NetManager shuts down
+const NODE_RULE_OWNER RuleOwner = "node"
+
+// RULES_RECONCILIATION_INTERVAL is how often the ledger is checked against the live tables
+const RULES_RECONCILIATION_INTERVAL = time.Minute
+
+func ServiceRuleOwner(serviceName string) RuleOwner {
+	return RuleOwner("service/" + serviceName)
+}
+
+func InstanceRuleOwner(serviceName string, instance int) RuleOwner {
+	return RuleOwner(fmt.Sprintf("instance/%s/%d", serviceName, instance))
+}
+
+// Rule is a firewall rule with its iptables parameters, in the IPv4 or IPv6 tables
+type Rule struct {
+	IPv6   bool
+	Table  string
+	Chain  string
+	Params []string
+}
+
+func (r Rule) key() string {
+	return fmt.Sprintf("%t/%s/%s/%s", r.IPv6, r.Table, r.Chain, strings.Join(r.Params, " "))
+}
+
+func (r Rule) String() string {
+	family := "IPv4"
+	if r.IPv6 {
+		family = "IPv6"
+	}
+	return fmt.Sprintf("%s %s %s %s", family, r.Table, r.Chain, strings.Join(r.Params, " "))
+}
+
+type ledgerEntry struct {
+	owner RuleOwner
+	rule  Rule
+}
+
+// ledgerChain is a chain created by the NetManager, owned by the node
+type ledgerChain struct {
+	ipv6  bool
+	table string
+	chain string
+}
+
+// ruleLedger records every chain and rule installed by the NetManager with its owner.
+// The same rule may be owned by several owners, it is removed from the tables together with its last owner.
+type ruleLedger struct {
+	chains  []ledgerChain
+	entries []ledgerEntry
+	lock    sync.Mutex
+	// closed to stop the periodic reconciliation
+	stop chan struct{}
+}
+
+var ledger = &ruleLedger{}
+
+func tableOf(ipv6 bool) IpTable {
+	if ipv6 {
+		return ipv6Table()
+	}
+	return ipv4Table()
+}
+
+// owned returns how many owners hold the rule
+func (l *ruleLedger) owned(rule Rule) int {
+	owners := 0
+	for _, entry := range l.entries {
+		if entry.rule.key() == rule.key() {
+			owners++
+		}
+	}
+	return owners
+}
+
+// InstallRules appends the rules for the owner, all of them or none.
+// The rules already in the tables, e.g. left by a previous run, are adopted without duplicating them.
+func InstallRules(owner RuleOwner, rules ...Rule) error {
+	ledger.lock.Lock()
+	defer ledger.lock.Unlock()
+
+	missing := map[bool][]Rule{}
+	seen := make(map[string]bool)
+	for _, rule := range rules {
+		if seen[rule.key()] || ledger.owned(rule) > 0 {
+			continue
+		}
+		seen[rule.key()] = true
+		missing[rule.IPv6] = append(missing[rule.IPv6], rule)
+	}
+	installed := make([]Rule, 0)
+	for _, ipv6 := range []bool{false, true} {
+		if len(missing[ipv6]) == 0 {
+			continue
+		}
+		err := tableOf(ipv6).Transaction(func(tx IpTable) error {
+			for _, rule := range missing[ipv6] {
+				if err := tx.AppendUnique(rule.Table, rule.Chain, rule.Params...); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			for _, rule := range installed {
+				_ = tableOf(rule.IPv6).Delete(rule.Table, rule.Chain, rule.Params...)
+			}
+			return err
+		}
+		installed = append(installed, missing[ipv6]...)
+	}
+	for _, rule := range rules {
+		ledger.entries = append(ledger.entries, ledgerEntry{owner: owner, rule: rule})
+	}
+	return nil
+}
+
+// RemoveRules removes the rules of the owner, the rules not owned are left untouched.
+// It goes on past the failures and returns the first error.
+func RemoveRules(owner RuleOwner, rules ...Rule) error {
+	ledger.lock.Lock()
+	defer ledger.lock.Unlock()
+	var result error
+	for _, rule := range rules {
+		if err := ledger.remove(owner, rule); err != nil && result == nil {
+			result = err
+		}
+	}
+	return result
+}
+
+// ReleaseRules removes all the rules of the owner, in reverse order of installation, and frees its host ports and public addresses
+func ReleaseRules(owner RuleOwner) error {
+	hostPorts.releaseOwner(owner)
+	addrErr := publicAddresses.releaseOwner(owner)
+	ledger.lock.Lock()
+	defer ledger.lock.Unlock()
+	if err := ledger.release(func(entry ledgerEntry) bool { return entry.owner == owner }); err != nil {
+		return err
+	}
+	return addrErr
+}
+
+func (l *ruleLedger) release(match func(ledgerEntry) bool) error {
+	var result error
+	for i := len(l.entries) - 1; i >= 0; i-- {
+		if entry := l.entries[i]; match(entry) {
+			if err := l.remove(entry.owner, entry.rule); err != nil && result == nil {
+				result = err
+			}
+		}
+	}
+	return result
+}
+
+// remove drops the last entry of the owner for the rule, deleting the rule from the tables if no one else owns it
+func (l *ruleLedger) remove(owner RuleOwner, rule Rule) error {
+	for i := len(l.entries) - 1; i >= 0; i-- {
+		if entry := l.entries[i]; entry.owner == owner && entry.rule.key() == rule.key() {
+			l.entries = append(l.entries[:i], l.entries[i+1:]...)
+			if l.owned(rule) > 0 {
+				return nil
+			}
+			return tableOf(rule.IPv6).Delete(rule.Table, rule.Chain, rule.Params...)
+		}
+	}
+	return nil
+}
+
+// CreateChain creates a chain owned by the node, replacing the one left by a previous run
+func CreateChain(ipv6 bool, table string, chain string) error {
+	ledger.lock.Lock()
+	defer ledger.lock.Unlock()
+	_ = tableOf(ipv6).DeleteChain(table, chain)
+	if err := tableOf(ipv6).AddChain(table, chain); err != nil {
+		return err
+	}
+	ledger.chains = append(ledger.chains, ledgerChain{ipv6: ipv6, table: table, chain: chain})
+	return nil
+}
+
+// ReconcileRules restores the chains and rules of the ledger missing from the live tables, e.g. flushed by another tool.
+// Returns how many were restored.
+func ReconcileRules() int {
+	ledger.lock.Lock()
+	defer ledger.lock.Unlock()
+
+	restored := 0
+	chains := append([]ledgerChain{}, ledger.chains...)
+	for _, entry := range ledger.entries {
+		chains = append(chains, ledgerChain{ipv6: entry.rule.IPv6, table: entry.rule.Table, chain: entry.rule.Chain})
+	}
+	checked := make(map[ledgerChain]bool)
+	for _, c := range chains {
+		if checked[c] {
+			continue
+		}
+		checked[c] = true
+		exists, err := tableOf(c.ipv6).ChainExists(c.table, c.chain)
+		if err != nil || exists {
+			continue
+		}
+		log.Printf("restoring the missing chain %s %s", c.table, c.chain)
+		if err := tableOf(c.ipv6).AddChain(c.table, c.chain); err != nil {
+			log.Printf("ERROR: unable to restore the chain %s %s: %v", c.table, c.chain, err)
+			continue
+		}
+		restored++
+	}
+
+	seen := make(map[string]bool)
+	for _, entry := range ledger.entries {
+		rule := entry.rule
+		if seen[rule.key()] {
+			continue
+		}
+		seen[rule.key()] = true
+		exists, err := tableOf(rule.IPv6).Exists(rule.Table, rule.Chain, rule.Params...)
+		if err != nil || exists {
+			continue
+		}
+		log.Printf("restoring the missing rule %s of %s", rule, entry.owner)
+		if err := tableOf(rule.IPv6).Append(rule.Table, rule.Chain, rule.Params...); err != nil {
+			log.Printf("ERROR: unable to restore the rule %s: %v", rule, err)
+			continue
+		}
+		restored++
+	}
+	return restored
+}
+
+// StartRulesReconciliation reconciles the ledger with the live tables every interval, until CleanupRules
+func StartRulesReconciliation(interval time.Duration) {
+	ledger.lock.Lock()
+	defer ledger.lock.Unlock()
+	if ledger.stop != nil {
+		return
+	}
+	stop := make(chan struct{})
+	ledger.stop = stop
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if restored := ReconcileRules(); restored > 0 {
+					log.Printf("restored %d firewall chains and rules", restored)
+				}
+			}
+		}
+	}()
+}
+
+// CleanupRules stops the reconciliation and removes all the rules, chains and public addresses installed by the NetManager
+func CleanupRules() {
+	ledger.lock.Lock()
+	defer ledger.lock.Unlock()
+	if ledger.stop != nil {
+		close(ledger.stop)
+		ledger.stop = nil
+	}
+	log.Printf("removing %d firewall rules", len(ledger.entries))
+	if err := ledger.release(func(ledgerEntry) bool { return true }); err != nil {
+		log.Printf("ERROR: unable to remove all the firewall rules: %v", err)
+	}
+	for i := len(ledger.chains) - 1; i >= 0; i-- {
+		c := ledger.chains[i]
+		_ = tableOf(c.ipv6).DeleteChain(c.table, c.chain)
+	}
+	ledger.chains = nil
+	if err := publicAddresses.releaseAll(); err != nil {
+		log.Printf("ERROR: unable to remove all the public addresses: %v", err)
+	}
+}
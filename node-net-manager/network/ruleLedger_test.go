@@ -0,0 +1,191 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+// faketable keeps the chains and rules in memory
+type faketable struct {
+	chains map[string][]string
+	// appends fail with this error when set
+	failAppend error
+}
+
+func newFakeTable() *faketable {
+	return &faketable{chains: map[string][]string{
+		"nat/PREROUTING":  {},
+		"nat/OUTPUT":      {},
+		"nat/POSTROUTING": {},
+		"filter/FORWARD":  {},
+		"filter/INPUT":    {},
+	}}
+}
+
+func (t *faketable) Append(table string, chain string, params ...string) error {
+	if t.failAppend != nil {
+		return t.failAppend
+	}
+	rules, ok := t.chains[table+"/"+chain]
+	if !ok {
+		return fmt.Errorf("no chain %s", chain)
+	}
+	t.chains[table+"/"+chain] = append(rules, strings.Join(params, " "))
+	return nil
+}
+
+func (t *faketable) AppendUnique(table string, chain string, params ...string) error {
+	if exists, _ := t.Exists(table, chain, params...); exists {
+		return nil
+	}
+	return t.Append(table, chain, params...)
+}
+
+func (t *faketable) Delete(table string, chain string, params ...string) error {
+	rules := t.chains[table+"/"+chain]
+	for i, rule := range rules {
+		if rule == strings.Join(params, " ") {
+			t.chains[table+"/"+chain] = append(rules[:i], rules[i+1:]...)
+			return nil
+		}
+	}
+	return errors.New("no such rule")
+}
+
+func (t *faketable) DeleteChain(table string, chain string) error {
+	delete(t.chains, table+"/"+chain)
+	return nil
+}
+
+func (t *faketable) AddChain(table string, chain string) error {
+	t.chains[table+"/"+chain] = []string{}
+	return nil
+}
+
+func (t *faketable) Exists(table string, chain string, params ...string) (bool, error) {
+	for _, rule := range t.chains[table+"/"+chain] {
+		if rule == strings.Join(params, " ") {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (t *faketable) ChainExists(table string, chain string) (bool, error) {
+	_, ok := t.chains[table+"/"+chain]
+	return ok, nil
+}
+
+func (t *faketable) Transaction(fn func(IpTable) error) error {
+	return fn(t)
+}
+
+func (t *faketable) rules() int {
+	count := 0
+	for _, rules := range t.chains {
+		count += len(rules)
+	}
+	return count
+}
+
+func useFakeTables() (*faketable, *faketable) {
+	v4, v6 := newFakeTable(), newFakeTable()
+	iptable, ip6table = v4, v6
+	ledger = &ruleLedger{}
+	hostPorts = &hostPortRegistry{}
+	return v4, v6
+}
+
+func TestRuleLedgerSharedRules(t *testing.T) {
+	v4, _ := useFakeTables()
+	first := InstanceRuleOwner("app.app.svc.svc", 0)
+	second := InstanceRuleOwner("app.app.svc.svc", 1)
+
+	assert.NilError(t, ManageVethForwarding(first, "goProxyBridge", "veth001", OpenPorts))
+	assert.NilError(t, ManageVethForwarding(second, "goProxyBridge", "veth001", OpenPorts))
+	assert.Equal(t, len(v4.chains["filter/FORWARD"]), 2)
+
+	// the rules are removed with their last owner
+	assert.NilError(t, ReleaseRules(first))
+	assert.Equal(t, len(v4.chains["filter/FORWARD"]), 2)
+	assert.NilError(t, ReleaseRules(second))
+	assert.Equal(t, len(v4.chains["filter/FORWARD"]), 0)
+
+	// the rules of other owners are left untouched
+	assert.NilError(t, ManageVethForwarding(first, "goProxyBridge", "veth001", OpenPorts))
+	assert.NilError(t, ManageVethForwarding(second, "goProxyBridge", "veth002", ClosePorts))
+	assert.Equal(t, len(v4.chains["filter/FORWARD"]), 2)
+}
+
+func TestRuleLedgerInstallAtomic(t *testing.T) {
+	v4, v6 := useFakeTables()
+	assert.NilError(t, CreateChain(false, "nat", chain))
+	assert.NilError(t, CreateChain(true, "nat", chain))
+	v6.failAppend = errors.New("injected fault")
+
+	err := AcceptEstablishedInput("goProxyTun")
+	assert.ErrorContains(t, err, "injected fault")
+	assert.Equal(t, v4.rules(), 0)
+	assert.Equal(t, len(ledger.entries), 0)
+
+	v6.failAppend = nil
+	assert.NilError(t, AcceptEstablishedInput("goProxyTun"))
+	assert.DeepEqual(t, v4.chains["filter/INPUT"], []string{"-i goProxyTun -m state --state RELATED,ESTABLISHED -j ACCEPT"})
+	assert.Equal(t, v6.rules(), 1)
+}
+
+func TestRuleLedgerReconcile(t *testing.T) {
+	v4, v6 := useFakeTables()
+	EnableForwarding("goProxyBridge", "goProxyTun")
+	assert.NilError(t, ManageContainerPortMappings(testOwner, []byte{10, 19, 1, 2}, PortMappings{{HostPort: 8080, ContainerPort: 80}}, OpenPorts))
+	assert.Equal(t, ReconcileRules(), 0)
+
+	// rules and chains removed by someone else are restored
+	assert.NilError(t, v4.Delete("filter", "FORWARD", "-o", "goProxyBridge", "-j", "ACCEPT"))
+	assert.NilError(t, v4.DeleteChain("nat", chain))
+	v6.chains["filter/FORWARD"] = []string{}
+	assert.Equal(t, ReconcileRules(), 1+1+1+4)
+	assert.Equal(t, len(v4.chains["filter/FORWARD"]), 4)
+	assert.DeepEqual(t, v4.chains["nat/"+chain], []string{"-p tcp --dport 8080 -j DNAT --to-destination 10.19.1.2:80"})
+	assert.Equal(t, len(v6.chains["filter/FORWARD"]), 4)
+	assert.Equal(t, ReconcileRules(), 0)
+}
+
+func TestRuleLedgerCleanup(t *testing.T) {
+	v4, v6 := useFakeTables()
+	EnableForwarding("goProxyBridge", "goProxyTun")
+	assert.NilError(t, AcceptEstablishedInput("goProxyTun"))
+	assert.NilError(t, ManageContainerPortMappings(testOwner, []byte{10, 19, 1, 2}, PortMappings{{HostPort: 8080, ContainerPort: 80}}, OpenPorts))
+	v4.chains["filter/FORWARD"] = append(v4.chains["filter/FORWARD"], "-j DOCKER-FORWARD")
+
+	CleanupRules()
+	assert.DeepEqual(t, v4.chains["filter/FORWARD"], []string{"-j DOCKER-FORWARD"})
+	assert.Equal(t, v4.rules(), 1)
+	assert.Equal(t, v6.rules(), 0)
+	_, exists := v4.chains["nat/"+chain]
+	assert.Assert(t, !exists)
+	assert.Equal(t, len(ledger.entries), 0)
+}
+
+func TestIptableFlushAll(t *testing.T) {
+	v4, v6 := useFakeTables()
+	for _, table := range []*faketable{v4, v6} {
+		assert.NilError(t, table.AddChain("nat", chain))
+		assert.NilError(t, table.Append("nat", "PREROUTING", "-j", chain))
+		assert.NilError(t, table.Append("nat", "OUTPUT", "-j", chain))
+		assert.NilError(t, table.AddChain("nat", snatChain))
+		assert.NilError(t, table.Append("nat", "POSTROUTING", "-j", snatChain))
+	}
+	IptableFlushAll()
+	for _, table := range []*faketable{v4, v6} {
+		assert.Equal(t, table.rules(), 0)
+		_, exists := table.chains["nat/"+chain]
+		assert.Assert(t, !exists)
+		_, exists = table.chains["nat/"+snatChain]
+		assert.Assert(t, !exists)
+	}
+}
@@ -0,0 +1,158 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// InterfaceKind selects the kernel parameters of an interface created by the NetManager
+type InterfaceKind string
+
+const (
+	BRIDGE_INTERFACE InterfaceKind = "bridge"
+	// VETH_INTERFACE is the bridge side of a veth pair
+	VETH_INTERFACE InterfaceKind = "veth"
+	TUN_INTERFACE  InterfaceKind = "tun"
+	// WORKLOAD_INTERFACE is the interface inside the namespace of a workload
+	WORKLOAD_INTERFACE InterfaceKind = "workload"
+)
+
+type sysctlValue struct {
+	// path relative to /proc/sys, %s is replaced by the interface name
+	path  string
+	value string
+}
+
+// interfaceSysctls are set on each interface as it is created
+var interfaceSysctls = map[InterfaceKind][]sysctlValue{
+	BRIDGE_INTERFACE: {
+		{"net/ipv4/conf/%s/rp_filter", "0"},
+		{"net/ipv6/conf/%s/accept_dad", "0"},
+	},
+	VETH_INTERFACE: {
+		{"net/ipv4/conf/%s/rp_filter", "0"},
+	},
+	TUN_INTERFACE: {
+		{"net/ipv4/conf/%s/rp_filter", "0"},
+	},
+	WORKLOAD_INTERFACE: {
+		{"net/ipv6/conf/%s/accept_dad", "0"},
+	},
+}
+
+// hostSysctls are set on the host at startup and restored at shutdown
+var hostSysctls = []sysctlValue{
+	{"net/ipv4/conf/all/rp_filter", "0"},
+	{"net/ipv4/ip_forward", "1"},
+	{"net/ipv6/conf/all/forwarding", "1"},
+}
+
+// sysctlRoot is where the kernel parameters are, replaced in the tests
+var sysctlRoot = "/proc/sys"
+
+// sysctlOriginals records the values of the host parameters before the first change
+type sysctlOriginals struct {
+	values map[string]string
+	// paths in order of change
+	order []string
+	lock  sync.Mutex
+}
+
+var sysctls = &sysctlOriginals{values: make(map[string]string)}
+
+// ReadSysctl returns the value of the kernel parameter, e.g. net/ipv4/ip_forward, in the current network namespace
+func ReadSysctl(path string) (string, error) {
+	data, err := os.ReadFile(filepath.Join(sysctlRoot, path))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// WriteSysctl writes the kernel parameter in the current network namespace and reads it back to verify it
+func WriteSysctl(path string, value string) error {
+	file, err := os.OpenFile(filepath.Join(sysctlRoot, path), os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return err
+	}
+	_, err = file.WriteString(value)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	current, err := ReadSysctl(path)
+	if err != nil {
+		return err
+	}
+	if current != value {
+		return fmt.Errorf("%s is %s after writing %s", path, current, value)
+	}
+	return nil
+}
+
+// SetSysctl writes a host kernel parameter, recording the value before the first change to restore it with RestoreSysctls
+func SetSysctl(path string, value string) error {
+	sysctls.lock.Lock()
+	defer sysctls.lock.Unlock()
+	original, err := ReadSysctl(path)
+	if err != nil {
+		return err
+	}
+	if err := WriteSysctl(path, value); err != nil {
+		return err
+	}
+	if _, recorded := sysctls.values[path]; !recorded {
+		sysctls.values[path] = original
+		sysctls.order = append(sysctls.order, path)
+	}
+	return nil
+}
+
+// RestoreSysctls writes back the original values of the host parameters, in reverse order of change
+func RestoreSysctls() error {
+	sysctls.lock.Lock()
+	defer sysctls.lock.Unlock()
+	var errs []error
+	for i := len(sysctls.order) - 1; i >= 0; i-- {
+		path := sysctls.order[i]
+		if err := WriteSysctl(path, sysctls.values[path]); err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs = append(errs, err)
+		}
+	}
+	sysctls.values = make(map[string]string)
+	sysctls.order = nil
+	return errors.Join(errs...)
+}
+
+// ConfigureHostSysctls disables the reverse path filtering and enables the IPv4 and IPv6 forwarding
+func ConfigureHostSysctls() error {
+	var errs []error
+	for _, sysctl := range hostSysctls {
+		if err := SetSysctl(sysctl.path, sysctl.value); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ConfigureInterface sets the kernel parameters of a new interface in the current network namespace.
+// All the parameters are attempted, the error lists the ones that failed.
+// The values are not recorded, they are gone with the interface.
+func ConfigureInterface(name string, kind InterfaceKind) error {
+	var errs []error
+	for _, sysctl := range interfaceSysctls[kind] {
+		if err := WriteSysctl(fmt.Sprintf(sysctl.path, name), sysctl.value); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("unable to configure the %s interface %s: %w", kind, name, errors.Join(errs...))
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package network
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+// useFakeSysctls points the kernel parameters to a temporary directory holding the given values
+func useFakeSysctls(t *testing.T, values map[string]string) {
+	root := t.TempDir()
+	for path, value := range values {
+		assert.NilError(t, os.MkdirAll(filepath.Dir(filepath.Join(root, path)), 0o755))
+		assert.NilError(t, os.WriteFile(filepath.Join(root, path), []byte(value+"\n"), 0o644))
+	}
+	previous := sysctlRoot
+	sysctlRoot = root
+	sysctls = &sysctlOriginals{values: make(map[string]string)}
+	t.Cleanup(func() { sysctlRoot = previous })
+}
+
+func TestSysctlSetAndRestore(t *testing.T) {
+	useFakeSysctls(t, map[string]string{
+		"net/ipv4/conf/all/rp_filter":  "2",
+		"net/ipv4/ip_forward":          "0",
+		"net/ipv6/conf/all/forwarding": "0",
+	})
+	assert.NilError(t, ConfigureHostSysctls())
+	value, err := ReadSysctl("net/ipv4/ip_forward")
+	assert.NilError(t, err)
+	assert.Equal(t, value, "1")
+
+	// the original value is the one before the first change
+	assert.NilError(t, SetSysctl("net/ipv4/ip_forward", "0"))
+	assert.NilError(t, RestoreSysctls())
+	for path, original := range map[string]string{
+		"net/ipv4/conf/all/rp_filter":  "2",
+		"net/ipv4/ip_forward":          "0",
+		"net/ipv6/conf/all/forwarding": "0",
+	} {
+		value, err := ReadSysctl(path)
+		assert.NilError(t, err)
+		assert.Equal(t, value, original)
+	}
+}
+
+func TestSysctlRestoreSkipsMissing(t *testing.T) {
+	useFakeSysctls(t, map[string]string{
+		"net/ipv4/conf/all/rp_filter":     "1",
+		"net/ipv4/conf/veth001/rp_filter": "1",
+	})
+	assert.NilError(t, SetSysctl("net/ipv4/conf/all/rp_filter", "0"))
+	assert.NilError(t, SetSysctl("net/ipv4/conf/veth001/rp_filter", "0"))
+	// the interface is gone
+	assert.NilError(t, os.RemoveAll(filepath.Join(sysctlRoot, "net/ipv4/conf/veth001")))
+	assert.NilError(t, RestoreSysctls())
+	value, err := ReadSysctl("net/ipv4/conf/all/rp_filter")
+	assert.NilError(t, err)
+	assert.Equal(t, value, "1")
+}
+
+func TestConfigureInterfaceErrors(t *testing.T) {
+	useFakeSysctls(t, map[string]string{
+		"net/ipv4/conf/goProxyBridge/rp_filter": "1",
+	})
+	// the IPv6 parameter is missing, the IPv4 one is set anyway
+	err := ConfigureInterface("goProxyBridge", BRIDGE_INTERFACE)
+	assert.ErrorContains(t, err, "bridge interface goProxyBridge")
+	assert.ErrorContains(t, err, "net/ipv6/conf/goProxyBridge/accept_dad")
+	value, err := ReadSysctl("net/ipv4/conf/goProxyBridge/rp_filter")
+	assert.NilError(t, err)
+	assert.Equal(t, value, "0")
+
+	// interfaces are not recorded for restore
+	assert.Equal(t, len(sysctls.order), 0)
+}
+
+func TestSysctlSetMissing(t *testing.T) {
+	useFakeSysctls(t, map[string]string{})
+	err := SetSysctl("net/ipv4/ip_forward", "1")
+	assert.Assert(t, errors.Is(err, os.ErrNotExist))
+	assert.Equal(t, len(sysctls.order), 0)
+}
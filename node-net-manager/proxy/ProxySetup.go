@@ -7,18 +7,18 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
-	"math/rand"
 	"net"
 	"os"
 	"os/exec"
 	"strconv"
 	"sync"
+	"time"
 
 	"github.com/songgao/water"
 )
 
 // create a  new GoProxyTunnel with the configuration from the custom local file
-func New() GoProxyTunnel {
+func New() *GoProxyTunnel {
 	// load netcfg.json
 	cfg, err := os.Open("/etc/netmanager/tuncfg.json")
 	if err != nil {
@@ -48,20 +48,50 @@ func New() GoProxyTunnel {
 }
 
 // create a  new GoProxyTunnel with a custom configuration
-func NewCustom(configuration Configuration) GoProxyTunnel {
-	proxy := GoProxyTunnel{
-		isListening:      false,
+func NewCustom(configuration Configuration) *GoProxyTunnel {
+	proxy := newGoProxyTunnel(configuration)
+
+	// create the TUN device
+	proxy.createTun()
+
+	// set local ip
+	ipstring, _ := network.GetLocalIPandIface()
+	proxy.localIP = net.ParseIP(ipstring)
+
+	logger.InfoLogger().Printf("Created ProxyTun device: %s\n", proxy.ifce.Name())
+	logger.InfoLogger().Printf("Local Ip detected: %s\n", proxy.localIP.String())
+
+	return proxy
+}
+
+// NewWithTransport creates a new GoProxyTunnel on top of the given packet device and tunnel sockets,
+// without creating any TUN device or UDP socket. E.g., used to run multiple proxies in memory.
+func NewWithTransport(configuration Configuration, localIP net.IP, device PacketDevice, socket TunnelSocket, dialer TunnelDialer) *GoProxyTunnel {
+	proxy := newGoProxyTunnel(configuration)
+	proxy.HostTUNDeviceName = device.Name()
+	proxy.ifce = device
+	proxy.listenConnection = socket
+	proxy.dialer = dialer
+	proxy.localIP = localIP
+	return proxy
+}
+
+func newGoProxyTunnel(configuration Configuration) *GoProxyTunnel {
+	proxy := &GoProxyTunnel{
 		errorChannel:     make(chan error),
 		finishChannel:    make(chan bool),
 		stopChannel:      make(chan bool),
-		connectionBuffer: make(map[string]*net.UDPConn),
+		connectionBuffer: make(map[string]*peerConnection),
+		dialer:           dialUDP,
 		proxycache:       NewProxyCache(),
+		affinity:         NewSessionAffinityTable(),
+		balancer:         NewWeightedRoundRobin(),
 		udpwrite:         sync.RWMutex{},
 		tunwrite:         sync.RWMutex{},
 		incomingChannel:  make(chan incomingMessage, 1000),
 		outgoingChannel:  make(chan outgoingMessage, 1000),
+		socketChannel:    make(chan TunnelSocket, 1),
 		mtusize:          strconv.Itoa(configuration.Mtusize),
-		randseed:         rand.New(rand.NewSource(42)),
 	}
 
 	// parse configuration file
@@ -79,16 +109,6 @@ func NewCustom(configuration Configuration) GoProxyTunnel {
 		Mask: net.CIDRMask(tunconfig.ProxySubnetworkIPv6Prefix, 128),
 	}
 	proxy.tunNetIPv6 = tunconfig.TunNetIPv6
-	// create the TUN device
-	proxy.createTun()
-
-	// set local ip
-	ipstring, _ := network.GetLocalIPandIface()
-	proxy.localIP = net.ParseIP(ipstring)
-
-	logger.InfoLogger().Printf("Created ProxyTun device: %s\n", proxy.ifce.Name())
-	logger.InfoLogger().Printf("Local Ip detected: %s\n", proxy.localIP.String())
-
 	return proxy
 }
 
@@ -97,15 +117,18 @@ func (proxy *GoProxyTunnel) SetEnvironment(env env.EnvironmentManager) {
 }
 
 func (proxy *GoProxyTunnel) IsListening() bool {
-	return proxy.isListening
+	return proxy.isListening.Load()
 }
 
 // start listening for packets in the TUN Proxy device
 func (proxy *GoProxyTunnel) Listen() {
-	if !proxy.isListening {
+	// set before starting the listeners, they only clear it when they stop
+	if proxy.isListening.CompareAndSwap(false, true) {
 		logger.InfoLogger().Println("Starting proxy listening mode")
 		go proxy.tunOutgoingListen()
 		go proxy.tunIngoingListen()
+		proxy.runDrainMonitor(10 * time.Second)
+		proxy.affinity.runEvictionJob(30 * time.Second)
 	}
 }
 
@@ -142,9 +165,7 @@ func (proxy *GoProxyTunnel) createTun() {
 
 	//disabling reverse path filtering
 	logger.InfoLogger().Println("Disabling tun dev reverse path filtering")
-	cmd = exec.Command("echo", "0", ">", "/proc/sys/net/ipv4/conf/"+ifce.Name()+"/rp_filter")
-	err = cmd.Run()
-	if err != nil {
+	if err = network.ConfigureInterface(ifce.Name(), network.TUN_INTERFACE); err != nil {
 		log.Printf("Error disabling tun dev reverse path filtering: %s ", err.Error())
 	}
 
@@ -168,37 +189,41 @@ func (proxy *GoProxyTunnel) createTun() {
 
 	//add firewalls rules
 	logger.InfoLogger().Println("adding firewall rule " + ifce.Name())
-	cmd = exec.Command("iptables", "-A", "INPUT", "-i", "tun0", "-m", "state",
-		"--state", "RELATED,ESTABLISHED", "-j", "ACCEPT")
-	err = cmd.Run()
+	err = network.AcceptEstablishedInput(ifce.Name())
 	if err != nil {
 		log.Fatal(err)
 	}
-	// IPv6
-	cmd = exec.Command("ip6tables", "-A", "INPUT", "-i", "tun0", "-m", "state",
-		"--state", "RELATED,ESTABLISHED", "-j", "ACCEPT")
-	err = cmd.Run()
+
+	// listen to local socket
+	proxy.listen = func() (TunnelSocket, error) {
+		return listenTunnelSocket(proxy.TunnelPort)
+	}
+	socket, err := proxy.listen()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	// listen to local socket
-	lstnAddr, err := net.ResolveUDPAddr("udp", fmt.Sprintf(":%v", proxy.TunnelPort))
+	proxy.HostTUNDeviceName = ifce.Name()
+	proxy.ifce = ifce
+	proxy.listenConnection = socket
+}
+
+// listenTunnelSocket opens the UDP socket receiving the packets of the other nodes
+func listenTunnelSocket(port int) (TunnelSocket, error) {
+	lstnAddr, err := net.ResolveUDPAddr("udp", fmt.Sprintf(":%v", port))
 	if nil != err {
-		log.Fatal("Unable to get UDP socket:", err)
+		return nil, fmt.Errorf("unable to get UDP socket: %w", err)
 	}
 	lstnConn, err := net.ListenUDP("udp", lstnAddr)
 	if nil != err {
-		log.Fatal("Unable to listen on UDP socket:", err)
+		return nil, fmt.Errorf("unable to listen on UDP socket: %w", err)
 	}
 	err = lstnConn.SetReadBuffer(BUFFER_SIZE)
 	if nil != err {
-		log.Fatal("Unable to set Read Buffer:", err)
+		_ = lstnConn.Close()
+		return nil, fmt.Errorf("unable to set Read Buffer: %w", err)
 	}
-
-	proxy.HostTUNDeviceName = ifce.Name()
-	proxy.ifce = ifce
-	proxy.listenConnection = lstnConn
+	return wrapUDPConn(lstnConn), nil
 }
 
 // Configuration implements Stringer interface
@@ -5,19 +5,24 @@ import (
 	"NetManager/env"
 	"NetManager/logger"
 	"NetManager/proxy/iputils"
+	"errors"
 	"fmt"
-	"math/rand"
 	"net"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
-	"github.com/songgao/water"
 )
 
 // const
 var BUFFER_SIZE = 64 * 1024
 
+// maximum number of datagrams read or written with a single system call
+const BATCH_SIZE = 32
+
 // Config
 type Configuration struct {
 	HostTUNDeviceName         string `json:"HostTunnelDeviceName"`
@@ -33,11 +38,12 @@ type Configuration struct {
 
 type GoProxyTunnel struct {
 	environment         env.EnvironmentManager
-	listenConnection    *net.UDPConn
+	listenConnection    TunnelSocket
 	incomingChannel     chan incomingMessage
-	connectionBuffer    map[string]*net.UDPConn
-	randseed            *rand.Rand
-	ifce                *water.Interface
+	connectionBuffer    map[string]*peerConnection
+	dialer              TunnelDialer
+	nat                 *natTraversal
+	ifce                PacketDevice
 	outgoingChannel     chan outgoingMessage
 	finishChannel       chan bool
 	errorChannel        chan error
@@ -49,12 +55,20 @@ type GoProxyTunnel struct {
 	ProxyIpSubnetwork   net.IPNet
 	ProxyIPv6Subnetwork net.IPNet
 	localIP             net.IP
-	proxycache          ProxyCache
-	TunnelPort          int
-	bufferPort          int
-	udpwrite            sync.RWMutex
-	tunwrite            sync.RWMutex
-	isListening         bool
+	// opens the tunnel socket again when the node changes address, nil to keep the socket
+	listen func() (TunnelSocket, error)
+	// new tunnel sockets for the ingoing listener
+	socketChannel chan TunnelSocket
+	// guards the local IP and the tunnel socket
+	addressLock sync.RWMutex
+	proxycache  *ProxyCache
+	affinity    *SessionAffinityTable
+	balancer    *WeightedRoundRobin
+	TunnelPort  int
+	bufferPort  int
+	udpwrite    sync.RWMutex
+	tunwrite    sync.RWMutex
+	isListening atomic.Bool
 }
 
 // incoming message from UDP channel
@@ -68,39 +82,64 @@ type outgoingMessage struct {
 	content *[]byte
 }
 
+// localAddress returns the IP of this node
+func (proxy *GoProxyTunnel) localAddress() net.IP {
+	proxy.addressLock.RLock()
+	defer proxy.addressLock.RUnlock()
+	return proxy.localIP
+}
+
+// tunnelSocket returns the socket receiving the packets of the other nodes
+func (proxy *GoProxyTunnel) tunnelSocket() TunnelSocket {
+	proxy.addressLock.RLock()
+	defer proxy.addressLock.RUnlock()
+	return proxy.listenConnection
+}
+
 // handler function for all outgoing messages that are received by the TUN device
 func (proxy *GoProxyTunnel) outgoingMessage() {
+	batch := newOutgoingBatch()
 	for {
 		select {
 		case msg := <-proxy.outgoingChannel:
 			// logger.DebugLogger().Println("outgoingChannelSize: ", len(proxy.outgoingChannel))
-			// logger.DebugLogger().Printf("Msg outgoingChannel: %x\n", (*msg.content))
-			ip, prot := decodePacket(*msg.content)
-			if ip == nil {
-				continue
-			}
-			logger.DebugLogger().Printf("Outgoing packet:\t\t\t%s ---> %s\n", ip.GetSrcIP().String(), ip.GetDestIP().String())
-
-			// continue only if the packet is udp or tcp, otherwise just drop it
-			if prot == nil {
-				logger.DebugLogger().Println("Neither TCP, nor UDP packet received. Dropping it.")
-				continue
-			}
-			// proxyConversion
-			newPacket := proxy.outgoingProxy(ip, prot)
-			if newPacket == nil {
-				// if no proxy conversion available, drop it
-				logger.ErrorLogger().Println("Unable to convert the packet")
-				continue
+			proxy.handleOutgoingMessage(msg, batch)
+			// the packets already queued leave together, with as few system calls as possible
+			for i := 1; i < BATCH_SIZE && len(proxy.outgoingChannel) > 0; i++ {
+				proxy.handleOutgoingMessage(<-proxy.outgoingChannel, batch)
 			}
+			proxy.flush(batch)
+		}
+	}
+}
 
-			// fetch remote address
-			dstHost, dstPort := proxy.locateRemoteAddress(ip.GetDestIP())
+// handleOutgoingMessage converts the packet and queues it in the batch towards the destination node
+func (proxy *GoProxyTunnel) handleOutgoingMessage(msg outgoingMessage, batch *outgoingBatch) {
+	// logger.DebugLogger().Printf("Msg outgoingChannel: %x\n", (*msg.content))
+	ip, prot := decodePacket(*msg.content)
+	if ip == nil {
+		return
+	}
+	logger.DebugLogger().Printf("Outgoing packet:\t\t\t%s ---> %s\n", ip.GetSrcIP().String(), ip.GetDestIP().String())
 
-			// packetForwarding to tunnel interface
-			proxy.forward(dstHost, dstPort, newPacket, 0)
-		}
+	// continue only if the packet is udp or tcp, otherwise just drop it
+	if prot == nil {
+		logger.DebugLogger().Println("Neither TCP, nor UDP packet received. Dropping it.")
+		return
+	}
+	// proxyConversion
+	newPacket := proxy.outgoingProxy(ip, prot)
+	if newPacket == nil {
+		// if no proxy conversion available, drop it
+		logger.ErrorLogger().Println("Unable to convert the packet")
+		return
 	}
+
+	// fetch remote address
+	dstPeer := proxy.locateRemoteAddress(ip.GetDestIP())
+
+	// packetForwarding to tunnel interface
+	proxy.enqueue(batch, dstPeer, newPacket)
 }
 
 // handler function for all ingoing messages that are received by the UDP socket
@@ -110,7 +149,20 @@ func (proxy *GoProxyTunnel) ingoingMessage() {
 		case msg := <-proxy.incomingChannel:
 			// logger.DebugLogger().Println("ingoingChannelSize: ", len(proxy.incomingChannel))
 			// logger.DebugLogger().Printf("Msg incomingChannel: %x\n", (*msg.content))
-			ip, prot := decodePacket(*msg.content)
+			content := *msg.content
+			if isNatControlPacket(content) {
+				if proxy.nat == nil {
+					continue
+				}
+				// the control packets may carry a packet relayed by another node
+				content = proxy.nat.handleControl(content, &msg.from)
+				if content == nil {
+					continue
+				}
+			} else if proxy.nat != nil {
+				proxy.nat.touch(&msg.from)
+			}
+			ip, prot := decodePacket(content)
 
 			// proceed only if this is a valid ip packet
 			if ip == nil {
@@ -128,7 +180,7 @@ func (proxy *GoProxyTunnel) ingoingMessage() {
 			var packetBytes []byte
 			if newPacket == nil {
 				// no conversion data, forward as is
-				packetBytes = *msg.content
+				packetBytes = content
 			} else {
 				packetBytes = packetToByte(newPacket)
 			}
@@ -182,8 +234,11 @@ func (proxy *GoProxyTunnel) outgoingProxy(ip iputils.NetworkLayerPacket, prot ip
 
 		if !exist || entry.dstport < 1 || !TableEntryCache.IsNamespaceStillValid(entry.dstip, &tableEntryList) {
 			// Choose between the table entry according to the ServiceIP algorithm
-			// TODO: so far this only uses RR, ServiceIP policies should be implemented here
-			tableEntry := tableEntryList[proxy.randseed.Intn(len(tableEntryList))]
+			tableEntry, found := proxy.selectTableEntry(tableEntryList, dstIP, srcIP, instanceIP, dstport)
+			if !found {
+				logger.DebugLogger().Printf("No instance available for new flows towards %s", dstIP.String())
+				return nil
+			}
 
 			entryDstIP := tableEntry.Nsipv6
 			if ip.GetProtocolVersion() == 4 {
@@ -206,6 +261,23 @@ func (proxy *GoProxyTunnel) outgoingProxy(ip iputils.NetworkLayerPacket, prot ip
 	return nil
 }
 
+// selectTableEntry chooses the destination instance of a new flow towards a ServiceIP.
+// Instances with weight 0 are draining and never receive new flows.
+// If the ServiceIP has session affinity enabled the flow is pinned to the instance bound to the client,
+// otherwise the instances are picked using smooth weighted round-robin.
+func (proxy *GoProxyTunnel) selectTableEntry(tableEntryList []TableEntryCache.TableEntry, dstServiceIp net.IP, srcip net.IP, srcInstanceIp net.IP, dstport int) (TableEntryCache.TableEntry, bool) {
+	candidates := activeInstances(tableEntryList)
+	if len(candidates) == 0 {
+		return TableEntryCache.TableEntry{}, false
+	}
+	if sip, found := candidates[0].GetServiceIP(dstServiceIp); found {
+		if key := affinityKey(sip, dstServiceIp, srcip, srcInstanceIp, dstport); key != "" {
+			return proxy.selectWithAffinity(key, sip, candidates), true
+		}
+	}
+	return proxy.balancer.Next(dstServiceIp.String(), candidates), true
+}
+
 func (proxy *GoProxyTunnel) convertToInstanceIp(ip iputils.NetworkLayerPacket) (net.IP, error) {
 	instanceTableEntry, instanceexist := proxy.environment.GetTableEntryByNsIP(ip.GetSrcIP())
 	instanceIP := net.IP{}
@@ -262,14 +334,14 @@ func (proxy *GoProxyTunnel) tunOutgoingListen() {
 	// async handler
 	go proxy.outgoingMessage()
 
-	proxy.isListening = true
 	logger.InfoLogger().Println("GoProxyTunnel outgoing listening started")
 	for {
 		select {
 		case stopmsg := <-proxy.stopChannel:
 			if stopmsg {
 				logger.DebugLogger().Println("Outgoing listener received stop message")
-				proxy.isListening = false
+				proxy.affinity.stopEvictionJob()
+				proxy.isListening.Store(false)
 				proxy.finishChannel <- true
 				return
 			}
@@ -287,23 +359,25 @@ func (proxy *GoProxyTunnel) tunIngoingListen() {
 	readerror := make(chan error)
 
 	// async listener
-	go proxy.udpread(proxy.listenConnection, proxy.incomingChannel, readerror)
+	go proxy.udpread(proxy.tunnelSocket(), proxy.incomingChannel, readerror)
 
 	// async handler
 	go proxy.ingoingMessage()
 
-	proxy.isListening = true
 	logger.InfoLogger().Println("GoProxyTunnel ingoing listening started")
 	for {
 		select {
 		case stopmsg := <-proxy.stopChannel:
 			if stopmsg {
 				logger.DebugLogger().Println("Ingoing listener received stop message")
-				_ = proxy.listenConnection.Close()
-				proxy.isListening = false
+				_ = proxy.tunnelSocket().Close()
+				proxy.isListening.Store(false)
 				proxy.finishChannel <- true
 				return
 			}
+		case socket := <-proxy.socketChannel:
+			// the node changed address, the listener of the previous socket is gone with it
+			go proxy.udpread(socket, proxy.incomingChannel, readerror)
 		case errormsg := <-readerror:
 			proxy.errorChannel <- errormsg
 			// go udpread(proxy.listenConnection, readoutput, readerror)
@@ -311,33 +385,84 @@ func (proxy *GoProxyTunnel) tunIngoingListen() {
 	}
 }
 
-// Given a network namespace IP find the machine IP and port for the tunneling
-func (proxy *GoProxyTunnel) locateRemoteAddress(nsIP net.IP) (net.IP, int) {
+// runDrainMonitor periodically releases the draining instances that are no longer used by any flow.
+// Closed flows leave the proxycache with the eviction job, then the instance can be removed before the grace period ends.
+func (proxy *GoProxyTunnel) runDrainMonitor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	go func() {
+		for range ticker.C {
+			proxy.releaseDrainedInstances()
+		}
+	}()
+}
+
+func (proxy *GoProxyTunnel) releaseDrainedInstances() {
+	for _, entry := range proxy.environment.GetDrainingInstances() {
+		// the IPv6 flows are translated towards the IPv6 namespace address
+		if proxy.proxycache.HasFlowsTowards(entry.Nsip) || (entry.Nsipv6 != nil && proxy.proxycache.HasFlowsTowards(entry.Nsipv6)) {
+			continue
+		}
+		proxy.environment.ReleaseDrainingInstance(entry.Nsip)
+	}
+}
+
+// Given a network namespace IP find the node, machine IP and port for the tunneling
+func (proxy *GoProxyTunnel) locateRemoteAddress(nsIP net.IP) remotePeer {
 	// if no local cache entry convert namespace IP to host IP via table query
 	tableElement, found := proxy.environment.GetTableEntryByNsIP(nsIP)
 	if found {
 		logger.DebugLogger().Println("Remote NS IP", nsIP.String(), " translated to ", tableElement.Nodeip.String())
-		return tableElement.Nodeip, tableElement.Nodeport
+		return newRemotePeer(tableElement)
 	}
 
 	// If nothing found, just drop the packet using an invalid port
-	return nsIP, -1
+	return remotePeer{host: nsIP, port: -1}
+}
+
+// enqueue adds the packet to the batch towards the destination node, the local packets are forwarded immediately
+func (proxy *GoProxyTunnel) enqueue(batch *outgoingBatch, dst remotePeer, packet gopacket.Packet) {
+	if dst.port < 0 || proxy.isLocal(dst) {
+		proxy.forward(dst, packet, 0)
+		return
+	}
+	con := proxy.getPeerConnection(dst.id, dst.traversable)
+	con.setAdvertised(dst.host, dst.port)
+	batch.add(con, dst, packet)
+}
+
+// flush sends the queued packets, one batch for each destination node.
+// If a batch fails the packets are forwarded one by one.
+func (proxy *GoProxyTunnel) flush(batch *outgoingBatch) {
+	for _, queue := range batch.queues {
+		if err := queue.peer.WriteBatch(queue.buffers); err != nil {
+			logger.ErrorLogger().Println(err)
+			_ = queue.peer.Close()
+			for _, packet := range queue.packets {
+				proxy.forward(queue.dst, packet, 1)
+			}
+		}
+	}
+	batch.reset()
+}
+
+func (proxy *GoProxyTunnel) isLocal(dst remotePeer) bool {
+	return dst.host.Equal(proxy.localAddress()) || (proxy.nat != nil && dst.id == proxy.nat.config.NodeID)
 }
 
 // forward message to final destination via UDP tunneling
-func (proxy *GoProxyTunnel) forward(dstHost net.IP, dstPort int, packet gopacket.Packet, attemptNumber int) {
-	if attemptNumber > 10 {
+func (proxy *GoProxyTunnel) forward(dst remotePeer, packet gopacket.Packet, attemptNumber int) {
+	if attemptNumber > 10 || dst.port < 0 {
 		return
 	}
 
 	packetBytes := packetToByte(packet)
 
 	// If destination host is this machine, forward packet directly to the ingoing traffic method
-	if dstHost.Equal(proxy.localIP) {
+	if proxy.isLocal(dst) {
 		logger.InfoLogger().Println("Packet forwarded locally")
 		msg := incomingMessage{
 			from: net.UDPAddr{
-				IP:   proxy.localIP,
+				IP:   proxy.localAddress(),
 				Port: 0,
 				Zone: "",
 			},
@@ -347,42 +472,22 @@ func (proxy *GoProxyTunnel) forward(dstHost net.IP, dstPort int, packet gopacket
 		return
 	}
 
-	// Check udp channel buffer to avoid creating a new channel
-	proxy.udpwrite.Lock()
-	hoststring := fmt.Sprintf("%s:%v", dstHost, dstPort)
-	con, exist := proxy.connectionBuffer[hoststring]
-	proxy.udpwrite.Unlock()
+	// Connections are kept by peer identity, the peer endpoint can change without replacing them
 	// TODO: flush connection buffer by time to time
-	if !exist {
-		logger.DebugLogger().Println("Establishing a new connection to node ", hoststring)
-		connection, err := createUDPChannel(hoststring)
-		if nil != err {
-			return
-		}
-		_ = connection.SetWriteBuffer(BUFFER_SIZE)
-		proxy.udpwrite.Lock()
-		proxy.connectionBuffer[hoststring] = connection
-		proxy.udpwrite.Unlock()
-		con = connection
-	}
+	con := proxy.getPeerConnection(dst.id, dst.traversable)
+	con.setAdvertised(dst.host, dst.port)
 
 	// send via UDP channel
-	proxy.udpwrite.Lock()
-	_, _, err := (*con).WriteMsgUDP(packetBytes, nil, nil)
-	proxy.udpwrite.Unlock()
+	_, err := con.Write(packetBytes)
 	if err != nil {
-		_ = (*con).Close()
+		_ = con.Close()
 		logger.ErrorLogger().Println(err)
-		connection, err := createUDPChannel(hoststring)
-		if nil != err {
-			return
+		if attemptNumber == 10 {
+			emitPeerUnreachable(dst.id, net.JoinHostPort(dst.host.String(), strconv.Itoa(dst.port)), err.Error())
 		}
-		proxy.udpwrite.Lock()
-		proxy.connectionBuffer[hoststring] = connection
-		proxy.udpwrite.Unlock()
 		// Try again
 		attemptNumber++
-		proxy.forward(dstHost, dstPort, packet, attemptNumber)
+		proxy.forward(dst, packet, attemptNumber)
 	}
 }
 
@@ -408,7 +513,7 @@ func createUDPChannel(hoststring string) (*net.UDPConn, error) {
 // read output from an interface and wrap the read operation with a channel
 // out channel gives back the byte array of the output
 // errchannel is the channel where in case of error the error is routed
-func (proxy *GoProxyTunnel) ifaceread(ifce *water.Interface, out chan<- outgoingMessage, errchannel chan<- error) {
+func (proxy *GoProxyTunnel) ifaceread(ifce PacketDevice, out chan<- outgoingMessage, errchannel chan<- error) {
 	buffer := make([]byte, BUFFER_SIZE)
 	for {
 		n, err := ifce.Read(buffer)
@@ -428,11 +533,18 @@ func (proxy *GoProxyTunnel) ifaceread(ifce *water.Interface, out chan<- outgoing
 // read output from an UDP connection and wrap the read operation with a channel
 // out channel gives back the byte array of the output
 // errchannel is the channel where in case of error the error is routed
-func (proxy *GoProxyTunnel) udpread(conn *net.UDPConn, out chan<- incomingMessage, errchannel chan<- error) {
+func (proxy *GoProxyTunnel) udpread(conn TunnelSocket, out chan<- incomingMessage, errchannel chan<- error) {
+	if batchSocket, ok := conn.(batchTunnelSocket); ok {
+		proxy.udpreadBatch(batchSocket, out, errchannel)
+		return
+	}
 	buffer := make([]byte, BUFFER_SIZE)
 	for {
 		packet := buffer
 		n, from, err := conn.ReadFromUDP(packet)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
 		if err != nil {
 			errchannel <- err
 		} else {
@@ -446,6 +558,24 @@ func (proxy *GoProxyTunnel) udpread(conn *net.UDPConn, out chan<- incomingMessag
 	}
 }
 
+// same as udpread, reading up to BATCH_SIZE datagrams per system call
+func (proxy *GoProxyTunnel) udpreadBatch(conn batchTunnelSocket, out chan<- incomingMessage, errchannel chan<- error) {
+	messages := make([]incomingMessage, BATCH_SIZE)
+	for {
+		n, err := conn.ReadBatch(messages)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			errchannel <- err
+			continue
+		}
+		for _, msg := range messages[:n] {
+			out <- msg
+		}
+	}
+}
+
 func packetToByte(packet gopacket.Packet) []byte {
 	options := gopacket.SerializeOptions{
 		ComputeChecksums: false,
@@ -454,7 +584,9 @@ func packetToByte(packet gopacket.Packet) []byte {
 	newBuffer := gopacket.NewSerializeBuffer()
 	err := gopacket.SerializePacket(newBuffer, options, packet)
 	if err != nil {
-		logger.ErrorLogger().Println(err)
+		// e.g. an application payload that gopacket failed to decode, the raw packet is still valid
+		logger.DebugLogger().Println(err)
+		return packet.Data()
 	}
 	return newBuffer.Bytes()
 }
@@ -483,6 +615,9 @@ func (proxy *GoProxyTunnel) GetFinishCh() <-chan bool {
 
 func decodePacket(msg []byte) (iputils.NetworkLayerPacket, iputils.TransportLayerProtocol) {
 	var ipType layers.IPProtocol
+	if len(msg) == 0 {
+		return nil, nil
+	}
 	switch msg[0] & 0xf0 {
 	case 0x40:
 		ipType = layers.IPProtocolIPv4
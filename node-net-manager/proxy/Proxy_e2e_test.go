@@ -0,0 +1,559 @@
+package proxy
+
+import (
+	"NetManager/TableEntryCache"
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// FakeClusterEnv resolves the entries of a whole fake cluster, shared by all the in-memory nodes
+type FakeClusterEnv struct {
+	entries []TableEntryCache.TableEntry
+}
+
+func (fakeenv *FakeClusterEnv) GetTableEntryByServiceIP(ip net.IP) []TableEntryCache.TableEntry {
+	result := make([]TableEntryCache.TableEntry, 0)
+	for _, entry := range fakeenv.entries {
+		if _, found := entry.GetServiceIP(ip); found {
+			result = append(result, entry)
+		}
+	}
+	return result
+}
+
+func (fakeenv *FakeClusterEnv) GetTableEntryByNsIP(ip net.IP) (TableEntryCache.TableEntry, bool) {
+	for _, entry := range fakeenv.entries {
+		if entry.Nsip.Equal(ip) || entry.Nsipv6.Equal(ip) {
+			return entry, true
+		}
+	}
+	return TableEntryCache.TableEntry{}, false
+}
+
+func (fakeenv *FakeClusterEnv) GetTableEntryByInstanceIP(ip net.IP) (TableEntryCache.TableEntry, bool) {
+	return TableEntryCache.TableEntry{}, false
+}
+
+func (fakeenv *FakeClusterEnv) GetDrainingInstances() []TableEntryCache.TableEntry {
+	return nil
+}
+
+func (fakeenv *FakeClusterEnv) ReleaseDrainingInstance(nsip net.IP) {
+}
+
+func fakeClusterEntry(servicename string, nodeip string, nsip string, instanceip string, serviceip string) TableEntryCache.TableEntry {
+	return TableEntryCache.TableEntry{
+		JobName:          "a.a." + servicename + ".b",
+		Appname:          "a",
+		Appns:            "a",
+		Servicename:      servicename,
+		Servicenamespace: "b",
+		Nodeip:           net.ParseIP(nodeip),
+		Nodeport:         50103,
+		Nsip:             net.ParseIP(nsip),
+		Nsipv6:           net.ParseIP("fc00::" + servicename),
+		ServiceIP: []TableEntryCache.ServiceIP{
+			{
+				IpType:  TableEntryCache.RoundRobin,
+				Address: net.ParseIP(serviceip),
+			},
+			{
+				IpType:  TableEntryCache.InstanceNumber,
+				Address: net.ParseIP(instanceip),
+			},
+		},
+	}
+}
+
+type fakeNode struct {
+	proxy  *GoProxyTunnel
+	device *MemoryDevice
+	socket *MemorySocket
+}
+
+func newFakeNode(t *testing.T, memnet *MemoryNetwork, env *FakeClusterEnv, nodeip string) fakeNode {
+	socket, err := memnet.Listen(&net.UDPAddr{IP: net.ParseIP(nodeip), Port: 50103})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return startFakeNode(t, memnet, env, nodeip, socket, nil)
+}
+
+// startFakeNode runs a proxy on the given socket, the setup function is called before the proxy starts listening
+func startFakeNode(t *testing.T, memnet *MemoryNetwork, env *FakeClusterEnv, nodeip string, socket *MemorySocket, setup func(proxy *GoProxyTunnel)) fakeNode {
+	config := Configuration{
+		HostTUNDeviceName:         "goProxyTun",
+		TunNetIP:                  "10.19.1.254",
+		ProxySubnetwork:           "10.30.0.0",
+		ProxySubnetworkMask:       "255.255.0.0",
+		TunnelPort:                50103,
+		Mtusize:                   1450,
+		TunNetIPv6:                "fcef::dead:beef",
+		ProxySubnetworkIPv6:       "fc00::",
+		ProxySubnetworkIPv6Prefix: 7,
+	}
+	device := NewMemoryDevice("goProxyTun")
+	proxy := NewWithTransport(config, net.ParseIP(nodeip), device, socket, memnet.Dialer(net.ParseIP(nodeip)))
+	proxy.SetEnvironment(env)
+	if setup != nil {
+		setup(proxy)
+	}
+	proxy.Listen()
+	t.Cleanup(func() {
+		_ = socket.Close()
+		_ = device.Close()
+	})
+	return fakeNode{proxy: proxy, device: device, socket: socket}
+}
+
+func serializeTestPacket(t *testing.T, srcIP string, dstIP string, transport gopacket.SerializableLayer, payload []byte) []byte {
+	ip := &layers.IPv4{
+		Version: 4,
+		TTL:     64,
+		SrcIP:   net.ParseIP(srcIP).To4(),
+		DstIP:   net.ParseIP(dstIP).To4(),
+	}
+	switch l := transport.(type) {
+	case *layers.TCP:
+		ip.Protocol = layers.IPProtocolTCP
+		_ = l.SetNetworkLayerForChecksum(ip)
+	case *layers.UDP:
+		ip.Protocol = layers.IPProtocolUDP
+		_ = l.SetNetworkLayerForChecksum(ip)
+	}
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, ip, transport, gopacket.Payload(payload)); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func assertDelivered(t *testing.T, device *MemoryDevice, srcIP string, dstIP string, srcPort int, dstPort int, payload []byte) {
+	t.Helper()
+	raw, err := device.Receive(2 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet := gopacket.NewPacket(raw, layers.LayerTypeIPv4, gopacket.Default)
+	ipv4, ok := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	if !ok {
+		t.Fatal("delivered packet is not IPv4")
+	}
+	if !ipv4.SrcIP.Equal(net.ParseIP(srcIP)) || !ipv4.DstIP.Equal(net.ParseIP(dstIP)) {
+		t.Errorf("delivered %s ---> %s; want %s ---> %s", ipv4.SrcIP, ipv4.DstIP, srcIP, dstIP)
+	}
+	var gotSrc, gotDst int
+	var gotPayload []byte
+	if tcp, ok := packet.Layer(layers.LayerTypeTCP).(*layers.TCP); ok {
+		gotSrc, gotDst, gotPayload = int(tcp.SrcPort), int(tcp.DstPort), tcp.Payload
+	} else if udp, ok := packet.Layer(layers.LayerTypeUDP).(*layers.UDP); ok {
+		gotSrc, gotDst, gotPayload = int(udp.SrcPort), int(udp.DstPort), udp.Payload
+	} else {
+		t.Fatal("delivered packet is neither TCP nor UDP")
+	}
+	if gotSrc != srcPort || gotDst != dstPort {
+		t.Errorf("delivered ports %d ---> %d; want %d ---> %d", gotSrc, gotDst, srcPort, dstPort)
+	}
+	if !bytes.Equal(gotPayload, payload) {
+		t.Errorf("delivered payload %q; want %q", gotPayload, payload)
+	}
+}
+
+// Two nodes running in memory. The client on node A calls the ServiceIP of the server deployed on node B.
+func getFakeCluster(t *testing.T) (fakeNode, fakeNode) {
+	memnet := NewMemoryNetwork()
+	env := &FakeClusterEnv{entries: []TableEntryCache.TableEntry{
+		fakeClusterEntry("client", "10.0.0.1", "10.19.1.2", "10.30.0.2", "10.30.1.2"),
+		fakeClusterEntry("server", "10.0.0.2", "10.19.2.2", "10.30.0.3", "10.30.255.255"),
+	}}
+	return newFakeNode(t, memnet, env, "10.0.0.1"), newFakeNode(t, memnet, env, "10.0.0.2")
+}
+
+func TestDataPlaneTCP(t *testing.T) {
+	nodeA, nodeB := getFakeCluster(t)
+
+	request := []byte("GET / HTTP/1.1")
+	nodeA.device.Inject(serializeTestPacket(t, "10.19.1.2", "10.30.255.255",
+		&layers.TCP{SrcPort: 1000, DstPort: 80, PSH: true, ACK: true, Window: 1024}, request))
+	// the server receives the packet from the client instance IP
+	assertDelivered(t, nodeB.device, "10.30.0.2", "10.19.2.2", 1000, 80, request)
+
+	response := []byte("HTTP/1.1 200 OK")
+	nodeB.device.Inject(serializeTestPacket(t, "10.19.2.2", "10.30.0.2",
+		&layers.TCP{SrcPort: 80, DstPort: 1000, PSH: true, ACK: true, Window: 1024}, response))
+	// the client receives the response from the ServiceIP it called
+	assertDelivered(t, nodeA.device, "10.30.255.255", "10.19.1.2", 80, 1000, response)
+}
+
+func TestDataPlaneUDP(t *testing.T) {
+	nodeA, nodeB := getFakeCluster(t)
+
+	request := []byte("ping")
+	nodeA.device.Inject(serializeTestPacket(t, "10.19.1.2", "10.30.255.255",
+		&layers.UDP{SrcPort: 2000, DstPort: 53}, request))
+	assertDelivered(t, nodeB.device, "10.30.0.2", "10.19.2.2", 2000, 53, request)
+
+	response := []byte("pong")
+	nodeB.device.Inject(serializeTestPacket(t, "10.19.2.2", "10.30.0.2",
+		&layers.UDP{SrcPort: 53, DstPort: 2000}, response))
+	assertDelivered(t, nodeA.device, "10.30.255.255", "10.19.1.2", 53, 2000, response)
+}
+
+// fakeSignallingBus delivers the hole punching requests between the in-memory nodes
+type fakeSignallingBus struct {
+	nodes    map[string]*GoProxyTunnel
+	disabled bool
+	lock     sync.RWMutex
+}
+
+type fakeSignalling struct {
+	bus    *fakeSignallingBus
+	nodeid string
+}
+
+func (signalling fakeSignalling) RequestHolePunching(peer string, endpoints []*net.UDPAddr, key []byte) error {
+	signalling.bus.lock.RLock()
+	target, exist := signalling.bus.nodes[peer]
+	disabled := signalling.bus.disabled
+	signalling.bus.lock.RUnlock()
+	if !exist || disabled {
+		return errors.New("signalling unavailable")
+	}
+	target.HandleHolePunchingRequest(signalling.nodeid, endpoints, key)
+	return nil
+}
+
+type fakeNatCluster struct {
+	memnet *MemoryNetwork
+	bus    *fakeSignallingBus
+	relay  fakeNode
+	nodeA  fakeNode
+	nodeB  fakeNode
+}
+
+func newFakeNatNode(t *testing.T, cluster *fakeNatCluster, env *FakeClusterEnv, nodeid string, privateip string, publicip string, relay bool) fakeNode {
+	var socket *MemorySocket
+	var err error
+	if publicip == "" {
+		socket, err = cluster.memnet.Listen(&net.UDPAddr{IP: net.ParseIP(privateip), Port: 50103})
+	} else {
+		socket, err = cluster.memnet.ListenBehindNat(&net.UDPAddr{IP: net.ParseIP(privateip), Port: 50103}, net.ParseIP(publicip))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := NatConfiguration{
+		NodeID:            nodeid,
+		RelayAddress:      "10.0.0.254:50103",
+		RelayID:           "relay",
+		Relay:             relay,
+		KeepaliveInterval: 50 * time.Millisecond,
+		PunchTimeout:      500 * time.Millisecond,
+	}
+	node := startFakeNode(t, cluster.memnet, env, privateip, socket, func(proxy *GoProxyTunnel) {
+		if err := proxy.EnableNatTraversal(config, fakeSignalling{bus: cluster.bus, nodeid: nodeid}); err != nil {
+			t.Fatal(err)
+		}
+	})
+	cluster.bus.lock.Lock()
+	cluster.bus.nodes[nodeid] = node.proxy
+	cluster.bus.lock.Unlock()
+	return node
+}
+
+// Node A and node B behind two different NATs, advertising their private addresses. The relay node is reachable by both.
+func getFakeNatCluster(t *testing.T) *fakeNatCluster {
+	cluster := &fakeNatCluster{
+		memnet: NewMemoryNetwork(),
+		bus:    &fakeSignallingBus{nodes: make(map[string]*GoProxyTunnel)},
+	}
+	client := fakeClusterEntry("client", "192.168.1.2", "10.19.1.2", "10.30.0.2", "10.30.1.2")
+	client.Nodeid = "worker-a"
+	server := fakeClusterEntry("server", "192.168.2.2", "10.19.2.2", "10.30.0.3", "10.30.255.255")
+	server.Nodeid = "worker-b"
+	env := &FakeClusterEnv{entries: []TableEntryCache.TableEntry{client, server}}
+
+	cluster.relay = newFakeNatNode(t, cluster, env, "relay", "10.0.0.254", "", true)
+	cluster.nodeA = newFakeNatNode(t, cluster, env, "worker-a", "192.168.1.2", "1.1.1.1", false)
+	cluster.nodeB = newFakeNatNode(t, cluster, env, "worker-b", "192.168.2.2", "2.2.2.2", false)
+	for _, node := range []fakeNode{cluster.nodeA, cluster.nodeB} {
+		waitFor(t, func() bool {
+			return len(node.proxy.nat.localCandidates()) > 0
+		}, "the node did not register to the relay")
+	}
+	return cluster
+}
+
+func waitFor(t *testing.T, condition func() bool, message string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal(message)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// peerStatus returns the state and the endpoint of the connection towards the peer
+func peerStatus(proxy *GoProxyTunnel, peerID string) (peerState, string) {
+	peer := proxy.getPeerConnection(peerID, true)
+	peer.lock.Lock()
+	defer peer.lock.Unlock()
+	return peer.state, peer.endpoint.String()
+}
+
+func sendRequest(t *testing.T, cluster *fakeNatCluster, payload []byte) {
+	cluster.nodeA.device.Inject(serializeTestPacket(t, "10.19.1.2", "10.30.255.255",
+		&layers.UDP{SrcPort: 2000, DstPort: 8080}, payload))
+}
+
+func TestNatHolePunching(t *testing.T) {
+	cluster := getFakeNatCluster(t)
+
+	// the first packet goes through the relay while the nodes punch the holes
+	sendRequest(t, cluster, []byte("first"))
+	assertDelivered(t, cluster.nodeB.device, "10.30.0.2", "10.19.2.2", 2000, 8080, []byte("first"))
+
+	waitFor(t, func() bool {
+		state, endpoint := peerStatus(cluster.nodeA.proxy, "worker-b")
+		return state == peerDirect && endpoint == cluster.nodeB.socket.PublicAddr().String()
+	}, "node A did not establish a direct path towards node B")
+	waitFor(t, func() bool {
+		state, endpoint := peerStatus(cluster.nodeB.proxy, "worker-a")
+		return state == peerDirect && endpoint == cluster.nodeA.socket.PublicAddr().String()
+	}, "node B did not establish a direct path towards node A")
+
+	sendRequest(t, cluster, []byte("direct"))
+	assertDelivered(t, cluster.nodeB.device, "10.30.0.2", "10.19.2.2", 2000, 8080, []byte("direct"))
+	cluster.nodeB.device.Inject(serializeTestPacket(t, "10.19.2.2", "10.30.0.2",
+		&layers.UDP{SrcPort: 8080, DstPort: 2000}, []byte("response")))
+	assertDelivered(t, cluster.nodeA.device, "10.30.255.255", "10.19.1.2", 8080, 2000, []byte("response"))
+}
+
+func TestNatRelayFallback(t *testing.T) {
+	cluster := getFakeNatCluster(t)
+	// without signalling node B never opens its NAT towards node A
+	cluster.bus.lock.Lock()
+	cluster.bus.disabled = true
+	cluster.bus.lock.Unlock()
+
+	sendRequest(t, cluster, []byte("first"))
+	assertDelivered(t, cluster.nodeB.device, "10.30.0.2", "10.19.2.2", 2000, 8080, []byte("first"))
+
+	waitFor(t, func() bool {
+		state, _ := peerStatus(cluster.nodeA.proxy, "worker-b")
+		return state == peerIndirect
+	}, "the hole punching did not time out")
+
+	sendRequest(t, cluster, []byte("relayed"))
+	assertDelivered(t, cluster.nodeB.device, "10.30.0.2", "10.19.2.2", 2000, 8080, []byte("relayed"))
+	cluster.nodeB.device.Inject(serializeTestPacket(t, "10.19.2.2", "10.30.0.2",
+		&layers.UDP{SrcPort: 8080, DstPort: 2000}, []byte("response")))
+	assertDelivered(t, cluster.nodeA.device, "10.30.255.255", "10.19.1.2", 8080, 2000, []byte("response"))
+}
+
+func TestNatMappingChange(t *testing.T) {
+	cluster := getFakeNatCluster(t)
+	sendRequest(t, cluster, []byte("first"))
+	assertDelivered(t, cluster.nodeB.device, "10.30.0.2", "10.19.2.2", 2000, 8080, []byte("first"))
+	waitFor(t, func() bool {
+		state, _ := peerStatus(cluster.nodeA.proxy, "worker-b")
+		return state == peerDirect
+	}, "node A did not establish a direct path towards node B")
+	connection := cluster.nodeA.proxy.getPeerConnection("worker-b", true)
+
+	// the NAT of node B assigns a new public port, the packets keep flowing until the nodes punch the new mapping
+	cluster.memnet.Rebind(cluster.nodeB.socket)
+	waitFor(t, func() bool {
+		sendRequest(t, cluster, []byte("keepalive"))
+		state, endpoint := peerStatus(cluster.nodeA.proxy, "worker-b")
+		return state == peerDirect && endpoint == cluster.nodeB.socket.PublicAddr().String()
+	}, "node A did not learn the new mapping of node B")
+
+	if cluster.nodeA.proxy.getPeerConnection("worker-b", true) != connection {
+		t.Error("the connection towards node B was replaced")
+	}
+	for {
+		if _, err := cluster.nodeB.device.Receive(100 * time.Millisecond); err != nil {
+			break
+		}
+	}
+	sendRequest(t, cluster, []byte("after"))
+	assertDelivered(t, cluster.nodeB.device, "10.30.0.2", "10.19.2.2", 2000, 8080, []byte("after"))
+}
+
+// forgedControlPacket builds a control packet claiming to come from the node, with a MAC computed without its key
+func forgedControlPacket(kind byte, nodeid string, fields ...string) []byte {
+	counter := string(bytes.Repeat([]byte{0xFF}, 8))
+	content := encodeNatPacket(kind, append([]string{nodeid, counter}, fields...), nil)
+	return append(content, natMac(make([]byte, NAT_KEY_SIZE), make([]byte, NAT_KEY_SIZE), content)...)
+}
+
+func TestNatForgedControlPackets(t *testing.T) {
+	cluster := getFakeNatCluster(t)
+	sendRequest(t, cluster, []byte("first"))
+	assertDelivered(t, cluster.nodeB.device, "10.30.0.2", "10.19.2.2", 2000, 8080, []byte("first"))
+	waitFor(t, func() bool {
+		state, _ := peerStatus(cluster.nodeA.proxy, "worker-b")
+		return state == peerDirect
+	}, "node A did not establish a direct path towards node B")
+	attacker := &net.UDPAddr{IP: net.ParseIP("6.6.6.6"), Port: 50103}
+
+	// a probe claiming to come from node B does not move the direct path
+	cluster.nodeA.proxy.nat.handleControl(forgedControlPacket(natPunch, "worker-b"), attacker)
+	if _, endpoint := peerStatus(cluster.nodeA.proxy, "worker-b"); endpoint != cluster.nodeB.socket.PublicAddr().String() {
+		t.Errorf("the forged probe moved the path towards node B to %s", endpoint)
+	}
+
+	// the relay neither overwrites the registration of node A nor registers unknown nodes
+	relay := cluster.relay.proxy.nat
+	relay.handleControl(forgedControlPacket(natRegister, "worker-a"), attacker)
+	relay.handleControl(forgedControlPacket(natRegister, "intruder"), attacker)
+	relay.rwlock.RLock()
+	registration := relay.registrations["worker-a"]
+	_, intruder := relay.registrations["intruder"]
+	relay.rwlock.RUnlock()
+	if registration.endpoint.String() != cluster.nodeA.socket.PublicAddr().String() {
+		t.Errorf("the forged registration moved node A to %s", registration.endpoint.String())
+	}
+	if intruder {
+		t.Error("the relay registered an unknown node")
+	}
+	if _, exist := cluster.relay.proxy.lookupPeerConnection("intruder"); exist {
+		t.Error("the unknown node created a peer connection on the relay")
+	}
+
+	// the relay only forwards the packets of the registered nodes coming from their registered endpoint
+	for {
+		if _, err := cluster.nodeB.device.Receive(100 * time.Millisecond); err != nil {
+			break
+		}
+	}
+	tunneled := serializeTestPacket(t, "10.30.0.2", "10.19.2.2", &layers.UDP{SrcPort: 2000, DstPort: 8080}, []byte("spoofed"))
+	relay.handleControl(encodeNatPacket(natRelay, []string{"worker-a", "worker-b"}, tunneled), attacker)
+	relay.handleControl(encodeNatPacket(natRelay, []string{"intruder", "worker-b"}, tunneled), attacker)
+	if packet, err := cluster.nodeB.device.Receive(200 * time.Millisecond); err == nil {
+		t.Errorf("the relay forwarded a spoofed packet: %x", packet)
+	}
+	// node B only accepts the relayed packets coming from the relay
+	if payload := cluster.nodeB.proxy.nat.handleControl(encodeNatPacket(natRelay, []string{"worker-a", "worker-b"}, tunneled), attacker); payload != nil {
+		t.Error("node B accepted a relayed packet that did not come from the relay")
+	}
+}
+
+// newNatPair returns two nodes that exchanged their keys, without any socket
+func newNatPair() (*GoProxyTunnel, *GoProxyTunnel) {
+	nodes := make([]*GoProxyTunnel, 2)
+	for i, id := range []string{"worker-a", "worker-b"} {
+		nodes[i] = getFakeTunnel()
+		nodes[i].connectionBuffer = make(map[string]*peerConnection)
+		nodes[i].nat = &natTraversal{
+			proxy:         nodes[i],
+			config:        NatConfiguration{NodeID: id},
+			directPeers:   make(map[string]string),
+			registrations: make(map[string]relayRegistration),
+		}
+	}
+	peerOfA, peerOfB := nodes[0].getPeerConnection("worker-b", true), nodes[1].getPeerConnection("worker-a", true)
+	peerOfA.remoteKey = nodes[1].nat.localKey(peerOfB)
+	peerOfB.remoteKey = nodes[0].nat.localKey(peerOfA)
+	return nodes[0], nodes[1]
+}
+
+func TestNatSealedControlPackets(t *testing.T) {
+	nodeA, nodeB := newNatPair()
+	peerOfB := nodeB.getPeerConnection("worker-a", true)
+	seal := func(fields ...string) []byte {
+		peerOfB.lock.Lock()
+		defer peerOfB.lock.Unlock()
+		packet, ok := nodeB.nat.seal(peerOfB, natRegistered, fields...)
+		if !ok {
+			t.Fatal("unable to seal a packet with the exchanged keys")
+		}
+		return packet
+	}
+
+	packet := seal("1.1.1.1:50103")
+	peer, fields, err := nodeA.nat.open(packet, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if peer.id != "worker-b" || len(fields) != 1 || fields[0] != "1.1.1.1:50103" {
+		t.Errorf("unexpected packet of %s: %v", peer.id, fields)
+	}
+	if _, _, err := nodeA.nat.open(packet, 1); !errors.Is(err, errNatReplayed) {
+		t.Errorf("the replayed packet was not rejected: %v", err)
+	}
+
+	tampered := seal("1.1.1.1:50103")
+	tampered[len(tampered)-sha256.Size-1] ^= 0xFF
+	if _, _, err := nodeA.nat.open(tampered, 1); !errors.Is(err, errNatUnauthenticated) {
+		t.Errorf("the tampered packet was not rejected: %v", err)
+	}
+	if _, _, err := nodeA.nat.open(forgedControlPacket(natRegistered, "worker-b", "6.6.6.6:1"), 1); !errors.Is(err, errNatUnauthenticated) {
+		t.Errorf("the forged packet was not rejected: %v", err)
+	}
+	if _, _, err := nodeA.nat.open(forgedControlPacket(natRegistered, "intruder", "6.6.6.6:1"), 1); !errors.Is(err, errNatUnknownPeer) {
+		t.Errorf("the packet of an unknown node was not rejected: %v", err)
+	}
+
+	// node B restarts with a new key, its previous packets are no longer accepted
+	nodeB.connectionBuffer = make(map[string]*peerConnection)
+	restarted := nodeB.getPeerConnection("worker-a", true)
+	restarted.remoteKey = nodeA.getPeerConnection("worker-b", true).localKey
+	peerOfA := nodeA.getPeerConnection("worker-b", true)
+	peerOfA.remoteKey = nodeB.nat.localKey(restarted)
+	peerOfA.recvCounter = 0
+	if _, _, err := nodeA.nat.open(packet, 1); !errors.Is(err, errNatUnauthenticated) {
+		t.Errorf("the packet sealed with the previous key was accepted: %v", err)
+	}
+}
+
+func TestNodeAddressChange(t *testing.T) {
+	memnet := NewMemoryNetwork()
+	env := &FakeClusterEnv{entries: []TableEntryCache.TableEntry{
+		fakeClusterEntry("client", "10.0.0.1", "10.19.1.2", "10.30.0.2", "10.30.1.2"),
+		fakeClusterEntry("server", "10.0.0.2", "10.19.2.2", "10.30.0.3", "10.30.255.255"),
+	}}
+	nodeA, nodeB := newFakeNode(t, memnet, env, "10.0.0.1"), newFakeNode(t, memnet, env, "10.0.0.2")
+	request := func(payload []byte) {
+		nodeA.device.Inject(serializeTestPacket(t, "10.19.1.2", "10.30.255.255",
+			&layers.UDP{SrcPort: 2000, DstPort: 8080}, payload))
+	}
+	request([]byte("before"))
+	assertDelivered(t, nodeB.device, "10.30.0.2", "10.19.2.2", 2000, 8080, []byte("before"))
+
+	// node B moves to another network, the cluster advertises its new address
+	newAddress := &net.UDPAddr{IP: net.ParseIP("10.0.1.2"), Port: 50103}
+	nodeB.proxy.listen = func() (TunnelSocket, error) {
+		socket, err := memnet.Listen(newAddress)
+		if err == nil {
+			t.Cleanup(func() { _ = socket.Close() })
+		}
+		return socket, err
+	}
+	nodeB.proxy.dialer = memnet.Dialer(newAddress.IP)
+	if err := nodeB.proxy.UpdateLocalAddress(newAddress.IP, nil); err != nil {
+		t.Fatal(err)
+	}
+	env.entries[1].Nodeip = newAddress.IP
+
+	if _, _, err := nodeB.socket.ReadFromUDP(make([]byte, 10)); !errors.Is(err, net.ErrClosed) {
+		t.Error("the socket of the previous address is still open")
+	}
+	request([]byte("after"))
+	assertDelivered(t, nodeB.device, "10.30.0.2", "10.19.2.2", 2000, 8080, []byte("after"))
+	nodeB.device.Inject(serializeTestPacket(t, "10.19.2.2", "10.30.0.2",
+		&layers.UDP{SrcPort: 8080, DstPort: 2000}, []byte("response")))
+	assertDelivered(t, nodeA.device, "10.30.255.255", "10.19.1.2", 8080, 2000, []byte("response"))
+}
@@ -2,11 +2,14 @@ package proxy
 
 import (
 	"NetManager/TableEntryCache"
+	"NetManager/env"
+	"NetManager/mqtt"
 	"NetManager/proxy/iputils"
 	"encoding/hex"
-	"math/rand"
+	"fmt"
 	"net"
 	"testing"
+	"time"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
@@ -77,11 +80,17 @@ func (fakeenv *FakeEnv) GetTableEntryByInstanceIP(ip net.IP) (TableEntryCache.Ta
 	return TableEntryCache.TableEntry{}, false
 }
 
-func getFakeTunnel() GoProxyTunnel {
-	tunnel := GoProxyTunnel{
-		tunNetIP:    "10.19.1.254",
-		ifce:        nil,
-		isListening: true,
+func (fakeenv *FakeEnv) GetDrainingInstances() []TableEntryCache.TableEntry {
+	return nil
+}
+
+func (fakeenv *FakeEnv) ReleaseDrainingInstance(nsip net.IP) {
+}
+
+func getFakeTunnel() *GoProxyTunnel {
+	tunnel := &GoProxyTunnel{
+		tunNetIP: "10.19.1.254",
+		ifce:     nil,
 		ProxyIpSubnetwork: net.IPNet{
 			IP:   net.ParseIP("10.30.0.0"),
 			Mask: net.IPMask(net.ParseIP("255.255.0.0").To4()),
@@ -90,13 +99,15 @@ func getFakeTunnel() GoProxyTunnel {
 		TunnelPort:        50011,
 		listenConnection:  nil,
 		proxycache:        NewProxyCache(),
-		randseed:          rand.New(rand.NewSource(42)),
+		affinity:          NewSessionAffinityTable(),
+		balancer:          NewWeightedRoundRobin(),
 		tunNetIPv6:        "fdfe::1337",
 		ProxyIPv6Subnetwork: net.IPNet{
 			IP:   net.ParseIP("fdff::"),
 			Mask: net.CIDRMask(16, 128),
 		},
 	}
+	tunnel.isListening.Store(true)
 	tunnel.SetEnvironment(&FakeEnv{})
 	return tunnel
 }
@@ -282,3 +293,352 @@ func TestIPv6NextHeader(t *testing.T) {
 		t.Error("Failed to detect TCP Header in IPv6 Next Header field.")
 	}
 }
+
+// FakeServiceEnv serves a ServiceIP backed by multiple instances
+type FakeServiceEnv struct {
+	FakeEnv
+	entries []TableEntryCache.TableEntry
+}
+
+func newFakeServiceEnv(affinity TableEntryCache.AffinityMode, instances int) *FakeServiceEnv {
+	env := &FakeServiceEnv{entries: make([]TableEntryCache.TableEntry, 0)}
+	for i := 0; i < instances; i++ {
+		env.entries = append(env.entries, TableEntryCache.TableEntry{
+			Appname:          "a",
+			Appns:            "a",
+			Servicename:      "b",
+			Servicenamespace: "b",
+			Instancenumber:   i,
+			Nodeip:           net.ParseIP("10.0.0.1"),
+			Nsip:             net.IPv4(10, 19, 2, byte(10+i)),
+			Nsipv6:           net.ParseIP(fmt.Sprintf("fd00::%d", 10+i)),
+			ServiceIP: []TableEntryCache.ServiceIP{{
+				IpType:     TableEntryCache.RoundRobin,
+				Address:    net.ParseIP("10.30.255.255"),
+				Address_v6: net.ParseIP("fdff:1000::ff"),
+				Affinity:   affinity,
+			}},
+		})
+	}
+	return env
+}
+
+func (fakeenv *FakeServiceEnv) GetTableEntryByServiceIP(ip net.IP) []TableEntryCache.TableEntry {
+	return fakeenv.entries
+}
+
+func (fakeenv *FakeServiceEnv) GetDrainingInstances() []TableEntryCache.TableEntry {
+	result := make([]TableEntryCache.TableEntry, 0)
+	for _, entry := range fakeenv.entries {
+		if entry.IsDraining() {
+			result = append(result, entry)
+		}
+	}
+	return result
+}
+
+func (fakeenv *FakeServiceEnv) ReleaseDrainingInstance(nsip net.IP) {
+	fakeenv.removeInstance(nsip)
+}
+
+func (fakeenv *FakeServiceEnv) removeInstance(nsip net.IP) {
+	for i, entry := range fakeenv.entries {
+		if entry.Nsip.Equal(nsip) {
+			fakeenv.entries = append(fakeenv.entries[:i], fakeenv.entries[i+1:]...)
+			return
+		}
+	}
+}
+
+func proxiedDestination(t *testing.T, proxy *GoProxyTunnel, srcIP string, srcPort int, dstPort int) net.IP {
+	_, ip, tcp := getFakePacket(srcIP, "10.30.255.255", srcPort, dstPort)
+	newpacket := proxy.outgoingProxy(ip, tcp)
+	if newpacket == nil {
+		t.Fatal("Packet should be proxied")
+	}
+	return newpacket.Layer(layers.LayerTypeIPv4).(*layers.IPv4).DstIP
+}
+
+func TestSessionAffinitySourceIPDestPort(t *testing.T) {
+	proxy := getFakeTunnel()
+	proxy.SetEnvironment(newFakeServiceEnv(TableEntryCache.AffinitySourceIPDestPort, 5))
+
+	first := proxiedDestination(t, proxy, "10.19.1.1", 1000, 80)
+	for srcport := 1001; srcport < 1050; srcport++ {
+		dst := proxiedDestination(t, proxy, "10.19.1.1", srcport, 80)
+		if !dst.Equal(first) {
+			t.Fatal("dstIP = ", dst.String(), "; want =", first.String())
+		}
+	}
+
+	// the binding must survive the eviction of the proxy cache
+	proxy.proxycache = NewProxyCache()
+	dst := proxiedDestination(t, proxy, "10.19.1.1", 2000, 80)
+	if !dst.Equal(first) {
+		t.Error("dstIP after cache eviction = ", dst.String(), "; want =", first.String())
+	}
+}
+
+func TestSessionAffinityRebalance(t *testing.T) {
+	proxy := getFakeTunnel()
+	env := newFakeServiceEnv(TableEntryCache.AffinitySourceIPDestPort, 5)
+	proxy.SetEnvironment(env)
+
+	before := make(map[int]net.IP)
+	for client := 1; client < 100; client++ {
+		before[client] = proxiedDestination(t, proxy, fmt.Sprintf("10.19.1.%d", client), 1000, 80)
+	}
+
+	// the bindings are kept, only the clients of the removed instance are rebalanced
+	removed := env.entries[2].Nsip
+	env.removeInstance(removed)
+
+	moved := make(map[string]bool)
+	for client := 1; client < 100; client++ {
+		after := proxiedDestination(t, proxy, fmt.Sprintf("10.19.1.%d", client), 1001, 80)
+		if after.Equal(removed) {
+			t.Fatal("flow routed to a removed instance")
+		}
+		if !before[client].Equal(removed) && !after.Equal(before[client]) {
+			t.Error("client ", client, " moved from ", before[client].String(), " to ", after.String())
+		}
+		if before[client].Equal(removed) {
+			moved[after.String()] = true
+			// rebound to the new instance
+			if again := proxiedDestination(t, proxy, fmt.Sprintf("10.19.1.%d", client), 1002, 80); !again.Equal(after) {
+				t.Error("client ", client, " not pinned to ", after.String(), " after the rebalance")
+			}
+		}
+	}
+	if len(moved) < 2 {
+		t.Error("clients of the removed instance should be spread across the remaining instances")
+	}
+}
+
+func TestSessionAffinityNone(t *testing.T) {
+	proxy := getFakeTunnel()
+	proxy.SetEnvironment(newFakeServiceEnv(TableEntryCache.AffinityNone, 5))
+
+	destinations := make(map[string]bool)
+	for srcport := 1000; srcport < 1050; srcport++ {
+		destinations[proxiedDestination(t, proxy, "10.19.1.1", srcport, 80).String()] = true
+	}
+	if len(destinations) < 2 {
+		t.Error("flows without affinity should be balanced across the instances")
+	}
+}
+
+func TestSessionAffinityEvictionJob(t *testing.T) {
+	table := NewSessionAffinityTable()
+	table.Bind("10.30.0.1|10.19.1.1", net.ParseIP("10.19.1.2"), time.Millisecond)
+	table.runEvictionJob(5 * time.Millisecond)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		table.rwlock.RLock()
+		bindings := len(table.bindings)
+		table.rwlock.RUnlock()
+		if bindings == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the expired binding was not evicted")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// once stopped the bindings are kept, and the job can be started again
+	table.stopEvictionJob()
+	table.stopEvictionJob()
+	table.Bind("10.30.0.1|10.19.1.1", net.ParseIP("10.19.1.2"), time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	table.rwlock.RLock()
+	bindings := len(table.bindings)
+	table.rwlock.RUnlock()
+	if bindings != 1 {
+		t.Error("the stopped eviction job removed a binding")
+	}
+	table.runEvictionJob(5 * time.Millisecond)
+	table.stopEvictionJob()
+}
+
+func setWeight(entry *TableEntryCache.TableEntry, weight int) {
+	entry.Weight = &weight
+}
+
+func TestWeightedRoundRobin(t *testing.T) {
+	proxy := getFakeTunnel()
+	env := newFakeServiceEnv(TableEntryCache.AffinityNone, 3)
+	setWeight(&env.entries[0], 1)
+	setWeight(&env.entries[1], 2)
+	setWeight(&env.entries[2], 3)
+	proxy.SetEnvironment(env)
+
+	counts := make(map[string]int)
+	for srcport := 1000; srcport < 1060; srcport++ {
+		counts[proxiedDestination(t, proxy, "10.19.1.1", srcport, 80).String()]++
+	}
+	for i, want := range []int{10, 20, 30} {
+		if got := counts[env.entries[i].Nsip.String()]; got != want {
+			t.Error("flows to instance ", i, " = ", got, "; want =", want)
+		}
+	}
+}
+
+func TestWeightedRoundRobinLoadHint(t *testing.T) {
+	proxy := getFakeTunnel()
+	env := newFakeServiceEnv(TableEntryCache.AffinityNone, 2)
+	setWeight(&env.entries[0], 2)
+	env.entries[0].LoadHint = 0.5
+	proxy.SetEnvironment(env)
+
+	counts := make(map[string]int)
+	for srcport := 1000; srcport < 1040; srcport++ {
+		counts[proxiedDestination(t, proxy, "10.19.1.1", srcport, 80).String()]++
+	}
+	if counts[env.entries[0].Nsip.String()] != 20 || counts[env.entries[1].Nsip.String()] != 20 {
+		t.Error("half loaded instance with double weight should receive the same flows, got ", counts)
+	}
+}
+
+func TestWeightZeroDrainsInstance(t *testing.T) {
+	proxy := getFakeTunnel()
+	env := newFakeServiceEnv(TableEntryCache.AffinityNone, 2)
+	proxy.SetEnvironment(env)
+
+	// open a flow towards each instance
+	existing := map[int]net.IP{
+		1000: proxiedDestination(t, proxy, "10.19.1.1", 1000, 80),
+		1001: proxiedDestination(t, proxy, "10.19.1.1", 1001, 80),
+	}
+	drained := env.entries[0].Nsip
+	setWeight(&env.entries[0], 0)
+
+	for srcport, dst := range existing {
+		if got := proxiedDestination(t, proxy, "10.19.1.1", srcport, 80); !got.Equal(dst) {
+			t.Error("existing flow moved from ", dst.String(), " to ", got.String())
+		}
+	}
+	for srcport := 2000; srcport < 2020; srcport++ {
+		if proxiedDestination(t, proxy, "10.19.1.1", srcport, 80).Equal(drained) {
+			t.Fatal("new flow routed to a draining instance")
+		}
+	}
+
+	// no new flows at all if every instance is draining
+	setWeight(&env.entries[1], 0)
+	_, ip, tcp := getFakePacket("10.19.1.1", "10.30.255.255", 3000, 80)
+	if proxy.outgoingProxy(ip, tcp) != nil {
+		t.Error("Packet should not be proxied")
+	}
+}
+
+func TestDrainingInstance(t *testing.T) {
+	proxy := getFakeTunnel()
+	fakeenv := newFakeServiceEnv(TableEntryCache.AffinityNone, 2)
+	var environment env.EnvironmentManager = fakeenv
+	proxy.SetEnvironment(environment)
+
+	existing := proxiedDestination(t, proxy, "10.19.1.1", 1000, 80)
+	var draining *TableEntryCache.TableEntry
+	for i := range fakeenv.entries {
+		if fakeenv.entries[i].Nsip.Equal(existing) {
+			draining = &fakeenv.entries[i]
+		}
+	}
+	// the instance is removed from the service by a table refresh
+	draining.DrainingUntil = time.Now().Add(time.Minute)
+
+	if got := proxiedDestination(t, proxy, "10.19.1.1", 1000, 80); !got.Equal(existing) {
+		t.Error("existing flow moved from ", existing.String(), " to ", got.String())
+	}
+	for srcport := 2000; srcport < 2010; srcport++ {
+		if proxiedDestination(t, proxy, "10.19.1.1", srcport, 80).Equal(existing) {
+			t.Fatal("new flow routed to a draining instance")
+		}
+	}
+
+	// the instance is in use, it must be kept
+	proxy.releaseDrainedInstances()
+	if len(environment.GetDrainingInstances()) != 1 {
+		t.Fatal("draining instance with active flows released")
+	}
+
+	// flows closed and evicted from the cache, the instance is released
+	proxy.proxycache = NewProxyCache()
+	proxy.releaseDrainedInstances()
+	if len(environment.GetDrainingInstances()) != 0 || len(fakeenv.entries) != 1 {
+		t.Error("draining instance without flows not released")
+	}
+}
+
+// FakeTableQuery answers the table queries of a real environment with the instances of each job
+type FakeTableQuery struct {
+	jobs map[string][]mqtt.ServiceInstance
+}
+
+func (fakequery *FakeTableQuery) TableQueryByIpRequestBlocking(sip string, force_optional ...bool) (mqtt.TableQueryResponse, error) {
+	return mqtt.TableQueryResponse{}, fmt.Errorf("unknown address %s", sip)
+}
+
+func (fakequery *FakeTableQuery) TableQueryByJobNameRequestBlocking(sname string, force_optional ...bool) (mqtt.TableQueryResponse, error) {
+	return mqtt.TableQueryResponse{JobName: sname, InstanceList: fakequery.jobs[sname], QueryKey: sname}, nil
+}
+
+func fakeServiceInstance(instance int, nsip string, nsipv6 string, sip mqtt.Sip) mqtt.ServiceInstance {
+	return mqtt.ServiceInstance{
+		InstanceNumber: instance,
+		NamespaceIp:    nsip,
+		NamespaceIpv6:  nsipv6,
+		WorkerID:       "node",
+		HostIp:         "10.0.0.1",
+		HostPort:       50011,
+		ServiceIp:      []mqtt.Sip{sip},
+	}
+}
+
+func TestDrainingInstanceThroughEnvironment(t *testing.T) {
+	roundRobin := mqtt.Sip{Type: "RR", Address: "10.30.255.255", Address_v6: "fdff:1000::ff"}
+	instances := []mqtt.ServiceInstance{
+		fakeServiceInstance(0, "10.19.2.10", "fd00::10", roundRobin),
+		fakeServiceInstance(1, "10.19.2.11", "fd00::11", roundRobin),
+	}
+	tablequery := &FakeTableQuery{jobs: map[string][]mqtt.ServiceInstance{
+		"a.a.c.b": {fakeServiceInstance(0, "10.19.1.1", "fc00::1", mqtt.Sip{Type: "InstanceNumber", Address: "10.30.255.253", Address_v6: "fdff::fd"})},
+		"a.a.b.b": instances,
+	}}
+	environment := env.NewTranslationEnvironment(env.Configuration{DrainingGracePeriod: time.Minute}, tablequery)
+	environment.RefreshServiceTable("a.a.c.b")
+	environment.RefreshServiceTable("a.a.b.b")
+	proxy := getFakeTunnel()
+	proxy.SetEnvironment(environment)
+
+	// an IPv6 flow is translated towards the IPv6 address of the instance
+	_, ip, tcp := getFakeV6Packet("fc00::1", "fdff:1000::ff", 1000, 80)
+	newpacket := proxy.outgoingProxy(ip, tcp)
+	if newpacket == nil {
+		t.Fatal("Packet should be proxied")
+	}
+	existing := newpacket.Layer(layers.LayerTypeIPv6).(*layers.IPv6).DstIP
+
+	// the instance of the flow is removed from the service
+	for i, instance := range instances {
+		if net.ParseIP(instance.NamespaceIpv6).Equal(existing) {
+			tablequery.jobs["a.a.b.b"] = append(instances[:i:i], instances[i+1:]...)
+		}
+	}
+	environment.RefreshServiceTable("a.a.b.b")
+	if len(environment.GetDrainingInstances()) != 1 {
+		t.Fatal("removed instance not draining")
+	}
+
+	proxy.releaseDrainedInstances()
+	if len(environment.GetDrainingInstances()) != 1 {
+		t.Fatal("draining instance with active IPv6 flows released")
+	}
+
+	proxy.proxycache = NewProxyCache()
+	proxy.releaseDrainedInstances()
+	if len(environment.GetDrainingInstances()) != 0 || len(environment.GetTableEntryByServiceIP(net.ParseIP("10.30.255.255"))) != 1 {
+		t.Error("draining instance without flows not released")
+	}
+}
@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"NetManager/logger"
+	"net"
+	"time"
+)
+
+// UpdateLocalAddress moves the proxy to the new address of the node.
+// The tunnel socket is opened again and the connections towards the other nodes are dialed again from the new address.
+// With the NAT traversal the direct paths are punched again, publicAddress replaces the endpoint advertised
+// to the other nodes unless nil, and the node registers again to the relay.
+func (proxy *GoProxyTunnel) UpdateLocalAddress(localIP net.IP, publicAddress *net.UDPAddr) error {
+	proxy.addressLock.Lock()
+	logger.InfoLogger().Printf("Proxy local address changed from %s to %s", proxy.localIP, localIP)
+	proxy.localIP = localIP
+	var err error
+	if proxy.listen != nil {
+		err = proxy.reopenTunnelSocket()
+	}
+	proxy.addressLock.Unlock()
+
+	proxy.resetPeerConnections()
+	if proxy.nat != nil {
+		proxy.nat.addressChanged(publicAddress)
+	}
+	return err
+}
+
+// reopenTunnelSocket replaces the tunnel socket, the address lock MUST be held by the caller
+func (proxy *GoProxyTunnel) reopenTunnelSocket() error {
+	if proxy.listenConnection != nil {
+		// the port is released before binding it again, the listener of the socket stops with it
+		_ = proxy.listenConnection.Close()
+	}
+	socket, err := proxy.listen()
+	if err != nil {
+		return err
+	}
+	proxy.listenConnection = socket
+	if proxy.IsListening() {
+		select {
+		case <-proxy.socketChannel:
+			// a socket already replaced before its listener started
+		default:
+		}
+		proxy.socketChannel <- socket
+	}
+	return nil
+}
+
+// resetPeerConnections closes the connections towards the other nodes, bound to the previous address
+func (proxy *GoProxyTunnel) resetPeerConnections() {
+	for _, peer := range proxy.peerConnections() {
+		peer.lock.Lock()
+		if proxy.nat != nil && peer.traversable {
+			// the NAT mappings of the previous address are gone, punch again at the next packet
+			proxy.nat.forgetDirectPeer(peer)
+			peer.state = peerIndirect
+			peer.punchStarted = time.Time{}
+			if peer.advertised != nil {
+				peer.setEndpoint(peer.advertised)
+			}
+		}
+		if peer.conn != nil {
+			_ = peer.conn.Close()
+			peer.conn = nil
+		}
+		peer.lock.Unlock()
+	}
+}
+
+// addressChanged forgets the endpoint observed by the relay and registers again from the new address
+func (nat *natTraversal) addressChanged(publicAddress *net.UDPAddr) {
+	nat.rwlock.Lock()
+	nat.publicEndpoint = nil
+	if publicAddress != nil {
+		nat.config.PublicAddress = publicAddress
+	}
+	nat.rwlock.Unlock()
+	nat.register()
+}
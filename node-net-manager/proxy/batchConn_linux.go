@@ -0,0 +1,242 @@
+//go:build linux
+
+package proxy
+
+import (
+	"NetManager/logger"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/sys/unix"
+)
+
+// maximum number of segments the kernel accepts in a single UDP GSO send
+const GSO_MAX_SEGMENTS = 64
+
+// batchConn is a UDP socket exchanging up to BATCH_SIZE datagrams per system call with recvmmsg and sendmmsg.
+// When the kernel supports it, consecutive datagrams towards the same destination are sent as a single
+// UDP GSO super-datagram, and the datagrams coalesced by UDP GRO on reception are split again.
+type batchConn struct {
+	*net.UDPConn
+	packetConn *ipv4.PacketConn
+	gso        atomic.Bool
+	gro        bool
+	readMsgs   []ipv4.Message
+	// datagrams already received but not yet returned by ReadBatch
+	pending   []incomingMessage
+	writeMsgs []ipv4.Message
+	readLock  sync.Mutex
+	writeLock sync.Mutex
+}
+
+// wrapUDPConn enables the batched I/O on the UDP socket
+func wrapUDPConn(conn *net.UDPConn) udpTunnelConn {
+	return newBatchConn(conn)
+}
+
+func newBatchConn(conn *net.UDPConn) *batchConn {
+	c := &batchConn{
+		UDPConn:    conn,
+		packetConn: ipv4.NewPacketConn(conn),
+		readMsgs:   make([]ipv4.Message, BATCH_SIZE),
+		pending:    make([]incomingMessage, 0, BATCH_SIZE),
+		writeMsgs:  make([]ipv4.Message, 0, BATCH_SIZE),
+	}
+	c.gso.Store(supportsGSO(conn))
+	c.gro = enableGRO(conn)
+	for i := range c.readMsgs {
+		c.readMsgs[i].Buffers = [][]byte{make([]byte, BUFFER_SIZE)}
+		c.readMsgs[i].OOB = make([]byte, unix.CmsgSpace(4))
+	}
+	logger.DebugLogger().Printf("Batched UDP I/O on %s, GSO: %v, GRO: %v", conn.LocalAddr(), c.gso.Load(), c.gro)
+	return c
+}
+
+func supportsGSO(conn *net.UDPConn) bool {
+	supported := false
+	_ = controlSocket(conn, func(fd int) {
+		_, err := unix.GetsockoptInt(fd, unix.IPPROTO_UDP, unix.UDP_SEGMENT)
+		supported = err == nil
+	})
+	return supported
+}
+
+func enableGRO(conn *net.UDPConn) bool {
+	enabled := false
+	_ = controlSocket(conn, func(fd int) {
+		enabled = unix.SetsockoptInt(fd, unix.IPPROTO_UDP, unix.UDP_GRO, 1) == nil
+	})
+	return enabled
+}
+
+func controlSocket(conn *net.UDPConn, f func(fd int)) error {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	return rawConn.Control(func(fd uintptr) {
+		f(int(fd))
+	})
+}
+
+// ReadBatch fills out with the received datagrams and returns how many were received
+func (c *batchConn) ReadBatch(out []incomingMessage) (int, error) {
+	c.readLock.Lock()
+	defer c.readLock.Unlock()
+	if len(c.pending) == 0 {
+		for i := range c.readMsgs {
+			c.readMsgs[i].OOB = c.readMsgs[i].OOB[:cap(c.readMsgs[i].OOB)]
+		}
+		n, err := c.packetConn.ReadBatch(c.readMsgs, 0)
+		if err != nil {
+			return 0, err
+		}
+		for i := 0; i < n; i++ {
+			c.splitDatagram(&c.readMsgs[i])
+		}
+	}
+	n := copy(out, c.pending)
+	c.pending = append(c.pending[:0], c.pending[n:]...)
+	return n, nil
+}
+
+// splitDatagram appends to the pending list the datagrams coalesced by GRO in the message
+func (c *batchConn) splitDatagram(msg *ipv4.Message) {
+	from, ok := msg.Addr.(*net.UDPAddr)
+	if !ok {
+		return
+	}
+	segment := msg.N
+	if c.gro {
+		if size := groSegmentSize(msg.OOB[:msg.NN]); size > 0 {
+			segment = size
+		}
+	}
+	for offset := 0; offset < msg.N; offset += segment {
+		end := min(offset+segment, msg.N)
+		content := make([]byte, end-offset)
+		copy(content, msg.Buffers[0][offset:end])
+		c.pending = append(c.pending, incomingMessage{
+			content: &content,
+			from:    *from,
+		})
+	}
+}
+
+func groSegmentSize(oob []byte) int {
+	messages, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0
+	}
+	for _, message := range messages {
+		if message.Header.Level == unix.IPPROTO_UDP && message.Header.Type == unix.UDP_GRO && len(message.Data) >= 4 {
+			return int(binary.NativeEndian.Uint32(message.Data))
+		}
+	}
+	return 0
+}
+
+// WriteBatch sends the datagrams on the connected socket
+func (c *batchConn) WriteBatch(buffers [][]byte) error {
+	return c.WriteBatchTo(buffers, nil)
+}
+
+// WriteBatchTo sends the datagrams towards addr, or towards the connected peer if addr is nil.
+// If the GSO send fails, e.g. the device does not support the checksum offload, GSO is disabled and the batch sent again.
+func (c *batchConn) WriteBatchTo(buffers [][]byte, addr *net.UDPAddr) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	for len(buffers) > 0 {
+		chunk := buffers[:min(len(buffers), BATCH_SIZE)]
+		sent, err := c.writeMessages(c.prepareMessages(chunk, addr))
+		// skip the datagrams already sent
+		buffers = buffers[sent:]
+		if err != nil && c.gso.Load() && isGSOError(err) {
+			logger.InfoLogger().Printf("UDP GSO not available on %s, falling back to single datagrams: %v", c.LocalAddr(), err)
+			c.gso.Store(false)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeMessages sends the messages and returns the number of datagrams sent
+func (c *batchConn) writeMessages(msgs []ipv4.Message) (int, error) {
+	sent := 0
+	for len(msgs) > 0 {
+		n, err := c.packetConn.WriteBatch(msgs, 0)
+		for _, msg := range msgs[:max(n, 0)] {
+			sent += len(msg.Buffers)
+		}
+		if err != nil {
+			return sent, err
+		}
+		msgs = msgs[n:]
+	}
+	return sent, nil
+}
+
+// prepareMessages builds a message for each datagram or, with GSO, for each group of consecutive datagrams with the
+// same size. Only the last datagram of a group can be shorter, as the kernel splits the super-datagram in equal segments.
+func (c *batchConn) prepareMessages(buffers [][]byte, addr *net.UDPAddr) []ipv4.Message {
+	msgs := c.writeMsgs[:0]
+	var netAddr net.Addr
+	if addr != nil {
+		netAddr = addr
+	}
+	if !c.gso.Load() {
+		for _, buffer := range buffers {
+			msgs = append(msgs, ipv4.Message{Buffers: [][]byte{buffer}, Addr: netAddr})
+		}
+		c.writeMsgs = msgs
+		return msgs
+	}
+	for i := 0; i < len(buffers); {
+		segment := len(buffers[i])
+		total := segment
+		j := i + 1
+		for j < len(buffers) && j-i < GSO_MAX_SEGMENTS && len(buffers[j]) <= segment && total+len(buffers[j]) <= BUFFER_SIZE-1024 {
+			total += len(buffers[j])
+			j++
+			if len(buffers[j-1]) < segment {
+				break
+			}
+		}
+		msg := ipv4.Message{Buffers: buffers[i:j], Addr: netAddr}
+		if j-i > 1 {
+			msg.OOB = gsoControlMessage(segment)
+		}
+		msgs = append(msgs, msg)
+		i = j
+	}
+	c.writeMsgs = msgs
+	return msgs
+}
+
+// gsoControlMessage returns the UDP_SEGMENT control message with the given segment size
+func gsoControlMessage(segment int) []byte {
+	oob := make([]byte, unix.CmsgSpace(2))
+	header := (*unix.Cmsghdr)(unsafe.Pointer(&oob[0]))
+	header.Level = unix.IPPROTO_UDP
+	header.Type = unix.UDP_SEGMENT
+	header.SetLen(unix.CmsgLen(2))
+	binary.NativeEndian.PutUint16(oob[unix.CmsgLen(0):], uint16(segment))
+	return oob
+}
+
+func isGSOError(err error) bool {
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return false
+	}
+	return errno == unix.EIO || errno == unix.EINVAL || errno == unix.EOPNOTSUPP
+}
@@ -0,0 +1,195 @@
+//go:build linux
+
+package proxy
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Packets per second exchanged on the loopback interface by the tunnel sockets, before and after the batched I/O:
+//
+//	go test ./proxy/ -run NONE -bench Tunnel -benchtime 200000x
+//
+// BenchmarkTunnelSingle sends and reads one datagram per system call, like the proxy did before the batched I/O.
+// BenchmarkTunnelBatch uses sendmmsg and recvmmsg, with UDP GSO and GRO when the kernel supports them.
+// BenchmarkTunnelBatchNoGSO uses sendmmsg and recvmmsg only.
+// Each benchmark reports the packets per second (pps) delivered from the sender to the receiver.
+
+const benchmarkPacketSize = 1400
+
+func listenLoopback(t testing.TB) *net.UDPConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadBuffer(4 * 1024 * 1024)
+	_ = conn.SetWriteBuffer(4 * 1024 * 1024)
+	t.Cleanup(func() { _ = conn.Close() })
+	return conn
+}
+
+func testDatagrams(count int, size int) [][]byte {
+	result := make([][]byte, count)
+	for i := range result {
+		result[i] = bytes.Repeat([]byte{byte(i)}, size)
+	}
+	return result
+}
+
+func receiveBatch(t *testing.T, receiver *batchConn, count int) [][]byte {
+	result := make([][]byte, 0, count)
+	messages := make([]incomingMessage, BATCH_SIZE)
+	_ = receiver.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for len(result) < count {
+		n, err := receiver.ReadBatch(messages)
+		if err != nil {
+			t.Fatalf("received %d datagrams out of %d: %v", len(result), count, err)
+		}
+		for _, msg := range messages[:n] {
+			result = append(result, *msg.content)
+		}
+	}
+	return result
+}
+
+func testBatchRoundTrip(t *testing.T, gso bool) {
+	sender := newBatchConn(listenLoopback(t))
+	receiver := newBatchConn(listenLoopback(t))
+	sender.gso.Store(sender.gso.Load() && gso)
+
+	// equal sizes are coalesced by GSO, the shorter datagram closes the group
+	datagrams := testDatagrams(10, 1000)
+	datagrams = append(datagrams, []byte("short"))
+	datagrams = append(datagrams, testDatagrams(5, 500)...)
+	err := sender.WriteBatchTo(datagrams, receiver.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	received := receiveBatch(t, receiver, len(datagrams))
+	for i := range datagrams {
+		if !bytes.Equal(received[i], datagrams[i]) {
+			t.Fatalf("datagram %d: received %d bytes, want %d", i, len(received[i]), len(datagrams[i]))
+		}
+	}
+}
+
+func TestBatchConnRoundTrip(t *testing.T) {
+	testBatchRoundTrip(t, false)
+}
+
+func TestBatchConnRoundTripGSO(t *testing.T) {
+	testBatchRoundTrip(t, true)
+}
+
+func TestBatchConnConnected(t *testing.T) {
+	receiver := newBatchConn(listenLoopback(t))
+	conn, err := dialUDP(receiver.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	datagrams := testDatagrams(40, 1200)
+	if err := writeBatch(conn, datagrams); err != nil {
+		t.Fatal(err)
+	}
+	if received := receiveBatch(t, receiver, len(datagrams)); len(received) != len(datagrams) {
+		t.Fatalf("received %d datagrams, want %d", len(received), len(datagrams))
+	}
+}
+
+// window of datagrams in flight, small enough to fit in the default socket receive buffer
+const benchmarkWindow = 64
+
+// runTunnelBenchmark sends b.N datagrams with send while the receive function counts them, then reports the rate.
+// The sender waits for the receiver to keep at most benchmarkWindow datagrams in flight, so that none is lost.
+func runTunnelBenchmark(b *testing.B, send func(datagrams [][]byte), receive func() (int, error)) {
+	datagrams := testDatagrams(BATCH_SIZE, benchmarkPacketSize)
+	received := 0
+	lock := sync.Mutex{}
+	progress := sync.NewCond(&lock)
+	b.ResetTimer()
+	start := time.Now()
+	go func() {
+		for {
+			n, err := receive()
+			lock.Lock()
+			if err != nil {
+				received = -1
+			} else {
+				received += n
+			}
+			progress.Broadcast()
+			lock.Unlock()
+			if err != nil {
+				return
+			}
+		}
+	}()
+	lock.Lock()
+	defer lock.Unlock()
+	for sent := 0; sent < b.N; {
+		for received >= 0 && sent-received > benchmarkWindow-BATCH_SIZE {
+			progress.Wait()
+		}
+		if received < 0 {
+			b.Fatalf("receive failed after %d datagrams sent", sent)
+		}
+		count := min(BATCH_SIZE, b.N-sent)
+		lock.Unlock()
+		send(datagrams[:count])
+		lock.Lock()
+		sent += count
+	}
+	for received >= 0 && received < b.N {
+		progress.Wait()
+	}
+	elapsed := time.Since(start)
+	b.StopTimer()
+	if received < b.N {
+		b.Fatalf("received %d datagrams out of %d", received, b.N)
+	}
+	b.ReportMetric(float64(b.N)/elapsed.Seconds(), "pps")
+}
+
+func BenchmarkTunnelSingle(b *testing.B) {
+	sender := listenLoopback(b)
+	receiver := listenLoopback(b)
+	_ = receiver.SetReadDeadline(time.Now().Add(time.Minute))
+	addr := receiver.LocalAddr().(*net.UDPAddr)
+	buffer := make([]byte, BUFFER_SIZE)
+	runTunnelBenchmark(b, func(datagrams [][]byte) {
+		for _, datagram := range datagrams {
+			_, _ = sender.WriteToUDP(datagram, addr)
+		}
+	}, func() (int, error) {
+		_, _, err := receiver.ReadFromUDP(buffer)
+		return 1, err
+	})
+}
+
+func benchmarkTunnelBatch(b *testing.B, gso bool) {
+	sender := newBatchConn(listenLoopback(b))
+	receiver := newBatchConn(listenLoopback(b))
+	_ = receiver.SetReadDeadline(time.Now().Add(time.Minute))
+	sender.gso.Store(sender.gso.Load() && gso)
+	addr := receiver.LocalAddr().(*net.UDPAddr)
+	messages := make([]incomingMessage, BATCH_SIZE)
+	runTunnelBenchmark(b, func(datagrams [][]byte) {
+		_ = sender.WriteBatchTo(datagrams, addr)
+	}, func() (int, error) {
+		return receiver.ReadBatch(messages)
+	})
+}
+
+func BenchmarkTunnelBatch(b *testing.B) {
+	benchmarkTunnelBatch(b, true)
+}
+
+func BenchmarkTunnelBatchNoGSO(b *testing.B) {
+	benchmarkTunnelBatch(b, false)
+}
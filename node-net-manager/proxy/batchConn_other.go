@@ -0,0 +1,12 @@
+//go:build !linux
+
+package proxy
+
+import (
+	"net"
+)
+
+// wrapUDPConn returns the UDP socket as is, the batched I/O is only available on Linux
+func wrapUDPConn(conn *net.UDPConn) udpTunnelConn {
+	return conn
+}
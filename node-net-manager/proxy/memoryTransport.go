@@ -0,0 +1,254 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// In-memory implementations of the PacketDevice and of the tunnel sockets.
+// They allow to run multiple GoProxyTunnel in the same process without root privileges, e.g. for testing.
+
+type memoryDatagram struct {
+	content []byte
+	from    *net.UDPAddr
+}
+
+// MemoryNetwork is an in-memory UDP network delivering the datagrams between the MemorySocket listening on it
+type MemoryNetwork struct {
+	sockets  map[string]*MemorySocket
+	nextPort int
+	rwlock   sync.RWMutex
+}
+
+func NewMemoryNetwork() *MemoryNetwork {
+	return &MemoryNetwork{
+		sockets:  make(map[string]*MemorySocket),
+		nextPort: 40000,
+		rwlock:   sync.RWMutex{},
+	}
+}
+
+// Listen opens a MemorySocket receiving the datagrams sent to addr
+func (n *MemoryNetwork) Listen(addr *net.UDPAddr) (*MemorySocket, error) {
+	n.rwlock.Lock()
+	defer n.rwlock.Unlock()
+	if _, exist := n.sockets[addr.String()]; exist {
+		return nil, fmt.Errorf("address %s already in use", addr.String())
+	}
+	socket := &MemorySocket{
+		network: n,
+		addr:    addr,
+		inbox:   make(chan memoryDatagram, 1000),
+		closed:  make(chan struct{}),
+	}
+	n.sockets[addr.String()] = socket
+	return socket, nil
+}
+
+// ListenBehindNat opens a MemorySocket behind a port restricted cone NAT with the given public IP.
+// The other sockets receive the datagrams from the public endpoint of the socket, and the datagrams sent to
+// the public endpoint are delivered only if they come from an endpoint the socket already sent a datagram to.
+// The private address of the socket is not reachable.
+func (n *MemoryNetwork) ListenBehindNat(addr *net.UDPAddr, publicIP net.IP) (*MemorySocket, error) {
+	socket, err := n.Listen(addr)
+	if err != nil {
+		return nil, err
+	}
+	n.rwlock.Lock()
+	defer n.rwlock.Unlock()
+	socket.allowed = make(map[string]bool)
+	n.mapPublicEndpoint(socket, publicIP)
+	return socket, nil
+}
+
+// Rebind simulates the NAT assigning a new public port to the socket, the previous mapping is lost
+func (n *MemoryNetwork) Rebind(socket *MemorySocket) {
+	n.rwlock.Lock()
+	defer n.rwlock.Unlock()
+	if socket.public == nil {
+		return
+	}
+	delete(n.sockets, socket.public.String())
+	socket.allowed = make(map[string]bool)
+	n.mapPublicEndpoint(socket, socket.public.IP)
+}
+
+func (n *MemoryNetwork) mapPublicEndpoint(socket *MemorySocket, publicIP net.IP) {
+	n.nextPort++
+	socket.public = &net.UDPAddr{IP: publicIP, Port: n.nextPort}
+	n.sockets[socket.public.String()] = socket
+}
+
+// Dialer returns a TunnelDialer whose connections send from the given local IP
+func (n *MemoryNetwork) Dialer(localIP net.IP) TunnelDialer {
+	return func(hoststring string) (TunnelConn, error) {
+		raddr, err := net.ResolveUDPAddr("udp", hoststring)
+		if err != nil {
+			return nil, err
+		}
+		n.rwlock.Lock()
+		n.nextPort++
+		laddr := &net.UDPAddr{IP: localIP, Port: n.nextPort}
+		n.rwlock.Unlock()
+		return &MemoryConn{network: n, laddr: laddr, raddr: raddr}, nil
+	}
+}
+
+// deliver routes the datagram to the socket listening on raddr, datagrams towards unknown addresses are lost
+func (n *MemoryNetwork) deliver(raddr *net.UDPAddr, from *net.UDPAddr, b []byte) {
+	n.rwlock.RLock()
+	socket, exist := n.sockets[raddr.String()]
+	filtered := exist && socket.public != nil && (socket.public.String() != raddr.String() || !socket.allowed[from.String()])
+	n.rwlock.RUnlock()
+	if !exist || filtered {
+		return
+	}
+	content := make([]byte, len(b))
+	copy(content, b)
+	select {
+	case socket.inbox <- memoryDatagram{content: content, from: from}:
+	case <-socket.closed:
+	default:
+		// receive buffer full, the datagram is lost like in a real UDP socket
+	}
+}
+
+// MemorySocket is an in-memory TunnelSocket
+type MemorySocket struct {
+	network *MemoryNetwork
+	addr    *net.UDPAddr
+	// public endpoint and endpoints allowed to reach it, only for the sockets behind NAT
+	public    *net.UDPAddr
+	allowed   map[string]bool
+	inbox     chan memoryDatagram
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (s *MemorySocket) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+	select {
+	case datagram := <-s.inbox:
+		return copy(b, datagram.content), datagram.from, nil
+	case <-s.closed:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (s *MemorySocket) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	from := s.addr
+	s.network.rwlock.Lock()
+	if s.public != nil {
+		from = s.public
+		s.allowed[addr.String()] = true
+	}
+	s.network.rwlock.Unlock()
+	s.network.deliver(addr, from, b)
+	return len(b), nil
+}
+
+// PublicAddr returns the endpoint seen by the other sockets
+func (s *MemorySocket) PublicAddr() *net.UDPAddr {
+	s.network.rwlock.RLock()
+	defer s.network.rwlock.RUnlock()
+	if s.public != nil {
+		return s.public
+	}
+	return s.addr
+}
+
+func (s *MemorySocket) Close() error {
+	s.closeOnce.Do(func() {
+		s.network.rwlock.Lock()
+		delete(s.network.sockets, s.addr.String())
+		if s.public != nil {
+			delete(s.network.sockets, s.public.String())
+		}
+		s.network.rwlock.Unlock()
+		close(s.closed)
+	})
+	return nil
+}
+
+// MemoryConn is an in-memory TunnelConn
+type MemoryConn struct {
+	network *MemoryNetwork
+	laddr   *net.UDPAddr
+	raddr   *net.UDPAddr
+}
+
+func (c *MemoryConn) Write(b []byte) (int, error) {
+	c.network.deliver(c.raddr, c.laddr, b)
+	return len(b), nil
+}
+
+func (c *MemoryConn) Close() error {
+	return nil
+}
+
+// MemoryDevice is an in-memory PacketDevice.
+// Inject simulates a packet sent by a local service, Receive returns the packets delivered by the proxy to the local services.
+type MemoryDevice struct {
+	name      string
+	toProxy   chan []byte
+	fromProxy chan []byte
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func NewMemoryDevice(name string) *MemoryDevice {
+	return &MemoryDevice{
+		name:      name,
+		toProxy:   make(chan []byte, 1000),
+		fromProxy: make(chan []byte, 1000),
+		closed:    make(chan struct{}),
+	}
+}
+
+func (d *MemoryDevice) Read(p []byte) (int, error) {
+	select {
+	case packet := <-d.toProxy:
+		return copy(p, packet), nil
+	case <-d.closed:
+		return 0, net.ErrClosed
+	}
+}
+
+func (d *MemoryDevice) Write(p []byte) (int, error) {
+	packet := make([]byte, len(p))
+	copy(packet, p)
+	select {
+	case d.fromProxy <- packet:
+		return len(p), nil
+	case <-d.closed:
+		return 0, net.ErrClosed
+	}
+}
+
+func (d *MemoryDevice) Name() string {
+	return d.name
+}
+
+func (d *MemoryDevice) Close() error {
+	d.closeOnce.Do(func() { close(d.closed) })
+	return nil
+}
+
+// Inject hands a packet to the proxy as if it was sent by a local service
+func (d *MemoryDevice) Inject(packet []byte) {
+	content := make([]byte, len(packet))
+	copy(content, packet)
+	d.toProxy <- content
+}
+
+// Receive returns the next packet delivered by the proxy to the local services
+func (d *MemoryDevice) Receive(timeout time.Duration) ([]byte, error) {
+	select {
+	case packet := <-d.fromProxy:
+		return packet, nil
+	case <-time.After(timeout):
+		return nil, errors.New("no packet received")
+	}
+}
@@ -0,0 +1,575 @@
+package proxy
+
+import (
+	"NetManager/logger"
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Control packets exchanged on the tunnel socket for the NAT traversal.
+// The first byte never collides with the version nibble of the tunneled IPv4 and IPv6 packets.
+// Except natRelay, they carry the id of the sender and a counter, and end with the HMAC of the packet
+// keyed with the keys the two nodes exchanged through the signalling channel.
+const (
+	// hole punching probe
+	natPunch byte = 0xF1
+	// answer to a probe
+	natPunchAck byte = 0xF2
+	// keepalive towards the relay
+	natRegister byte = 0xF3
+	// answer of the relay, carries the public endpoint of the sender observed by the relay
+	natRegistered byte = 0xF4
+	// packet relayed between two registered nodes, carries the id of the sender, the id of the receiver and the tunneled packet
+	natRelay byte = 0xF5
+)
+
+const (
+	DEFAULT_NAT_KEEPALIVE_INTERVAL = 10 * time.Second
+	DEFAULT_NAT_PUNCH_TIMEOUT      = 5 * time.Second
+	// NAT_KEY_SIZE is the size of the key each node generates for each peer
+	NAT_KEY_SIZE = 32
+)
+
+var (
+	errNatUnknownPeer      = errors.New("unknown node")
+	errNatNoKey            = errors.New("no key exchanged with the node")
+	errNatUnauthenticated  = errors.New("invalid HMAC")
+	errNatReplayed         = errors.New("replayed control packet")
+	errNatTruncatedControl = errors.New("truncated NAT control packet")
+)
+
+// NatConfiguration enables the UDP hole punching between the nodes behind NAT
+type NatConfiguration struct {
+	// identity of this node, the worker id
+	NodeID string
+	// endpoint advertised by this node, used as hole punching candidate together with the one observed by the relay
+	PublicAddress *net.UDPAddr
+	// tunnel endpoint (host:port) of the node relaying the traffic when the hole punching fails, empty to disable the relay
+	RelayAddress string
+	// worker id of the relay node, required with the RelayAddress to authenticate the registrations
+	RelayID string
+	// this node relays the traffic of the other nodes
+	Relay bool
+	// keepalive towards the relay and the peers reached directly
+	KeepaliveInterval time.Duration
+	// time given to the hole punching before falling back to the relay
+	PunchTimeout time.Duration
+}
+
+// NatSignalling delivers the hole punching requests to the other nodes through an authenticated channel, e.g. the MQTT broker.
+// The request carries the key the peer uses to authenticate its control packets towards this node.
+type NatSignalling interface {
+	RequestHolePunching(peer string, endpoints []*net.UDPAddr, key []byte) error
+}
+
+type relayRegistration struct {
+	endpoint *net.UDPAddr
+	lastSeen time.Time
+}
+
+// natTraversal establishes the direct paths between the nodes behind NAT.
+// A node willing to reach a peer asks the peer, through the signalling channel, to send probes towards its endpoints
+// while it sends probes towards the peer endpoints. Both NATs then accept the packets of the other node.
+// Until the direct path is established, or if the hole punching fails, the packets are sent through the relay.
+type natTraversal struct {
+	proxy      *GoProxyTunnel
+	config     NatConfiguration
+	signalling NatSignalling
+	relayAddr  *net.UDPAddr
+	// endpoint of this node observed by the relay
+	publicEndpoint *net.UDPAddr
+	// endpoint -> peer id of the peers reached directly
+	directPeers map[string]string
+	// peer id -> endpoint of the nodes registered to this relay
+	registrations map[string]relayRegistration
+	rwlock        sync.RWMutex
+}
+
+// EnableNatTraversal makes the proxy reach the other nodes using UDP hole punching, or through the relay node
+// when the hole punching fails. MUST be called before Listen.
+func (proxy *GoProxyTunnel) EnableNatTraversal(config NatConfiguration, signalling NatSignalling) error {
+	if config.NodeID == "" {
+		return errors.New("the NAT traversal requires the node id")
+	}
+	if signalling == nil {
+		return errors.New("the NAT traversal requires a signalling channel")
+	}
+	if config.RelayAddress != "" && !config.Relay && config.RelayID == "" {
+		return errors.New("the NAT relay requires the relay node id")
+	}
+	if config.KeepaliveInterval <= 0 {
+		config.KeepaliveInterval = DEFAULT_NAT_KEEPALIVE_INTERVAL
+	}
+	if config.PunchTimeout <= 0 {
+		config.PunchTimeout = DEFAULT_NAT_PUNCH_TIMEOUT
+	}
+	nat := &natTraversal{
+		proxy:         proxy,
+		config:        config,
+		signalling:    signalling,
+		directPeers:   make(map[string]string),
+		registrations: make(map[string]relayRegistration),
+		rwlock:        sync.RWMutex{},
+	}
+	if config.RelayAddress != "" {
+		relayAddr, err := net.ResolveUDPAddr("udp", config.RelayAddress)
+		if err != nil {
+			return err
+		}
+		nat.relayAddr = relayAddr
+	}
+	proxy.nat = nat
+	nat.register()
+	nat.runMaintenance()
+	logger.InfoLogger().Printf("NAT traversal enabled for node %s, relay: %s", config.NodeID, config.RelayAddress)
+	return nil
+}
+
+// HandleHolePunchingRequest starts sending probes towards the endpoints of the peer that asked for hole punching.
+// The peer id and key MUST come from an authenticated channel, only the nodes known this way take part in the NAT traversal.
+// Unless this node is already punching towards the peer, the peer is asked to do the same towards the endpoints of this node.
+func (proxy *GoProxyTunnel) HandleHolePunchingRequest(peerID string, endpoints []*net.UDPAddr, key []byte) {
+	if proxy.nat == nil || peerID == "" || peerID == proxy.nat.config.NodeID || len(key) != NAT_KEY_SIZE {
+		return
+	}
+	logger.DebugLogger().Printf("NAT - hole punching requested by %s towards %v", peerID, endpoints)
+	peer := proxy.getPeerConnection(peerID, true)
+	peer.lock.Lock()
+	defer peer.lock.Unlock()
+	peer.candidates = endpoints
+	newKey := !bytes.Equal(peer.remoteKey, key)
+	if newKey {
+		// the counter of the peer starts again with its new key
+		peer.remoteKey = bytes.Clone(key)
+		peer.recvCounter = 0
+	}
+	switch {
+	case newKey:
+		// first request of the peer, or the peer restarted, it needs the key of this node
+		proxy.nat.forgetDirectPeer(peer)
+		proxy.nat.startPunching(peer, true)
+	case peer.state == peerPunching:
+		proxy.nat.probe(peer)
+	case peer.state == peerDirect && time.Since(peer.lastSeen) <= proxy.nat.peerTimeout():
+		proxy.nat.probe(peer)
+	default:
+		// the peer lost the path towards this node, e.g. the NAT changed the mapping of this node
+		proxy.nat.forgetDirectPeer(peer)
+		proxy.nat.startPunching(peer, true)
+	}
+}
+
+// send writes the packet towards the peer, the peer lock MUST be held by the caller
+func (nat *natTraversal) send(peer *peerConnection, b []byte) (int, error) {
+	if err := nat.sendBatch(peer, [][]byte{b}); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// sendBatch writes the packets towards the peer, the peer lock MUST be held by the caller
+func (nat *natTraversal) sendBatch(peer *peerConnection, buffers [][]byte) error {
+	now := time.Now()
+	if peer.state == peerDirect && now.Sub(peer.lastSeen) > nat.peerTimeout() {
+		logger.InfoLogger().Printf("NAT - direct path towards %s expired", peer.id)
+		emitPeerUnreachable(peer.id, peer.endpoint.String(), "direct path expired")
+		nat.forgetDirectPeer(peer)
+	}
+	if peer.state == peerDirect {
+		return writeBatchTo(nat.proxy.tunnelSocket(), buffers, peer.endpoint)
+	}
+	if peer.state == peerIndirect && now.Sub(peer.punchStarted) > nat.punchRetryInterval() {
+		nat.startPunching(peer, true)
+	}
+	if nat.relayAddr != nil {
+		relayed := make([][]byte, 0, len(buffers))
+		for _, b := range buffers {
+			relayed = append(relayed, encodeNatPacket(natRelay, []string{nat.config.NodeID, peer.id}, b))
+		}
+		return writeBatchTo(nat.proxy.tunnelSocket(), relayed, nat.relayAddr)
+	}
+	if peer.endpoint == nil {
+		return errors.New("unknown endpoint for peer " + peer.id)
+	}
+	// no relay, best effort towards the last known endpoint
+	return writeBatchTo(nat.proxy.tunnelSocket(), buffers, peer.endpoint)
+}
+
+// startPunching sends the probes towards the peer and, if signal is set, asks the peer to do the same.
+// The peer lock MUST be held by the caller.
+func (nat *natTraversal) startPunching(peer *peerConnection, signal bool) {
+	logger.DebugLogger().Printf("NAT - hole punching towards %s", peer.id)
+	peer.state = peerPunching
+	peer.punchStarted = time.Now()
+	if signal {
+		endpoints := nat.localCandidates()
+		key := nat.localKey(peer)
+		go func() {
+			if err := nat.signalling.RequestHolePunching(peer.id, endpoints, key); err != nil {
+				logger.ErrorLogger().Printf("NAT - unable to signal the hole punching to %s: %v", peer.id, err)
+			}
+		}()
+	}
+	nat.probe(peer)
+}
+
+// probe sends a hole punching probe towards every known endpoint of the peer, the peer lock MUST be held by the caller.
+// Nothing is sent until the peer gave its key.
+func (nat *natTraversal) probe(peer *peerConnection) {
+	probe, ok := nat.seal(peer, natPunch)
+	if !ok {
+		return
+	}
+	sent := make(map[string]bool)
+	targets := append([]*net.UDPAddr{peer.endpoint, peer.advertised}, peer.candidates...)
+	for _, addr := range targets {
+		if addr == nil || sent[addr.String()] {
+			continue
+		}
+		sent[addr.String()] = true
+		_, _ = nat.proxy.tunnelSocket().WriteToUDP(probe, addr)
+	}
+}
+
+// localCandidates returns the endpoints the other nodes can try to reach this node at
+func (nat *natTraversal) localCandidates() []*net.UDPAddr {
+	nat.rwlock.RLock()
+	defer nat.rwlock.RUnlock()
+	result := make([]*net.UDPAddr, 0, 2)
+	if nat.publicEndpoint != nil {
+		result = append(result, nat.publicEndpoint)
+	}
+	if nat.config.PublicAddress != nil && (nat.publicEndpoint == nil || nat.publicEndpoint.String() != nat.config.PublicAddress.String()) {
+		result = append(result, nat.config.PublicAddress)
+	}
+	return result
+}
+
+// handleControl processes a NAT control packet and returns the tunneled packet to deliver locally, if any
+func (nat *natTraversal) handleControl(content []byte, from *net.UDPAddr) []byte {
+	switch content[0] {
+	case natPunch, natPunchAck:
+		peer, _, err := nat.open(content, 0)
+		if err != nil {
+			logger.DebugLogger().Printf("NAT - rejected probe from %s: %v", from.String(), err)
+			return nil
+		}
+		nat.establishDirectPath(peer, from, content[0] == natPunch)
+	case natRegister:
+		if !nat.config.Relay {
+			return nil
+		}
+		peer, _, err := nat.open(content, 0)
+		if err != nil {
+			logger.DebugLogger().Printf("NAT - rejected registration from %s: %v", from.String(), err)
+			return nil
+		}
+		nat.rwlock.Lock()
+		nat.registrations[peer.id] = relayRegistration{endpoint: from, lastSeen: time.Now()}
+		nat.rwlock.Unlock()
+		peer.lock.Lock()
+		registered, ok := nat.seal(peer, natRegistered, from.String())
+		peer.lock.Unlock()
+		if ok {
+			_, _ = nat.proxy.tunnelSocket().WriteToUDP(registered, from)
+		}
+	case natRegistered:
+		peer, fields, err := nat.open(content, 1)
+		if err != nil || peer.id != nat.config.RelayID {
+			logger.DebugLogger().Printf("NAT - rejected registration answer from %s: %v", from.String(), err)
+			return nil
+		}
+		endpoint, err := net.ResolveUDPAddr("udp", fields[0])
+		if err != nil {
+			return nil
+		}
+		nat.rwlock.Lock()
+		if nat.publicEndpoint == nil || nat.publicEndpoint.String() != endpoint.String() {
+			logger.InfoLogger().Printf("NAT - public endpoint observed by the relay: %s", endpoint.String())
+		}
+		nat.publicEndpoint = endpoint
+		nat.rwlock.Unlock()
+	case natRelay:
+		ids, payload, err := decodeNatPacket(content, 2)
+		if err != nil {
+			return nil
+		}
+		if ids[1] == nat.config.NodeID {
+			// the relay checked the sender
+			if nat.relayAddr == nil || from.String() != nat.relayAddr.String() {
+				logger.DebugLogger().Printf("NAT - rejected relayed packet from %s", from.String())
+				return nil
+			}
+			return payload
+		}
+		if !nat.config.Relay {
+			return nil
+		}
+		nat.rwlock.RLock()
+		sender, senderExist := nat.registrations[ids[0]]
+		registration, exist := nat.registrations[ids[1]]
+		nat.rwlock.RUnlock()
+		// only the registered nodes, from their registered endpoint, or this node itself
+		self := ids[0] == nat.config.NodeID && nat.relayAddr != nil && from.String() == nat.relayAddr.String()
+		if !self && (!senderExist || sender.endpoint.String() != from.String()) {
+			logger.DebugLogger().Printf("NAT - unable to relay for unregistered node %s from %s", ids[0], from.String())
+			return nil
+		}
+		if !exist {
+			logger.DebugLogger().Printf("NAT - unable to relay towards unregistered node %s", ids[1])
+			return nil
+		}
+		_, _ = nat.proxy.tunnelSocket().WriteToUDP(content, registration.endpoint)
+	}
+	return nil
+}
+
+// establishDirectPath records that the peer answered from the given endpoint, and answers its probe if ack is set
+func (nat *natTraversal) establishDirectPath(peer *peerConnection, from *net.UDPAddr, ack bool) {
+	peer.lock.Lock()
+	defer peer.lock.Unlock()
+	if peer.state != peerDirect || peer.endpoint.String() != from.String() {
+		logger.InfoLogger().Printf("NAT - direct path towards %s via %s", peer.id, from.String())
+		nat.forgetDirectPeer(peer)
+	}
+	peer.setEndpoint(from)
+	peer.state = peerDirect
+	peer.lastSeen = time.Now()
+	nat.rwlock.Lock()
+	nat.directPeers[from.String()] = peer.id
+	nat.rwlock.Unlock()
+	if !ack {
+		return
+	}
+	if answer, ok := nat.seal(peer, natPunchAck); ok {
+		_, _ = nat.proxy.tunnelSocket().WriteToUDP(answer, from)
+	}
+}
+
+// localKey returns the key of this node for the peer, generated on first use. The peer lock MUST be held by the caller.
+func (nat *natTraversal) localKey(peer *peerConnection) []byte {
+	if peer.localKey == nil {
+		key := make([]byte, NAT_KEY_SIZE)
+		if _, err := rand.Read(key); err != nil {
+			logger.ErrorLogger().Println("[ERROR]: NAT - unable to generate a key:", err)
+			return nil
+		}
+		peer.localKey = key
+	}
+	return peer.localKey
+}
+
+// seal builds an authenticated control packet towards the peer, false until the peer gave its key.
+// The peer lock MUST be held by the caller.
+func (nat *natTraversal) seal(peer *peerConnection, kind byte, fields ...string) ([]byte, bool) {
+	if peer.remoteKey == nil || nat.localKey(peer) == nil {
+		return nil, false
+	}
+	peer.sendCounter++
+	counter := binary.BigEndian.AppendUint64(nil, peer.sendCounter)
+	content := encodeNatPacket(kind, append([]string{nat.config.NodeID, string(counter)}, fields...), nil)
+	return append(content, natMac(peer.remoteKey, peer.localKey, content)...), true
+}
+
+// open authenticates a control packet of a known peer and returns the peer and the fields following the id and the counter
+func (nat *natTraversal) open(content []byte, fieldsCount int) (*peerConnection, []string, error) {
+	if len(content) < sha256.Size {
+		return nil, nil, errNatTruncatedControl
+	}
+	signed, mac := content[:len(content)-sha256.Size], content[len(content)-sha256.Size:]
+	fields, rest, err := decodeNatPacket(signed, 2+fieldsCount)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(rest) != 0 || len(fields[1]) != 8 {
+		return nil, nil, errNatTruncatedControl
+	}
+	// the nodes are only known through the signalling channel, the unknown ids don't create any state
+	peer, exist := nat.proxy.lookupPeerConnection(fields[0])
+	if !exist {
+		return nil, nil, fmt.Errorf("%w %s", errNatUnknownPeer, fields[0])
+	}
+	peer.lock.Lock()
+	defer peer.lock.Unlock()
+	if peer.localKey == nil || peer.remoteKey == nil {
+		return nil, nil, fmt.Errorf("%w %s", errNatNoKey, peer.id)
+	}
+	if !hmac.Equal(mac, natMac(peer.localKey, peer.remoteKey, signed)) {
+		return nil, nil, errNatUnauthenticated
+	}
+	counter := binary.BigEndian.Uint64([]byte(fields[1]))
+	if counter <= peer.recvCounter {
+		return nil, nil, errNatReplayed
+	}
+	peer.recvCounter = counter
+	return peer, fields[2:], nil
+}
+
+// natMac is the HMAC-SHA256 of the control packet, keyed with the key of the receiver followed by the key of the sender
+func natMac(receiverKey []byte, senderKey []byte, content []byte) []byte {
+	key := make([]byte, 0, len(receiverKey)+len(senderKey))
+	key = append(append(key, receiverKey...), senderKey...)
+	mac := hmac.New(sha256.New, key)
+	mac.Write(content)
+	return mac.Sum(nil)
+}
+
+// forgetDirectPeer drops the direct path towards the peer, the peer lock MUST be held by the caller
+func (nat *natTraversal) forgetDirectPeer(peer *peerConnection) {
+	if peer.state == peerDirect {
+		peer.state = peerIndirect
+	}
+	if peer.endpoint == nil {
+		return
+	}
+	nat.rwlock.Lock()
+	delete(nat.directPeers, peer.endpoint.String())
+	nat.rwlock.Unlock()
+}
+
+// touch refreshes the direct path of the peer sending a tunneled packet from the given endpoint
+func (nat *natTraversal) touch(from *net.UDPAddr) {
+	nat.rwlock.RLock()
+	peerID, exist := nat.directPeers[from.String()]
+	nat.rwlock.RUnlock()
+	if !exist {
+		return
+	}
+	peer := nat.proxy.getPeerConnection(peerID, true)
+	peer.lock.Lock()
+	if peer.state == peerDirect {
+		peer.lastSeen = time.Now()
+	}
+	peer.lock.Unlock()
+}
+
+// register keeps the mapping towards the relay open and learns the public endpoint of this node.
+// The keys are first exchanged with the relay through the signalling channel.
+func (nat *natTraversal) register() {
+	if nat.relayAddr == nil || nat.config.Relay {
+		return
+	}
+	relay := nat.proxy.getPeerConnection(nat.config.RelayID, true)
+	relay.lock.Lock()
+	registration, ok := nat.seal(relay, natRegister)
+	if !ok && relay.state != peerPunching {
+		nat.startPunching(relay, true)
+	}
+	relay.lock.Unlock()
+	if !ok {
+		return
+	}
+	_, err := nat.proxy.tunnelSocket().WriteToUDP(registration, nat.relayAddr)
+	if err != nil {
+		logger.ErrorLogger().Println("NAT - unable to register to the relay:", err)
+	}
+}
+
+// runMaintenance periodically sends the probes of the ongoing hole punching, and the keepalives
+func (nat *natTraversal) runMaintenance() {
+	probeTicker := time.NewTicker(nat.config.PunchTimeout / 10)
+	keepaliveTicker := time.NewTicker(nat.config.KeepaliveInterval)
+	go func() {
+		for {
+			select {
+			case <-probeTicker.C:
+				nat.probePunchingPeers()
+			case <-keepaliveTicker.C:
+				nat.register()
+				nat.keepalive()
+			}
+		}
+	}()
+}
+
+func (nat *natTraversal) probePunchingPeers() {
+	for _, peer := range nat.proxy.peerConnections() {
+		peer.lock.Lock()
+		if peer.state == peerPunching {
+			if time.Since(peer.punchStarted) > nat.config.PunchTimeout {
+				logger.InfoLogger().Printf("NAT - hole punching towards %s failed, using the relay", peer.id)
+				peer.state = peerIndirect
+			} else {
+				nat.probe(peer)
+			}
+		}
+		peer.lock.Unlock()
+	}
+}
+
+func (nat *natTraversal) keepalive() {
+	for _, peer := range nat.proxy.peerConnections() {
+		peer.lock.Lock()
+		if peer.state == peerDirect {
+			if probe, ok := nat.seal(peer, natPunch); ok {
+				_, _ = nat.proxy.tunnelSocket().WriteToUDP(probe, peer.endpoint)
+			}
+		}
+		peer.lock.Unlock()
+	}
+	if !nat.config.Relay {
+		return
+	}
+	nat.rwlock.Lock()
+	defer nat.rwlock.Unlock()
+	for id, registration := range nat.registrations {
+		if time.Since(registration.lastSeen) > nat.peerTimeout() {
+			delete(nat.registrations, id)
+		}
+	}
+}
+
+// peerTimeout is the time after which a silent peer is no longer considered reachable
+func (nat *natTraversal) peerTimeout() time.Duration {
+	return 3 * nat.config.KeepaliveInterval
+}
+
+// punchRetryInterval is the time between two hole punching attempts towards a peer reached through the relay
+func (nat *natTraversal) punchRetryInterval() time.Duration {
+	return 6 * nat.config.KeepaliveInterval
+}
+
+func isNatControlPacket(content []byte) bool {
+	return len(content) > 0 && content[0]&0xf0 == 0xf0
+}
+
+// encodeNatPacket builds the control packet: kind, then each field prefixed by its length, then the payload
+func encodeNatPacket(kind byte, fields []string, payload []byte) []byte {
+	size := 1 + len(payload)
+	for _, field := range fields {
+		size += 1 + len(field)
+	}
+	result := make([]byte, 0, size)
+	result = append(result, kind)
+	for _, field := range fields {
+		result = append(result, byte(len(field)))
+		result = append(result, field...)
+	}
+	return append(result, payload...)
+}
+
+func decodeNatPacket(content []byte, fieldsCount int) ([]string, []byte, error) {
+	fields := make([]string, 0, fieldsCount)
+	offset := 1
+	for i := 0; i < fieldsCount; i++ {
+		if offset >= len(content) {
+			return nil, nil, errNatTruncatedControl
+		}
+		length := int(content[offset])
+		offset++
+		if offset+length > len(content) {
+			return nil, nil, errNatTruncatedControl
+		}
+		fields = append(fields, string(content[offset:offset+length]))
+		offset += length
+	}
+	return fields, content[offset:], nil
+}
@@ -0,0 +1,247 @@
+package proxy
+
+import (
+	"NetManager/TableEntryCache"
+	"NetManager/events"
+	"NetManager/logger"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+)
+
+type peerState int
+
+const (
+	// no direct path towards the peer, the packets go through the relay if any
+	peerIndirect peerState = iota
+	// hole punching in progress, the packets go through the relay if any
+	peerPunching peerState = iota
+	// the peer answered from its endpoint, the packets are sent there directly
+	peerDirect peerState = iota
+)
+
+// remotePeer is the node hosting a namespace IP
+type remotePeer struct {
+	// worker id of the node, or host:port if the cluster did not provide it
+	id string
+	// only the nodes identified by their worker id can take part in the NAT traversal
+	traversable bool
+	host        net.IP
+	port        int
+}
+
+func newRemotePeer(entry TableEntryCache.TableEntry) remotePeer {
+	if entry.Nodeid == "" {
+		return remotePeer{
+			id:   fmt.Sprintf("%s:%v", entry.Nodeip, entry.Nodeport),
+			host: entry.Nodeip,
+			port: entry.Nodeport,
+		}
+	}
+	return remotePeer{
+		id:          entry.Nodeid,
+		traversable: true,
+		host:        entry.Nodeip,
+		port:        entry.Nodeport,
+	}
+}
+
+// peerConnection is the TunnelConn towards another node, identified by the peer id.
+// The endpoint of the peer can change, e.g. the NAT assigned a new mapping or the node changed address,
+// without replacing the connection.
+type peerConnection struct {
+	id          string
+	traversable bool
+	// endpoint advertised by the cluster for the node
+	advertised *net.UDPAddr
+	// endpoint the packets are sent to
+	endpoint *net.UDPAddr
+	// connection dialed towards the endpoint, used when the NAT traversal is disabled
+	conn   TunnelConn
+	dialer TunnelDialer
+	nat    *natTraversal
+	// NAT traversal state
+	state        peerState
+	candidates   []*net.UDPAddr
+	punchStarted time.Time
+	lastSeen     time.Time
+	// key generated by this node, the peer authenticates its control packets with it
+	localKey []byte
+	// key of the peer, received through the signalling channel
+	remoteKey []byte
+	// counters of the control packets, the replayed ones are rejected
+	sendCounter uint64
+	recvCounter uint64
+	lock        sync.Mutex
+}
+
+func newPeerConnection(id string, traversable bool, dialer TunnelDialer, nat *natTraversal) *peerConnection {
+	return &peerConnection{
+		id:          id,
+		traversable: traversable,
+		dialer:      dialer,
+		nat:         nat,
+		state:       peerIndirect,
+		candidates:  make([]*net.UDPAddr, 0),
+	}
+}
+
+// setAdvertised updates the endpoint advertised by the cluster for the peer
+func (peer *peerConnection) setAdvertised(host net.IP, port int) {
+	addr := &net.UDPAddr{IP: host, Port: port}
+	peer.lock.Lock()
+	defer peer.lock.Unlock()
+	if peer.advertised != nil && peer.advertised.String() == addr.String() {
+		return
+	}
+	peer.advertised = addr
+	// a direct path learned with the NAT traversal has precedence over the advertised endpoint
+	if peer.state != peerDirect {
+		peer.setEndpoint(addr)
+	}
+}
+
+// setEndpoint changes the endpoint of the peer, the lock MUST be held by the caller
+func (peer *peerConnection) setEndpoint(addr *net.UDPAddr) {
+	if peer.endpoint != nil && peer.endpoint.String() == addr.String() {
+		return
+	}
+	peer.endpoint = addr
+	if peer.conn != nil {
+		_ = peer.conn.Close()
+		peer.conn = nil
+	}
+}
+
+// Write sends the packet towards the peer, directly or through the relay
+func (peer *peerConnection) Write(b []byte) (int, error) {
+	peer.lock.Lock()
+	defer peer.lock.Unlock()
+	if peer.nat != nil && peer.traversable {
+		return peer.nat.send(peer, b)
+	}
+	if peer.endpoint == nil {
+		return 0, errors.New("unknown endpoint for peer " + peer.id)
+	}
+	if peer.conn == nil {
+		conn, err := peer.dialer(peer.endpoint.String())
+		if err != nil {
+			return 0, err
+		}
+		peer.conn = conn
+	}
+	return peer.conn.Write(b)
+}
+
+// WriteBatch sends the packets towards the peer, with a single system call when the socket supports it
+func (peer *peerConnection) WriteBatch(buffers [][]byte) error {
+	peer.lock.Lock()
+	defer peer.lock.Unlock()
+	if peer.nat != nil && peer.traversable {
+		return peer.nat.sendBatch(peer, buffers)
+	}
+	if peer.endpoint == nil {
+		return errors.New("unknown endpoint for peer " + peer.id)
+	}
+	if peer.conn == nil {
+		conn, err := peer.dialer(peer.endpoint.String())
+		if err != nil {
+			return err
+		}
+		peer.conn = conn
+	}
+	return writeBatch(peer.conn, buffers)
+}
+
+// Close releases the dialed connection, the next Write dials the endpoint again
+func (peer *peerConnection) Close() error {
+	peer.lock.Lock()
+	defer peer.lock.Unlock()
+	if peer.conn == nil {
+		return nil
+	}
+	err := peer.conn.Close()
+	peer.conn = nil
+	return err
+}
+
+// getPeerConnection returns the connection towards the peer, creating it if needed
+func (proxy *GoProxyTunnel) getPeerConnection(id string, traversable bool) *peerConnection {
+	proxy.udpwrite.Lock()
+	defer proxy.udpwrite.Unlock()
+	peer, exist := proxy.connectionBuffer[id]
+	if !exist {
+		logger.DebugLogger().Println("Establishing a new connection to node ", id)
+		peer = newPeerConnection(id, traversable, proxy.dialer, proxy.nat)
+		proxy.connectionBuffer[id] = peer
+	}
+	return peer
+}
+
+// lookupPeerConnection returns the connection towards the peer, if any
+func (proxy *GoProxyTunnel) lookupPeerConnection(id string) (*peerConnection, bool) {
+	proxy.udpwrite.RLock()
+	defer proxy.udpwrite.RUnlock()
+	peer, exist := proxy.connectionBuffer[id]
+	return peer, exist
+}
+
+// emitPeerUnreachable tells the event subscribers that the packets towards the peer are not delivered
+func emitPeerUnreachable(peer string, address string, reason string) {
+	events.GetInstance().Emit(events.Event{
+		EventType:   events.PeerUnreachable,
+		EventTarget: peer,
+		Payload:     events.PeerEvent{Peer: peer, Address: address, Reason: reason},
+	})
+}
+
+// outgoingBatch groups the outgoing packets by destination node
+type outgoingBatch struct {
+	queues []*peerQueue
+	index  map[*peerConnection]*peerQueue
+}
+
+type peerQueue struct {
+	peer    *peerConnection
+	dst     remotePeer
+	packets []gopacket.Packet
+	buffers [][]byte
+}
+
+func newOutgoingBatch() *outgoingBatch {
+	return &outgoingBatch{
+		queues: make([]*peerQueue, 0),
+		index:  make(map[*peerConnection]*peerQueue),
+	}
+}
+
+func (batch *outgoingBatch) add(peer *peerConnection, dst remotePeer, packet gopacket.Packet) {
+	queue, exist := batch.index[peer]
+	if !exist {
+		queue = &peerQueue{peer: peer, dst: dst}
+		batch.index[peer] = queue
+		batch.queues = append(batch.queues, queue)
+	}
+	queue.packets = append(queue.packets, packet)
+	queue.buffers = append(queue.buffers, packetToByte(packet))
+}
+
+func (batch *outgoingBatch) reset() {
+	batch.queues = batch.queues[:0]
+	clear(batch.index)
+}
+
+// peerConnections returns a snapshot of the connections towards the other nodes
+func (proxy *GoProxyTunnel) peerConnections() []*peerConnection {
+	proxy.udpwrite.RLock()
+	defer proxy.udpwrite.RUnlock()
+	result := make([]*peerConnection, 0, len(proxy.connectionBuffer))
+	for _, peer := range proxy.connectionBuffer {
+		result = append(result, peer)
+	}
+	return result
+}
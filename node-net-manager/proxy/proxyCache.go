@@ -29,8 +29,8 @@ type ProxyCache struct {
 	rwlock                sync.RWMutex
 }
 
-func NewProxyCache() ProxyCache {
-	cache := ProxyCache{
+func NewProxyCache() *ProxyCache {
+	cache := &ProxyCache{
 		cache:                 make([]ConversionList, 65535),
 		conversionListMaxSize: 10,
 		rwlock:                sync.RWMutex{},
@@ -107,6 +107,21 @@ func (cache *ProxyCache) RetrieveByInstanceIp(srcip net.IP, srcport int, dstport
 	return ConversionEntry{}, false
 }
 
+// HasFlowsTowards returns true if any cached flow is translated towards the given namespace IP
+func (cache *ProxyCache) HasFlowsTowards(nsip net.IP) bool {
+	cache.rwlock.RLock()
+	defer cache.rwlock.RUnlock()
+
+	for _, elem := range cache.cache {
+		for _, entry := range elem.conversionList {
+			if entry.dstip.Equal(nsip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // Add new conversion entry, if srcpip && srcport already added the entry is updated
 func (cache *ProxyCache) Add(entry ConversionEntry) {
 	cache.rwlock.Lock()
@@ -0,0 +1,174 @@
+package proxy
+
+import (
+	"NetManager/TableEntryCache"
+	"NetManager/logger"
+	"hash/fnv"
+	"math"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DEFAULT_AFFINITY_TTL is used when a ServiceIP enables the session affinity without specifying a TTL
+const DEFAULT_AFFINITY_TTL = 10 * time.Minute
+
+type affinityEntry struct {
+	nsip    net.IP
+	ttl     time.Duration
+	expires time.Time
+}
+
+// SessionAffinityTable keeps the client to instance bindings of the ServiceIPs with session affinity enabled.
+// The table is independent of the ProxyCache, so a binding outlives the eviction of the flows that created it.
+type SessionAffinityTable struct {
+	bindings map[string]affinityEntry
+	rwlock   sync.RWMutex
+	// closed to stop the eviction job, nil when it is not running
+	stopEviction chan struct{}
+}
+
+func NewSessionAffinityTable() *SessionAffinityTable {
+	return &SessionAffinityTable{
+		bindings: make(map[string]affinityEntry),
+		rwlock:   sync.RWMutex{},
+	}
+}
+
+// runEvictionJob starts a goroutine that periodically removes the expired bindings until stopEvictionJob is called
+func (table *SessionAffinityTable) runEvictionJob(interval time.Duration) {
+	table.rwlock.Lock()
+	defer table.rwlock.Unlock()
+	if table.stopEviction != nil {
+		return
+	}
+	stop := make(chan struct{})
+	table.stopEviction = stop
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				table.evictExpired(now)
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// stopEvictionJob stops the goroutine started by runEvictionJob, the bindings are kept
+func (table *SessionAffinityTable) stopEvictionJob() {
+	table.rwlock.Lock()
+	defer table.rwlock.Unlock()
+	if table.stopEviction != nil {
+		close(table.stopEviction)
+		table.stopEviction = nil
+	}
+}
+
+func (table *SessionAffinityTable) evictExpired(now time.Time) {
+	table.rwlock.Lock()
+	defer table.rwlock.Unlock()
+	evictedCount := 0
+	for key, binding := range table.bindings {
+		if now.After(binding.expires) {
+			delete(table.bindings, key)
+			evictedCount++
+		}
+	}
+	if evictedCount > 0 {
+		logger.DebugLogger().Printf("Evicted %d session affinity bindings", evictedCount)
+	}
+}
+
+// Lookup returns the namespace IP bound to the key and refreshes the binding TTL
+func (table *SessionAffinityTable) Lookup(key string) (net.IP, bool) {
+	table.rwlock.Lock()
+	defer table.rwlock.Unlock()
+	binding, exist := table.bindings[key]
+	if !exist || time.Now().After(binding.expires) {
+		return nil, false
+	}
+	binding.expires = time.Now().Add(binding.ttl)
+	table.bindings[key] = binding
+	return binding.nsip, true
+}
+
+// Bind pins the key to the namespace IP for the given ttl
+func (table *SessionAffinityTable) Bind(key string, nsip net.IP, ttl time.Duration) {
+	table.rwlock.Lock()
+	defer table.rwlock.Unlock()
+	table.bindings[key] = affinityEntry{
+		nsip:    nsip,
+		ttl:     ttl,
+		expires: time.Now().Add(ttl),
+	}
+}
+
+// affinityKey returns the key used to pin the flow, or an empty string if the affinity is disabled
+func affinityKey(sip TableEntryCache.ServiceIP, dstServiceIp net.IP, srcip net.IP, srcInstanceIp net.IP, dstport int) string {
+	switch sip.Affinity {
+	case TableEntryCache.AffinitySourceInstance:
+		return dstServiceIp.String() + "|" + srcInstanceIp.String()
+	case TableEntryCache.AffinitySourceIPDestPort:
+		return dstServiceIp.String() + "|" + srcip.String() + ":" + strconv.Itoa(dstport)
+	}
+	return ""
+}
+
+// rendezvousSelect picks the table entry with the highest weighted hash score for the given key.
+// When an instance joins or leaves, only the keys whose best scoring instance changed are moved.
+func rendezvousSelect(key string, tableEntryList []TableEntryCache.TableEntry) TableEntryCache.TableEntry {
+	var best TableEntryCache.TableEntry
+	bestScore := math.Inf(-1)
+	for _, entry := range tableEntryList {
+		score := rendezvousScore(key, entry)
+		if score > bestScore {
+			best = entry
+			bestScore = score
+		}
+	}
+	return best
+}
+
+// rendezvousScore computes -weight/ln(h) with h being the hash of key and instance mapped in (0,1)
+func rendezvousScore(key string, entry TableEntryCache.TableEntry) float64 {
+	hash := fnv.New64a()
+	_, _ = hash.Write([]byte(key))
+	_, _ = hash.Write([]byte{0})
+	_, _ = hash.Write(entry.Nsip.To16())
+	h := (float64(mix64(hash.Sum64())>>11) + 0.5) / float64(uint64(1)<<53)
+	return -float64(entry.GetEffectiveWeight()) / math.Log(h)
+}
+
+// mix64 is the murmur3 finalizer. FNV-1a barely spreads the last bytes to the high bits, without it
+// the instances whose addresses differ in the last bit share their clients when one of them leaves
+func mix64(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+// selectWithAffinity returns the instance bound to the key, if still active, or binds a new one using consistent hashing
+func (proxy *GoProxyTunnel) selectWithAffinity(key string, sip TableEntryCache.ServiceIP, candidates []TableEntryCache.TableEntry) TableEntryCache.TableEntry {
+	ttl := sip.AffinityTTL
+	if ttl <= 0 {
+		ttl = DEFAULT_AFFINITY_TTL
+	}
+	if nsip, exist := proxy.affinity.Lookup(key); exist {
+		for _, entry := range candidates {
+			if entry.Nsip.Equal(nsip) {
+				return entry
+			}
+		}
+	}
+	entry := rendezvousSelect(key, candidates)
+	proxy.affinity.Bind(key, entry.Nsip, ttl)
+	return entry
+}
@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"net"
+)
+
+// PacketDevice exchanges the raw IP packets with the local service instances.
+// In production this is the TUN device (*water.Interface).
+type PacketDevice interface {
+	Read(p []byte) (int, error)
+	Write(p []byte) (int, error)
+	Name() string
+	Close() error
+}
+
+// TunnelSocket receives the packets tunneled by the other nodes.
+// With the NAT traversal enabled the packets towards the other nodes are sent from this socket as well,
+// so that the NAT mapping used to receive the packets is the same used to send them.
+// In production this is the UDP socket listening on the TunnelPort (*net.UDPConn).
+type TunnelSocket interface {
+	ReadFromUDP(b []byte) (int, *net.UDPAddr, error)
+	WriteToUDP(b []byte, addr *net.UDPAddr) (int, error)
+	Close() error
+}
+
+// TunnelConn sends the tunneled packets towards another node.
+// In production this is a connected UDP socket (*net.UDPConn).
+type TunnelConn interface {
+	Write(b []byte) (int, error)
+	Close() error
+}
+
+// TunnelDialer opens a TunnelConn towards the given host:port
+type TunnelDialer func(hoststring string) (TunnelConn, error)
+
+// batchTunnelSocket is a TunnelSocket exchanging multiple datagrams per system call
+type batchTunnelSocket interface {
+	ReadBatch(out []incomingMessage) (int, error)
+	WriteBatchTo(buffers [][]byte, addr *net.UDPAddr) error
+}
+
+// batchTunnelConn is a TunnelConn sending multiple datagrams per system call
+type batchTunnelConn interface {
+	WriteBatch(buffers [][]byte) error
+}
+
+// udpTunnelConn is a UDP socket usable both as TunnelSocket and as TunnelConn
+type udpTunnelConn interface {
+	TunnelSocket
+	Write(b []byte) (int, error)
+}
+
+// dialUDP is the TunnelDialer used in production
+func dialUDP(hoststring string) (TunnelConn, error) {
+	connection, err := createUDPChannel(hoststring)
+	if err != nil {
+		return nil, err
+	}
+	return wrapUDPConn(connection), nil
+}
+
+// writeBatchTo sends the datagrams towards addr, with a single system call if the socket supports it
+func writeBatchTo(socket TunnelSocket, buffers [][]byte, addr *net.UDPAddr) error {
+	if batchSocket, ok := socket.(batchTunnelSocket); ok {
+		return batchSocket.WriteBatchTo(buffers, addr)
+	}
+	for _, buffer := range buffers {
+		if _, err := socket.WriteToUDP(buffer, addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeBatch sends the datagrams on the connection, with a single system call if the connection supports it
+func writeBatch(conn TunnelConn, buffers [][]byte) error {
+	if batchConn, ok := conn.(batchTunnelConn); ok {
+		return batchConn.WriteBatch(buffers)
+	}
+	for _, buffer := range buffers {
+		if _, err := conn.Write(buffer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
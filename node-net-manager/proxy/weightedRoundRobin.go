@@ -0,0 +1,57 @@
+package proxy
+
+import (
+	"NetManager/TableEntryCache"
+	"sync"
+)
+
+// WeightedRoundRobin implements the smooth weighted round-robin selection for each ServiceIP.
+// Every instance gets a number of new flows proportional to its effective weight, interleaved with the other instances.
+type WeightedRoundRobin struct {
+	// ServiceIP -> instance namespace IP -> current weight
+	currentWeights map[string]map[string]int
+	rwlock         sync.RWMutex
+}
+
+func NewWeightedRoundRobin() *WeightedRoundRobin {
+	return &WeightedRoundRobin{
+		currentWeights: make(map[string]map[string]int),
+		rwlock:         sync.RWMutex{},
+	}
+}
+
+// Next returns the next instance for the ServiceIP among the given candidates.
+// The candidates MUST have an effective weight greater than 0.
+func (wrr *WeightedRoundRobin) Next(serviceIp string, candidates []TableEntryCache.TableEntry) TableEntryCache.TableEntry {
+	wrr.rwlock.Lock()
+	defer wrr.rwlock.Unlock()
+
+	previous := wrr.currentWeights[serviceIp]
+	weights := make(map[string]int, len(candidates))
+	total := 0
+	best := -1
+	for i, entry := range candidates {
+		key := entry.Nsip.String()
+		effective := entry.GetEffectiveWeight()
+		weights[key] = previous[key] + effective
+		total += effective
+		if best < 0 || weights[key] > weights[candidates[best].Nsip.String()] {
+			best = i
+		}
+	}
+	weights[candidates[best].Nsip.String()] -= total
+	// instances that left the candidate list are forgotten
+	wrr.currentWeights[serviceIp] = weights
+	return candidates[best]
+}
+
+// activeInstances returns the instances that can receive new flows
+func activeInstances(tableEntryList []TableEntryCache.TableEntry) []TableEntryCache.TableEntry {
+	result := make([]TableEntryCache.TableEntry, 0, len(tableEntryList))
+	for _, entry := range tableEntryList {
+		if entry.GetEffectiveWeight() > 0 {
+			result = append(result, entry)
+		}
+	}
+	return result
+}
@@ -0,0 +1,179 @@
+package server
+
+import (
+	"NetManager/handlers"
+	"NetManager/logger"
+	"NetManager/model"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+var (
+	errClientCertificateNotPinned = errors.New("client certificate not pinned")
+	errNoPeerCredentials          = errors.New("no peer credentials")
+)
+
+type peerCredentialsKey struct{}
+
+// apiTLSConfig is the TLS configuration of the TCP listener, nil when the API is served in clear text
+func apiTLSConfig(config model.NetConfiguration) (*tls.Config, error) {
+	if config.ApiCert == "" && config.ApiKey == "" {
+		if config.ApiClientCa != "" || len(config.ApiClientCertPins) > 0 {
+			return nil, errors.New("ApiClientCa and ApiClientCertPins require ApiCert and ApiKey")
+		}
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(config.ApiCert, config.ApiKey)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load the API certificate: %v", err)
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if config.ApiClientCa != "" {
+		ca, err := os.ReadFile(config.ApiClientCa)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read the client CA: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificate found in %s", config.ApiClientCa)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	if len(config.ApiClientCertPins) > 0 {
+		pins, err := parseCertificatePins(config.ApiClientCertPins)
+		if err != nil {
+			return nil, err
+		}
+		// the pins alone are enough to trust a self-signed client certificate
+		if tlsConfig.ClientAuth != tls.RequireAndVerifyClientCert {
+			tlsConfig.ClientAuth = tls.RequireAnyClientCert
+		}
+		tlsConfig.VerifyPeerCertificate = verifyPinnedCertificate(pins)
+	}
+	return tlsConfig, nil
+}
+
+// parseCertificatePins accepts the hex SHA-256 fingerprints with or without colons, e.g. as printed by openssl
+func parseCertificatePins(fingerprints []string) (map[[sha256.Size]byte]bool, error) {
+	pins := make(map[[sha256.Size]byte]bool, len(fingerprints))
+	for _, fingerprint := range fingerprints {
+		raw, err := hex.DecodeString(strings.ReplaceAll(fingerprint, ":", ""))
+		if err != nil || len(raw) != sha256.Size {
+			return nil, fmt.Errorf("invalid SHA-256 certificate fingerprint %q", fingerprint)
+		}
+		pins[[sha256.Size]byte(raw)] = true
+	}
+	return pins, nil
+}
+
+// verifyPinnedCertificate accepts the connection only if the client certificate is pinned
+func verifyPinnedCertificate(pins map[[sha256.Size]byte]bool) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 || !pins[sha256.Sum256(rawCerts[0])] {
+			return errClientCertificateNotPinned
+		}
+		return nil
+	}
+}
+
+// tokenAuth rejects the requests without one of the bearer tokens, nothing is checked when there are none
+func tokenAuth(tokens []string, next http.Handler) http.Handler {
+	if len(tokens) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		token, ok := strings.CutPrefix(request.Header.Get("Authorization"), "Bearer ")
+		if !ok || !validToken(tokens, token) {
+			logger.InfoLogger().Printf("Rejected unauthenticated request from %s to %s", request.RemoteAddr, request.URL.Path)
+			writer.Header().Set("WWW-Authenticate", `Bearer realm="netmanager"`)
+			handlers.WriteProblem(writer, request, http.StatusUnauthorized, handlers.PROBLEM_UNAUTHORIZED, "a valid bearer token is required")
+			return
+		}
+		next.ServeHTTP(writer, request)
+	})
+}
+
+func validToken(tokens []string, token string) bool {
+	valid := 0
+	for _, candidate := range tokens {
+		if candidate != "" {
+			valid |= subtle.ConstantTimeCompare([]byte(candidate), []byte(token))
+		}
+	}
+	return valid == 1
+}
+
+// withPeerCredentials stores the credentials of the process connected to the unix socket in the context of its requests
+func withPeerCredentials(ctx context.Context, conn net.Conn) context.Context {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return ctx
+	}
+	rawConn, err := unixConn.SyscallConn()
+	if err != nil {
+		return ctx
+	}
+	var cred *unix.Ucred
+	var credErr error
+	err = rawConn.Control(func(fd uintptr) {
+		cred, credErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	})
+	if err != nil || credErr != nil {
+		logger.ErrorLogger().Println("[ERROR]: unable to read the peer credentials:", err, credErr)
+		return ctx
+	}
+	return context.WithValue(ctx, peerCredentialsKey{}, cred)
+}
+
+// peerCredentialsAuth rejects the callers on the unix socket whose UID and GID are not allowed.
+// Root is always allowed, anyone when no UID and GID are configured.
+func peerCredentialsAuth(uids []int, gids []int, next http.Handler) http.Handler {
+	if len(uids) == 0 && len(gids) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if err := authorizePeer(request.Context(), uids, gids); err != nil {
+			logger.InfoLogger().Printf("Rejected request to %s: %v", request.URL.Path, err)
+			handlers.WriteProblem(writer, request, http.StatusForbidden, handlers.PROBLEM_FORBIDDEN, err.Error())
+			return
+		}
+		next.ServeHTTP(writer, request)
+	})
+}
+
+func authorizePeer(ctx context.Context, uids []int, gids []int) error {
+	cred, ok := ctx.Value(peerCredentialsKey{}).(*unix.Ucred)
+	if !ok {
+		return errNoPeerCredentials
+	}
+	if cred.Uid == 0 {
+		return nil
+	}
+	for _, uid := range uids {
+		if uint32(uid) == cred.Uid {
+			return nil
+		}
+	}
+	for _, gid := range gids {
+		if uint32(gid) == cred.Gid {
+			return nil
+		}
+	}
+	return fmt.Errorf("peer uid %d gid %d (pid %d) not allowed", cred.Uid, cred.Gid, cred.Pid)
+}
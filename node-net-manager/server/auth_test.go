@@ -0,0 +1,208 @@
+package server
+
+import (
+	"NetManager/model"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"gotest.tools/assert"
+)
+
+var okHandler = http.HandlerFunc(func(writer http.ResponseWriter, _ *http.Request) {
+	writer.WriteHeader(http.StatusOK)
+})
+
+// writeTestCertificate writes a self-signed certificate and its key, returns the paths and the certificate
+func writeTestCertificate(t *testing.T, name string) (string, string, tls.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NilError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+		DNSNames:              []string{"localhost"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NilError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.NilError(t, err)
+
+	certPath := filepath.Join(t.TempDir(), name+".crt")
+	keyPath := filepath.Join(t.TempDir(), name+".key")
+	assert.NilError(t, os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	assert.NilError(t, os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	assert.NilError(t, err)
+	return certPath, keyPath, cert
+}
+
+func fingerprint(cert tls.Certificate) string {
+	sum := sha256.Sum256(cert.Certificate[0])
+	return hex.EncodeToString(sum[:])
+}
+
+func TestTokenAuth(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	tokenAuth(nil, okHandler).ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/register", nil))
+	assert.Equal(t, recorder.Code, http.StatusOK)
+
+	handler := tokenAuth([]string{"", "secret", "other"}, okHandler)
+	for header, status := range map[string]int{
+		"":              http.StatusUnauthorized,
+		"Bearer ":       http.StatusUnauthorized,
+		"Bearer wrong":  http.StatusUnauthorized,
+		"Basic secret":  http.StatusUnauthorized,
+		"Bearer secret": http.StatusOK,
+		"Bearer other":  http.StatusOK,
+	} {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodPost, "/container/deploy", nil)
+		if header != "" {
+			request.Header.Set("Authorization", header)
+		}
+		handler.ServeHTTP(recorder, request)
+		assert.Equal(t, recorder.Code, status, header)
+		if status == http.StatusUnauthorized {
+			assert.Assert(t, recorder.Header().Get("WWW-Authenticate") != "")
+		}
+	}
+}
+
+func TestAuthorizePeer(t *testing.T) {
+	withCred := func(uid uint32, gid uint32) context.Context {
+		return context.WithValue(context.Background(), peerCredentialsKey{}, &unix.Ucred{Pid: 1, Uid: uid, Gid: gid})
+	}
+	assert.NilError(t, authorizePeer(withCred(0, 0), []int{1000}, nil))
+	assert.NilError(t, authorizePeer(withCred(1000, 1000), []int{1000}, nil))
+	assert.NilError(t, authorizePeer(withCred(1001, 998), []int{1000}, []int{998}))
+	assert.ErrorContains(t, authorizePeer(withCred(1001, 1001), []int{1000}, []int{998}), "not allowed")
+	assert.Equal(t, authorizePeer(context.Background(), []int{1000}, nil), errNoPeerCredentials)
+}
+
+func TestPeerCredentialsOnUnixSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "netmanager.sock")
+	listener, err := net.Listen("unix", socket)
+	assert.NilError(t, err)
+	credentials := make(chan *unix.Ucred, 1)
+	socketServer := &http.Server{
+		Handler: http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			cred, _ := request.Context().Value(peerCredentialsKey{}).(*unix.Ucred)
+			credentials <- cred
+		}),
+		ConnContext: withPeerCredentials,
+	}
+	go func() { _ = socketServer.Serve(listener) }()
+	defer socketServer.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		},
+	}}
+	response, err := client.Get("http://netmanager/tasks/unknown")
+	assert.NilError(t, err)
+	_ = response.Body.Close()
+
+	cred := <-credentials
+	assert.Assert(t, cred != nil)
+	assert.Equal(t, int(cred.Uid), os.Getuid())
+	assert.Equal(t, int(cred.Gid), os.Getgid())
+	assert.Equal(t, int(cred.Pid), os.Getpid())
+}
+
+func TestAPITLSConfigValidation(t *testing.T) {
+	tlsConfig, err := apiTLSConfig(model.NetConfiguration{})
+	assert.NilError(t, err)
+	assert.Assert(t, tlsConfig == nil)
+
+	_, err = apiTLSConfig(model.NetConfiguration{ApiClientCertPins: []string{"00"}})
+	assert.ErrorContains(t, err, "require ApiCert")
+
+	certPath, keyPath, _ := writeTestCertificate(t, "server")
+	_, err = apiTLSConfig(model.NetConfiguration{ApiCert: certPath, ApiKey: keyPath, ApiClientCertPins: []string{"00"}})
+	assert.ErrorContains(t, err, "invalid SHA-256")
+
+	tlsConfig, err = apiTLSConfig(model.NetConfiguration{ApiCert: certPath, ApiKey: keyPath})
+	assert.NilError(t, err)
+	assert.Equal(t, tlsConfig.ClientAuth, tls.NoClientCert)
+}
+
+func TestPinnedClientCertificate(t *testing.T) {
+	certPath, keyPath, _ := writeTestCertificate(t, "server")
+	_, _, pinned := writeTestCertificate(t, "pinned")
+	caPath, _, signedByCA := writeTestCertificate(t, "ca")
+	_, _, other := writeTestCertificate(t, "other")
+
+	tests := []struct {
+		name     string
+		config   model.NetConfiguration
+		client   *tls.Certificate
+		accepted bool
+	}{
+		{"pinned", model.NetConfiguration{ApiClientCertPins: []string{fingerprint(pinned)}}, &pinned, true},
+		{"pin with colons", model.NetConfiguration{ApiClientCertPins: []string{colons(fingerprint(pinned))}}, &pinned, true},
+		{"not pinned", model.NetConfiguration{ApiClientCertPins: []string{fingerprint(pinned)}}, &other, false},
+		{"no client certificate", model.NetConfiguration{ApiClientCertPins: []string{fingerprint(pinned)}}, nil, false},
+		{"signed by the CA", model.NetConfiguration{ApiClientCa: caPath}, &signedByCA, true},
+		{"not signed by the CA", model.NetConfiguration{ApiClientCa: caPath}, &other, false},
+		{"signed by the CA but not pinned", model.NetConfiguration{ApiClientCa: caPath, ApiClientCertPins: []string{fingerprint(pinned)}}, &signedByCA, false},
+	}
+	for _, test := range tests {
+		test.config.ApiCert, test.config.ApiKey = certPath, keyPath
+		tlsConfig, err := apiTLSConfig(test.config)
+		assert.NilError(t, err, test.name)
+
+		apiServer := httptest.NewUnstartedServer(okHandler)
+		apiServer.TLS = tlsConfig
+		apiServer.Config.ErrorLog = nil
+		apiServer.StartTLS()
+
+		clientConfig := &tls.Config{InsecureSkipVerify: true}
+		if test.client != nil {
+			clientConfig.Certificates = []tls.Certificate{*test.client}
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientConfig}}
+		response, err := client.Get(apiServer.URL)
+		if test.accepted {
+			assert.NilError(t, err, test.name)
+			assert.Equal(t, response.StatusCode, http.StatusOK, test.name)
+			_ = response.Body.Close()
+		} else {
+			assert.Assert(t, err != nil, test.name)
+		}
+		apiServer.Close()
+	}
+}
+
+func colons(fingerprint string) string {
+	withColons := ""
+	for i := 0; i < len(fingerprint); i += 2 {
+		if i > 0 {
+			withColons += ":"
+		}
+		withColons += fingerprint[i : i+2]
+	}
+	return withColons
+}
@@ -9,65 +9,71 @@ import (
 	"NetManager/network"
 	"NetManager/proxy"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/http"
 	"os"
-	"time"
 
 	"github.com/gorilla/mux"
 )
 
-const IP_UPDATE_TIMER = 2 * time.Minute
-
-type undeployRequest struct {
-	Servicename    string `json:"serviceName"`
-	Instancenumber int    `json:"instanceNumber"`
-}
-
 type registerRequest struct {
 	ClientID       string `json:"client_id"`
 	ClusterAddress string `json:"cluster_address"`
 }
 
-type DeployResponse struct {
-	ServiceName string `json:"serviceName"`
-	NsAddress   string `json:"nsAddress"`
+// errAlreadyRegistered is returned when the node is registered again with another worker ID
+var errAlreadyRegistered = errors.New("node already registered with another worker ID")
+
+// watchNodeAddress follows the node address, the proxy and the cluster are updated as soon as it changes
+func watchNodeAddress() {
+	_, err := network.WatchNodeAddress(net.ParseIP(model.GetNodePublicAddress()), nodeAddressChanged)
+	if err != nil {
+		logger.ErrorLogger().Println("Unable to follow the node address changes:", err)
+	}
 }
 
-func update() {
-	for {
-		time.Sleep(IP_UPDATE_TIMER)
-		defaultLink := network.GetOutboundIP()
-		if model.NetConfig.NodePublicAddress != defaultLink.String() {
-			logger.InfoLogger().Printf("Updating NodePublicAddress from %s to %s", model.NetConfig.NodePublicAddress, defaultLink.String())
-			// update service in the cluster
-			//for each service instance in the worker, update the public address
-			for _, si := range Env.GetTableEntriesOnNode() {
-				err := mqtt.NotifyAddressChange(si.Appname, si.Instancenumber, defaultLink.String(), model.NetConfig.NodePublicPort)
-				if err != nil {
-					logger.ErrorLogger().Println("[ERROR]:", err)
-				}
-			}
-			model.NetConfig.NodePublicAddress = defaultLink.String()
-		}
+func nodeAddressChanged(address net.IP) {
+	logger.InfoLogger().Printf("Updating NodePublicAddress from %s to %s", model.GetNodePublicAddress(), address.String())
+	model.SetNodePublicAddress(address.String())
+
+	// not registered yet, the proxy and the cluster get the new address with the registration
+	if Proxy == nil || model.WorkerID == "" {
+		return
+	}
+	localIP, err := network.LocalOutboundIP()
+	if err != nil {
+		logger.ErrorLogger().Println("[ERROR]:", err)
+		localIP = address
+	}
+	publicAddress, _ := net.ResolveUDPAddr("udp", net.JoinHostPort(model.GetNodePublicAddress(), model.NetConfig.NodePublicPort))
+	if err := Proxy.UpdateLocalAddress(localIP, publicAddress); err != nil {
+		logger.ErrorLogger().Println("[ERROR]: unable to move the proxy to the new address:", err)
+	}
+	// the cluster updates all the instances of the node
+	if err := mqtt.NotifyNodeAddressChange(model.GetNodePublicAddress(), model.NetConfig.NodePublicPort); err != nil {
+		logger.ErrorLogger().Println("[ERROR]:", err)
 	}
 }
 
 func HandleRequests(port int) {
 	netRouter := mux.NewRouter().StrictSlash(true)
 	netRouter.HandleFunc("/register", register).Methods("POST")
+	netRouter.HandleFunc("/v2/register", registerV2).Methods("POST")
 
-	//If default route, fetch default gateway address and use that, update regularly
-	if model.NetConfig.NodePublicAddress == "0.0.0.0" {
+	//If default route, fetch default gateway address and use that, follow its changes
+	if model.GetNodePublicAddress() == "0.0.0.0" {
 		defaultLink := network.GetOutboundIP()
-		model.NetConfig.NodePublicAddress = defaultLink.String()
-		go update()
+		model.SetNodePublicAddress(defaultLink.String())
+		watchNodeAddress()
 	}
 
-	handlers.RegisterAllManagers(&Env, &model.WorkerID, model.NetConfig.NodePublicAddress, model.NetConfig.NodePublicPort, netRouter)
+	handlers.RegisterAllManagers(&Env, &model.WorkerID, model.GetNodePublicAddress(), model.NetConfig.NodePublicPort, netRouter)
+	// the unversioned routes are also the /v1 ones
+	netRouter.PathPrefix("/v1/").Handler(http.StripPrefix("/v1", netRouter))
 
 	if port <= 0 {
 		logger.InfoLogger().Println("Starting NetManager on unix socket /etc/netmanager/netmanager.sock")
@@ -76,15 +82,34 @@ func HandleRequests(port int) {
 		if err != nil {
 			log.Fatalf("Could not create listner: %s", err)
 		}
-		log.Fatal(http.Serve(listener, netRouter))
+		socketServer := &http.Server{
+			Handler:     peerCredentialsAuth(model.NetConfig.ApiSocketUids, model.NetConfig.ApiSocketGids, netRouter),
+			ConnContext: withPeerCredentials,
+		}
+		log.Fatal(socketServer.Serve(listener))
 	} else {
-		log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", port), netRouter))
+		tlsConfig, err := apiTLSConfig(model.NetConfig)
+		if err != nil {
+			log.Fatalf("Invalid API TLS configuration: %s", err)
+		}
+		tcpServer := &http.Server{
+			Addr:      fmt.Sprintf(":%d", port),
+			Handler:   tokenAuth(model.NetConfig.ApiTokens, netRouter),
+			TLSConfig: tlsConfig,
+		}
+		if tlsConfig == nil {
+			if len(model.NetConfig.ApiTokens) == 0 {
+				logger.InfoLogger().Printf("WARNING: the API on port %d is not authenticated, set ApiTokens or ApiClientCa", port)
+			}
+			log.Fatal(tcpServer.ListenAndServe())
+		}
+		log.Fatal(tcpServer.ListenAndServeTLS("", ""))
 	}
 }
 
 var (
 	Env   env.Environment
-	Proxy proxy.GoProxyTunnel
+	Proxy *proxy.GoProxyTunnel
 )
 
 /*
@@ -102,28 +127,74 @@ Response: 200 or Failure code
 func register(writer http.ResponseWriter, request *http.Request) {
 	logger.InfoLogger().Println("Received registration request, registering the NetManager to the Cluster")
 
-	reqBody, _ := io.ReadAll(request.Body)
+	reqBody, err := io.ReadAll(request.Body)
+	if err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		return
+	}
 	var requestStruct registerRequest
-	err := json.Unmarshal(reqBody, &requestStruct)
+	err = json.Unmarshal(reqBody, &requestStruct)
 	if err != nil {
 		writer.WriteHeader(http.StatusBadRequest)
+		return
 	}
 	log.Println(requestStruct)
 
+	if err := registerNode(requestStruct); err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	writer.WriteHeader(http.StatusOK)
+}
+
+/*
+Endpoint: /v2/register
+Usage: used to initialize the Network manager, see /register
+Method: POST
+Request Json:
+
+	{
+		client_id:string # id of the worker node, required
+		cluster_address:string # optional
+	}
+
+Response: 200 OK, also when already registered with the same worker ID, or a problem+json body:
+400 invalid-json, 422 validation-failed, 409 node-already-registered
+*/
+func registerV2(writer http.ResponseWriter, request *http.Request) {
+	logger.InfoLogger().Println("Received registration request, registering the NetManager to the Cluster")
+
+	var requestStruct registerRequest
+	if err := handlers.DecodeRequest(request, &requestStruct); err != nil {
+		handlers.WriteDecodeProblem(writer, request, err)
+		return
+	}
+	if requestStruct.ClientID == "" {
+		handlers.WriteProblem(writer, request, http.StatusUnprocessableEntity, handlers.PROBLEM_VALIDATION_FAILED, "",
+			handlers.FieldError{Field: "client_id", Reason: "required"})
+		return
+	}
+
+	if err := registerNode(requestStruct); err != nil {
+		handlers.WriteProblem(writer, request, http.StatusConflict, handlers.PROBLEM_NODE_ALREADY_REGISTERED, err.Error())
+		return
+	}
+	writer.WriteHeader(http.StatusOK)
+}
+
+// registerNode connects the NetManager to the cluster, nothing is done when it is already registered with the same worker ID
+func registerNode(requestStruct registerRequest) error {
 	// drop the request if the node is already initialized
 	if model.WorkerID != "" {
 		if model.WorkerID == requestStruct.ClientID {
 			logger.InfoLogger().Printf("Node already initialized")
-			writer.WriteHeader(http.StatusOK)
-		} else {
-			logger.InfoLogger().Printf("Attempting to re-initialize a node with a different worker ID")
-			writer.WriteHeader(http.StatusBadRequest)
+			return nil
 		}
-		return
+		logger.InfoLogger().Printf("Attempting to re-initialize a node with a different worker ID")
+		return errAlreadyRegistered
 	}
 
 	model.WorkerID = requestStruct.ClientID
-
 	//Use default cluster address given by NodeEngine version >= v0.4.302
 	if requestStruct.ClusterAddress != "" {
 		model.NetConfig.ClusterUrl = requestStruct.ClusterAddress
@@ -132,7 +203,7 @@ func register(writer http.ResponseWriter, request *http.Request) {
 	//log registration startup
 	logger.InfoLogger().Printf(
 		"STARTUP_CONFIG: Node=%s:%s | Cluster=%s:%s",
-		model.NetConfig.NodePublicAddress,
+		model.GetNodePublicAddress(),
 		model.NetConfig.NodePublicPort,
 		model.NetConfig.ClusterUrl,
 		model.NetConfig.ClusterMqttPort,
@@ -143,6 +214,9 @@ func register(writer http.ResponseWriter, request *http.Request) {
 
 	// initialize the proxy tunnel
 	Proxy = proxy.New()
+	if model.NetConfig.NatTraversal {
+		enableNatTraversal(requestStruct.ClientID)
+	}
 	Proxy.Listen()
 
 	// initialize the Env Manager
@@ -150,6 +224,35 @@ func register(writer http.ResponseWriter, request *http.Request) {
 
 	Proxy.SetEnvironment(&Env)
 
+	if model.NetConfig.DockerNetworkPlugin {
+		networkID, err := Env.ConfigureDockerNetwork(env.DOCKER_NETWORK_NAME)
+		if err != nil {
+			logger.ErrorLogger().Println("Unable to create the docker network:", err)
+		} else {
+			logger.InfoLogger().Printf("Docker network %s ready: %s", env.DOCKER_NETWORK_NAME, networkID)
+		}
+	}
+
 	logger.InfoLogger().Printf("NetManager is now running 🟢")
-	writer.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// enableNatTraversal lets the proxy reach the nodes behind NAT using the MQTT broker as signalling channel
+func enableNatTraversal(workerID string) {
+	publicAddress, err := net.ResolveUDPAddr("udp", net.JoinHostPort(model.GetNodePublicAddress(), model.NetConfig.NodePublicPort))
+	if err != nil {
+		logger.ErrorLogger().Println("Invalid node public address:", err)
+	}
+	err = Proxy.EnableNatTraversal(proxy.NatConfiguration{
+		NodeID:        workerID,
+		PublicAddress: publicAddress,
+		RelayAddress:  model.NetConfig.NatRelayAddress,
+		RelayID:       model.NetConfig.NatRelayID,
+		Relay:         model.NetConfig.NatRelay,
+	}, mqtt.NatSignalling{})
+	if err != nil {
+		logger.ErrorLogger().Println("Unable to enable the NAT traversal:", err)
+		return
+	}
+	mqtt.RegisterHolePunchingHandler(Proxy.HandleHolePunchingRequest)
 }